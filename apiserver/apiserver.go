@@ -20,33 +20,107 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"coriolis-logger/apiserver/controllers"
 	"coriolis-logger/apiserver/routers"
 	"coriolis-logger/config"
 	"coriolis-logger/datastore/common"
+	"coriolis-logger/graceful"
 	wsWriter "coriolis-logger/writers/websocket"
 
+	"github.com/juju/loggo"
 	"github.com/pkg/errors"
 )
 
+// logger is named so it does not shadow the standard log package,
+// used to stop the process if the server fails.
+var logger = loggo.GetLogger("coriolis.logger.apiserver")
+
+func init() {
+	logger.SetLogLevel(loggo.INFO)
+}
+
+// InheritedListenerName is the name under which the API server
+// listener is passed on to a new process during a graceful restart.
+const InheritedListenerName = "api"
+
 type APIServer struct {
 	listener net.Listener
 	srv      *http.Server
+	cfg      config.APIServer
+	// newHandler returns the handler serving requests with the given
+	// config. The handler is replaced by Reconfigure().
+	newHandler func(config.APIServer) (http.Handler, error)
+	handler    atomic.Value
+	// reconfigureMut serializes calls to Reconfigure().
+	reconfigureMut sync.Mutex
+}
+
+func (h *APIServer) serveHTTP(writer http.ResponseWriter, req *http.Request) {
+	h.handler.Load().(http.Handler).ServeHTTP(writer, req)
+}
+
+// Reconfigure starts serving requests with the API server settings of
+// cfg, such as authentication and query limits. Requests already being
+// served are not affected. Changes to the listener and websocket
+// settings are logged and ignored, as they require a restart.
+func (h *APIServer) Reconfigure(cfg *config.Config) error {
+	h.reconfigureMut.Lock()
+	defer h.reconfigureMut.Unlock()
+
+	for _, setting := range h.cfg.RestartRequired(cfg.APIServer) {
+		logger.Warningf("changing api server setting %s requires a restart, ignoring it", setting)
+	}
+	// Settings that require a restart keep their current value.
+	newCfg := cfg.APIServer
+	newCfg.Bind = h.cfg.Bind
+	newCfg.Port = h.cfg.Port
+	newCfg.UseTLS = h.cfg.UseTLS
+	newCfg.TLSConfig = h.cfg.TLSConfig
+	newCfg.WSRateInterval = h.cfg.WSRateInterval
+	newCfg.WSReplayCount = h.cfg.WSReplayCount
+	newCfg.WSReplayMaxAge = h.cfg.WSReplayMaxAge
+	newCfg.WSReplayCompactInterval = h.cfg.WSReplayCompactInterval
+
+	handler, err := h.newHandler(newCfg)
+	if err != nil {
+		return errors.Wrap(err, "getting router")
+	}
+	h.handler.Store(handler)
+	h.cfg = newCfg
+	logger.Infof("api server reconfigured")
+	return nil
 }
 
 func (h *APIServer) Start() error {
 	go func() {
-		if err := h.srv.Serve(h.listener); err != nil {
+		// Serve returns ErrServerClosed once Stop() is called.
+		if err := h.srv.Serve(h.listener); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 	return nil
 }
 
+// File returns a duplicate of the socket the API server listens on,
+// to be passed on to a new process.
+func (h *APIServer) File() (*os.File, error) {
+	tcpListener, ok := h.listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("listener can not be passed on")
+	}
+	return tcpListener.File()
+}
+
+// stopTimeout is the time Stop() waits for the requests being served.
+const stopTimeout = 5 * time.Second
+
 func (h *APIServer) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
 	defer cancel()
 	if err := h.srv.Shutdown(ctx); err != nil {
 		return fmt.Errorf("failed to shutdown web server: %q", err)
@@ -55,14 +129,47 @@ func (h *APIServer) Stop() error {
 	return nil
 }
 
-func GetAPIServer(cfg config.APIServer, hub *wsWriter.Hub, datastore common.DataStore) (*APIServer, error) {
-	logHandler := controllers.NewLogHandler(hub, datastore, cfg)
-	router, err := routers.GetRouter(cfg, logHandler)
+func GetAPIServer(cfg config.APIServer, hub *wsWriter.Hub, datastore common.DataStore, listener common.HealthChecker) (*APIServer, error) {
+	logHandler := controllers.NewLogHandler(hub, datastore, listener, cfg)
+	return newAPIServer(cfg, func(cfg config.APIServer) (http.Handler, error) {
+		return routers.GetRouter(cfg, logHandler.WithConfig(cfg))
+	})
+}
+
+// GetMetricsAPIServer returns an API server that only exposes
+// Prometheus metrics.
+func GetMetricsAPIServer(cfg config.APIServer) (*APIServer, error) {
+	return newAPIServer(cfg, func(config.APIServer) (http.Handler, error) {
+		return routers.GetMetricsRouter(), nil
+	})
+}
+
+// listen creates the API server listener, or reuses the one inherited
+// from the process that started us, during a graceful restart.
+func listen(cfg config.APIServer) (net.Listener, error) {
+	if file := graceful.Inherited(InheritedListenerName); file != nil {
+		defer file.Close()
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "using inherited listener")
+		}
+		return listener, nil
+	}
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Bind, cfg.Port))
+}
+
+func newAPIServer(cfg config.APIServer, newHandler func(config.APIServer) (http.Handler, error)) (*APIServer, error) {
+	handler, err := newHandler(cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting router")
 	}
+	apiServer := &APIServer{
+		cfg:        cfg,
+		newHandler: newHandler,
+	}
+	apiServer.handler.Store(handler)
 	srv := &http.Server{
-		Handler: router,
+		Handler: http.HandlerFunc(apiServer.serveHTTP),
 	}
 	if cfg.UseTLS {
 		tlsCfg, err := cfg.TLSConfig.TLSConfig()
@@ -71,12 +178,11 @@ func GetAPIServer(cfg config.APIServer, hub *wsWriter.Hub, datastore common.Data
 		}
 		srv.TLSConfig = tlsCfg
 	}
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Bind, cfg.Port))
+	listener, err := listen(cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &APIServer{
-		srv:      srv,
-		listener: listener,
-	}, nil
+	apiServer.srv = srv
+	apiServer.listener = listener
+	return apiServer, nil
 }
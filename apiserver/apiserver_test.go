@@ -0,0 +1,101 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"coriolis-logger/config"
+)
+
+// newTestAPIServer starts an API server listening on a random port,
+// which keeps the web sockets opened on /ws open until the client
+// closes them.
+func newTestAPIServer(t *testing.T) *APIServer {
+	upgrader := websocket.Upgrader{}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	cfg := config.APIServer{Bind: "127.0.0.1", Port: 0}
+	srv, err := newAPIServer(cfg, func(config.APIServer) (http.Handler, error) {
+		return handler, nil
+	})
+	if err != nil {
+		t.Fatalf("creating api server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting api server: %v", err)
+	}
+	return srv
+}
+
+// stopWithin calls srv.Stop(), and fails the test if it does not return
+// within timeout, or before the test deadline.
+func stopWithin(t *testing.T, srv *APIServer, timeout time.Duration) {
+	if deadline, ok := t.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		errCh <- srv.Stop()
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("stopping api server: %v", err)
+		}
+		t.Logf("api server stopped in %v", time.Since(start))
+	case <-time.After(timeout):
+		t.Fatalf("api server did not stop within %v", timeout)
+	}
+}
+
+func TestAPIServer_StopCompletesWithinTimeout(t *testing.T) {
+	srv := newTestAPIServer(t)
+	url := fmt.Sprintf("ws://%s/ws", srv.listener.Addr())
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("opening web socket: %v", err)
+	}
+	defer conn.Close()
+
+	stopWithin(t, srv, stopTimeout+100*time.Millisecond)
+
+	// New connections are refused once stopped.
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatalf("web socket opened after the api server stopped")
+	}
+}
+
+func TestAPIServer_StopWithZeroActiveConnections(t *testing.T) {
+	srv := newTestAPIServer(t)
+	stopWithin(t, srv, 100*time.Millisecond)
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/juju/loggo"
+
+	"coriolis-logger/config"
+)
+
+// auditLog records the requests authenticated with each API key.
+var auditLog = loggo.GetLogger("coriolis.logger.apiserver.audit")
+
+func init() {
+	auditLog.SetLogLevel(loggo.INFO)
+}
+
+type apiKeyAuth struct {
+	keys []config.APIKey
+}
+
+func getAPIKeyAuthenticator(keys []config.APIKey) Authenticator {
+	return apiKeyAuth{
+		keys: keys,
+	}
+}
+
+// key returns the API key of a request. Browsers can not set headers
+// on websocket connections, so those may also pass the key in the
+// "api_key" query parameter.
+func (a apiKeyAuth) key(req *http.Request) string {
+	if key := req.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if websocket.IsWebSocketUpgrade(req) {
+		return req.URL.Query().Get("api_key")
+	}
+	return ""
+}
+
+// lookup returns the configured key matching the one given. All keys
+// are compared, so the time taken does not reveal which one matched.
+func (a apiKeyAuth) lookup(key string) (config.APIKey, bool) {
+	var ret config.APIKey
+	var found bool
+	for _, apiKey := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(apiKey.Key), []byte(key)) == 1 {
+			ret = apiKey
+			found = true
+		}
+	}
+	return ret, found
+}
+
+func (a apiKeyAuth) Authenticate(req *http.Request) (context.Context, error) {
+	key := a.key(req)
+	if key == "" {
+		return nil, fmt.Errorf("missing api key")
+	}
+	apiKey, ok := a.lookup(key)
+	if !ok {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	auditLog.Infof("%s %s authenticated with api key %q", req.Method, req.URL.Path, apiKey.Name)
+
+	authDetails := AuthDetails{
+		UserID:   apiKey.Name,
+		IsAdmin:  true,
+		ReadOnly: apiKey.ReadOnly,
+	}
+
+	ctx := req.Context()
+
+	return context.WithValue(ctx, AuthDetailsKey, authDetails), nil
+}
@@ -51,6 +51,11 @@ type AuthDetails struct {
 	UserID    string
 	IsAdmin   bool
 	ExpiresAt time.Time
+	// ReadOnly is set for users that may only view logs.
+	ReadOnly bool
+	// AllowedFields holds the log fields the user can see. A nil
+	// value allows all fields.
+	AllowedFields []string
 }
 
 func getKeystoneAuthenticator(cfg *config.KeystoneAuth) (Authenticator, error) {
@@ -74,6 +79,18 @@ func GetAuthMiddleware(cfg config.APIServer) (MiddlewareWrapper, error) {
 		return &middlewareWrapper{
 			a: authenticator,
 		}, nil
+	case config.AuthenticationJWT:
+		authenticator, err := getJWTAuthenticator(cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting jwt authenticator")
+		}
+		return &middlewareWrapper{
+			a: authenticator,
+		}, nil
+	case config.AuthenticationAPIKey:
+		return &middlewareWrapper{
+			a: getAPIKeyAuthenticator(cfg.APIKeys),
+		}, nil
 	case config.AuthenticationNone:
 		return nil, AuthenticationDisabledErr
 	default:
@@ -32,7 +32,7 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ctx, err := h.auth.Authenticate(req)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to authenticate: %v", err)
-		w.WriteHeader(http.StatusForbidden)
+		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(errMsg))
 		log.Errorf(errMsg)
 		return
@@ -0,0 +1,138 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+)
+
+// jwtClaims holds the token claims we use.
+type jwtClaims struct {
+	Roles []string `json:"roles,omitempty"`
+	jwt.StandardClaims
+}
+
+type jwtAuth struct {
+	secret     []byte
+	publicKey  *rsa.PublicKey
+	adminRoles map[string]bool
+}
+
+func getJWTAuthenticator(cfg config.APIServer) (Authenticator, error) {
+	auth := jwtAuth{
+		adminRoles: map[string]bool{},
+	}
+	if cfg.JWTSecret != "" {
+		auth.secret = []byte(cfg.JWTSecret)
+	}
+	if cfg.JWTPublicKeyFile != "" {
+		keyPEM, err := ioutil.ReadFile(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading jwt public key")
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(keyPEM)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing jwt public key")
+		}
+		auth.publicKey = key
+	}
+	for _, role := range cfg.JWTAdminRoles {
+		auth.adminRoles[role] = true
+	}
+	return auth, nil
+}
+
+// key returns the key used to verify a token. Only the algorithms we
+// have a key for are accepted.
+func (j jwtAuth) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method {
+	case jwt.SigningMethodHS256:
+		if j.secret != nil {
+			return j.secret, nil
+		}
+	case jwt.SigningMethodRS256:
+		if j.publicKey != nil {
+			return j.publicKey, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected signing method %q", token.Header["alg"])
+}
+
+// isAdmin returns true if the roles are allowed to view logs.
+func (j jwtAuth) isAdmin(roles []string) bool {
+	if len(j.adminRoles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if j.adminRoles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// token returns the bearer token of a request. Browsers can not set
+// headers on websocket connections, so those may also pass the token
+// in the "token" query parameter.
+func (j jwtAuth) token(req *http.Request) string {
+	authHeader := req.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	if websocket.IsWebSocketUpgrade(req) {
+		return req.URL.Query().Get("token")
+	}
+	return ""
+}
+
+func (j jwtAuth) Authenticate(req *http.Request) (context.Context, error) {
+	tokenStr := j.token(req)
+	if tokenStr == "" {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+
+	claims := &jwtClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, j.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "validating token")
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	authDetails := AuthDetails{
+		UserID:  claims.Subject,
+		IsAdmin: j.isAdmin(claims.Roles),
+	}
+	if claims.ExpiresAt != 0 {
+		authDetails.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+
+	ctx := req.Context()
+
+	return context.WithValue(ctx, AuthDetailsKey, authDetails), nil
+}
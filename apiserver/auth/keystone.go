@@ -17,6 +17,7 @@ package auth
 import (
 	"context"
 	"coriolis-logger/config"
+	"coriolis-logger/params"
 	"fmt"
 	"net/http"
 
@@ -41,6 +42,37 @@ func (k keystoneAuth) rolesAsMap() map[string]bool {
 	return ret
 }
 
+// allowedFields returns the log fields that can be seen with the given
+// roles, as set in field_roles. It returns nil, allowing all fields, if
+// none of the roles are listed there.
+func (k keystoneAuth) allowedFields(roles []string) []string {
+	if k.cfg == nil || len(k.cfg.FieldRoles) == 0 {
+		return nil
+	}
+	allowed := map[string]bool{}
+	var found bool
+	for _, role := range roles {
+		fields, ok := k.cfg.FieldRoles[role]
+		if !ok {
+			continue
+		}
+		found = true
+		for _, field := range fields {
+			allowed[field] = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	ret := []string{}
+	for _, field := range params.QueryFields {
+		if allowed[field] {
+			ret = append(ret, field)
+		}
+	}
+	return ret
+}
+
 func (k keystoneAuth) Authenticate(req *http.Request) (context.Context, error) {
 	authToken := req.Header.Get("X-Auth-Token")
 	if authToken == "" {
@@ -66,10 +98,15 @@ func (k keystoneAuth) Authenticate(req *http.Request) (context.Context, error) {
 			break
 		}
 	}
+	userRoles := make([]string, 0, len(keystoneContext.Roles))
+	for _, val := range keystoneContext.Roles {
+		userRoles = append(userRoles, val.Name)
+	}
 	authDetails := AuthDetails{
-		UserID:    keystoneContext.User.ID,
-		IsAdmin:   isAdmin,
-		ExpiresAt: keystoneContext.ExpiresAt,
+		UserID:        keystoneContext.User.ID,
+		IsAdmin:       isAdmin,
+		ExpiresAt:     keystoneContext.ExpiresAt,
+		AllowedFields: k.allowedFields(userRoles),
 	}
 
 	ctx := req.Context()
@@ -20,9 +20,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"coriolis-logger/apiserver/auth"
@@ -40,6 +44,33 @@ import (
 
 var log = loggo.GetLogger("coriolis.logger.controllers")
 
+// nextCursorHeader holds the cursor that can be used to fetch the
+// messages following a log download.
+const nextCursorHeader = "X-Next-Cursor"
+
+// truncatedHeader is set to true when a log download left out messages
+// because of its limit.
+const truncatedHeader = "X-Truncated"
+
+// nextPageHeader holds the page following a log listing, if any.
+const nextPageHeader = "X-Next-Page"
+
+const (
+	// defaultListPageSize is the number of logs in each page of a
+	// paginated listing, unless set with per_page, which may not go
+	// above maxListPageSize.
+	defaultListPageSize = 100
+	maxListPageSize     = 1000
+)
+
+// structuredDataPrefix is the prefix of the download parameters that
+// filter on structured data, such as sd.migration_id.
+const structuredDataPrefix = "sd."
+
+// healthCheckTimeout is the maximum amount of time we wait for each
+// component to report its health.
+const healthCheckTimeout = 5 * time.Second
+
 func canAccess(ctx context.Context) bool {
 	details := ctx.Value(auth.AuthDetailsKey)
 	if details == nil {
@@ -50,15 +81,37 @@ func canAccess(ctx context.Context) bool {
 	return authDetails.IsAdmin
 }
 
-func NewLogHandler(hub *wsWriter.Hub, datastore common.DataStore, cfg config.APIServer) *LogHandlers {
+// canModify returns true if the authenticated user can delete logs.
+func canModify(ctx context.Context) bool {
+	if !canAccess(ctx) {
+		return false
+	}
+	return !ctx.Value(auth.AuthDetailsKey).(auth.AuthDetails).ReadOnly
+}
+
+// allowedFields returns the log fields the authenticated user can see,
+// or nil if all fields are allowed.
+func allowedFields(ctx context.Context) []string {
+	details := ctx.Value(auth.AuthDetailsKey)
+	if details == nil {
+		return nil
+	}
+	return details.(auth.AuthDetails).AllowedFields
+}
+
+// NewLogHandler returns the API handlers. The health of listener, the
+// syslog worker, is reported by the health endpoints.
+func NewLogHandler(hub *wsWriter.Hub, datastore common.DataStore, listener common.HealthChecker, cfg config.APIServer) *LogHandlers {
 	han := &LogHandlers{
-		hub:   hub,
-		store: datastore,
-		cfg:   cfg,
+		hub:      hub,
+		store:    datastore,
+		listener: listener,
+		cfg:      cfg,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 16384,
 		},
+		rotating: new(int32),
 	}
 
 	corsChecker := han.getCORSChecker()
@@ -66,32 +119,52 @@ func NewLogHandler(hub *wsWriter.Hub, datastore common.DataStore, cfg config.API
 	return han
 }
 
+// WithConfig returns handlers serving the same hub and datastore as l,
+// using cfg instead of the config l was created with.
+func (l *LogHandlers) WithConfig(cfg config.APIServer) *LogHandlers {
+	han := &LogHandlers{
+		hub:      l.hub,
+		store:    l.store,
+		listener: l.listener,
+		cfg:      cfg,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  l.upgrader.ReadBufferSize,
+			WriteBufferSize: l.upgrader.WriteBufferSize,
+		},
+		rotating: l.rotating,
+	}
+	han.upgrader.CheckOrigin = han.getCORSChecker()
+	return han
+}
+
 type LogHandlers struct {
 	hub      *wsWriter.Hub
 	store    common.DataStore
+	listener common.HealthChecker
 	cfg      config.APIServer
 	upgrader websocket.Upgrader
+	// rotating is set while a rotation requested through the API is
+	// running. It is shared with the handlers returned by
+	// WithConfig(), so reloading the config does not allow a second
+	// rotation to start.
+	rotating *int32
 }
 
+// getSeverity parses the severity query parameter, given either as a
+// level or as a name, defaulting to DefaultSeverityLevel.
 func getSeverity(severity string) (logging.Severity, error) {
-	var ret logging.Severity
 	if severity == "" {
 		return logging.DefaultSeverityLevel, nil
 	}
-	cliSeverity, err := strconv.Atoi(severity)
-	if err != nil {
-		return ret, fmt.Errorf("invalid severity %q", severity)
-	}
-	if cliSeverity > 7 || cliSeverity < 0 {
-		ret = logging.DefaultSeverityLevel
-	} else {
-		ret = logging.Severity(cliSeverity)
-	}
-	return ret, nil
+	return logging.ParseSeverity(severity)
 }
 
+// getCORSChecker returns the function checking the origin of web
+// socket upgrade requests against the allowed origins. Requests without
+// an origin do not come from a browser, and are always allowed.
 func (l *LogHandlers) getCORSChecker() func(r *http.Request) bool {
-	if l.cfg.CORSOrigins == nil || len(l.cfg.CORSOrigins) == 0 {
+	origins := l.cfg.GetCORSOrigins()
+	if len(origins) == 0 {
 		return nil
 	}
 
@@ -100,7 +173,7 @@ func (l *LogHandlers) getCORSChecker() func(r *http.Request) bool {
 		if origin == "" {
 			return true
 		}
-		for _, val := range l.cfg.CORSOrigins {
+		for _, val := range origins {
 			if val == "*" || val == origin {
 				return true
 			}
@@ -116,12 +189,12 @@ func (l *LogHandlers) WSHandler(writer http.ResponseWriter, req *http.Request) {
 		writer.Write([]byte("you need admin level access to view logs"))
 		return
 	}
-	severityStr := req.URL.Query().Get("severity")
-	severity, err := getSeverity(severityStr)
+	opts, err := streamFilterOptions(req)
 	if err != nil {
-		log.Warningf("invalid severity %q. Ignoring", severityStr)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
 	}
-	binName := req.URL.Query().Get("app_name")
 
 	conn, err := l.upgrader.Upgrade(writer, req, nil)
 	if err != nil {
@@ -129,10 +202,6 @@ func (l *LogHandlers) WSHandler(writer http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	opts := wsWriter.ClientFilterOptions{
-		Severity: &severity,
-		AppName:  &binName,
-	}
 	// TODO (gsamfira): Handle ExpiresAt. Right now, if a client uses
 	// a valid token to authenticate, and keeps the websocket connection
 	// open, it will allow that client to stream logs via websockets
@@ -150,10 +219,111 @@ func (l *LogHandlers) WSHandler(writer http.ResponseWriter, req *http.Request) {
 	client.Go()
 }
 
+// streamFilterOptions returns the filters of the logs streamed to a web
+// socket or Server-Sent Events client, from the request query.
+func streamFilterOptions(req *http.Request) (wsWriter.ClientFilterOptions, error) {
+	severityStr := req.URL.Query().Get("severity")
+	severity, err := getSeverity(severityStr)
+	if err != nil {
+		log.Warningf("invalid severity %q. Ignoring", severityStr)
+		severity = logging.DefaultSeverityLevel
+	}
+	binName := req.URL.Query().Get("app_name")
+
+	opts := wsWriter.ClientFilterOptions{
+		Severity: &severity,
+		AppName:  &binName,
+	}
+	if facilityStr := req.URL.Query().Get("facility"); facilityStr != "" {
+		facility, err := logging.ParseFacility(facilityStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid facility: %q", facilityStr)
+		}
+		opts.Facility = &facility
+	}
+	return opts, nil
+}
+
+// sseKeepAliveInterval is the interval at which comments are sent to
+// Server-Sent Events clients, so idle connections are not closed by
+// proxies, and disconnected clients are noticed.
+const sseKeepAliveInterval = 30 * time.Second
+
+// StreamHandler streams logs as Server-Sent Events, for clients that
+// can not use web sockets. It takes the same filters as WSHandler, and
+// each message is sent as a JSON encoded event. The client is dropped
+// once it disconnects.
+func (l *LogHandlers) StreamHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view logs"))
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte("streaming is not supported"))
+		return
+	}
+	opts, err := streamFilterOptions(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+
+	client := wsWriter.NewStreamClient(opts, l.hub)
+	if err := l.hub.Register(client); err != nil {
+		log.Errorf("failed to register new client: %v", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer client.Unregister()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := writer.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case msg, ok := <-client.Messages():
+			if !ok {
+				// The hub dropped the client.
+				return
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Errorf("failed to encode message: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(writer, "data: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// timestampToTime parses a Unix timestamp, or an RFC3339 one.
 func timestampToTime(stamp string) (time.Time, error) {
 	if stamp == "" {
 		return time.Time{}, nil
 	}
+	if tm, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+		return tm, nil
+	}
 	i, err := strconv.ParseInt(stamp, 10, 64)
 	if err != nil {
 		return time.Time{}, errors.Wrap(err, "converting timestamp")
@@ -167,7 +337,7 @@ func timestampToTime(stamp string) (time.Time, error) {
 // This is done because some browsers like Safari have issues with
 // chunked downloads. This is a workaround that should be removed at a later
 // time.
-func (l *LogHandlers) downloadAsFile(reader common.Reader, writer http.ResponseWriter, logName string) {
+func (l *LogHandlers) downloadAsFile(reader common.Reader, writer http.ResponseWriter, filename, contentType string, truncated func() bool) {
 	tmpfile, err := ioutil.TempFile("", "coriolis-logger")
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
@@ -212,8 +382,14 @@ func (l *LogHandlers) downloadAsFile(reader common.Reader, writer http.ResponseW
 	}
 
 	size := strconv.FormatInt(logStat.Size(), 10)
-	writer.Header().Set("Content-Disposition", "attachment; filename="+logName+".log")
-	writer.Header().Set("Content-Type", "text/plain")
+	if cursor := reader.Cursor(); cursor != "" {
+		writer.Header().Set(nextCursorHeader, cursor)
+	}
+	if truncated() {
+		writer.Header().Set(truncatedHeader, "true")
+	}
+	writer.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	writer.Header().Set("Content-Type", contentType)
 	writer.Header().Set("Content-Length", size)
 
 	if _, err := io.Copy(writer, tmpfile); err != nil {
@@ -223,7 +399,7 @@ func (l *LogHandlers) downloadAsFile(reader common.Reader, writer http.ResponseW
 	return
 }
 
-func (l *LogHandlers) downloadAsChuks(reader common.Reader, writer http.ResponseWriter, logName string) {
+func (l *LogHandlers) downloadAsChuks(reader common.Reader, writer http.ResponseWriter, filename, contentType string, truncated func() bool) {
 	data, err := reader.ReadNext()
 	if err != nil {
 		if err != io.EOF {
@@ -232,8 +408,19 @@ func (l *LogHandlers) downloadAsChuks(reader common.Reader, writer http.Response
 			return
 		}
 	}
-	writer.Header().Set("Content-Disposition", "attachment; filename="+logName+".log")
-	writer.Header().Set("Content-Type", "text/plain")
+	writer.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	writer.Header().Set("Content-Type", contentType)
+	// The cursor is only known once the whole log has been sent,
+	// so we send it as a trailer, along with whether it was truncated.
+	writer.Header().Set("Trailer", nextCursorHeader+", "+truncatedHeader)
+	defer func() {
+		if cursor := reader.Cursor(); cursor != "" {
+			writer.Header().Set(nextCursorHeader, cursor)
+		}
+		if truncated() {
+			writer.Header().Set(truncatedHeader, "true")
+		}
+	}()
 
 	_, err = writer.Write(data)
 	if err != nil {
@@ -270,58 +457,571 @@ func (l *LogHandlers) DownloadLogHandler(writer http.ResponseWriter, req *http.R
 	disableChunkedAsBool, _ := strconv.ParseBool(disableChunked)
 
 	vars := mux.Vars(req)
-	severityStr := req.URL.Query().Get("severity")
-	severity, err := getSeverity(severityStr)
-	if err != nil {
-		log.Warningf("invalid severity %q. Ignoring", severityStr)
-	}
 	if vars["log"] == "" {
 		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(writer, fmt.Sprintf("missing log name"))
+		fmt.Fprintf(writer, "missing log name")
+		return
 	}
-	startDateStamp := req.URL.Query().Get("start_date")
+	// start and end are short for start_date and end_date.
+	startDateStamp := queryValue(req, "start_date", "start")
 	startDate, err := timestampToTime(startDateStamp)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(writer, fmt.Sprintf("invalid start date: %q", startDateStamp))
+		fmt.Fprintf(writer, "invalid start date: %q", startDateStamp)
+		return
 	}
 
-	endDateStamp := req.URL.Query().Get("end_date")
+	endDateStamp := queryValue(req, "end_date", "end")
 	endDate, err := timestampToTime(endDateStamp)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(writer, fmt.Sprintf("invalid end date: %q", endDateStamp))
+		fmt.Fprintf(writer, "invalid end date: %q", endDateStamp)
+		return
 	}
 
 	queryParams := params.QueryParams{
 		StartDate: startDate,
 		EndDate:   endDate,
 		AppName:   vars["log"],
-		Severity:  int(severity),
+		Hostname:  req.URL.Query().Get("hostname"),
+		// Users limited to some fields get those fields for every
+		// message, instead of just the message text.
+		AllowedFields: allowedFields(ctx),
+	}
+
+	// Severity filtering is only applied when explicitly requested.
+	// Downloads include messages of all severity levels by default.
+	if severityStr := req.URL.Query().Get("severity"); severityStr != "" {
+		severity, err := getSeverity(severityStr)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid severity: %q", severityStr)
+			return
+		}
+		queryParams.Severity = &severity
+	}
+	if facilityStr := req.URL.Query().Get("facility"); facilityStr != "" {
+		facility, err := logging.ParseFacility(facilityStr)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid facility: %q", facilityStr)
+			return
+		}
+		queryParams.Facility = &facility
+	}
+	if source := req.URL.Query().Get("source"); source != "" {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid source: %q", source)
+			return
+		}
+		// Addresses are stored in their canonical form.
+		queryParams.SourceAddr = ip.String()
+	}
+	queryParams.MsgID = req.URL.Query().Get("msgid")
+	// Downloads are always limited, so a single request can not
+	// load a whole log in memory. default_query_limit applies unless
+	// the client sets a limit, with 0 standing for an unset one.
+	queryParams.Limit = l.cfg.GetDefaultQueryLimit()
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid limit: %q", limitStr)
+			return
+		}
+		if maxLimit := l.cfg.GetMaxQueryLimit(); limit > maxLimit {
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(writer, "limit %d exceeds the maximum of %d", limit, maxLimit)
+			return
+		}
+		if limit > 0 {
+			queryParams.Limit = limit
+		}
+	}
+	if offsetStr := req.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid offset: %q", offsetStr)
+			return
+		}
+		queryParams.Offset = offset
+	}
+	switch order := req.URL.Query().Get("order"); order {
+	case "", params.OrderAsc:
+		queryParams.Order = params.OrderAsc
+	case params.OrderDesc:
+		queryParams.Order = params.OrderDesc
+	default:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid order: %q", order)
+		return
+	}
+	queryParams.ClusterID = req.URL.Query().Get("cluster")
+	for key, values := range req.URL.Query() {
+		name := strings.TrimPrefix(key, structuredDataPrefix)
+		if name == key || len(values) == 0 {
+			continue
+		}
+		if name == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid structured data filter: %q", key)
+			return
+		}
+		if queryParams.StructuredData == nil {
+			queryParams.StructuredData = map[string]string{}
+		}
+		queryParams.StructuredData[name] = values[0]
+	}
+	if cursor := req.URL.Query().Get("cursor"); cursor != "" {
+		if _, err := common.DecodeCursor(cursor); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid cursor: %q", cursor)
+			return
+		}
+		queryParams.Cursor = cursor
+	}
+
+	ndjson := wantsNDJSON(req)
+	if ndjson && common.SelectsFields(l.store) {
+		// The datastore returns the messages as JSON, with all the
+		// fields the user may see.
+		if len(queryParams.AllowedFields) == 0 {
+			queryParams.AllowedFields = params.QueryFields
+		}
+		queryParams.JSON = true
+	}
+
+	// The request context is cancelled when the client goes away, so
+	// aborted downloads stop the datastore query.
+	var reader common.Reader = l.store.ResultReader(ctx, queryParams)
+	// Whether the log exists is only checked if nothing was found,
+	// so downloads do not list logs.
+	first, err := reader.ReadNext()
+	if errors.Cause(err) == common.UnsupportedParamErr {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	if err == io.EOF {
+		exists, err := l.logExists(vars["log"])
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Errorf("error listing logs: %v", err)
+			return
+		}
+		if !exists {
+			writer.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(writer, "log %q not found", vars["log"])
+			return
+		}
 	}
+	reader = &peekedReader{Reader: reader, first: first, err: err}
 
-	reader := l.store.ResultReader(queryParams)
+	filename, contentType := vars["log"]+".log", "text/plain"
+	if ndjson {
+		if !queryParams.JSON {
+			reader = &ndjsonReader{reader: reader}
+		}
+		filename, contentType = vars["log"]+".ndjson", ndjsonContentType
+	}
+	truncated := func() bool {
+		ret, err := l.truncated(ctx, queryParams, reader)
+		if err != nil && ctx.Err() == nil {
+			log.Warningf("failed to check if the download of %q was truncated: %v", vars["log"], err)
+		}
+		return ret
+	}
 	if disableChunkedAsBool {
-		l.downloadAsFile(reader, writer, vars["log"])
+		l.downloadAsFile(reader, writer, filename, contentType, truncated)
 		return
 	}
-	l.downloadAsChuks(reader, writer, vars["log"])
+	l.downloadAsChuks(reader, writer, filename, contentType, truncated)
 	return
 }
 
+// truncated returns true if messages selected by queryParams were left
+// out of their download, read by reader, because of its limit.
+func (l *LogHandlers) truncated(ctx context.Context, queryParams params.QueryParams, reader common.Reader) (bool, error) {
+	if queryParams.Limit == 0 {
+		return false, nil
+	}
+	// Look for a message following the ones downloaded. The newest
+	// messages are downloaded with the desc order, so those left out
+	// are older than the cursor.
+	if cursor := reader.Cursor(); cursor != "" && queryParams.Order != params.OrderDesc {
+		queryParams.Cursor = cursor
+	} else {
+		queryParams.Offset += queryParams.Limit
+	}
+	queryParams.Limit = 1
+	next := l.store.ResultReader(ctx, queryParams)
+	for {
+		data, err := next.ReadNext()
+		if len(data) > 0 {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// logExists returns true if the datastore lists the log.
+func (l *LogHandlers) logExists(logName string) (bool, error) {
+	// Only the log is listed, which InfluxDB does without listing
+	// all logs.
+	logs, err := common.ListWithFilter(l.store, params.ListParams{
+		Pattern: "^" + regexp.QuoteMeta(logName) + "$",
+	})
+	if err != nil {
+		return false, err
+	}
+	return common.HasLog(logs, logName), nil
+}
+
+// peekedReader returns the result of a first ReadNext() call made on
+// the reader it wraps, before reading further.
+type peekedReader struct {
+	common.Reader
+	first  []byte
+	err    error
+	peeked bool
+}
+
+func (p *peekedReader) ReadNext() ([]byte, error) {
+	if !p.peeked {
+		p.peeked = true
+		return p.first, p.err
+	}
+	return p.Reader.ReadNext()
+}
+
+// queryValue returns the first of the query parameters that is set.
+func queryValue(req *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := req.URL.Query().Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// logInfo is a log, along with its metadata, as returned by the list
+// endpoint. Metadata that could not be fetched is left out.
+type logInfo struct {
+	LogName        string `json:"log_name"`
+	FirstTimestamp string `json:"first_timestamp,omitempty"`
+	LastTimestamp  string `json:"last_timestamp,omitempty"`
+	Count          int64  `json:"count,omitempty"`
+	Size           int64  `json:"size,omitempty"`
+}
+
+// logInfos returns logs as returned by the list endpoint, along with
+// their metadata if withMetadata is set.
+func (l *LogHandlers) logInfos(logs []map[string]string, withMetadata bool) []logInfo {
+	ret := make([]logInfo, 0, len(logs))
+	for _, val := range logs {
+		info := logInfo{LogName: val["log_name"]}
+		if !withMetadata {
+			ret = append(ret, info)
+			continue
+		}
+		metadata, err := l.store.Metadata(info.LogName)
+		if err != nil {
+			log.Warningf("failed to fetch metadata of log %q: %v", info.LogName, err)
+		} else {
+			info.FirstTimestamp = metadata.FirstTimestamp.UTC().Format(time.RFC3339Nano)
+			info.LastTimestamp = metadata.LastTimestamp.UTC().Format(time.RFC3339Nano)
+			info.Count = metadata.Count
+			info.Size = metadata.Size
+		}
+		ret = append(ret, info)
+	}
+	return ret
+}
+
+// listParams returns the filters and pagination of a log listing, from
+// the request query. Listings are only paginated if a page is set.
+func listParams(req *http.Request) (params.ListParams, error) {
+	query := req.URL.Query()
+	ret := params.ListParams{
+		Prefix:  query.Get("filter"),
+		Pattern: query.Get("pattern"),
+	}
+	if ret.Pattern != "" {
+		if _, err := regexp.Compile(ret.Pattern); err != nil {
+			return ret, fmt.Errorf("invalid pattern: %q", ret.Pattern)
+		}
+	}
+	pageStr := query.Get("page")
+	if pageStr == "" {
+		return ret, nil
+	}
+	page, err := strconv.Atoi(pageStr)
+	if err != nil || page < 1 {
+		return ret, fmt.Errorf("invalid page: %q", pageStr)
+	}
+	perPage := defaultListPageSize
+	if perPageStr := query.Get("per_page"); perPageStr != "" {
+		perPage, err = strconv.Atoi(perPageStr)
+		if err != nil || perPage < 1 || perPage > maxListPageSize {
+			return ret, fmt.Errorf("invalid per_page: %q, must be between 1 and %d", perPageStr, maxListPageSize)
+		}
+	}
+	ret.Limit = perPage
+	ret.Offset = (page - 1) * perPage
+	return ret, nil
+}
+
+// ListLogsHandler lists the logs. With metadata=true, their metadata is
+// fetched too, which costs a datastore query per log, so it is best
+// used along with pagination. With format=simple, only the log names
+// are returned, as they were before metadata was added. Logs can be
+// filtered by name prefix or pattern, and paginated, in which case the
+// X-Next-Page header holds the next page, if any.
 func (l *LogHandlers) ListLogsHandler(writer http.ResponseWriter, req *http.Request) {
-	logs, err := l.store.List()
+	format := req.URL.Query().Get("format")
+	if format != "" && format != "simple" {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid format: %q", format)
+		return
+	}
+	var withMetadata bool
+	if metadataStr := req.URL.Query().Get("metadata"); metadataStr != "" {
+		var err error
+		withMetadata, err = strconv.ParseBool(metadataStr)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid metadata: %q", metadataStr)
+			return
+		}
+		if withMetadata && format == "simple" {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "metadata can not be used with format=simple")
+			return
+		}
+	}
+	filter, err := listParams(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	// One more log is listed, to know if there is a next page.
+	pageSize := filter.Limit
+	if pageSize > 0 {
+		filter.Limit++
+	}
+	logs, err := common.ListWithFilter(l.store, filter)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("error listing logs: %v", err)
+		writeJSONError(writer, http.StatusInternalServerError, "failed to list logs")
+		return
 	}
-	ret := map[string][]map[string]string{
-		"logs": logs,
+	if pageSize > 0 && len(logs) > pageSize {
+		logs = logs[:pageSize]
+		writer.Header().Set(nextPageHeader, strconv.Itoa(filter.Offset/pageSize+2))
+	}
+
+	var ret interface{}
+	if format == "simple" {
+		ret = map[string][]map[string]string{
+			"logs": logs,
+		}
+	} else {
+		ret = map[string][]logInfo{
+			"logs": l.logInfos(logs, withMetadata),
+		}
 	}
 	js, err := json.Marshal(ret)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("error listing logs: %v", err)
+		writeJSONError(writer, http.StatusInternalServerError, "failed to list logs")
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(js)
+}
+
+// apiError is the body of the error responses sent as JSON.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSONError responds with status, and a JSON body holding msg.
+// The underlying error is expected to be logged by the caller, rather
+// than returned to the client.
+func writeJSONError(writer http.ResponseWriter, status int, msg string) {
+	js, _ := json.Marshal(apiError{Error: msg})
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(js)
+}
+
+// componentHealth is the health of a component, as returned by the
+// health endpoints.
+type componentHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Clients is the number of connected web socket clients.
+	Clients *int `json:"clients,omitempty"`
+}
+
+// healthCheck is a component checked by the health endpoints, along
+// with the statuses reported when it works, and when it does not.
+type healthCheck struct {
+	name    string
+	checker common.HealthChecker
+	ok      string
+	failed  string
+}
+
+// HealthHandler reports the health of the syslog listener, the
+// datastore and the web socket hub. It responds with 503 if any of
+// them is degraded, so it can be used by load balancers and readiness
+// probes.
+func (l *LogHandlers) HealthHandler(writer http.ResponseWriter, req *http.Request) {
+	checks := []healthCheck{
+		{name: "syslog", checker: l.listener, ok: "listening", failed: "error"},
+		{name: "datastore", checker: l.store, ok: "ok", failed: "degraded"},
+		{name: "websocket", checker: l.hub, ok: "ok", failed: "degraded"},
+	}
+
+	status := http.StatusOK
+	components := map[string]componentHealth{}
+	for _, check := range checks {
+		if check.checker == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+		err := check.checker.HealthCheck(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("%s health check failed: %v", check.name, err)
+			components[check.name] = componentHealth{
+				Status: check.failed,
+				Error:  err.Error(),
+			}
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		components[check.name] = componentHealth{Status: check.ok}
+	}
+	if ws, ok := components["websocket"]; ok {
+		clients := l.hub.ClientCount()
+		ws.Clients = &clients
+		components["websocket"] = ws
+	}
+
+	ret := map[string]interface{}{
+		"status":     "ok",
+		"components": components,
+	}
+	if status != http.StatusOK {
+		ret["status"] = "degraded"
+	}
+	js, err := json.Marshal(ret)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error encoding health status: %v", err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(js)
+}
+
+// DeleteLogHandler removes the messages of a log from the datastore.
+// Only the messages older than the optional older_than parameter, an
+// RFC3339 timestamp, are removed, if it is set.
+func (l *LogHandlers) DeleteLogHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canModify(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to delete logs"))
+		return
+	}
+	vars := mux.Vars(req)
+	if vars["log"] == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "missing log name")
+		return
+	}
+	var olderThan time.Time
+	if olderThanStr := req.URL.Query().Get("older_than"); olderThanStr != "" {
+		var err error
+		olderThan, err = time.Parse(time.RFC3339, olderThanStr)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid older_than: %q", olderThanStr)
+			return
+		}
+	}
+
+	if err := l.store.Delete(vars["log"], olderThan); err != nil {
+		if err == common.LogNotFoundErr {
+			writer.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(writer, "log %q not found", vars["log"])
+			return
+		}
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error deleting log %q: %v", vars["log"], err)
+		return
+	}
+	if olderThan.IsZero() {
+		log.Infof("deleted log %q", vars["log"])
+	} else {
+		log.Infof("deleted messages of log %q older than %s", vars["log"], olderThan)
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// RotateHandler removes messages older than the older_than parameter,
+// an RFC3339 timestamp, from all logs. Only one rotation requested
+// through the API runs at a time.
+func (l *LogHandlers) RotateHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canModify(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to rotate logs"))
+		return
+	}
+	olderThanStr := req.URL.Query().Get("older_than")
+	if olderThanStr == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "missing older_than")
+		return
+	}
+	olderThan, err := time.Parse(time.RFC3339, olderThanStr)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid older_than: %q", olderThanStr)
+		return
+	}
+	if olderThan.After(time.Now()) {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "older_than can not be in the future")
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(l.rotating, 0, 1) {
+		writer.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(writer, "a rotation is already in progress")
+		return
+	}
+	defer atomic.StoreInt32(l.rotating, 0)
+
+	if err := l.store.Rotate(olderThan); err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error rotating logs: %v", err)
+		return
 	}
-	fmt.Fprintf(writer, string(js))
+	log.Infof("rotated logs older than %s", olderThan)
+	writer.WriteHeader(http.StatusNoContent)
 }
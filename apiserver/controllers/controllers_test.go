@@ -0,0 +1,471 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"coriolis-logger/apiserver/auth"
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+	wsWriter "coriolis-logger/writers/websocket"
+)
+
+// fakeStore is a datastore holding the messages of a single log, which
+// records the calls it receives.
+type fakeStore struct {
+	logName  string
+	messages []string
+	// selectsFields is returned by SelectsFields().
+	selectsFields bool
+	// checksParams is set for datastores whose readers fail with the
+	// error of common.CheckReadParams().
+	checksParams bool
+
+	// queries holds the parameters of the readers returned, and
+	// deleted the times messages of the log were deleted before.
+	queries []params.QueryParams
+	deleted []time.Time
+	// metadataCalls is the number of times Metadata() was called.
+	metadataCalls int
+}
+
+var _ common.DataStore = (*fakeStore)(nil)
+
+func (f *fakeStore) Start() error                          { return nil }
+func (f *fakeStore) Stop() error                           { return nil }
+func (f *fakeStore) Wait()                                 {}
+func (f *fakeStore) HealthCheck(ctx context.Context) error { return nil }
+func (f *fakeStore) Write(logMsg logging.LogMessage) error { return nil }
+func (f *fakeStore) Rotate(olderThan time.Time) error      { return nil }
+func (f *fakeStore) SelectsFields() bool                   { return f.selectsFields }
+
+func (f *fakeStore) Delete(logName string, olderThan time.Time) error {
+	if logName != f.logName {
+		return common.LogNotFoundErr
+	}
+	f.deleted = append(f.deleted, olderThan)
+	return nil
+}
+
+func (f *fakeStore) List() ([]map[string]string, error) {
+	return []map[string]string{{"log_name": f.logName}}, nil
+}
+
+func (f *fakeStore) Metadata(logName string) (common.LogMetadata, error) {
+	f.metadataCalls++
+	if logName != f.logName {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	return common.LogMetadata{Count: int64(len(f.messages))}, nil
+}
+
+// ResultReader returns the messages selected by the offset and limit
+// of p.
+func (f *fakeStore) ResultReader(ctx context.Context, p params.QueryParams) common.Reader {
+	f.queries = append(f.queries, p)
+	messages := f.messages
+	if p.AppName != f.logName {
+		messages = nil
+	}
+	if p.Offset < len(messages) {
+		messages = messages[p.Offset:]
+	} else {
+		messages = nil
+	}
+	if p.Limit > 0 && p.Limit < len(messages) {
+		messages = messages[:p.Limit]
+	}
+	reader := &fakeReader{messages: messages}
+	if f.checksParams {
+		reader.err = common.CheckReadParams(p)
+	}
+	return reader
+}
+
+// fakeReader returns a message per ReadNext() call, or err if set.
+type fakeReader struct {
+	messages []string
+	err      error
+}
+
+func (f *fakeReader) ReadNext() ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(f.messages) == 0 {
+		return nil, io.EOF
+	}
+	msg := f.messages[0]
+	f.messages = f.messages[1:]
+	return []byte(msg + "\n"), nil
+}
+
+func (f *fakeReader) Cursor() string {
+	return ""
+}
+
+// serve sends a request to handler on behalf of an admin, with the log
+// name set as the log route variable.
+func serve(handler http.HandlerFunc, method, target, logName string) *httptest.ResponseRecorder {
+	return serveAs(auth.AuthDetails{IsAdmin: true}, handler, method, target, logName)
+}
+
+// serveAs sends a request to handler on behalf of the user described by
+// details.
+func serveAs(details auth.AuthDetails, handler http.HandlerFunc, method, target, logName string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	ctx := context.WithValue(req.Context(), auth.AuthDetailsKey, details)
+	req = mux.SetURLVars(req.WithContext(ctx), map[string]string{"log": logName})
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	return recorder
+}
+
+func newTestHandlers(store *fakeStore, cfg config.APIServer) *LogHandlers {
+	return NewLogHandler(nil, store, nil, cfg)
+}
+
+func TestDownloadSeverity(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected *logging.Severity
+		status   int
+	}{
+		{"", nil, http.StatusOK},
+		{"?severity=3", severityPtr(logging.Error), http.StatusOK},
+		{"?severity=warning", severityPtr(logging.Warning), http.StatusOK},
+		{"?severity=8", nil, http.StatusBadRequest},
+		{"?severity=loud", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		store := &fakeStore{logName: "coriolis-worker", messages: []string{"message"}}
+		han := newTestHandlers(store, config.APIServer{})
+		resp := serve(han.DownloadLogHandler, "GET", "/api/v1/logs/coriolis-worker"+tt.query, "coriolis-worker")
+		if resp.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.status, resp.Code)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		severity := store.queries[0].Severity
+		if (severity == nil) != (tt.expected == nil) || (severity != nil && *severity != *tt.expected) {
+			t.Errorf("%q: expected severity %v, got %v", tt.query, tt.expected, severity)
+		}
+	}
+}
+
+func severityPtr(severity logging.Severity) *logging.Severity {
+	return &severity
+}
+
+func TestDownloadFacility(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected *logging.Facility
+		status   int
+	}{
+		{"", nil, http.StatusOK},
+		{"?facility=16", facilityPtr(logging.LocalUse0), http.StatusOK},
+		{"?facility=local1", facilityPtr(logging.LocalUse1), http.StatusOK},
+		{"?facility=24", nil, http.StatusBadRequest},
+		{"?facility=nowhere", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		store := &fakeStore{logName: "coriolis-worker", messages: []string{"message"}}
+		han := newTestHandlers(store, config.APIServer{})
+		resp := serve(han.DownloadLogHandler, "GET", "/api/v1/logs/coriolis-worker"+tt.query, "coriolis-worker")
+		if resp.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.status, resp.Code)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		facility := store.queries[0].Facility
+		if (facility == nil) != (tt.expected == nil) || (facility != nil && *facility != *tt.expected) {
+			t.Errorf("%q: expected facility %v, got %v", tt.query, tt.expected, facility)
+		}
+	}
+}
+
+func facilityPtr(facility logging.Facility) *logging.Facility {
+	return &facility
+}
+
+func TestDownloadLimit(t *testing.T) {
+	messages := []string{"first", "second", "third", "fourth"}
+	tests := []struct {
+		query     string
+		status    int
+		limit     int
+		lines     int
+		truncated bool
+	}{
+		// default_query_limit only applies when no limit is set.
+		{"", http.StatusOK, 3, 3, true},
+		{"&limit=2", http.StatusOK, 2, 2, true},
+		{"&limit=4", http.StatusOK, 4, 4, false},
+		{"&limit=5", http.StatusOK, 5, 4, false},
+		// A limit of 0 is the same as an unset one.
+		{"&limit=0", http.StatusOK, 3, 3, true},
+		{"&limit=11", http.StatusUnprocessableEntity, 0, 0, false},
+		{"&limit=-1", http.StatusBadRequest, 0, 0, false},
+		{"&limit=all", http.StatusBadRequest, 0, 0, false},
+	}
+	for _, chunked := range []bool{true, false} {
+		for _, tt := range tests {
+			store := &fakeStore{logName: "coriolis-worker", messages: messages}
+			han := newTestHandlers(store, config.APIServer{DefaultQueryLimit: 3, MaxQueryLimit: 10})
+			target := "/api/v1/logs/coriolis-worker?disable_chunked=" + strconv.FormatBool(!chunked) + tt.query
+			resp := serve(han.DownloadLogHandler, "GET", target, "coriolis-worker")
+			if resp.Code != tt.status {
+				t.Errorf("%q: expected status %d, got %d", target, tt.status, resp.Code)
+				continue
+			}
+			if tt.status != http.StatusOK {
+				continue
+			}
+			if limit := store.queries[0].Limit; limit != tt.limit {
+				t.Errorf("%q: expected limit %d, got %d", target, tt.limit, limit)
+			}
+			if lines := strings.Count(resp.Body.String(), "\n"); lines != tt.lines {
+				t.Errorf("%q: expected %d messages, got %d", target, tt.lines, lines)
+			}
+			header := resp.Result().Header
+			if chunked {
+				header = resp.Result().Trailer
+			}
+			if truncated := header.Get(truncatedHeader) == "true"; truncated != tt.truncated {
+				t.Errorf("%q: expected truncated to be %v, got %v", target, tt.truncated, truncated)
+			}
+		}
+	}
+}
+
+func TestDownloadUnsupportedParams(t *testing.T) {
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"?offset=1", http.StatusBadRequest},
+		{"?order=desc", http.StatusBadRequest},
+		{"?msgid=ID47", http.StatusBadRequest},
+		{"?cluster=cluster-a", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		store := &fakeStore{logName: "coriolis-worker", messages: []string{"message"}, checksParams: true}
+		han := newTestHandlers(store, config.APIServer{})
+		resp := serve(han.DownloadLogHandler, "GET", "/api/v1/logs/coriolis-worker"+tt.query, "coriolis-worker")
+		if resp.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.status, resp.Code)
+		}
+	}
+}
+
+func TestDownloadNDJSON(t *testing.T) {
+	// Datastores that only return the message text have each line
+	// returned as a message.
+	store := &fakeStore{logName: "coriolis-worker", messages: []string{"disk /dev/sdb is 50% done"}}
+	han := newTestHandlers(store, config.APIServer{})
+	req := httptest.NewRequest("GET", "/api/v1/logs/coriolis-worker", nil)
+	req.Header.Set("Accept", ndjsonContentType)
+	ctx := context.WithValue(req.Context(), auth.AuthDetailsKey, auth.AuthDetails{IsAdmin: true})
+	req = mux.SetURLVars(req.WithContext(ctx), map[string]string{"log": "coriolis-worker"})
+	resp := httptest.NewRecorder()
+	han.DownloadLogHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+	if body := resp.Body.String(); body != `{"message":"disk /dev/sdb is 50% done"}`+"\n" {
+		t.Fatalf("expected the message as JSON, got %q", body)
+	}
+	if store.queries[0].JSON {
+		t.Fatalf("expected the datastore not to be asked for JSON")
+	}
+
+	// Datastores that select fields return JSON themselves, which is
+	// sent as is, multi-line messages included.
+	line := `{"hostname":"coriolis worker","message":"Traceback:\nValueError"}`
+	store = &fakeStore{logName: "coriolis-worker", messages: []string{line}, selectsFields: true}
+	han = newTestHandlers(store, config.APIServer{})
+	resp = httptest.NewRecorder()
+	han.DownloadLogHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+	if body := resp.Body.String(); body != line+"\n" {
+		t.Fatalf("expected %q, got %q", line+"\n", body)
+	}
+	if !store.queries[0].JSON || strings.Join(store.queries[0].AllowedFields, ",") != strings.Join(params.QueryFields, ",") {
+		t.Fatalf("expected all the fields to be asked for as JSON, got %+v", store.queries[0])
+	}
+}
+
+func TestDeleteLog(t *testing.T) {
+	olderThan := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		details auth.AuthDetails
+		logName string
+		query   string
+		status  int
+		// deleted is the time messages are deleted before, if any
+		// are.
+		deleted *time.Time
+	}{
+		{auth.AuthDetails{IsAdmin: true}, "coriolis-worker", "", http.StatusNoContent, &time.Time{}},
+		{auth.AuthDetails{IsAdmin: true}, "coriolis-worker", "?older_than=2026-10-01T00:00:00Z", http.StatusNoContent, &olderThan},
+		{auth.AuthDetails{IsAdmin: true}, "coriolis-worker", "?older_than=2026-10-01", http.StatusBadRequest, nil},
+		{auth.AuthDetails{IsAdmin: true}, "coriolis-api", "", http.StatusNotFound, nil},
+		{auth.AuthDetails{IsAdmin: true, ReadOnly: true}, "coriolis-worker", "", http.StatusForbidden, nil},
+		{auth.AuthDetails{}, "coriolis-worker", "", http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		store := &fakeStore{logName: "coriolis-worker", messages: []string{"message"}}
+		han := newTestHandlers(store, config.APIServer{})
+		resp := serveAs(tt.details, han.DeleteLogHandler, "DELETE", "/api/v1/logs/"+tt.logName+tt.query, tt.logName)
+		if resp.Code != tt.status {
+			t.Errorf("%s%s: expected status %d, got %d", tt.logName, tt.query, tt.status, resp.Code)
+			continue
+		}
+		if tt.deleted == nil {
+			if len(store.deleted) != 0 {
+				t.Errorf("%s%s: expected nothing to be deleted, got %v", tt.logName, tt.query, store.deleted)
+			}
+			continue
+		}
+		if len(store.deleted) != 1 || !store.deleted[0].Equal(*tt.deleted) {
+			t.Errorf("%s%s: expected messages older than %v to be deleted, got %v", tt.logName, tt.query, *tt.deleted, store.deleted)
+		}
+	}
+}
+
+func TestListLogsMetadata(t *testing.T) {
+	tests := []struct {
+		query  string
+		status int
+		// metadata is set if the metadata is expected to be fetched.
+		metadata bool
+	}{
+		{"", http.StatusOK, false},
+		{"?format=simple", http.StatusOK, false},
+		{"?metadata=false", http.StatusOK, false},
+		{"?metadata=true", http.StatusOK, true},
+		{"?metadata=1&page=1", http.StatusOK, true},
+		{"?metadata=yes", http.StatusBadRequest, false},
+		{"?metadata=true&format=simple", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		store := &fakeStore{logName: "coriolis-worker", messages: []string{"first", "second"}}
+		han := newTestHandlers(store, config.APIServer{})
+		resp := serve(han.ListLogsHandler, "GET", "/api/v1/logs/"+tt.query, "")
+		if resp.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.status, resp.Code)
+			continue
+		}
+		expectedCalls := 0
+		if tt.metadata {
+			expectedCalls = 1
+		}
+		if store.metadataCalls != expectedCalls {
+			t.Errorf("%q: expected %d metadata calls, got %d", tt.query, expectedCalls, store.metadataCalls)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var body struct {
+			Logs []map[string]interface{} `json:"logs"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+			t.Errorf("%q: invalid body %q: %v", tt.query, resp.Body.String(), err)
+			continue
+		}
+		if len(body.Logs) != 1 || body.Logs[0]["log_name"] != "coriolis-worker" {
+			t.Errorf("%q: unexpected logs %v", tt.query, body.Logs)
+			continue
+		}
+		count, hasCount := body.Logs[0]["count"]
+		if hasCount != tt.metadata || (tt.metadata && count != float64(2)) {
+			t.Errorf("%q: unexpected metadata in %v", tt.query, body.Logs[0])
+		}
+	}
+}
+
+// asAdmin serves requests to handler on behalf of an admin.
+func asAdmin(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), auth.AuthDetailsKey, auth.AuthDetails{IsAdmin: true})
+		handler(w, r.WithContext(ctx))
+	})
+}
+
+func TestWSOriginCheck(t *testing.T) {
+	tests := []struct {
+		cfg    config.APIServer
+		origin string
+		status int
+	}{
+		{config.APIServer{CORS: &config.CORS{AllowedOrigins: []string{"https://dashboard.example.com"}}}, "https://dashboard.example.com", http.StatusSwitchingProtocols},
+		{config.APIServer{CORS: &config.CORS{AllowedOrigins: []string{"https://dashboard.example.com"}}}, "https://evil.example.com", http.StatusForbidden},
+		{config.APIServer{CORS: &config.CORS{AllowedOrigins: []string{"*"}}}, "https://evil.example.com", http.StatusSwitchingProtocols},
+		{config.APIServer{CORSOrigins: []string{"https://dashboard.example.com"}}, "https://dashboard.example.com", http.StatusSwitchingProtocols},
+		{config.APIServer{CORSOrigins: []string{"https://dashboard.example.com"}}, "https://evil.example.com", http.StatusForbidden},
+		// Clients which are not browsers send no origin.
+		{config.APIServer{CORSOrigins: []string{"https://dashboard.example.com"}}, "", http.StatusSwitchingProtocols},
+		// Without allowed origins, only the origin of the server is.
+		{config.APIServer{}, "https://dashboard.example.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		hub := wsWriter.NewHub(ctx, tt.cfg)
+		hub.Start()
+		han := NewLogHandler(hub, &fakeStore{}, nil, tt.cfg)
+		srv := httptest.NewServer(asAdmin(han.WSHandler))
+
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws%s", srv.URL[len("http"):]), header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Errorf("%q: dialing web socket: %v", tt.origin, err)
+		} else if resp.StatusCode != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.origin, tt.status, resp.StatusCode)
+		}
+		srv.Close()
+		cancel()
+		hub.Stop()
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/params"
+)
+
+// ndjsonContentType is the content type of downloads sent as newline
+// delimited JSON.
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsNDJSON returns true if the client asked for newline delimited
+// JSON, rather than plain text, in the Accept header.
+func wantsNDJSON(req *http.Request) bool {
+	for _, value := range req.Header["Accept"] {
+		for _, accepted := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(accepted)
+			if err != nil {
+				continue
+			}
+			switch mediaType {
+			case ndjsonContentType, "application/json":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ndjsonReader returns the lines of a reader of a datastore that only
+// returns the message text as JSON objects holding the message, one per
+// line. Datastores selecting fields return JSON themselves, see
+// params.QueryParams.JSON. Lines are taken as messages, so those
+// datastores return the lines of multi-line messages as several ones.
+type ndjsonReader struct {
+	reader common.Reader
+}
+
+var _ common.Reader = (*ndjsonReader)(nil)
+
+func (n *ndjsonReader) ReadNext() ([]byte, error) {
+	data, err := n.reader.ReadNext()
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)*2))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		js, err := json.Marshal(map[string]string{params.FieldMessage: string(line)})
+		if err != nil {
+			return nil, errors.Wrap(err, "encoding message")
+		}
+		buf.Write(js)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *ndjsonReader) Cursor() string {
+	return n.reader.Cursor()
+}
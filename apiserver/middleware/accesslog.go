@@ -0,0 +1,150 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package middleware
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/juju/loggo"
+
+	"coriolis-logger/config"
+)
+
+var log = loggo.GetLogger("coriolis.logger.apiserver.access")
+
+func init() {
+	log.SetLogLevel(loggo.INFO)
+}
+
+// statusWriter records the status code and size of a response. It
+// keeps the optional interfaces of the wrapped writer that we rely on,
+// for web sockets and chunked downloads.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(data)
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *statusWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer can not be hijacked")
+	}
+	if s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// accessEntry is a request, as logged in JSON.
+type accessEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Size       int64   `json:"size"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// dashIfEmpty returns "-", used by the Combined Log Format for missing
+// values, if value is empty.
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func formatCombined(entry accessEntry, start time.Time) string {
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %d %q %q %.3f`,
+		entry.RemoteAddr, start.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.Path, entry.Proto, entry.Status, entry.Size,
+		dashIfEmpty(entry.Referer), dashIfEmpty(entry.UserAgent), entry.DurationMS)
+}
+
+// AccessLog returns a middleware logging every request once it is
+// served, in the given format. The path is logged without the query
+// string, which may hold authentication tokens.
+func AccessLog(format config.AccessLogFormat) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: writer}
+			next.ServeHTTP(sw, req)
+
+			remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				remoteAddr = req.RemoteAddr
+			}
+			entry := accessEntry{
+				Time:       start.UTC().Format(time.RFC3339Nano),
+				RemoteAddr: remoteAddr,
+				Method:     req.Method,
+				Path:       req.URL.Path,
+				Proto:      req.Proto,
+				Status:     sw.status,
+				Size:       sw.size,
+				Referer:    req.Referer(),
+				UserAgent:  req.UserAgent(),
+				DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+
+			if format == config.AccessLogJSON {
+				js, err := json.Marshal(entry)
+				if err != nil {
+					log.Errorf("failed to encode access log: %v", err)
+					return
+				}
+				log.Infof("%s", js)
+				return
+			}
+			log.Infof("%s", formatCombined(entry, start))
+		})
+	}
+}
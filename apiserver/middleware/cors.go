@@ -0,0 +1,91 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"coriolis-logger/config"
+)
+
+// corsExposedHeaders are the response headers browsers may let
+// scripts read. They allow paging through downloads and listings.
+var corsExposedHeaders = []string{"X-Next-Cursor", "X-Next-Page"}
+
+// CORS returns a middleware setting the Access-Control-Allow-* headers
+// on responses to requests from allowed origins, and answering
+// preflight requests. Requests from other origins are served without
+// those headers, so browsers block them, and their preflight requests
+// are rejected. It must wrap the router, as preflight requests do not
+// match any route.
+func CORS(cfg config.CORS) func(http.Handler) http.Handler {
+	methods := strings.Join(cfg.GetAllowedMethods(), ", ")
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	var wildcard bool
+	for _, val := range cfg.AllowedOrigins {
+		if val == "*" {
+			wildcard = true
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+			if origin == "" {
+				next.ServeHTTP(writer, req)
+				return
+			}
+
+			header := writer.Header()
+			header.Add("Vary", "Origin")
+			if !cfg.AllowsOrigin(origin) {
+				if preflight {
+					writer.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(writer, req)
+				return
+			}
+
+			// Tokens are sent in headers, not cookies, so credentials
+			// are never allowed, and "*" can be used as is.
+			if wildcard {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+			}
+			if !preflight {
+				header.Set("Access-Control-Expose-Headers", exposed)
+				next.ServeHTTP(writer, req)
+				return
+			}
+
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			header.Set("Access-Control-Allow-Methods", methods)
+			if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				// Authentication uses several headers, depending on
+				// the middleware, so all requested ones are allowed.
+				header.Set("Access-Control-Allow-Headers", requested)
+			}
+			if cfg.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+			}
+			writer.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
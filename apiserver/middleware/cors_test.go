@@ -0,0 +1,128 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"coriolis-logger/config"
+)
+
+const dashboardOrigin = "https://dashboard.example.com"
+
+// newCORSServer starts a server wrapping a handler answering 200 to
+// every request with the CORS middleware. It must be closed once done.
+func newCORSServer(cfg config.CORS) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	return httptest.NewServer(CORS(cfg)(handler))
+}
+
+// browserRequest sends a request the way a browser would from origin.
+// Preflight requests ask for method, along with the Authorization
+// header.
+func browserRequest(t *testing.T, srv *httptest.Server, method, origin string, preflight string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+"/api/v1/logs", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if preflight != "" {
+		req.Header.Set("Access-Control-Request-Method", preflight)
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORSPreflight(t *testing.T) {
+	srv := newCORSServer(config.CORS{
+		AllowedOrigins: []string{dashboardOrigin},
+		AllowedMethods: []string{"GET", "DELETE"},
+		MaxAge:         600,
+	})
+	defer srv.Close()
+
+	resp := browserRequest(t, srv, "OPTIONS", dashboardOrigin, "DELETE")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  dashboardOrigin,
+		"Access-Control-Allow-Methods": "GET, DELETE",
+		"Access-Control-Allow-Headers": "authorization",
+		"Access-Control-Max-Age":       "600",
+	}
+	for header, value := range expected {
+		if got := resp.Header.Get(header); got != value {
+			t.Errorf("expected %s to be %q, got %q", header, value, got)
+		}
+	}
+}
+
+func TestCORSPreflightFromUnknownOrigin(t *testing.T) {
+	srv := newCORSServer(config.CORS{AllowedOrigins: []string{dashboardOrigin}})
+	defer srv.Close()
+
+	resp := browserRequest(t, srv, "OPTIONS", "https://evil.example.com", "GET")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("expected no allowed origin, got %q", got)
+	}
+}
+
+func TestCORSRequests(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		// expected is the Access-Control-Allow-Origin header sent.
+		expected string
+	}{
+		{[]string{dashboardOrigin}, dashboardOrigin, dashboardOrigin},
+		{[]string{dashboardOrigin}, "https://evil.example.com", ""},
+		{[]string{dashboardOrigin}, "", ""},
+		{[]string{"*"}, "https://any.example.com", "*"},
+	}
+	for _, tt := range tests {
+		srv := newCORSServer(config.CORS{AllowedOrigins: tt.allowed})
+		resp := browserRequest(t, srv, "GET", tt.origin, "")
+		srv.Close()
+
+		// Requests are served either way, browsers hide the responses
+		// from scripts of other origins.
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%q: expected status %d, got %d", tt.origin, http.StatusOK, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.expected {
+			t.Errorf("%q: expected allowed origin %q, got %q", tt.origin, tt.expected, got)
+		}
+		exposed := resp.Header.Get("Access-Control-Expose-Headers")
+		if (exposed != "") != (tt.expected != "") {
+			t.Errorf("%q: unexpected exposed headers %q", tt.origin, exposed)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipFlushSize is the number of uncompressed bytes after which the
+// compressed data is sent to the client, so long downloads are
+// streamed rather than held back by the compressor.
+const gzipFlushSize = 64 * 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// acceptsGzip returns true if the client accepts gzip encoded
+// responses.
+func acceptsGzip(req *http.Request) bool {
+	for _, value := range req.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			accepted := true
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// gzipWriter compresses the body of a response, unless the handler
+// already encoded it, or the response has no body.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+	// decided is set once the headers are written, and bypass if the
+	// body is sent as is.
+	decided bool
+	bypass  bool
+	// pending is the number of bytes written since the last flush.
+	pending int
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.decided {
+		g.ResponseWriter.WriteHeader(status)
+		return
+	}
+	g.decided = true
+	header := g.Header()
+	noBody := status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified
+	if noBody || header.Get("Content-Encoding") != "" {
+		g.bypass = true
+		g.ResponseWriter.WriteHeader(status)
+		return
+	}
+	header.Set("Content-Encoding", "gzip")
+	// The length of the compressed body is not known in advance.
+	header.Del("Content-Length")
+	g.gz = gzipWriters.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipWriter) Write(data []byte) (int, error) {
+	if !g.decided {
+		// Otherwise, the content type is detected from the
+		// compressed data.
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.bypass {
+		return g.ResponseWriter.Write(data)
+	}
+	n, err := g.gz.Write(data)
+	if err != nil {
+		return n, err
+	}
+	g.pending += n
+	if g.pending >= gzipFlushSize {
+		g.Flush()
+	}
+	return n, nil
+}
+
+// Flush sends what was compressed so far to the client.
+func (g *gzipWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+		g.pending = 0
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close writes the end of the compressed body, and returns the
+// compressor to the pool.
+func (g *gzipWriter) close() {
+	if g.gz == nil {
+		return
+	}
+	g.gz.Close()
+	g.gz.Reset(nil)
+	gzipWriters.Put(g.gz)
+	g.gz = nil
+}
+
+// Gzip is a middleware compressing response bodies for clients
+// accepting gzip. Compressed data is flushed regularly, so downloads
+// are still streamed. Web socket upgrades and HEAD requests are served
+// as is.
+func Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Add("Vary", "Accept-Encoding")
+		upgrade := strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+		if upgrade || req.Method == http.MethodHead || !acceptsGzip(req) {
+			next.ServeHTTP(writer, req)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: writer}
+		defer gw.close()
+		next.ServeHTTP(gw, req)
+	})
+}
@@ -0,0 +1,285 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// typicalLogs returns count lines looking like the logs of a Coriolis
+// worker.
+func typicalLogs(count int) []byte {
+	var buf bytes.Buffer
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	for idx := 0; idx < count; idx++ {
+		fmt.Fprintf(&buf,
+			"%s coriolis coriolis-worker[%d]: INFO coriolis.tasks.migration [req-%08x] Replicating disk %d of instance %08x: %d bytes transferred\n",
+			ts.Add(time.Duration(idx)*time.Millisecond).Format(time.RFC3339Nano),
+			1000+idx%7, idx*7919, idx%4, idx%13, idx*65536)
+	}
+	return buf.Bytes()
+}
+
+// gunzip returns the decompressed data.
+func gunzip(t testing.TB, data []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("reading gzip header: %v", err)
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompressing: %v", err)
+	}
+	return plain
+}
+
+// serveGzip sends a GET request with the given Accept-Encoding header to
+// handler, wrapped by the gzip middleware.
+func serveGzip(handler http.HandlerFunc, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/v1/logs/coriolis-worker", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	recorder := httptest.NewRecorder()
+	Gzip(handler).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"GZIP":                true,
+		"deflate, gzip;q=1.0": true,
+		"br, *":               true,
+		"gzip;q=0":            false,
+		"deflate, br":         false,
+		"identity":            false,
+	}
+	for value, expected := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			req.Header.Set("Accept-Encoding", value)
+		}
+		if accepted := acceptsGzip(req); accepted != expected {
+			t.Errorf("%q: expected %v, got %v", value, expected, accepted)
+		}
+	}
+}
+
+func TestGzipCompressesLogs(t *testing.T) {
+	logs := typicalLogs(1000)
+	resp := serveGzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(logs)))
+		// Written in chunks, like the log downloads.
+		for _, line := range bytes.SplitAfter(logs, []byte("\n")) {
+			w.Write(line)
+		}
+	}, "gzip")
+
+	if encoding := resp.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", encoding)
+	}
+	if length := resp.Header().Get("Content-Length"); length != "" {
+		t.Fatalf("expected no content length, got %s", length)
+	}
+	if vary := resp.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Fatalf("expected to vary on Accept-Encoding, got %q", vary)
+	}
+	if plain := gunzip(t, resp.Body.Bytes()); !bytes.Equal(plain, logs) {
+		t.Fatalf("decompressed body differs from the logs sent")
+	}
+}
+
+func TestGzipSizeReduction(t *testing.T) {
+	logs := typicalLogs(1000)
+	resp := serveGzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(logs)
+	}, "gzip")
+	ratio := float64(resp.Body.Len()) / float64(len(logs))
+	if ratio > 0.5 {
+		t.Fatalf("expected at least 50%% size reduction, got %d bytes from %d", resp.Body.Len(), len(logs))
+	}
+}
+
+func TestGzipServesAsIs(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		handler        http.HandlerFunc
+	}{
+		{"", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("plain"))
+		}},
+		{"gzip;q=0", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("plain"))
+		}},
+		// Already encoded by the handler.
+		{"gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "identity")
+			w.Write([]byte("plain"))
+		}},
+		// Without a body.
+		{"gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}},
+	}
+	for idx, tt := range tests {
+		resp := serveGzip(tt.handler, tt.acceptEncoding)
+		if encoding := resp.Header().Get("Content-Encoding"); encoding == "gzip" {
+			t.Errorf("%d: expected the response not to be compressed", idx)
+		}
+		if resp.Code == http.StatusOK && resp.Body.String() != "plain" {
+			t.Errorf("%d: expected body %q, got %q", idx, "plain", resp.Body.String())
+		}
+	}
+}
+
+func TestGzipStreams(t *testing.T) {
+	first := typicalLogs(1000)
+	if len(first) < gzipFlushSize {
+		t.Fatalf("expected more than %d bytes of logs, got %d", gzipFlushSize, len(first))
+	}
+	release := make(chan struct{})
+	srv := httptest.NewServer(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(first)
+		// The handler waits for the client to read the first logs,
+		// which must have been flushed.
+		<-release
+		w.Write([]byte("last\n"))
+	})))
+	defer srv.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip encoded response")
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("reading gzip header: %v", err)
+	}
+	// The flushed data is not the whole of it, but at least what was
+	// written before the last flush.
+	got := make([]byte, gzipFlushSize)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(zr, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("reading streamed logs: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("logs were not streamed before the handler returned")
+	}
+	if !bytes.Equal(got, first[:gzipFlushSize]) {
+		t.Fatalf("streamed logs differ from the logs sent")
+	}
+
+	close(release)
+	rest, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("reading the rest of the logs: %v", err)
+	}
+	if !strings.HasSuffix(string(rest), "last\n") || len(rest) != len(first)-gzipFlushSize+len("last\n") {
+		t.Fatalf("unexpected end of logs")
+	}
+}
+
+func TestGzipSkipsWebSocketUpgrades(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Upgrading fails if the response writer can not be hijacked.
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	})))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("Accept-Encoding", "gzip")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("opening web socket: %v", err)
+	}
+	defer conn.Close()
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", msg)
+	}
+}
+
+func BenchmarkGzipLogs(b *testing.B) {
+	logs := typicalLogs(10000)
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, line := range bytes.SplitAfter(logs, []byte("\n")) {
+			w.Write(line)
+		}
+	}))
+	req := httptest.NewRequest("GET", "/api/v1/logs/coriolis-worker", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	var compressed int
+	b.SetBytes(int64(len(logs)))
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		compressed = recorder.Body.Len()
+	}
+	b.StopTimer()
+	reduction := 100 * (1 - float64(compressed)/float64(len(logs)))
+	b.ReportMetric(reduction, "%reduction")
+	if reduction < 50 {
+		b.Fatalf("expected at least 50%% size reduction, got %.1f%%", reduction)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// gen writes the OpenAPI spec of the API server as a Go source file, so
+// it is served without being reflected at runtime.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+
+	"coriolis-logger/apiserver/openapi"
+)
+
+func main() {
+	out := flag.String("o", "spec.go", "file to write the spec to")
+	flag.Parse()
+
+	spec, err := openapi.Build()
+	if err != nil {
+		log.Fatalf("failed to build spec: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "// Code generated by gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(buf, "package openapi\n\n")
+	fmt.Fprintf(buf, "// spec is the OpenAPI spec of the API server.\n")
+	fmt.Fprintf(buf, "const spec = %q\n", spec)
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("failed to format spec: %v", err)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatalf("failed to write spec: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package openapi describes the API server as an OpenAPI 3.0 spec. The
+// spec is reflected from the annotated request and response types
+// below, and generated at build time into spec.go, with go generate.
+package openapi
+
+//go:generate go run ./gen -o spec.go
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/swaggest/openapi-go/openapi3"
+)
+
+const (
+	// SpecPath and DocsPath are where the spec, and the page
+	// rendering it, are served.
+	SpecPath = "/openapi.json"
+	DocsPath = "/docs"
+
+	// apiVersion is the version of the API described by the spec.
+	apiVersion = "v1"
+)
+
+type logRequest struct {
+	Log string `path:"log" required:"true" description:"The name of the log."`
+}
+
+type listLogsRequest struct {
+	Format   string `query:"format" enum:"simple" description:"Set to simple to only get the log names."`
+	Metadata bool   `query:"metadata" description:"Set to true to also get the metadata of each log, which costs a datastore query per log. Can not be used with format=simple."`
+	Filter   string `query:"filter" description:"Only list the logs whose name starts with this prefix."`
+	Pattern  string `query:"pattern" description:"Only list the logs whose name matches this regular expression."`
+	Page     int    `query:"page" minimum:"1" description:"Paginate the listing, and return this page, starting from 1. Logs are sorted by name."`
+	PerPage  int    `query:"per_page" minimum:"1" maximum:"1000" description:"The number of logs in each page. Defaults to 100."`
+}
+
+type logInfo struct {
+	LogName        string `json:"log_name"`
+	FirstTimestamp string `json:"first_timestamp,omitempty" format:"date-time" description:"Timestamp of the oldest message."`
+	LastTimestamp  string `json:"last_timestamp,omitempty" format:"date-time" description:"Timestamp of the newest message."`
+	Count          int64  `json:"count,omitempty" description:"Number of messages."`
+	Size           int64  `json:"size,omitempty" description:"Approximate size of the messages, in bytes."`
+}
+
+type listLogsResponse struct {
+	NextPage int       `header:"X-Next-Page" description:"The next page of a paginated listing, if there is one."`
+	Logs     []logInfo `json:"logs"`
+}
+
+type downloadLogRequest struct {
+	logRequest
+	StartDate      string `query:"start_date" description:"Only download the messages logged since this Unix or RFC3339 timestamp. Can be shortened to start."`
+	EndDate        string `query:"end_date" description:"Only download the messages logged until this Unix or RFC3339 timestamp. Can be shortened to end."`
+	Hostname       string `query:"hostname" description:"Only download the messages sent by this host."`
+	Severity       string `query:"severity" description:"Only download the messages with this severity, given as a level from 0 to 7 or as a name, or a more severe one."`
+	Facility       string `query:"facility" description:"Only download the messages logged with this facility, given as a code from 0 to 23 or as a name."`
+	Source         string `query:"source" description:"Only download the messages received from this IP address, regardless of the hostname they claim."`
+	MsgID          string `query:"msgid" description:"Only download the RFC5424 messages with this MSGID, which identifies their type. Only supported by the influxdb, postgres and sqlite datastores."`
+	Limit          int    `query:"limit" minimum:"0" description:"Maximum number of messages to download. Defaults to default_query_limit when unset or 0."`
+	Offset         int    `query:"offset" minimum:"0" description:"Number of matching messages to skip. Only supported by the influxdb, postgres and sqlite datastores."`
+	Order          string `query:"order" enum:"asc,desc" description:"With desc, the newest messages are downloaded. Messages are always returned oldest first. Only supported by the influxdb, postgres and sqlite datastores."`
+	Cursor         string `query:"cursor" description:"Resume downloading after the last message of a previous download."`
+	Cluster        string `query:"cluster" description:"Only download the messages stored by the instance with this cluster_id. Only supported by the influxdb, postgres and sqlite datastores."`
+	DisableChunked bool   `query:"disable_chunked" description:"Attempt to disable chunked transfer."`
+}
+
+type downloadLogResponse struct {
+	NextCursor string `header:"X-Next-Cursor" description:"Pass as cursor to resume the download after the last message."`
+	Truncated  bool   `header:"X-Truncated" description:"Set to true when messages were left out because of the limit."`
+}
+
+type streamRequest struct {
+	Severity string `query:"severity" description:"Only stream the messages with this severity level, from 0 to 7, or a more severe one."`
+	AppName  string `query:"app_name" description:"The name of the log to stream."`
+	Facility string `query:"facility" description:"Only stream the messages logged with this facility, given as a code from 0 to 23 or as a name."`
+}
+
+type deleteLogRequest struct {
+	logRequest
+	OlderThan string `query:"older_than" format:"date-time" description:"Only delete the messages logged before this RFC3339 timestamp."`
+}
+
+type rotateRequest struct {
+	OlderThan string `query:"older_than" required:"true" format:"date-time" description:"Delete the messages logged before this RFC3339 timestamp."`
+}
+
+type componentHealth struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Clients *int   `json:"clients,omitempty" description:"Number of connected web socket clients."`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status" enum:"ok,degraded"`
+	Components map[string]componentHealth `json:"components"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// response is a response of an operation. The body is described by
+// output, if set, and may also be sent as the other content types, as
+// text.
+type response struct {
+	status      int
+	output      interface{}
+	contentType string
+	otherTypes  []string
+}
+
+// operation is an endpoint of the API.
+type operation struct {
+	method      string
+	path        string
+	summary     string
+	description string
+	input       interface{}
+	responses   []response
+	// public is set for the endpoints that do not require
+	// authentication.
+	public bool
+}
+
+// textBody is the body of plain text responses.
+var textBody = new(string)
+
+var operations = []operation{
+	{
+		method:  http.MethodGet,
+		path:    "/api/v1/logs/",
+		summary: "List logs",
+		description: "Lists the logs. With metadata=true, their metadata is returned too. " +
+			"With format=simple, only the log names are returned.",
+		input: new(listLogsRequest),
+		responses: []response{
+			{status: http.StatusOK, output: new(listLogsResponse)},
+			{status: http.StatusBadRequest, output: textBody, contentType: "text/plain"},
+			{status: http.StatusInternalServerError, output: new(apiError)},
+		},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/v1/logs/{log}/",
+		summary: "Download a log",
+		description: "Downloads the messages of a log, as plain text, or as newline " +
+			"delimited JSON if application/x-ndjson is accepted. Messages can also be " +
+			"filtered by structured data, with sd.{name} parameters.",
+		input: new(downloadLogRequest),
+		responses: []response{
+			{
+				status:      http.StatusOK,
+				output:      new(downloadLogResponse),
+				contentType: "text/plain",
+				otherTypes:  []string{"application/x-ndjson"},
+			},
+			{status: http.StatusBadRequest, output: textBody, contentType: "text/plain"},
+			{status: http.StatusForbidden, output: textBody, contentType: "text/plain"},
+			{status: http.StatusNotFound, output: textBody, contentType: "text/plain"},
+			{status: http.StatusUnprocessableEntity, output: textBody, contentType: "text/plain"},
+		},
+	},
+	{
+		method:      http.MethodDelete,
+		path:        "/api/v1/logs/{log}/",
+		summary:     "Delete a log",
+		description: "Removes the messages of a log, or only the ones older than older_than.",
+		input:       new(deleteLogRequest),
+		responses: []response{
+			{status: http.StatusNoContent},
+			{status: http.StatusBadRequest, output: textBody, contentType: "text/plain"},
+			{status: http.StatusForbidden, output: textBody, contentType: "text/plain"},
+			{status: http.StatusNotFound, output: textBody, contentType: "text/plain"},
+		},
+	},
+	{
+		method:      http.MethodGet,
+		path:        "/api/v1/logs/stream/",
+		summary:     "Stream logs using Server-Sent Events",
+		description: "Sends each message received as a Server-Sent Event, holding the message as JSON.",
+		input:       new(streamRequest),
+		responses: []response{
+			{status: http.StatusOK, contentType: "text/event-stream"},
+			{status: http.StatusBadRequest, output: textBody, contentType: "text/plain"},
+		},
+	},
+	{
+		method:      http.MethodGet,
+		path:        "/api/v1/ws/",
+		summary:     "Stream logs using web sockets",
+		description: "Upgrades the connection to a web socket, and sends each message received as JSON.",
+		input:       new(streamRequest),
+		responses: []response{
+			{status: http.StatusSwitchingProtocols},
+			{status: http.StatusBadRequest, output: textBody, contentType: "text/plain"},
+		},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/rotate/",
+		summary:     "Rotate logs",
+		description: "Removes the messages older than older_than from all logs.",
+		input:       new(rotateRequest),
+		responses: []response{
+			{status: http.StatusNoContent},
+			{status: http.StatusBadRequest, output: textBody, contentType: "text/plain"},
+			{status: http.StatusForbidden, output: textBody, contentType: "text/plain"},
+			{status: http.StatusConflict, output: textBody, contentType: "text/plain"},
+		},
+	},
+	{
+		method:      http.MethodGet,
+		path:        "/api/v1/health/",
+		summary:     "Check health",
+		description: "Checks the syslog listener, the datastore and the web socket hub.",
+		responses: []response{
+			{status: http.StatusOK, output: new(healthResponse)},
+			{status: http.StatusServiceUnavailable, output: new(healthResponse)},
+		},
+	},
+	{
+		method:      http.MethodGet,
+		path:        "/healthz",
+		summary:     "Check health without authentication",
+		description: "Same as /api/v1/health/. The path can be changed with health_path.",
+		responses: []response{
+			{status: http.StatusOK, output: new(healthResponse)},
+			{status: http.StatusServiceUnavailable, output: new(healthResponse)},
+		},
+		public: true,
+	},
+}
+
+// securitySchemes are the authentication methods of the API, only one
+// of which is enabled, by the auth_middleware setting.
+var securitySchemes = map[string]openapi3.SecurityScheme{
+	"keystone": {
+		APIKeySecurityScheme: &openapi3.APIKeySecurityScheme{
+			Name: "X-Auth-Token",
+			In:   openapi3.APIKeySecuritySchemeInHeader,
+		},
+	},
+	"apikey": {
+		APIKeySecurityScheme: &openapi3.APIKeySecurityScheme{
+			Name: "X-Api-Key",
+			In:   openapi3.APIKeySecuritySchemeInHeader,
+		},
+	},
+	// The HTTP bearer scheme can not be read back by openapi3, so the
+	// header is described as an API key instead.
+	"jwt": {
+		APIKeySecurityScheme: (&openapi3.APIKeySecurityScheme{
+			Name: "Authorization",
+			In:   openapi3.APIKeySecuritySchemeInHeader,
+		}).WithDescription("A JWT, as \"Bearer <token>\"."),
+	},
+}
+
+// Build reflects the spec of the API.
+func Build() ([]byte, error) {
+	reflector := openapi3.Reflector{}
+	spec := reflector.SpecEns()
+	spec.Info.
+		WithTitle("coriolis-logger").
+		WithDescription("Stores the syslog messages of Coriolis, and serves them.").
+		WithVersion(apiVersion)
+
+	schemes := openapi3.ComponentsSecuritySchemes{}
+	var security []map[string][]string
+	// Sorted, so the spec is the same on each build.
+	names := make([]string, 0, len(securitySchemes))
+	for name := range securitySchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		scheme := securitySchemes[name]
+		schemes.WithMapOfSecuritySchemeOrRefValuesItem(name, openapi3.SecuritySchemeOrRef{
+			SecurityScheme: &scheme,
+		})
+		security = append(security, map[string][]string{name: {}})
+	}
+	if spec.Components == nil {
+		spec.Components = &openapi3.Components{}
+	}
+	spec.Components.WithSecuritySchemes(schemes)
+
+	for _, op := range operations {
+		oaiOp := openapi3.Operation{}
+		oaiOp.WithSummary(op.summary).WithDescription(op.description)
+		if op.public {
+			oaiOp.Security = []map[string][]string{}
+		} else {
+			oaiOp.Security = security
+		}
+		if op.input != nil {
+			if err := reflector.SetRequest(&oaiOp, op.input, op.method); err != nil {
+				return nil, errors.Wrapf(err, "reflecting request of %s %s", op.method, op.path)
+			}
+		}
+		for _, rsp := range op.responses {
+			err := reflector.SetupResponse(openapi3.OperationContext{
+				Operation:       &oaiOp,
+				Output:          rsp.output,
+				HTTPStatus:      rsp.status,
+				RespContentType: rsp.contentType,
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "reflecting response of %s %s", op.method, op.path)
+			}
+			if len(rsp.otherTypes) > 0 {
+				resp := oaiOp.Responses.MapOfResponseOrRefValues[strconv.Itoa(rsp.status)].Response
+				for _, contentType := range rsp.otherTypes {
+					resp.Content[contentType] = openapi3.MediaType{
+						Schema: &openapi3.SchemaOrRef{
+							Schema: (&openapi3.Schema{}).WithType(openapi3.SchemaTypeString),
+						},
+					}
+				}
+			}
+		}
+		if err := spec.AddOperation(op.method, op.path, oaiOp); err != nil {
+			return nil, errors.Wrapf(err, "adding %s %s", op.method, op.path)
+		}
+	}
+
+	js, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding spec")
+	}
+	// Make sure the spec can be read back.
+	if err := new(openapi3.Spec).UnmarshalJSON(js); err != nil {
+		return nil, errors.Wrap(err, "decoding spec")
+	}
+	return js, nil
+}
+
+// docsPage renders the spec with Redoc.
+const docsPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <title>coriolis-logger API</title>
+    <meta charset="utf-8"/>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+  </head>
+  <body>
+    <redoc spec-url="` + SpecPath + `"></redoc>
+    <script src="https://cdn.redoc.ly/redoc/latest/bundles/redoc.standalone.js"></script>
+  </body>
+</html>
+`
+
+// SpecHandler serves the spec generated at build time.
+func SpecHandler(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write([]byte(spec))
+}
+
+// DocsHandler serves a page rendering the spec.
+func DocsHandler(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Write([]byte(docsPage))
+}
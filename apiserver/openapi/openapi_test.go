@@ -0,0 +1,218 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/swaggest/openapi-go/openapi3"
+)
+
+// decodeSpec returns the spec served, as generic JSON.
+func decodeSpec(t *testing.T) map[string]interface{} {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(spec), &doc); err != nil {
+		t.Fatalf("decoding spec: %v", err)
+	}
+	return doc
+}
+
+func TestSpecIsGenerated(t *testing.T) {
+	built, err := Build()
+	if err != nil {
+		t.Fatalf("building spec: %v", err)
+	}
+	if string(built) != spec {
+		t.Fatalf("spec.go is out of date, run go generate ./apiserver/openapi")
+	}
+}
+
+func TestSpecRoundTrip(t *testing.T) {
+	// Decoding validates the spec against the OpenAPI 3.0 schema:
+	// required keys must be set, and unknown ones are rejected.
+	var decoded openapi3.Spec
+	if err := json.Unmarshal([]byte(spec), &decoded); err != nil {
+		t.Fatalf("invalid spec: %v", err)
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("encoding spec: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatalf("decoding encoded spec: %v", err)
+	}
+	if !reflect.DeepEqual(got, decodeSpec(t)) {
+		t.Fatalf("spec changed when round tripped:\n%s", encoded)
+	}
+}
+
+// resolve returns the value ref, a local JSON pointer, points to in doc.
+func resolve(doc map[string]interface{}, ref string) (interface{}, bool) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	var val interface{} = doc
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if val, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// refs returns the values of the $ref keys found in val.
+func refs(val interface{}) []string {
+	found := []string{}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if ref, ok := item.(string); ok && key == "$ref" {
+				found = append(found, ref)
+				continue
+			}
+			found = append(found, refs(item)...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			found = append(found, refs(item)...)
+		}
+	}
+	return found
+}
+
+var pathParamRegex = regexp.MustCompile(`\{([^}]+)\}`)
+
+func TestSpecIsValid(t *testing.T) {
+	doc := decodeSpec(t)
+	if version, _ := doc["openapi"].(string); !strings.HasPrefix(version, "3.0.") {
+		t.Fatalf("expected an OpenAPI 3.0 spec, got version %q", version)
+	}
+	for _, ref := range refs(doc) {
+		if _, ok := resolve(doc, ref); !ok {
+			t.Errorf("unresolved reference %q", ref)
+		}
+	}
+
+	components, _ := doc["components"].(map[string]interface{})
+	schemes, _ := components["securitySchemes"].(map[string]interface{})
+	paths := doc["paths"].(map[string]interface{})
+	for path, item := range paths {
+		for method, val := range item.(map[string]interface{}) {
+			op := val.(map[string]interface{})
+			if responses, _ := op["responses"].(map[string]interface{}); len(responses) == 0 {
+				t.Errorf("%s %s: no responses", method, path)
+			}
+
+			// Path parameters must be declared, and required.
+			declared := map[string]bool{}
+			params, _ := op["parameters"].([]interface{})
+			for _, p := range params {
+				param := p.(map[string]interface{})
+				if param["in"] == "path" {
+					if param["required"] != true {
+						t.Errorf("%s %s: path parameter %v must be required", method, path, param["name"])
+					}
+					declared[param["name"].(string)] = true
+				}
+			}
+			for _, m := range pathParamRegex.FindAllStringSubmatch(path, -1) {
+				if !declared[m[1]] {
+					t.Errorf("%s %s: path parameter %q is not declared", method, path, m[1])
+				}
+				delete(declared, m[1])
+			}
+			for name := range declared {
+				t.Errorf("%s %s: path parameter %q is not in the path", method, path, name)
+			}
+
+			security, _ := op["security"].([]interface{})
+			for _, requirement := range security {
+				for name := range requirement.(map[string]interface{}) {
+					if _, ok := schemes[name]; !ok {
+						t.Errorf("%s %s: unknown security scheme %q", method, path, name)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSpecCoversEndpoints(t *testing.T) {
+	paths := decodeSpec(t)["paths"].(map[string]interface{})
+	expected := map[string][]string{
+		"/api/v1/logs/":        {"get"},
+		"/api/v1/logs/{log}/":  {"get", "delete"},
+		"/api/v1/logs/stream/": {"get"},
+		"/api/v1/ws/":          {"get"},
+		"/api/v1/rotate/":      {"post"},
+		"/api/v1/health/":      {"get"},
+		"/healthz":             {"get"},
+	}
+	for path, methods := range expected {
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			t.Errorf("missing path %s", path)
+			continue
+		}
+		for _, method := range methods {
+			if _, ok := item[method]; !ok {
+				t.Errorf("missing %s %s", method, path)
+			}
+		}
+	}
+	// The health check is public, the API is not. There is no global
+	// security requirement, so operations without one are public.
+	healthz := paths["/healthz"].(map[string]interface{})["get"].(map[string]interface{})
+	if security, _ := healthz["security"].([]interface{}); len(security) != 0 {
+		t.Errorf("expected /healthz not to require authentication, got %v", healthz["security"])
+	}
+	logs := paths["/api/v1/logs/"].(map[string]interface{})["get"].(map[string]interface{})
+	if security, _ := logs["security"].([]interface{}); len(security) == 0 {
+		t.Errorf("expected /api/v1/logs/ to require authentication")
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	SpecHandler(recorder, httptest.NewRequest("GET", SpecPath, nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected spec response: %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if recorder.Body.String() != spec {
+		t.Fatalf("expected the generated spec to be served")
+	}
+
+	recorder = httptest.NewRecorder()
+	DocsHandler(recorder, httptest.NewRequest("GET", DocsPath, nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected docs content type %q", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), `spec-url="`+SpecPath+`"`) {
+		t.Fatalf("expected the docs page to render %s", SpecPath)
+	}
+}
@@ -20,14 +20,29 @@ import (
 
 	"coriolis-logger/apiserver/auth"
 	"coriolis-logger/apiserver/controllers"
+	"coriolis-logger/apiserver/middleware"
+	"coriolis-logger/apiserver/openapi"
 	"coriolis-logger/config"
 	gorillaHandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func GetRouter(cfg config.APIServer, han *controllers.LogHandlers) (*mux.Router, error) {
+// GetRouter returns the handler serving the API. The compression, CORS
+// and access log middlewares wrap the router, so they also see the requests that
+// match no route, such as CORS preflight requests.
+func GetRouter(cfg config.APIServer, han *controllers.LogHandlers) (http.Handler, error) {
 	router := mux.NewRouter()
+	// The access log replaces the request logs printed on stdout.
+	logged := func(handler http.Handler) http.Handler {
+		return gorillaHandlers.LoggingHandler(os.Stdout, handler)
+	}
+	if cfg.AccessLog {
+		logged = func(handler http.Handler) http.Handler {
+			return handler
+		}
+	}
 	apiRouter := router.PathPrefix("/api/v1").Subrouter()
 	authMiddleware, err := auth.GetAuthMiddleware(cfg)
 	if err != nil {
@@ -38,10 +53,47 @@ func GetRouter(cfg config.APIServer, han *controllers.LogHandlers) (*mux.Router,
 		apiRouter.Use(authMiddleware.Handler)
 	}
 
-	apiRouter.Handle("/{ws:ws\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.WSHandler))).Methods("GET")
-	apiRouter.Handle("/{logs:logs\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.ListLogsHandler))).Methods("GET")
-	apiRouter.Handle("/logs/{log}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.DownloadLogHandler))).Methods("GET")
-	apiRouter.Handle("/logs/{log}/", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.DownloadLogHandler))).Methods("GET")
+	apiRouter.Handle("/{ws:ws\\/?}", logged(http.HandlerFunc(han.WSHandler))).Methods("GET")
+	apiRouter.Handle("/{logs:logs\\/?}", logged(http.HandlerFunc(han.ListLogsHandler))).Methods("GET")
+	// Registered before the log downloads, which would otherwise
+	// match it.
+	apiRouter.Handle("/{stream:logs\\/stream\\/?}", logged(http.HandlerFunc(han.StreamHandler))).Methods("GET")
+	apiRouter.Handle("/logs/{log}", logged(http.HandlerFunc(han.DownloadLogHandler))).Methods("GET")
+	apiRouter.Handle("/logs/{log}/", logged(http.HandlerFunc(han.DownloadLogHandler))).Methods("GET")
+	apiRouter.Handle("/logs/{log}", logged(http.HandlerFunc(han.DeleteLogHandler))).Methods("DELETE")
+	apiRouter.Handle("/logs/{log}/", logged(http.HandlerFunc(han.DeleteLogHandler))).Methods("DELETE")
+	apiRouter.Handle("/{rotate:rotate\\/?}", logged(http.HandlerFunc(han.RotateHandler))).Methods("POST")
+	apiRouter.Handle("/{health:health\\/?}", logged(http.HandlerFunc(han.HealthHandler))).Methods("GET")
 
-	return router, nil
+	// The health endpoint is not authenticated, so it can be used by
+	// load balancers and readiness probes.
+	router.Handle(cfg.GetHealthPath(), logged(http.HandlerFunc(han.HealthHandler))).Methods("GET")
+	// So are the API spec and its docs page.
+	router.Handle(openapi.SpecPath, logged(http.HandlerFunc(openapi.SpecHandler))).Methods("GET")
+	router.Handle(openapi.DocsPath, logged(http.HandlerFunc(openapi.DocsHandler))).Methods("GET")
+	if cfg.EnableMetrics {
+		router.Handle("/metrics", logged(promhttp.Handler())).Methods("GET")
+	}
+
+	var handler http.Handler = router
+	if cfg.CompressResponses {
+		handler = middleware.Gzip(handler)
+	}
+	if cfg.CORS != nil {
+		handler = middleware.CORS(*cfg.CORS)(handler)
+	}
+	// The access log is the outermost middleware, so it also logs
+	// requests rejected by the other ones.
+	if cfg.AccessLog {
+		handler = middleware.AccessLog(cfg.LogFormat)(handler)
+	}
+	return handler, nil
+}
+
+// GetMetricsRouter returns a router that only serves Prometheus
+// metrics. It is used when running in metrics only mode.
+func GetMetricsRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Handle("/metrics", gorillaHandlers.LoggingHandler(os.Stdout, promhttp.Handler())).Methods("GET")
+	return router
 }
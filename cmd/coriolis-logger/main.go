@@ -17,27 +17,52 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
+	"time"
 
 	"coriolis-logger/apiserver"
 	"coriolis-logger/config"
 	"coriolis-logger/datastore"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/graceful"
 	"coriolis-logger/logging"
 	"coriolis-logger/syslog"
+	"coriolis-logger/writers/file"
+	"coriolis-logger/writers/grpc"
+	"coriolis-logger/writers/kafka"
+	"coriolis-logger/writers/loki"
+	"coriolis-logger/writers/metrics"
 	"coriolis-logger/writers/stdout"
+	"coriolis-logger/writers/webhook"
 	"coriolis-logger/writers/websocket"
 
 	"github.com/juju/loggo"
+	"github.com/pkg/errors"
 )
 
 var log = loggo.GetLogger("coriolis.logger.cmd")
 
+const (
+	// healthCheckInterval is the interval at which the datastore
+	// health is checked.
+	healthCheckInterval = 30 * time.Second
+	// healthCheckTimeout is the maximum amount of time a health check
+	// may take.
+	healthCheckTimeout = 5 * time.Second
+)
+
 func main() {
-	stop := make(chan os.Signal)
+	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGTERM)
 	signal.Notify(stop, syscall.SIGINT)
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, syscall.SIGUSR2)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	log.SetLogLevel(loggo.DEBUG)
 
 	cfgFile := flag.String("config", "", "coriolis-logger config file")
@@ -57,38 +82,57 @@ func main() {
 		log.Errorf("failed to validate config: %q", err)
 		os.Exit(1)
 	}
+	if err := setLogLevel(cfg); err != nil {
+		log.Errorf("failed to set log level: %q", err)
+		os.Exit(1)
+	}
 	// ctx, cancel := context.WithCancel(context.Background())
 	ctx, cancel := context.WithCancel(context.Background())
+	// The datastore and writers have their own context, canceled once
+	// the syslog worker wrote the messages it drained on shutdown.
+	writeCtx, stopWriting := context.WithCancel(context.Background())
 	errChan := make(chan error)
 
 	configuredWriters := []logging.Writer{}
 
-	datastore, err := datastore.GetDatastore(ctx, cfg.Syslog)
-	if err != nil {
-		log.Errorf("error getting datastore: %q", err)
-		os.Exit(1)
-	}
-	if err := datastore.Start(); err != nil {
-		log.Errorf("error starting datastore: %q", err)
-		os.Exit(1)
-	}
-	configuredWriters = append(configuredWriters, datastore)
-
-	if cfg.Syslog.LogToStdout {
-		stdoutWriter, err := stdout.NewStdOutWriter()
+	var store common.DataStore
+	var websocketWorker *websocket.Hub
+	writers := &optionalWriters{}
+	if cfg.Syslog.MetricsOnly {
+		log.Infof("running in metrics only mode. Logs will not be stored")
+		metricsWriter, err := metrics.NewMetricsWriter()
 		if err != nil {
-			log.Errorf("error getting stdout datastore: %q", err)
+			log.Errorf("error getting metrics writer: %q", err)
 			os.Exit(1)
 		}
-		configuredWriters = append(configuredWriters, stdoutWriter)
-	}
+		configuredWriters = append(configuredWriters, metricsWriter)
+	} else {
+		store, err = datastore.GetDatastore(writeCtx, cfg.Syslog, cfg.ClusterID)
+		if err != nil {
+			log.Errorf("error getting datastore: %q", err)
+			os.Exit(1)
+		}
+		if err := store.Start(); err != nil {
+			log.Errorf("error starting datastore: %q", err)
+			os.Exit(1)
+		}
+		configuredWriters = append(configuredWriters, store)
 
-	websocketWorker := websocket.NewHub(ctx)
-	if err := websocketWorker.Start(); err != nil {
-		log.Errorf("error starting websocket worker: %q", err)
-		os.Exit(1)
+		// The hub also gets the messages drained on shutdown.
+		websocketWorker = websocket.NewHub(writeCtx, cfg.APIServer)
+		if err := websocketWorker.Start(); err != nil {
+			log.Errorf("error starting websocket worker: %q", err)
+			os.Exit(1)
+		}
+		configuredWriters = append(configuredWriters, websocketWorker)
+
+		started, err := writers.start(writeCtx, nil, cfg)
+		if err != nil {
+			log.Errorf("error starting writers: %q", err)
+			os.Exit(1)
+		}
+		configuredWriters = append(configuredWriters, started...)
 	}
-	configuredWriters = append(configuredWriters, websocketWorker)
 
 	writer := logging.NewAggregateWriter(configuredWriters...)
 
@@ -102,8 +146,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	apiServer, err := apiserver.GetAPIServer(
-		cfg.APIServer, websocketWorker, datastore)
+	var apiServer *apiserver.APIServer
+	if cfg.Syslog.MetricsOnly {
+		apiServer, err = apiserver.GetMetricsAPIServer(cfg.APIServer)
+	} else {
+		apiServer, err = apiserver.GetAPIServer(
+			cfg.APIServer, websocketWorker, store, syslogSvc)
+	}
 	if err != nil {
 		log.Errorf("error getting api worker: %q", err)
 		os.Exit(1)
@@ -114,21 +163,275 @@ func main() {
 		os.Exit(1)
 	}
 
-	select {
-	case <-stop:
-		log.Infof("shutting down gracefully")
-		// if err := syslogSvc.Stop(); err != nil {
-		// 	log.Errorf("error stopping syslog worker: %q", err)
-		// }
-		cancel()
-	case err := <-errChan:
-		log.Errorf("worker set error: %q. Shutting down", err)
-		// if err := syslogSvc.Stop(); err != nil {
-		// 	log.Errorf("error stopping syslog worker: %q", err)
-		// }
-		cancel()
+	if store != nil {
+		go monitorHealth(ctx, store)
+	}
+
+	running := true
+	for running {
+		select {
+		case <-stop:
+			log.Infof("shutting down gracefully")
+			// if err := syslogSvc.Stop(); err != nil {
+			// 	log.Errorf("error stopping syslog worker: %q", err)
+			// }
+			cancel()
+			running = false
+		case <-reload:
+			log.Infof("reloading config from %s", *cfgFile)
+			newCfg, err := reloadConfig(writeCtx, *cfgFile, cfg, writers, writer, syslogSvc, apiServer)
+			if err != nil {
+				log.Errorf("error reloading config: %q", err)
+				continue
+			}
+			cfg = newCfg
+			log.Infof("config reloaded")
+		case <-restart:
+			log.Infof("restarting gracefully")
+			if err := restartProcess(syslogSvc, apiServer); err != nil {
+				log.Errorf("error restarting: %q", err)
+				continue
+			}
+			syslogSvc.HandOff()
+			cancel()
+			running = false
+		case err := <-errChan:
+			log.Errorf("worker set error: %q. Shutting down", err)
+			// if err := syslogSvc.Stop(); err != nil {
+			// 	log.Errorf("error stopping syslog worker: %q", err)
+			// }
+			cancel()
+			running = false
+		}
 	}
 	syslogSvc.Wait()
-	datastore.Wait()
+	stopWriting()
+	if store != nil {
+		store.Wait()
+	}
+	writers.wait()
 	apiServer.Stop()
 }
+
+// optionalWriters holds the writers enabled by optional settings.
+type optionalWriters struct {
+	stdout  logging.Writer
+	file    logging.Writer
+	loki    loki.Writer
+	kafka   kafka.Writer
+	webhook webhook.Writer
+	grpc    grpc.Writer
+}
+
+// start creates and starts the writers enabled in cfg, but not in
+// old, if set, and returns them. Writers can not be stopped or
+// changed while running, so changes to the settings of the others
+// are logged and ignored.
+func (w *optionalWriters) start(ctx context.Context, old, cfg *config.Config) ([]logging.Writer, error) {
+	if old == nil {
+		old = &config.Config{}
+	}
+	started := []logging.Writer{}
+	var err error
+
+	if cfg.Syslog.LogToStdout && w.stdout == nil {
+		if w.stdout, err = stdout.NewStdOutWriter(); err != nil {
+			return started, errors.Wrap(err, "getting stdout writer")
+		}
+		started = append(started, w.stdout)
+	} else if !cfg.Syslog.LogToStdout && w.stdout != nil {
+		log.Warningf("disabling log_to_stdout requires a restart, ignoring it")
+	}
+
+	if cfg.Syslog.LogToFile && w.file == nil {
+		if w.file, err = file.NewFileWriter(cfg.Syslog.FileWriter); err != nil {
+			return started, errors.Wrap(err, "getting file writer")
+		}
+		started = append(started, w.file)
+	} else if w.file != nil && (!cfg.Syslog.LogToFile || !reflect.DeepEqual(old.Syslog.FileWriter, cfg.Syslog.FileWriter)) {
+		log.Warningf("changing the file writer requires a restart, ignoring it")
+	}
+
+	if cfg.Loki != nil && w.loki == nil {
+		lokiWriter, err := loki.NewLokiWriter(ctx, cfg.Loki)
+		if err != nil {
+			return started, errors.Wrap(err, "getting loki writer")
+		}
+		if err := lokiWriter.Start(); err != nil {
+			return started, errors.Wrap(err, "starting loki writer")
+		}
+		w.loki = lokiWriter
+		started = append(started, lokiWriter)
+	} else if w.loki != nil && !reflect.DeepEqual(old.Loki, cfg.Loki) {
+		log.Warningf("changing the loki writer requires a restart, ignoring it")
+	}
+
+	if cfg.Kafka != nil && w.kafka == nil {
+		kafkaWriter, err := kafka.NewKafkaWriter(ctx, cfg.Kafka)
+		if err != nil {
+			return started, errors.Wrap(err, "getting kafka writer")
+		}
+		if err := kafkaWriter.Start(); err != nil {
+			return started, errors.Wrap(err, "starting kafka writer")
+		}
+		w.kafka = kafkaWriter
+		started = append(started, kafkaWriter)
+	} else if w.kafka != nil && !reflect.DeepEqual(old.Kafka, cfg.Kafka) {
+		log.Warningf("changing the kafka writer requires a restart, ignoring it")
+	}
+
+	if cfg.Webhook != nil && w.webhook == nil {
+		webhookWriter, err := webhook.NewWebhookWriter(ctx, cfg.Webhook)
+		if err != nil {
+			return started, errors.Wrap(err, "getting webhook writer")
+		}
+		if err := webhookWriter.Start(); err != nil {
+			return started, errors.Wrap(err, "starting webhook writer")
+		}
+		w.webhook = webhookWriter
+		started = append(started, webhookWriter)
+	} else if w.webhook != nil && !reflect.DeepEqual(old.Webhook, cfg.Webhook) {
+		log.Warningf("changing the webhook writer requires a restart, ignoring it")
+	}
+
+	if cfg.GRPCWriter != nil && w.grpc == nil {
+		grpcWriter, err := grpc.NewGRPCWriter(ctx, cfg.GRPCWriter)
+		if err != nil {
+			return started, errors.Wrap(err, "getting grpc writer")
+		}
+		if err := grpcWriter.Start(); err != nil {
+			return started, errors.Wrap(err, "starting grpc writer")
+		}
+		w.grpc = grpcWriter
+		started = append(started, grpcWriter)
+	} else if w.grpc != nil && !reflect.DeepEqual(old.GRPCWriter, cfg.GRPCWriter) {
+		log.Warningf("changing the grpc writer requires a restart, ignoring it")
+	}
+	return started, nil
+}
+
+// wait waits for the writers that run in the background to stop.
+func (w *optionalWriters) wait() {
+	if w.loki != nil {
+		w.loki.Wait()
+	}
+	if w.kafka != nil {
+		w.kafka.Wait()
+	}
+	if w.webhook != nil {
+		w.webhook.Wait()
+	}
+	if w.grpc != nil {
+		w.grpc.Wait()
+	}
+}
+
+// setLogLevel configures our loggers as set by log_level, if set.
+func setLogLevel(cfg *config.Config) error {
+	if cfg.LogLevel == "" {
+		return nil
+	}
+	return loggo.ConfigureLoggers(cfg.LogLevel)
+}
+
+// reloadConfig reads the config file again and applies the settings
+// that can be changed while running: the log level, the writers
+// enabled since the last load, the API server settings and some of
+// the syslog settings. The others are logged and ignored. The config
+// that is now in use is returned.
+func reloadConfig(ctx context.Context, cfgFile string, current *config.Config, writers *optionalWriters, writer *logging.AggregateWriter, syslogSvc *syslog.SyslogWorker, apiServer *apiserver.APIServer) (*config.Config, error) {
+	cfg, err := config.NewConfig(cfgFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading config")
+	}
+	if cfg.ClusterID != current.ClusterID {
+		log.Warningf("changing cluster_id requires a restart, ignoring it")
+		cfg.ClusterID = current.ClusterID
+	}
+	if cfg.Syslog.MetricsOnly != current.Syslog.MetricsOnly {
+		return nil, fmt.Errorf("changing metrics_only requires a restart")
+	}
+
+	if cfg.LogLevel != current.LogLevel {
+		if err := setLogLevel(cfg); err != nil {
+			return nil, errors.Wrap(err, "setting log level")
+		}
+		log.Infof("log level set to %q", cfg.LogLevel)
+	}
+
+	if !cfg.Syslog.MetricsOnly {
+		started, err := writers.start(ctx, current, cfg)
+		for _, val := range started {
+			writer.AddWriter(val)
+			log.Infof("started writing logs to %T", val)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "starting writers")
+		}
+	}
+
+	if err := syslogSvc.Reconfigure(cfg); err != nil {
+		return nil, errors.Wrap(err, "reconfiguring syslog worker")
+	}
+	if err := apiServer.Reconfigure(cfg); err != nil {
+		return nil, errors.Wrap(err, "reconfiguring api server")
+	}
+	return cfg, nil
+}
+
+// monitorHealth periodically checks the health of the datastore, until
+// ctx is canceled. Failures are logged along with the number of checks
+// that failed in a row, so outages stand out in the logs.
+func monitorHealth(ctx context.Context, store common.DataStore) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := store.HealthCheck(checkCtx)
+		cancel()
+		if err != nil {
+			failures++
+			log.Errorf("datastore health check failed (%d consecutive failures). Logs may not be stored: %v", failures, err)
+			continue
+		}
+		if failures > 0 {
+			log.Infof("datastore is healthy again, after %d failed health checks", failures)
+			failures = 0
+		}
+	}
+}
+
+// restartProcess starts a new copy of this process, passing on the
+// syslog and API server sockets, so no connections are refused while
+// the new process starts up.
+func restartProcess(syslogSvc *syslog.SyslogWorker, apiServer *apiserver.APIServer) error {
+	files, err := syslogSvc.Files()
+	if err != nil {
+		return errors.Wrap(err, "fetching syslog sockets")
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	apiFile, err := apiServer.File()
+	if err != nil {
+		return errors.Wrap(err, "fetching api server socket")
+	}
+	files[apiserver.InheritedListenerName] = apiFile
+
+	proc, err := graceful.Restart(files)
+	if err != nil {
+		return errors.Wrap(err, "starting new process")
+	}
+	log.Infof("started new process with pid %d", proc.Pid)
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// TestYAMLKeysMatchTOML checks every setting has the same key in YAML
+// and TOML configs.
+func TestYAMLKeysMatchTOML(t *testing.T) {
+	seen := map[reflect.Type]bool{}
+	var walk func(typ reflect.Type)
+	walk = func(typ reflect.Type) {
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct || typ.PkgPath() != reflect.TypeOf(Config{}).PkgPath() || seen[typ] {
+			return
+		}
+		seen[typ] = true
+		for idx := 0; idx < typ.NumField(); idx++ {
+			field := typ.Field(idx)
+			if field.PkgPath != "" {
+				continue
+			}
+			tomlKey := field.Tag.Get("toml")
+			yamlKey := field.Tag.Get("yaml")
+			if tomlKey == "" || yamlKey != tomlKey {
+				t.Errorf("%s.%s: toml key %q, yaml key %q", typ.Name(), field.Name, tomlKey, yamlKey)
+			}
+			walk(field.Type)
+		}
+	}
+	walk(reflect.TypeOf(Config{}))
+}
+
+func TestExampleYAMLConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("../examples/coriolis-logger.yaml")
+	if err != nil {
+		t.Fatalf("failed to read example: %v", err)
+	}
+	var cfg Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil {
+		t.Fatalf("failed to decode example: %v", err)
+	}
+	if cfg.APIServer.Bind != "0.0.0.0" || cfg.APIServer.Port != 9998 {
+		t.Fatalf("expected the api server to listen on 0.0.0.0:9998, got %s:%d", cfg.APIServer.Bind, cfg.APIServer.Port)
+	}
+	if cfg.APIServer.TLSConfig.CRT == "" {
+		t.Fatalf("expected the api server certificate to be set")
+	}
+	if cfg.Syslog.DataStore != InfluxDBDatastore || cfg.Syslog.InfluxDB == nil || cfg.Syslog.InfluxDB.Database == "" {
+		t.Fatalf("expected the influxdb datastore to be set, got %+v", cfg.Syslog)
+	}
+}
+
+func TestTOMLKeysOfUntaggedSettings(t *testing.T) {
+	// Keys of settings that had no toml tag matched their field name,
+	// regardless of case, which they still do.
+	var cfg Config
+	data := `
+[APIServer]
+Bind = "127.0.0.1"
+UseTLS = true
+[APIServer.tls]
+CRT = "/tmp/crt.pem"
+[syslog]
+datastore = "influxdb"
+[syslog.influxdb]
+verifyserver = true
+`
+	if _, err := toml.Decode(data, &cfg); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if cfg.APIServer.Bind != "127.0.0.1" || !cfg.APIServer.UseTLS || cfg.APIServer.TLSConfig.CRT != "/tmp/crt.pem" {
+		t.Fatalf("expected the api server settings to be set, got %+v", cfg.APIServer)
+	}
+	if cfg.Syslog.DataStore != InfluxDBDatastore || !cfg.Syslog.InfluxDB.VerifyServer {
+		t.Fatalf("expected the syslog settings to be set, got %+v", cfg.Syslog)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EnvPrefix is the prefix of the environment variables that override
+// config settings.
+const EnvPrefix = "CORIOLIS"
+
+// sensitiveSuffixes are the endings of the names of the settings whose
+// value must never be logged.
+var sensitiveSuffixes = []string{"PASSWORD", "SECRET", "TOKEN", "KEY"}
+
+func isSensitive(envName string) bool {
+	for _, suffix := range sensitiveSuffixes {
+		if strings.HasSuffix(envName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyEnvOverrides replaces the settings of cfg with the value of the
+// matching environment variables. The variable of a setting is named
+// after its path in the config file, uppercased and joined with "_",
+// such as CORIOLIS_APISERVER_PORT or CORIOLIS_SYSLOG_INFLUXDB_PASSWORD.
+// String, boolean and numeric settings can be overridden, and lists of
+// strings, as comma separated values. Optional sections are created
+// when one of their settings is set.
+func ApplyEnvOverrides(cfg *Config) error {
+	_, err := applyEnvOverrides(reflect.ValueOf(cfg).Elem(), EnvPrefix)
+	return err
+}
+
+// envName returns the name a struct field is known by in environment
+// variables, which is its toml key, uppercased.
+func envName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("toml"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+	return strings.ToUpper(name)
+}
+
+// applyEnvOverrides sets the fields of the struct val from the
+// environment variables starting with prefix. It returns true if any
+// field was set.
+func applyEnvOverrides(val reflect.Value, prefix string) (bool, error) {
+	var set bool
+	for idx := 0; idx < val.NumField(); idx++ {
+		field := val.Type().Field(idx)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := prefix + "_" + envName(field)
+		fieldVal := val.Field(idx)
+
+		switch {
+		case fieldVal.Kind() == reflect.Struct:
+			fieldSet, err := applyEnvOverrides(fieldVal, name)
+			if err != nil {
+				return false, err
+			}
+			set = set || fieldSet
+			continue
+		case fieldVal.Kind() == reflect.Ptr && fieldVal.Type().Elem().Kind() == reflect.Struct:
+			// Optional sections are only created if one of their
+			// settings is set.
+			section := reflect.New(fieldVal.Type().Elem())
+			if !fieldVal.IsNil() {
+				section = fieldVal
+			}
+			fieldSet, err := applyEnvOverrides(section.Elem(), name)
+			if err != nil {
+				return false, err
+			}
+			if fieldSet {
+				fieldVal.Set(section)
+				set = true
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fieldVal, value); err != nil {
+			return false, errors.Wrapf(err, "parsing %s", name)
+		}
+		if isSensitive(name) {
+			log.Infof("%s set from environment", name)
+		} else {
+			log.Infof("%s set from environment: %q", name, value)
+		}
+		set = true
+	}
+	return set, nil
+}
+
+// setFromEnv sets field to value, converted to the field type.
+func setFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(parsed)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("setting can not be set from the environment")
+		}
+		items := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = reflect.Append(items, reflect.ValueOf(item).Convert(field.Type().Elem()))
+			}
+		}
+		field.Set(items)
+	default:
+		return fmt.Errorf("setting can not be set from the environment")
+	}
+	return nil
+}
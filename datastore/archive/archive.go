@@ -0,0 +1,471 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package archive stores rotated logs in S3 compatible object storage.
+// Each archived object holds the messages of a single application,
+// saved as gzip compressed, newline delimited JSON. Object names
+// encode the application name and the time range of the messages
+// they hold:
+//
+//	<prefix><app_name>/<first_timestamp>-<last_timestamp>.ndjson.gz
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	minio "github.com/minio/minio-go/v6"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.archive")
+
+const (
+	objectSuffix = ".ndjson.gz"
+
+	// readChunkSize is the approximate amount of data, in bytes,
+	// returned by a reader on each call to ReadNext().
+	readChunkSize = 1024 * 1024
+	// maxRecordSize is the maximum size of a single archived record.
+	maxRecordSize = 16 * 1024 * 1024
+)
+
+// Record is the archived representation of a log message.
+type Record struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Hostname  string           `json:"hostname"`
+	Severity  logging.Severity `json:"severity"`
+	Facility  logging.Facility `json:"facility"`
+	Message   string           `json:"message"`
+	// SourceAddr is the IP address the message was received from.
+	SourceAddr string `json:"source_addr,omitempty"`
+}
+
+// NewArchiver returns an archiver that uploads to the object storage
+// described by cfg.
+func NewArchiver(cfg *config.Archive) (*Archiver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating archive config")
+	}
+	client, err := minio.NewWithRegion(
+		cfg.Endpoint, cfg.AccessKey, cfg.SecretKey, cfg.UseTLS, cfg.Region)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting object storage client")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config")
+	}
+	if tlsCfg != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsCfg
+		client.SetCustomTransport(transport)
+	}
+	return &Archiver{
+		cfg:    cfg,
+		client: client,
+	}, nil
+}
+
+type Archiver struct {
+	cfg    *config.Archive
+	client *minio.Client
+}
+
+func (a *Archiver) appPrefix(appName string) string {
+	return a.cfg.Prefix + appName + "/"
+}
+
+// object is an archived object of an application.
+type object struct {
+	name string
+	from time.Time
+	to   time.Time
+}
+
+// objects returns the archived objects of an application, sorted by
+// the timestamp of their first message.
+func (a *Archiver) objects(appName string) ([]object, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	prefix := a.appPrefix(appName)
+	ret := []object{}
+	for info := range a.client.ListObjectsV2(a.cfg.Bucket, prefix, false, done) {
+		if info.Err != nil {
+			return nil, errors.Wrap(info.Err, "listing archived objects")
+		}
+		stamps := strings.SplitN(
+			strings.TrimSuffix(strings.TrimPrefix(info.Key, prefix), objectSuffix), "-", 2)
+		if len(stamps) != 2 || !strings.HasSuffix(info.Key, objectSuffix) {
+			continue
+		}
+		from, err := strconv.ParseInt(stamps[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		to, err := strconv.ParseInt(stamps[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, object{
+			name: info.Key,
+			from: time.Unix(0, from),
+			to:   time.Unix(0, to),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].from.Before(ret[j].from)
+	})
+	return ret, nil
+}
+
+// NewExport returns an export that collects the messages of an
+// application that are about to be rotated out of the datastore.
+// Messages are buffered in a temporary file until Upload() is called.
+func (a *Archiver) NewExport(appName string) (*Export, error) {
+	tmp, err := ioutil.TempFile("", "coriolis-logger-archive")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating temporary file")
+	}
+	gz := gzip.NewWriter(tmp)
+	return &Export{
+		archiver: a,
+		appName:  appName,
+		tmp:      tmp,
+		gz:       gz,
+		enc:      json.NewEncoder(gz),
+	}, nil
+}
+
+// Export is a set of messages of a single application, that will be
+// uploaded as one archived object.
+type Export struct {
+	archiver *Archiver
+	appName  string
+	tmp      *os.File
+	gz       *gzip.Writer
+	enc      *json.Encoder
+
+	first time.Time
+	last  time.Time
+	count int
+}
+
+// Add appends a message to the export. Messages must be added in
+// chronological order.
+func (e *Export) Add(rec Record) error {
+	if err := e.enc.Encode(rec); err != nil {
+		return errors.Wrap(err, "encoding record")
+	}
+	if e.count == 0 {
+		e.first = rec.Timestamp
+	}
+	e.last = rec.Timestamp
+	e.count++
+	return nil
+}
+
+// Count returns the number of messages in the export.
+func (e *Export) Count() int {
+	return e.count
+}
+
+// Last returns the timestamp of the newest message in the export.
+func (e *Export) Last() time.Time {
+	return e.last
+}
+
+// Upload saves the export to the object storage. It is safe to remove
+// the exported messages from the datastore only if Upload() succeeds.
+func (e *Export) Upload() error {
+	if e.count == 0 {
+		return nil
+	}
+	if err := e.gz.Close(); err != nil {
+		return errors.Wrap(err, "compressing export")
+	}
+	info, err := e.tmp.Stat()
+	if err != nil {
+		return errors.Wrap(err, "fetching export info")
+	}
+	if _, err := e.tmp.Seek(0, 0); err != nil {
+		return errors.Wrap(err, "seeking export")
+	}
+
+	name := fmt.Sprintf(
+		"%s%d-%d%s", e.archiver.appPrefix(e.appName),
+		e.first.UnixNano(), e.last.UnixNano(), objectSuffix)
+	_, err = e.archiver.client.PutObject(
+		e.archiver.cfg.Bucket, name, e.tmp, info.Size(),
+		minio.PutObjectOptions{ContentType: "application/x-ndjson", ContentEncoding: "gzip"})
+	if err != nil {
+		return errors.Wrapf(err, "uploading %q", name)
+	}
+	log.Infof("archived %d messages of %q to %q", e.count, e.appName, name)
+	return nil
+}
+
+// Close releases the resources used by the export.
+func (e *Export) Close() error {
+	e.tmp.Close()
+	return os.Remove(e.tmp.Name())
+}
+
+// NewReader returns a reader over the archived messages matching p.
+// If before is not zero, only messages older than it are returned.
+func (a *Archiver) NewReader(p params.QueryParams, before time.Time) *Reader {
+	return &Reader{
+		archiver: a,
+		params:   p,
+		before:   before,
+		cursor:   p.Cursor,
+	}
+}
+
+var _ common.Reader = (*Reader)(nil)
+
+// Reader streams archived messages of an application, oldest first.
+type Reader struct {
+	archiver *Archiver
+	params   params.QueryParams
+	before   time.Time
+
+	objects []object
+	started bool
+	after   *time.Time
+
+	current *minio.Object
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+
+	cursor string
+	read   int
+}
+
+func (r *Reader) init() error {
+	r.started = true
+	if r.params.Cursor != "" {
+		cursor, err := common.DecodeCursor(r.params.Cursor)
+		if err != nil {
+			return errors.Wrap(err, "parsing cursor")
+		}
+		after := time.Unix(0, cursor.Timestamp)
+		r.after = &after
+	}
+
+	objects, err := r.archiver.objects(r.params.AppName)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if !r.params.StartDate.IsZero() && obj.to.Before(r.params.StartDate) {
+			continue
+		}
+		if !r.params.EndDate.IsZero() && obj.from.After(r.params.EndDate) {
+			continue
+		}
+		if !r.before.IsZero() && !obj.from.Before(r.before) {
+			continue
+		}
+		if r.after != nil && !obj.to.After(*r.after) {
+			continue
+		}
+		r.objects = append(r.objects, obj)
+	}
+	return nil
+}
+
+func (r *Reader) closeCurrent() {
+	if r.gz != nil {
+		r.gz.Close()
+		r.gz = nil
+	}
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	r.scanner = nil
+}
+
+// nextObject opens the next archived object. It returns io.EOF when
+// there are no more objects to read.
+func (r *Reader) nextObject() error {
+	r.closeCurrent()
+	if len(r.objects) == 0 {
+		return io.EOF
+	}
+	obj := r.objects[0]
+	r.objects = r.objects[1:]
+
+	current, err := r.archiver.client.GetObject(
+		r.archiver.cfg.Bucket, obj.name, minio.GetObjectOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "fetching %q", obj.name)
+	}
+	r.current = current
+	gz, err := gzip.NewReader(current)
+	if err != nil {
+		r.closeCurrent()
+		return errors.Wrapf(err, "reading %q", obj.name)
+	}
+	r.gz = gz
+	r.scanner = bufio.NewScanner(gz)
+	r.scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	return nil
+}
+
+func (r *Reader) matches(rec Record) bool {
+	if !r.params.StartDate.IsZero() && rec.Timestamp.Before(r.params.StartDate) {
+		return false
+	}
+	if !r.params.EndDate.IsZero() && rec.Timestamp.After(r.params.EndDate) {
+		return false
+	}
+	if !r.before.IsZero() && !rec.Timestamp.Before(r.before) {
+		return false
+	}
+	if r.after != nil && !rec.Timestamp.After(*r.after) {
+		return false
+	}
+	if r.params.Hostname != "" && rec.Hostname != r.params.Hostname {
+		return false
+	}
+	if r.params.SourceAddr != "" && rec.SourceAddr != r.params.SourceAddr {
+		return false
+	}
+	if r.params.Severity != nil && rec.Severity > *r.params.Severity {
+		return false
+	}
+	if r.params.Facility != nil && rec.Facility != *r.params.Facility {
+		return false
+	}
+	return true
+}
+
+// formatRecord returns a record as a log line. Unless the allowed
+// fields are limited, only the message is returned.
+func (r *Reader) formatRecord(rec Record) string {
+	if len(r.params.AllowedFields) == 0 {
+		if r.params.JSON {
+			js, _ := json.Marshal(map[string]string{params.FieldMessage: rec.Message})
+			return string(js)
+		}
+		return rec.Message
+	}
+	values := map[string]string{
+		params.FieldTime:     rec.Timestamp.UTC().Format(time.RFC3339Nano),
+		params.FieldHostname: rec.Hostname,
+		params.FieldSeverity: rec.Severity.String(),
+		params.FieldFacility: rec.Facility.String(),
+		params.FieldMessage:  rec.Message,
+	}
+	record := map[string]string{}
+	parts := []string{}
+	for _, field := range params.QueryFields {
+		for _, allowed := range r.params.AllowedFields {
+			if field == allowed {
+				record[field] = values[field]
+				parts = append(parts, values[field])
+				break
+			}
+		}
+	}
+	if r.params.JSON {
+		js, _ := json.Marshal(record)
+		return string(js)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r *Reader) ReadNext() ([]byte, error) {
+	if !r.started {
+		if err := r.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing archive reader")
+		}
+		if err := r.nextObject(); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, 0, readChunkSize)
+	for len(buf) < readChunkSize {
+		if r.scanner == nil {
+			break
+		}
+		if r.params.Limit > 0 && r.read >= r.params.Limit {
+			r.closeCurrent()
+			break
+		}
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				r.closeCurrent()
+				return nil, errors.Wrap(err, "reading archived object")
+			}
+			if err := r.nextObject(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(r.scanner.Bytes(), &rec); err != nil {
+			r.closeCurrent()
+			return nil, errors.Wrap(err, "decoding archived record")
+		}
+		if !r.matches(rec) {
+			continue
+		}
+		r.read++
+		r.cursor = common.EncodeCursor(common.Cursor{Timestamp: rec.Timestamp.UnixNano()})
+		line := r.formatRecord(rec)
+		buf = append(buf, line...)
+		if len(line) > 0 && line[len(line)-1] != '\n' {
+			buf = append(buf, '\n')
+		}
+	}
+
+	if len(buf) == 0 {
+		return nil, io.EOF
+	}
+	return buf, nil
+}
+
+func (r *Reader) Cursor() string {
+	return r.cursor
+}
+
+// Read returns the number of messages returned by the reader so far.
+func (r *Reader) Read() int {
+	return r.read
+}
@@ -0,0 +1,568 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.bolt")
+
+const (
+	// maxPendingMessages is the number of buffered messages after which
+	// a write will trigger a flush, regardless of the write interval.
+	maxPendingMessages = 20000
+	// readChunkSize is the number of messages returned by a reader on
+	// each call to ReadNext().
+	readChunkSize = 20000
+	// rotateBatchSize is the number of keys deleted in a single write
+	// transaction when rotating logs, so writes are not blocked for
+	// too long.
+	rotateBatchSize = 10000
+	// keySize is the size of a message key: a big endian nanosecond
+	// timestamp, followed by a big endian sequence number.
+	keySize = 16
+)
+
+// record is the representation of a log message stored in bolt.
+type record struct {
+	Hostname string `json:"hostname"`
+	Priority int    `json:"priority"`
+	Severity int    `json:"severity"`
+	Facility int    `json:"facility"`
+	ProcID   int    `json:"proc_id,omitempty"`
+	MsgID    string `json:"msg_id,omitempty"`
+	Message  string `json:"message"`
+	// SourceAddr is the IP address the message was received from.
+	SourceAddr string `json:"source_addr,omitempty"`
+}
+
+func NewBoltDatastore(ctx context.Context, cfg *config.Bolt) (common.DataStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating bolt config")
+	}
+
+	db, err := bbolt.Open(cfg.Path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "opening bolt database")
+	}
+
+	return &BoltDataStore{
+		cfg:      cfg,
+		db:       db,
+		messages: []logging.LogMessage{},
+		ctx:      ctx,
+		closed:   make(chan struct{}),
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+var _ common.DataStore = (*BoltDataStore)(nil)
+
+// BoltDataStore keeps the logs of each application in a separate
+// bucket, keyed by timestamp.
+type BoltDataStore struct {
+	cfg      *config.Bolt
+	db       *bbolt.DB
+	mut      sync.Mutex
+	messages []logging.LogMessage
+	ctx      context.Context
+	closed   chan struct{}
+	quit     chan struct{}
+}
+
+// messageKey returns the key of a message logged at tm. The sequence
+// number keeps keys of messages with the same timestamp unique.
+func messageKey(tm time.Time, seq uint64) []byte {
+	key := make([]byte, keySize)
+	binary.BigEndian.PutUint64(key[:8], uint64(tm.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// timestampKey returns the smallest key of messages logged at tm.
+func timestampKey(tm time.Time) []byte {
+	return messageKey(tm, 0)
+}
+
+func keyTimestamp(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:8]))
+}
+
+func (b *BoltDataStore) doWork() {
+	var interval int
+	if b.cfg.WriteInterval == 0 {
+		interval = 1
+	} else {
+		interval = b.cfg.WriteInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	rotationTicker := time.NewTicker(1 * time.Hour)
+	defer func() {
+		ticker.Stop()
+		rotationTicker.Stop()
+		if err := b.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
+		b.db.Close()
+		close(b.closed)
+	}()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.flush(); err != nil {
+				log.Errorf("failed to flush logs to backend: %v", err)
+			}
+		case <-rotationTicker.C:
+			retentionPeriod := b.cfg.GetLogRetention()
+			log.Infof("deleting logs older than %d days", retentionPeriod)
+			day := 24 * time.Hour
+			olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+			if err := b.Rotate(olderThan); err != nil {
+				log.Errorf("failed to rotate logs: %v", err)
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+func (b *BoltDataStore) Start() error {
+	go b.doWork()
+	return nil
+}
+
+func (b *BoltDataStore) Stop() error {
+	close(b.quit)
+	b.Wait()
+	return nil
+}
+
+func (b *BoltDataStore) Wait() {
+	<-b.closed
+}
+
+func (b *BoltDataStore) flush() error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.flushLocked()
+}
+
+// flushLocked stores all pending messages in a single transaction.
+// The caller must hold b.mut.
+func (b *BoltDataStore) flushLocked() error {
+	if len(b.messages) == 0 {
+		return nil
+	}
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		for _, msg := range b.messages {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(msg.AppName))
+			if err != nil {
+				return errors.Wrapf(err, "creating bucket for %q", msg.AppName)
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return errors.Wrap(err, "getting sequence")
+			}
+			value, err := json.Marshal(record{
+				Hostname: msg.Hostname,
+				Priority: msg.Priority,
+				Severity: int(msg.Severity),
+				Facility: int(msg.Facility),
+				ProcID:   msg.ProcID,
+				MsgID:    msg.MsgID,
+				Message:  msg.Message,
+
+				SourceAddr: msg.SourceAddr,
+			})
+			if err != nil {
+				return errors.Wrap(err, "encoding log message")
+			}
+			if err := bucket.Put(messageKey(msg.Timestamp, seq), value); err != nil {
+				return errors.Wrap(err, "storing log message")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "writing logs")
+	}
+	b.messages = []logging.LogMessage{}
+	return nil
+}
+
+func (b *BoltDataStore) Write(logMsg logging.LogMessage) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if logMsg.AppName == "" {
+		// Bucket names may not be empty.
+		return fmt.Errorf("missing application name")
+	}
+	b.messages = append(b.messages, logMsg)
+	if len(b.messages) >= maxPendingMessages {
+		if err := b.flushLocked(); err != nil {
+			return errors.Wrap(err, "flushing logs")
+		}
+	}
+	return nil
+}
+
+// bucketNames returns the names of all buckets.
+func (b *BoltDataStore) bucketNames() ([]string, error) {
+	names := []string{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// rotateBucket deletes up to rotateBatchSize keys older than cutoff
+// from a bucket. It returns the number of keys deleted.
+func (b *BoltDataStore) rotateBucket(name string, cutoff []byte) (int, error) {
+	var deleted int
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+			if deleted >= rotateBatchSize {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return errors.Wrap(err, "deleting log message")
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Rotate deletes all messages older than olderThan. Messages are
+// deleted in batches, each in its own write transaction.
+func (b *BoltDataStore) Rotate(olderThan time.Time) error {
+	names, err := b.bucketNames()
+	if err != nil {
+		return errors.Wrap(err, "listing buckets")
+	}
+	for _, name := range names {
+		if err := b.rotateLog(name, olderThan); err != nil {
+			return errors.Wrapf(err, "rotating %q", name)
+		}
+	}
+	return nil
+}
+
+// rotateLog deletes the messages of a log older than olderThan.
+func (b *BoltDataStore) rotateLog(name string, olderThan time.Time) error {
+	cutoff := timestampKey(olderThan)
+	for {
+		deleted, err := b.rotateBucket(name, cutoff)
+		if err != nil {
+			return err
+		}
+		if deleted < rotateBatchSize {
+			return nil
+		}
+	}
+}
+
+// Delete removes the bucket holding a log, or only the messages older
+// than olderThan, if set. Pending messages are written first, so they
+// do not recreate it.
+func (b *BoltDataStore) Delete(binaryName string, olderThan time.Time) error {
+	if err := b.flush(); err != nil {
+		log.Warningf("failed to flush logs before deleting %q: %v", binaryName, err)
+	}
+	if !olderThan.IsZero() {
+		err := b.db.View(func(tx *bbolt.Tx) error {
+			if tx.Bucket([]byte(binaryName)) == nil {
+				return common.LogNotFoundErr
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(b.rotateLog(binaryName, olderThan), "deleting old messages")
+	}
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket([]byte(binaryName))
+	})
+	if err != nil {
+		if err == bbolt.ErrBucketNotFound {
+			return common.LogNotFoundErr
+		}
+		return errors.Wrap(err, "deleting bucket")
+	}
+	return nil
+}
+
+// Metadata summarizes the bucket holding a log. Keys are ordered by
+// timestamp, so the first and last ones hold the timestamps we want.
+// The size is the space used by the bucket pages. Pending messages are
+// written first, so they are included.
+func (b *BoltDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	b.flush()
+	ret := common.LogMetadata{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(binaryName))
+		if bucket == nil {
+			return common.LogNotFoundErr
+		}
+		c := bucket.Cursor()
+		first, _ := c.First()
+		last, _ := c.Last()
+		if first == nil {
+			return common.LogNotFoundErr
+		}
+		stats := bucket.Stats()
+		ret.Count = int64(stats.KeyN)
+		ret.Size = int64(stats.LeafInuse)
+		ret.FirstTimestamp = time.Unix(0, keyTimestamp(first))
+		ret.LastTimestamp = time.Unix(0, keyTimestamp(last))
+		return nil
+	})
+	if err != nil {
+		if err == common.LogNotFoundErr {
+			return common.LogMetadata{}, err
+		}
+		return common.LogMetadata{}, errors.Wrap(err, "fetching log metadata")
+	}
+	return ret, nil
+}
+
+// HealthCheck verifies the database can be read.
+func (b *BoltDataStore) HealthCheck(ctx context.Context) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return nil
+	})
+}
+
+func (b *BoltDataStore) ResultReader(ctx context.Context, params params.QueryParams) common.Reader {
+	return &boltReader{
+		datastore: b,
+		params:    params,
+		cursor:    params.Cursor,
+	}
+}
+
+func (b *BoltDataStore) List() ([]map[string]string, error) {
+	names, err := b.bucketNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	// Buckets are iterated in key order, so names are already sorted.
+	ret := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, map[string]string{"log_name": name})
+	}
+	return ret, nil
+}
+
+// boltReader iterates over the bucket of an application, between
+// StartDate and EndDate. Each call to ReadNext() opens a new read
+// transaction, resuming after the last key seen.
+type boltReader struct {
+	datastore *BoltDataStore
+	params    params.QueryParams
+
+	// lastKey is the key of the last message looked at.
+	lastKey []byte
+	started bool
+	done    bool
+	cursor  string
+	// read is the number of messages returned so far.
+	read int
+}
+
+// init flushes pending messages and positions the reader after the
+// cursor it was created with, if any.
+func (b *boltReader) init() error {
+	b.started = true
+	b.datastore.flush()
+	if b.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(b.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	key, err := hex.DecodeString(cursor.Key)
+	if err != nil || len(key) != keySize {
+		return fmt.Errorf("invalid cursor")
+	}
+	b.lastKey = key
+	return nil
+}
+
+func (b *boltReader) chunkSize() int {
+	if b.params.Limit > 0 && b.params.Limit-b.read < readChunkSize {
+		return b.params.Limit - b.read
+	}
+	return readChunkSize
+}
+
+func (b *boltReader) matches(rec record) bool {
+	if b.params.Hostname != "" && rec.Hostname != b.params.Hostname {
+		return false
+	}
+	if b.params.SourceAddr != "" && rec.SourceAddr != b.params.SourceAddr {
+		return false
+	}
+	if b.params.Severity != nil && rec.Severity > int(*b.params.Severity) {
+		return false
+	}
+	if b.params.Facility != nil && rec.Facility != int(*b.params.Facility) {
+		return false
+	}
+	return true
+}
+
+// seek positions c on the first key the reader should look at.
+func (b *boltReader) seek(c *bbolt.Cursor) ([]byte, []byte) {
+	if b.lastKey != nil {
+		k, v := c.Seek(b.lastKey)
+		if k != nil && bytes.Equal(k, b.lastKey) {
+			k, v = c.Next()
+		}
+		return k, v
+	}
+	if !b.params.StartDate.IsZero() {
+		return c.Seek(timestampKey(b.params.StartDate))
+	}
+	return c.First()
+}
+
+var _ common.Reader = (*boltReader)(nil)
+
+func (b *boltReader) ReadNext() ([]byte, error) {
+	if b.done {
+		return nil, io.EOF
+	}
+
+	if !b.started {
+		if b.params.AppName == "" {
+			return nil, fmt.Errorf("missing application name")
+		}
+		if err := common.CheckReadParams(b.params); err != nil {
+			return nil, err
+		}
+		if err := b.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+	}
+
+	chunkSize := b.chunkSize()
+	var endDate int64
+	if !b.params.EndDate.IsZero() {
+		endDate = b.params.EndDate.UnixNano()
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	var count int
+	var timestamp int64
+	err := b.datastore.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.params.AppName))
+		if bucket == nil {
+			b.done = true
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := b.seek(c)
+		for ; k != nil; k, v = c.Next() {
+			if endDate != 0 && keyTimestamp(k) > endDate {
+				k = nil
+				break
+			}
+			// Keys are only valid for the life of the transaction.
+			b.lastKey = append(b.lastKey[:0], k...)
+
+			var rec record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return errors.Wrap(err, "decoding log message")
+			}
+			if !b.matches(rec) {
+				continue
+			}
+			if _, err := buf.WriteString(rec.Message); err != nil {
+				return errors.Wrap(err, "reading value")
+			}
+			if len(rec.Message) > 0 && rec.Message[len(rec.Message)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+			timestamp = keyTimestamp(k)
+			count++
+			if count >= chunkSize {
+				break
+			}
+		}
+		if k == nil {
+			b.done = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading logs")
+	}
+
+	b.read += count
+	if count > 0 {
+		b.cursor = common.EncodeCursor(common.Cursor{
+			Timestamp: timestamp,
+			Key:       hex.EncodeToString(b.lastKey),
+		})
+	}
+	if b.params.Limit > 0 && b.read >= b.params.Limit {
+		b.done = true
+	}
+	if count == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *boltReader) Cursor() string {
+	return b.cursor
+}
@@ -15,24 +15,285 @@
 package common
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"coriolis-logger/logging"
 	"coriolis-logger/params"
 	"coriolis-logger/worker"
-	client "github.com/influxdata/influxdb1-client/v2"
 )
 
+// LogNotFoundErr is returned when deleting a log that does not exist.
+var LogNotFoundErr = fmt.Errorf("log not found")
+
+// UnsupportedParamErr is returned by readers asked to filter or sort
+// messages in a way their datastore can not.
+var UnsupportedParamErr = fmt.Errorf("not supported by the datastore")
+
+// CheckReadParams returns UnsupportedParamErr if p sets the offset,
+// order, MSGID or cluster of the messages read, which datastores that
+// can only read messages oldest first, filtered by their common
+// fields, do not support.
+func CheckReadParams(p params.QueryParams) error {
+	switch {
+	case p.Offset > 0:
+		return errors.Wrap(UnsupportedParamErr, "offset")
+	case p.Order == params.OrderDesc:
+		return errors.Wrap(UnsupportedParamErr, "order")
+	case p.MsgID != "":
+		return errors.Wrap(UnsupportedParamErr, "msgid")
+	case p.ClusterID != "":
+		return errors.Wrap(UnsupportedParamErr, "cluster")
+	}
+	return nil
+}
+
+// HealthChecker is implemented by components that can report whether
+// they are able to work.
+type HealthChecker interface {
+	// HealthCheck returns an error describing why the component is
+	// not working, if it is not.
+	HealthCheck(ctx context.Context) error
+}
+
 type DataStore interface {
 	worker.SimpleWorker
+	HealthChecker
 
 	Write(logMsg logging.LogMessage) error
 	Rotate(olderThan time.Time) error
-	ResultReader(p params.QueryParams) Reader
+	// Delete removes the messages of a log older than olderThan, or
+	// all of them if olderThan is zero. Unlike Rotate, other logs are
+	// left untouched. It returns LogNotFoundErr if there is no log
+	// with that name.
+	Delete(binaryName string, olderThan time.Time) error
+	// ResultReader returns a reader for the logs matching p. Readers
+	// that query a remote service stop once ctx is done.
+	ResultReader(ctx context.Context, p params.QueryParams) Reader
 	List() ([]map[string]string, error)
-	Query(q client.Query) (*client.ChunkedResponse, error)
+	// Metadata returns a summary of the messages of a log. It returns
+	// LogNotFoundErr if there is no log with that name.
+	Metadata(binaryName string) (LogMetadata, error)
+}
+
+// LogMetadata summarizes the messages held in a log.
+type LogMetadata struct {
+	// FirstTimestamp and LastTimestamp are the timestamps of the
+	// oldest and newest messages.
+	FirstTimestamp time.Time
+	LastTimestamp  time.Time
+	// Count is the number of messages.
+	Count int64
+	// Size is the approximate size of the messages, in bytes, or 0
+	// if the datastore can not tell it cheaply.
+	Size int64
+}
+
+// HasLog returns true if a log with the given name is in logs, as
+// returned by DataStore.List().
+func HasLog(logs []map[string]string, name string) bool {
+	for _, val := range logs {
+		if val["log_name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldsSelector is implemented by datastores whose readers return the
+// fields listed in params.QueryParams.AllowedFields for each message,
+// as JSON if params.QueryParams.JSON is set. Readers of other datastores
+// only return the message text.
+type FieldsSelector interface {
+	SelectsFields() bool
+}
+
+// SelectsFields returns true if the readers of store return the allowed
+// fields of each message.
+func SelectsFields(store DataStore) bool {
+	selector, ok := store.(FieldsSelector)
+	return ok && selector.SelectsFields()
+}
+
+// FilteredLister is implemented by datastores that can filter and
+// paginate log listings themselves, instead of listing all logs.
+type FilteredLister interface {
+	// ListWithFilter returns the logs matching p, sorted by name.
+	ListWithFilter(p params.ListParams) ([]map[string]string, error)
+}
+
+// ListWithFilter returns the logs of store matching p, sorted by name.
+// Datastores that do not implement FilteredLister list all their logs,
+// which are then filtered.
+func ListWithFilter(store DataStore, p params.ListParams) ([]map[string]string, error) {
+	if lister, ok := store.(FilteredLister); ok {
+		return lister.ListWithFilter(p)
+	}
+	logs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	return FilterLogs(logs, p)
+}
+
+// FilterLogs returns the logs, as returned by DataStore.List(),
+// matching p, sorted by name.
+func FilterLogs(logs []map[string]string, p params.ListParams) ([]map[string]string, error) {
+	var re *regexp.Regexp
+	if p.Pattern != "" {
+		var err error
+		re, err = regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "compiling pattern")
+		}
+	}
+	matching := []map[string]string{}
+	for _, val := range logs {
+		name := val["log_name"]
+		if !strings.HasPrefix(name, p.Prefix) {
+			continue
+		}
+		if re != nil && !re.MatchString(name) {
+			continue
+		}
+		matching = append(matching, val)
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i]["log_name"] < matching[j]["log_name"]
+	})
+
+	if p.Offset >= len(matching) {
+		return []map[string]string{}, nil
+	}
+	matching = matching[p.Offset:]
+	if p.Limit > 0 && p.Limit < len(matching) {
+		matching = matching[:p.Limit]
+	}
+	return matching, nil
 }
 
 type Reader interface {
 	ReadNext() ([]byte, error)
+	// Cursor returns an opaque value that can be passed back in
+	// params.QueryParams to resume reading after the last message
+	// returned by ReadNext().
+	Cursor() string
+}
+
+// Cursor is the position of a message in a log. Datastores that can
+// hold several messages with the same timestamp use Key to break ties.
+// Those that can not tell them apart use Skip, the number of messages
+// with that timestamp already returned, in the order they are read. If
+// neither is set, all the messages with that timestamp were returned.
+type Cursor struct {
+	Timestamp int64  `json:"t"`
+	Key       string `json:"k,omitempty"`
+	Skip      int    `json:"s,omitempty"`
+}
+
+// EncodeCursor returns the opaque representation of a cursor.
+func EncodeCursor(c Cursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// DecodeCursor parses a cursor previously returned by EncodeCursor.
+func DecodeCursor(cursor string) (Cursor, error) {
+	var ret Cursor
+	js, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ret, errors.Wrap(err, "decoding cursor")
+	}
+	if err := json.Unmarshal(js, &ret); err != nil {
+		return ret, errors.Wrap(err, "decoding cursor")
+	}
+	return ret, nil
+}
+
+// pointTimesIdle is the time after which PointTimes forgets the series
+// that were not written to.
+const pointTimesIdle = time.Minute
+
+// PointTimes assigns the times of the points of datastores, such as
+// InfluxDB, that overwrite the points of a series that have the same
+// time. Messages whose timestamp only has second precision, such as
+// RFC3164 ones, get the nanoseconds of the time they are written at.
+// Points that would not come after the previous one of their series,
+// in the same burst, are moved a nanosecond after it instead. It is not
+// safe for concurrent use.
+type PointTimes struct {
+	// series holds the time of the last point of each series, and
+	// when it was written.
+	series map[string]seriesTime
+	// pruned is when the idle series were last forgotten.
+	pruned time.Time
+}
+
+type seriesTime struct {
+	last    time.Time
+	written time.Time
+}
+
+// Next returns the time of the point of a message with timestamp ts,
+// written at now, in the series identified by series. See SeriesKey().
+func (p *PointTimes) Next(series string, ts, now time.Time) time.Time {
+	if p.series == nil {
+		p.series = map[string]seriesTime{}
+	}
+	if now.Sub(p.pruned) > pointTimesIdle {
+		for key, val := range p.series {
+			if now.Sub(val.written) > pointTimesIdle {
+				delete(p.series, key)
+			}
+		}
+		p.pruned = now
+	}
+
+	ret := ts
+	prev, ok := p.series[series]
+	var tied bool
+	if ts.Nanosecond() == 0 {
+		ret = ts.Add(time.Duration(now.Nanosecond()))
+		tied = ok && ts.Equal(prev.last.Truncate(time.Second))
+	} else {
+		// Older messages, sent out of order, are left alone.
+		tied = ok && ret.After(prev.last.Add(-time.Second))
+	}
+	if tied && !ret.After(prev.last) {
+		ret = prev.last.Add(time.Nanosecond)
+		if ts.Nanosecond() == 0 && !ret.Before(ts.Add(time.Second)) {
+			// The second is full, which only happens with a billion
+			// messages in it.
+			ret = prev.last
+		}
+	}
+	p.series[series] = seriesTime{last: ret, written: now}
+	return ret
+}
+
+// SeriesKey returns the key of the series of a point, identified by its
+// measurement and tags, as used by PointTimes.
+func SeriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf strings.Builder
+	buf.WriteString(measurement)
+	for _, key := range keys {
+		buf.WriteByte(0)
+		buf.WriteString(key)
+		buf.WriteByte(0)
+		buf.WriteString(tags[key])
+	}
+	return buf.String()
 }
@@ -0,0 +1,139 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-logger/params"
+)
+
+func TestPointTimesSameSecond(t *testing.T) {
+	var times PointTimes
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 10, 15, 10, 0, 1, 500, time.UTC)
+
+	// Writing at the same instant, as with a coarse clock, still
+	// gives distinct times within the second of the message.
+	first := times.Next("series", ts, now)
+	second := times.Next("series", ts, now)
+	if !first.Equal(ts.Add(500)) {
+		t.Fatalf("expected %v, got %v", ts.Add(500), first)
+	}
+	if !second.After(first) {
+		t.Fatalf("expected %v to be after %v", second, first)
+	}
+	if second.Truncate(time.Second) != ts {
+		t.Fatalf("expected %v to be in the second of %v", second, ts)
+	}
+}
+
+func TestPointTimesKeepsPreciseTimestamps(t *testing.T) {
+	var times PointTimes
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 42, time.UTC)
+	if got := times.Next("series", ts, time.Now()); !got.Equal(ts) {
+		t.Fatalf("expected %v, got %v", ts, got)
+	}
+	later := ts.Add(time.Millisecond)
+	if got := times.Next("series", later, time.Now()); !got.Equal(later) {
+		t.Fatalf("expected %v, got %v", later, got)
+	}
+}
+
+func TestPointTimesSamePreciseTimestamps(t *testing.T) {
+	var times PointTimes
+	now := time.Now()
+	// Bursts of RFC5424 messages often share their timestamp.
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 123000000, time.UTC)
+	expected := []time.Time{ts, ts.Add(1), ts.Add(2)}
+	for _, want := range expected {
+		if got := times.Next("series", ts, now); !got.Equal(want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	// Messages logged in between move after the burst, older ones
+	// are left alone.
+	if got := times.Next("series", ts.Add(-time.Microsecond), now); !got.Equal(ts.Add(3)) {
+		t.Fatalf("expected %v, got %v", ts.Add(3), got)
+	}
+	older := ts.Add(-time.Minute)
+	if got := times.Next("series", older, now); !got.Equal(older) {
+		t.Fatalf("expected %v, got %v", older, got)
+	}
+}
+
+func TestPointTimesSeries(t *testing.T) {
+	var times PointTimes
+	now := time.Now()
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 123000000, time.UTC)
+	times.Next("series", ts, now)
+
+	// Points of other series do not overwrite each other.
+	if got := times.Next("other", ts, now); !got.Equal(ts) {
+		t.Fatalf("expected %v, got %v", ts, got)
+	}
+	// Idle series are forgotten.
+	if got := times.Next("series", ts, now.Add(2*pointTimesIdle)); !got.Equal(ts) {
+		t.Fatalf("expected %v, got %v", ts, got)
+	}
+	if len(times.series) != 1 {
+		t.Fatalf("expected the idle series to be forgotten, got %v", times.series)
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	key := SeriesKey("coriolis-worker", map[string]string{"hostname": "a", "severity": "6"})
+	if other := SeriesKey("coriolis-worker", map[string]string{"severity": "6", "hostname": "a"}); other != key {
+		t.Fatalf("expected the key not to depend on the order of tags")
+	}
+	if other := SeriesKey("coriolis-worker", map[string]string{"hostname": "a,severity=6"}); other == key {
+		t.Fatalf("expected tag values not to be mistaken for tags")
+	}
+}
+
+func TestPointTimesOtherSecond(t *testing.T) {
+	var times PointTimes
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 10, 15, 10, 0, 0, 900, time.UTC)
+	times.Next("series", ts, now)
+
+	// An older message is not moved after the last one.
+	older := ts.Add(-time.Minute)
+	if got := times.Next("series", older, now); !got.Equal(older.Add(900)) {
+		t.Fatalf("expected %v, got %v", older.Add(900), got)
+	}
+}
+
+func TestCheckReadParams(t *testing.T) {
+	tests := []struct {
+		params      params.QueryParams
+		unsupported bool
+	}{
+		{params.QueryParams{AppName: "coriolis-worker", Limit: 10, Order: params.OrderAsc}, false},
+		{params.QueryParams{Offset: 1}, true},
+		{params.QueryParams{Order: params.OrderDesc}, true},
+		{params.QueryParams{MsgID: "ID47"}, true},
+		{params.QueryParams{ClusterID: "cluster-a"}, true},
+	}
+	for _, tt := range tests {
+		err := CheckReadParams(tt.params)
+		if unsupported := errors.Cause(err) == UnsupportedParamErr; unsupported != tt.unsupported || (err != nil && !unsupported) {
+			t.Errorf("%+v: expected unsupported to be %v, got %v", tt.params, tt.unsupported, err)
+		}
+	}
+}
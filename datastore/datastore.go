@@ -19,23 +19,107 @@ import (
 	"fmt"
 
 	"coriolis-logger/config"
+	"coriolis-logger/datastore/bolt"
 	"coriolis-logger/datastore/common"
+	"coriolis-logger/datastore/elasticsearch"
+	"coriolis-logger/datastore/file"
 	"coriolis-logger/datastore/influxdb"
+	"coriolis-logger/datastore/influxdb2"
+	"coriolis-logger/datastore/memory"
+	"coriolis-logger/datastore/multi"
+	"coriolis-logger/datastore/postgres"
+	"coriolis-logger/datastore/redis"
+	"coriolis-logger/datastore/sqlite"
 	"github.com/pkg/errors"
 )
 
-func GetDatastore(ctx context.Context, cfg config.Syslog) (common.DataStore, error) {
+// GetDatastore returns the datastore selected in cfg. Datastores that
+// support it label logs with clusterID.
+func GetDatastore(ctx context.Context, cfg config.Syslog, clusterID string) (common.DataStore, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, errors.Wrap(err, "validating syslog config")
 	}
-	switch cfg.DataStore {
+	if cfg.DataStore == config.MultiDatastore {
+		return getMultiDatastore(ctx, cfg, clusterID)
+	}
+	return newDatastore(ctx, cfg, cfg.DataStore, clusterID)
+}
+
+// getMultiDatastore returns a datastore writing to all the datastores
+// listed in the multi config section.
+func getMultiDatastore(ctx context.Context, cfg config.Syslog, clusterID string) (common.DataStore, error) {
+	if cfg.Multi == nil {
+		return nil, fmt.Errorf("invalid multi datastore config")
+	}
+	// The children are stopped by the multi datastore, once all
+	// queued messages are written to them.
+	childCtx := context.Background()
+	var primary multi.Child
+	secondaries := []multi.Child{}
+	for _, childCfg := range cfg.Multi.Datastores {
+		store, err := newDatastore(childCtx, cfg, childCfg.Type, clusterID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting %s datastore", childCfg.Type)
+		}
+		child := multi.Child{
+			Name:  string(childCfg.Type),
+			Store: store,
+		}
+		if childCfg.Primary {
+			primary = child
+		} else {
+			secondaries = append(secondaries, child)
+		}
+	}
+	return multi.NewMultiDatastore(ctx, primary, secondaries...)
+}
+
+func newDatastore(ctx context.Context, cfg config.Syslog, datastore config.DatastoreType, clusterID string) (common.DataStore, error) {
+	switch datastore {
 	case config.InfluxDBDatastore:
 		// Validation should already be done by the config package, but
 		// it pays to be paranoid sometimes
 		if cfg.InfluxDB == nil {
 			return nil, fmt.Errorf("invalid influxdb datastore config")
 		}
-		return influxdb.NewInfluxDBDatastore(ctx, cfg.InfluxDB)
+		return influxdb.NewInfluxDBDatastore(ctx, cfg.InfluxDB, clusterID)
+	case config.InfluxDB2Datastore:
+		if cfg.InfluxDB2 == nil {
+			return nil, fmt.Errorf("invalid influxdb2 datastore config")
+		}
+		return influxdb2.NewInfluxDB2Datastore(ctx, cfg.InfluxDB2)
+	case config.PostgresDatastore:
+		if cfg.Postgres == nil {
+			return nil, fmt.Errorf("invalid postgres datastore config")
+		}
+		return postgres.NewPostgresDatastore(ctx, cfg.Postgres, clusterID)
+	case config.SQLiteDatastore:
+		if cfg.SQLite == nil {
+			return nil, fmt.Errorf("invalid sqlite datastore config")
+		}
+		return sqlite.NewSQLiteDatastore(ctx, cfg.SQLite, clusterID)
+	case config.FileDatastore:
+		if cfg.File == nil {
+			return nil, fmt.Errorf("invalid file datastore config")
+		}
+		return file.NewFileDatastore(ctx, cfg.File)
+	case config.ElasticsearchDatastore:
+		if cfg.Elasticsearch == nil {
+			return nil, fmt.Errorf("invalid elasticsearch datastore config")
+		}
+		return elasticsearch.NewElasticsearchDatastore(ctx, cfg.Elasticsearch)
+	case config.RedisDatastore:
+		if cfg.Redis == nil {
+			return nil, fmt.Errorf("invalid redis datastore config")
+		}
+		return redis.NewRedisDatastore(ctx, cfg.Redis)
+	case config.BoltDatastore:
+		if cfg.Bolt == nil {
+			return nil, fmt.Errorf("invalid bolt datastore config")
+		}
+		return bolt.NewBoltDatastore(ctx, cfg.Bolt)
+	case config.MemoryDatastore:
+		return memory.NewMemoryDatastore(ctx, cfg.Memory)
 	default:
 		return nil, fmt.Errorf("invalid datastore type")
 	}
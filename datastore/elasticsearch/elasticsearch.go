@@ -0,0 +1,735 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	es "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/google/uuid"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.elasticsearch")
+
+const (
+	// maxPendingMessages is the number of buffered messages after which
+	// a write will trigger a flush, regardless of the write interval.
+	maxPendingMessages = 20000
+	// readChunkSize is the number of documents fetched by a reader on
+	// each call to ReadNext().
+	readChunkSize = 10000
+)
+
+// document is the representation of a log message stored in
+// elasticsearch.
+type document struct {
+	// ID is a unique identifier used to break ties between messages
+	// with the same timestamp when paginating.
+	ID        string `json:"id"`
+	Timestamp string `json:"@timestamp"`
+	AppName   string `json:"app_name"`
+	Hostname  string `json:"hostname"`
+	Priority  int    `json:"priority"`
+	Severity  int    `json:"severity"`
+	Facility  int    `json:"facility"`
+	ProcID    int    `json:"proc_id,omitempty"`
+	MsgID     string `json:"msg_id,omitempty"`
+	Message   string `json:"message"`
+	// SourceAddr is the IP address the message was received from.
+	SourceAddr string `json:"source_addr,omitempty"`
+}
+
+// indexTemplate returns the template applied to all log indices.
+func indexTemplate(prefix string) map[string]interface{} {
+	return map[string]interface{}{
+		"index_patterns": []string{prefix + "*"},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"id":          map[string]string{"type": "keyword"},
+					"@timestamp":  map[string]string{"type": "date_nanos"},
+					"app_name":    map[string]string{"type": "keyword"},
+					"hostname":    map[string]string{"type": "keyword"},
+					"priority":    map[string]string{"type": "integer"},
+					"severity":    map[string]string{"type": "integer"},
+					"facility":    map[string]string{"type": "integer"},
+					"proc_id":     map[string]string{"type": "integer"},
+					"msg_id":      map[string]string{"type": "keyword"},
+					"message":     map[string]string{"type": "text"},
+					"source_addr": map[string]string{"type": "ip"},
+				},
+			},
+		},
+	}
+}
+
+func NewElasticsearchDatastore(ctx context.Context, cfg *config.Elasticsearch) (common.DataStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating elasticsearch config")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	client, err := es.NewClient(es.Config{
+		Addresses: cfg.URLs,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "getting elasticsearch client")
+	}
+
+	return &ElasticsearchDataStore{
+		cfg:      cfg,
+		client:   client,
+		prefix:   cfg.GetIndexPrefix(),
+		messages: []logging.LogMessage{},
+		ctx:      ctx,
+		closed:   make(chan struct{}),
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+var _ common.DataStore = (*ElasticsearchDataStore)(nil)
+
+type ElasticsearchDataStore struct {
+	cfg      *config.Elasticsearch
+	client   *es.Client
+	prefix   string
+	mut      sync.Mutex
+	messages []logging.LogMessage
+	ctx      context.Context
+	closed   chan struct{}
+	quit     chan struct{}
+}
+
+// indexName returns the name of the index holding the logs of appName.
+// Index names must be lowercase and may not contain some characters,
+// which are replaced with an underscore.
+func (e *ElasticsearchDataStore) indexName(appName string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`\/*?"<>| ,#:`, r) {
+			return '_'
+		}
+		return r
+	}, strings.ToLower(appName))
+	return e.prefix + name
+}
+
+// responseError returns an error describing a failed API response.
+func responseError(resp *esapi.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("elasticsearch returned %s: %s", resp.Status(), strings.TrimSpace(string(body)))
+}
+
+func (e *ElasticsearchDataStore) putIndexTemplate() error {
+	body, err := json.Marshal(indexTemplate(e.prefix))
+	if err != nil {
+		return errors.Wrap(err, "encoding index template")
+	}
+	resp, err := e.client.Indices.PutIndexTemplate(
+		strings.TrimRight(e.prefix, "-_")+"-template", bytes.NewReader(body),
+		e.client.Indices.PutIndexTemplate.WithContext(e.ctx))
+	if err != nil {
+		return errors.Wrap(err, "putting index template")
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return errors.Wrap(responseError(resp), "putting index template")
+	}
+	return nil
+}
+
+func (e *ElasticsearchDataStore) doWork() {
+	var interval int
+	if e.cfg.WriteInterval == 0 {
+		interval = 1
+	} else {
+		interval = e.cfg.WriteInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	rotationTicker := time.NewTicker(1 * time.Hour)
+	defer func() {
+		ticker.Stop()
+		rotationTicker.Stop()
+		if err := e.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
+		close(e.closed)
+	}()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				log.Errorf("failed to flush logs to backend: %v", err)
+			}
+		case <-rotationTicker.C:
+			retentionPeriod := e.cfg.GetLogRetention()
+			log.Infof("deleting logs older than %d days", retentionPeriod)
+			day := 24 * time.Hour
+			olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+			if err := e.Rotate(olderThan); err != nil {
+				log.Errorf("failed to rotate logs: %v", err)
+			}
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+func (e *ElasticsearchDataStore) Start() error {
+	if err := e.putIndexTemplate(); err != nil {
+		return errors.Wrap(err, "creating index template")
+	}
+	go e.doWork()
+	return nil
+}
+
+func (e *ElasticsearchDataStore) Stop() error {
+	close(e.quit)
+	e.Wait()
+	return nil
+}
+
+func (e *ElasticsearchDataStore) Wait() {
+	<-e.closed
+}
+
+func (e *ElasticsearchDataStore) flush() error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.flushLocked()
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// flushLocked indexes all pending messages using the bulk API.
+// The caller must hold e.mut.
+func (e *ElasticsearchDataStore) flushLocked() error {
+	if len(e.messages) == 0 {
+		return nil
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	enc := json.NewEncoder(buf)
+	for _, msg := range e.messages {
+		action := map[string]interface{}{
+			"index": map[string]string{
+				"_index": e.indexName(msg.AppName),
+			},
+		}
+		doc := document{
+			ID:        uuid.New().String(),
+			Timestamp: msg.Timestamp.UTC().Format(time.RFC3339Nano),
+			AppName:   msg.AppName,
+			Hostname:  msg.Hostname,
+			Priority:  msg.Priority,
+			Severity:  int(msg.Severity),
+			Facility:  int(msg.Facility),
+			ProcID:    msg.ProcID,
+			MsgID:     msg.MsgID,
+			Message:   msg.Message,
+
+			SourceAddr: msg.SourceAddr,
+		}
+		if err := enc.Encode(action); err != nil {
+			return errors.Wrap(err, "encoding bulk action")
+		}
+		if err := enc.Encode(doc); err != nil {
+			return errors.Wrap(err, "encoding document")
+		}
+	}
+
+	resp, err := e.client.Bulk(buf, e.client.Bulk.WithContext(e.ctx))
+	if err != nil {
+		return errors.Wrap(err, "sending bulk request")
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return errors.Wrap(responseError(resp), "sending bulk request")
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return errors.Wrap(err, "decoding bulk response")
+	}
+	// The request succeeded, so messages that failed to be indexed are
+	// not retried, as they would most likely fail again.
+	e.messages = []logging.LogMessage{}
+	if result.Errors {
+		var failed int
+		var firstErr json.RawMessage
+		for _, item := range result.Items {
+			for _, res := range item {
+				if res.Status/100 != 2 {
+					failed++
+					if firstErr == nil {
+						firstErr = res.Error
+					}
+				}
+			}
+		}
+		return fmt.Errorf("failed to index %d messages: %s", failed, string(firstErr))
+	}
+	return nil
+}
+
+func (e *ElasticsearchDataStore) Write(logMsg logging.LogMessage) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	e.messages = append(e.messages, logMsg)
+	if len(e.messages) >= maxPendingMessages {
+		if err := e.flushLocked(); err != nil {
+			return errors.Wrap(err, "flushing logs")
+		}
+	}
+	return nil
+}
+
+// Rotate deletes all messages older than olderThan from all log indices.
+func (e *ElasticsearchDataStore) Rotate(olderThan time.Time) error {
+	return e.deleteOlderThan([]string{e.prefix + "*"}, olderThan)
+}
+
+// deleteOlderThan deletes the messages older than olderThan from
+// indices. It returns LogNotFoundErr if an index does not exist.
+func (e *ElasticsearchDataStore) deleteOlderThan(indices []string, olderThan time.Time) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				"@timestamp": map[string]string{
+					"lt": olderThan.UTC().Format(time.RFC3339Nano),
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return errors.Wrap(err, "encoding query")
+	}
+	resp, err := e.client.DeleteByQuery(
+		indices, bytes.NewReader(body),
+		e.client.DeleteByQuery.WithContext(e.ctx),
+		e.client.DeleteByQuery.WithConflicts("proceed"))
+	if err != nil {
+		return errors.Wrap(err, "deleting old logs")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return common.LogNotFoundErr
+	}
+	if resp.IsError() {
+		return errors.Wrap(responseError(resp), "deleting old logs")
+	}
+	return nil
+}
+
+// Delete removes the index holding a log, or only the messages older
+// than olderThan, if set. Pending messages are written first, so they
+// do not recreate it.
+func (e *ElasticsearchDataStore) Delete(binaryName string, olderThan time.Time) error {
+	if err := e.flush(); err != nil {
+		log.Warningf("failed to flush logs before deleting %q: %v", binaryName, err)
+	}
+	if !olderThan.IsZero() {
+		return e.deleteOlderThan([]string{e.indexName(binaryName)}, olderThan)
+	}
+	resp, err := e.client.Indices.Delete(
+		[]string{e.indexName(binaryName)},
+		e.client.Indices.Delete.WithContext(e.ctx))
+	if err != nil {
+		return errors.Wrap(err, "deleting index")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return common.LogNotFoundErr
+	}
+	if resp.IsError() {
+		return errors.Wrap(responseError(resp), "deleting index")
+	}
+	return nil
+}
+
+// HealthCheck pings the elasticsearch cluster.
+func (e *ElasticsearchDataStore) HealthCheck(ctx context.Context) error {
+	res, err := e.client.Ping(e.client.Ping.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "pinging elasticsearch")
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("pinging elasticsearch: %s", res.Status())
+	}
+	return nil
+}
+
+func (e *ElasticsearchDataStore) ResultReader(ctx context.Context, params params.QueryParams) common.Reader {
+	return &elasticsearchReader{
+		datastore: e,
+		params:    params,
+		cursor:    params.Cursor,
+	}
+}
+
+type statsResponse struct {
+	Indices map[string]json.RawMessage `json:"indices"`
+}
+
+func (e *ElasticsearchDataStore) List() ([]map[string]string, error) {
+	resp, err := e.client.Indices.Stats(
+		e.client.Indices.Stats.WithContext(e.ctx),
+		e.client.Indices.Stats.WithIndex(e.prefix+"*"),
+		e.client.Indices.Stats.WithMetric("docs"))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return nil, errors.Wrap(responseError(resp), "listing logs")
+	}
+
+	var stats statsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, errors.Wrap(err, "decoding response")
+	}
+	names := make([]string, 0, len(stats.Indices))
+	for index := range stats.Indices {
+		names = append(names, strings.TrimPrefix(index, e.prefix))
+	}
+	sort.Strings(names)
+
+	ret := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, map[string]string{"log_name": name})
+	}
+	return ret, nil
+}
+
+type metadataResponse struct {
+	Hits struct {
+		Total struct {
+			Value int64 `json:"value"`
+		} `json:"total"`
+	} `json:"hits"`
+	Aggregations struct {
+		First struct {
+			Value *float64 `json:"value"`
+		} `json:"first"`
+		Last struct {
+			Value *float64 `json:"value"`
+		} `json:"last"`
+		Size struct {
+			Value *float64 `json:"value"`
+		} `json:"size"`
+	} `json:"aggregations"`
+}
+
+// Metadata counts the documents of a log, and aggregates their
+// timestamps and message lengths. Timestamps are stored with
+// millisecond precision. Pending messages are written first, so they
+// are included once the index is refreshed.
+func (e *ElasticsearchDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	e.flush()
+	query := map[string]interface{}{
+		"size":             0,
+		"track_total_hits": true,
+		"aggs": map[string]interface{}{
+			"first": map[string]interface{}{
+				"min": map[string]string{"field": "@timestamp"},
+			},
+			"last": map[string]interface{}{
+				"max": map[string]string{"field": "@timestamp"},
+			},
+			"size": map[string]interface{}{
+				"sum": map[string]interface{}{
+					"script": map[string]string{
+						"source": "params._source.message == null ? 0 : params._source.message.length()",
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "encoding query")
+	}
+	resp, err := e.client.Search(
+		e.client.Search.WithContext(e.ctx),
+		e.client.Search.WithIndex(e.indexName(binaryName)),
+		e.client.Search.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "executing query")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	if resp.IsError() {
+		return common.LogMetadata{}, errors.Wrap(responseError(resp), "executing query")
+	}
+
+	var result metadataResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "reading results")
+	}
+	aggs := result.Aggregations
+	if result.Hits.Total.Value == 0 || aggs.First.Value == nil || aggs.Last.Value == nil {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	ret := common.LogMetadata{
+		FirstTimestamp: time.Unix(0, int64(*aggs.First.Value)*int64(time.Millisecond)),
+		LastTimestamp:  time.Unix(0, int64(*aggs.Last.Value)*int64(time.Millisecond)),
+		Count:          result.Hits.Total.Value,
+	}
+	if aggs.Size.Value != nil {
+		ret.Size = int64(*aggs.Size.Value)
+	}
+	return ret, nil
+}
+
+// elasticsearchReader pages through a log using search_after, sorting
+// documents by timestamp and id.
+type elasticsearchReader struct {
+	datastore *ElasticsearchDataStore
+	params    params.QueryParams
+
+	// searchAfter holds the sort values of the last document returned.
+	searchAfter []interface{}
+	started     bool
+	done        bool
+	cursor      string
+	// read is the number of messages returned so far.
+	read int
+}
+
+// init flushes pending messages and positions the reader after the
+// cursor it was created with, if any.
+func (e *elasticsearchReader) init() error {
+	e.started = true
+	e.datastore.flush()
+	if e.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(e.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	if cursor.Key == "" {
+		return fmt.Errorf("invalid cursor")
+	}
+	e.searchAfter = []interface{}{cursor.Timestamp, cursor.Key}
+	return nil
+}
+
+func (e *elasticsearchReader) chunkSize() int {
+	if e.params.Limit > 0 && e.params.Limit-e.read < readChunkSize {
+		return e.params.Limit - e.read
+	}
+	return readChunkSize
+}
+
+func (e *elasticsearchReader) prepareQuery() (map[string]interface{}, error) {
+	if e.params.AppName == "" {
+		return nil, fmt.Errorf("missing application name")
+	}
+
+	filters := []interface{}{}
+	if !e.params.StartDate.IsZero() || !e.params.EndDate.IsZero() {
+		dateRange := map[string]string{}
+		if !e.params.StartDate.IsZero() {
+			dateRange["gte"] = e.params.StartDate.UTC().Format(time.RFC3339Nano)
+		}
+		if !e.params.EndDate.IsZero() {
+			dateRange["lte"] = e.params.EndDate.UTC().Format(time.RFC3339Nano)
+		}
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{"@timestamp": dateRange},
+		})
+	}
+	if e.params.Hostname != "" {
+		filters = append(filters, map[string]interface{}{
+			"term": map[string]string{"hostname": e.params.Hostname},
+		})
+	}
+	if e.params.SourceAddr != "" {
+		filters = append(filters, map[string]interface{}{
+			"term": map[string]string{"source_addr": e.params.SourceAddr},
+		})
+	}
+	if e.params.Severity != nil {
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{
+				"severity": map[string]int{"lte": int(*e.params.Severity)},
+			},
+		})
+	}
+	if e.params.Facility != nil {
+		filters = append(filters, map[string]interface{}{
+			"term": map[string]int{"facility": int(*e.params.Facility)},
+		})
+	}
+
+	query := map[string]interface{}{
+		"size": e.chunkSize(),
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": filters,
+			},
+		},
+		"sort": []interface{}{
+			map[string]string{"@timestamp": "asc"},
+			map[string]string{"id": "asc"},
+		},
+		"_source": []string{"message"},
+	}
+	if e.searchAfter != nil {
+		query["search_after"] = e.searchAfter
+	}
+	return query, nil
+}
+
+type searchResponse struct {
+	Hits struct {
+		Hits []struct {
+			Source struct {
+				Message string `json:"message"`
+			} `json:"_source"`
+			Sort []interface{} `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+var _ common.Reader = (*elasticsearchReader)(nil)
+
+func (e *elasticsearchReader) ReadNext() ([]byte, error) {
+	if e.done {
+		return nil, io.EOF
+	}
+
+	if !e.started {
+		if err := common.CheckReadParams(e.params); err != nil {
+			return nil, err
+		}
+		if err := e.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+	}
+
+	chunkSize := e.chunkSize()
+	query, err := e.prepareQuery()
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing query")
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding query")
+	}
+
+	client := e.datastore.client
+	resp, err := client.Search(
+		client.Search.WithContext(e.datastore.ctx),
+		client.Search.WithIndex(e.datastore.indexName(e.params.AppName)),
+		client.Search.WithIgnoreUnavailable(true),
+		client.Search.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		return nil, errors.Wrap(err, "executing query")
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return nil, errors.Wrap(responseError(resp), "executing query")
+	}
+
+	var result searchResponse
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "reading results")
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	hits := result.Hits.Hits
+	for _, hit := range hits {
+		message := hit.Source.Message
+		if _, err := buf.WriteString(message); err != nil {
+			return nil, errors.Wrap(err, "reading value")
+		}
+		if len(message) > 0 && message[len(message)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	count := len(hits)
+	e.read += count
+	if count > 0 {
+		last := hits[count-1].Sort
+		if len(last) != 2 {
+			return nil, fmt.Errorf("unexpected sort values in response")
+		}
+		timestamp, err := strconv.ParseInt(fmt.Sprintf("%v", last[0]), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing timestamp")
+		}
+		id := fmt.Sprintf("%v", last[1])
+		e.searchAfter = []interface{}{timestamp, id}
+		e.cursor = common.EncodeCursor(common.Cursor{
+			Timestamp: timestamp,
+			Key:       id,
+		})
+	}
+
+	if count < chunkSize || (e.params.Limit > 0 && e.read >= e.params.Limit) {
+		e.done = true
+	}
+	if count == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *elasticsearchReader) Cursor() string {
+	return e.cursor
+}
@@ -0,0 +1,754 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.file")
+
+const (
+	logSuffix     = ".log"
+	archiveSuffix = ".gz"
+
+	// readChunkSize is the approximate amount of data, in bytes,
+	// returned by a reader on each call to ReadNext().
+	readChunkSize = 1024 * 1024
+	// maxRecordSize is the maximum size of a single record in a log file.
+	maxRecordSize = 16 * 1024 * 1024
+
+	rotationInterval = 24 * time.Hour
+)
+
+// record is the on-disk representation of a log message. Each record
+// is saved as a single line of JSON.
+type record struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Hostname  string           `json:"hostname"`
+	Severity  logging.Severity `json:"severity"`
+	Facility  logging.Facility `json:"facility"`
+	Message   string           `json:"message"`
+	// SourceAddr is the IP address the message was received from.
+	SourceAddr string `json:"source_addr,omitempty"`
+}
+
+func NewFileDatastore(ctx context.Context, cfg *config.FileStore) (common.DataStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating file datastore config")
+	}
+
+	return &FileDataStore{
+		cfg:    cfg,
+		files:  map[string]*logFile{},
+		ctx:    ctx,
+		closed: make(chan struct{}),
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+var _ common.DataStore = (*FileDataStore)(nil)
+
+// FileDataStore appends log messages to one file per application,
+// under the configured base directory. Rotated files are compressed
+// and kept alongside the active file until they expire.
+type FileDataStore struct {
+	cfg    *config.FileStore
+	mut    sync.Mutex
+	files  map[string]*logFile
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+}
+
+// logFile is an open log file. Writes to the same file are serialized
+// by its mutex.
+type logFile struct {
+	mut sync.Mutex
+	fd  *os.File
+}
+
+func (f *FileDataStore) doWork() {
+	var interval int
+	if f.cfg.WriteInterval == 0 {
+		interval = 1
+	} else {
+		interval = f.cfg.WriteInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	rotationTicker := time.NewTicker(rotationInterval)
+	defer func() {
+		ticker.Stop()
+		rotationTicker.Stop()
+		f.closeAll()
+		close(f.closed)
+	}()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-ticker.C:
+			if f.cfg.GetFsyncPolicy() == config.FsyncInterval {
+				f.syncAll()
+			}
+		case <-rotationTicker.C:
+			retentionPeriod := f.cfg.GetLogRetention()
+			log.Infof("rotating logs and deleting logs older than %d days", retentionPeriod)
+			day := 24 * time.Hour
+			olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+			if err := f.Rotate(olderThan); err != nil {
+				log.Errorf("failed to rotate logs: %v", err)
+			}
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+func (f *FileDataStore) Start() error {
+	go f.doWork()
+	return nil
+}
+
+func (f *FileDataStore) Stop() error {
+	close(f.quit)
+	f.Wait()
+	return nil
+}
+
+func (f *FileDataStore) Wait() {
+	<-f.closed
+}
+
+func (f *FileDataStore) syncAll() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for name, lf := range f.files {
+		lf.mut.Lock()
+		if err := lf.fd.Sync(); err != nil {
+			log.Errorf("failed to sync log %q: %v", name, err)
+		}
+		lf.mut.Unlock()
+	}
+}
+
+func (f *FileDataStore) closeAll() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for name, lf := range f.files {
+		lf.mut.Lock()
+		if err := lf.fd.Sync(); err != nil {
+			log.Errorf("failed to sync log %q: %v", name, err)
+		}
+		lf.fd.Close()
+		lf.mut.Unlock()
+	}
+	f.files = map[string]*logFile{}
+}
+
+// logPath returns the path of the active log file of an application.
+// Application names that would escape the base directory are rejected.
+func (f *FileDataStore) logPath(appName string) (string, error) {
+	if appName == "" || appName == "." || appName == ".." || filepath.Base(appName) != appName {
+		return "", fmt.Errorf("invalid log name %q", appName)
+	}
+	return filepath.Join(f.cfg.BaseDir, appName+logSuffix), nil
+}
+
+func (f *FileDataStore) getFile(appName string) (*logFile, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if lf, ok := f.files[appName]; ok {
+		return lf, nil
+	}
+	logPath, err := f.logPath(appName)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening log file")
+	}
+	lf := &logFile{fd: fd}
+	f.files[appName] = lf
+	return lf, nil
+}
+
+func (f *FileDataStore) Write(logMsg logging.LogMessage) error {
+	line, err := json.Marshal(record{
+		Timestamp: logMsg.Timestamp,
+		Hostname:  logMsg.Hostname,
+		Severity:  logMsg.Severity,
+		Facility:  logMsg.Facility,
+		Message:   logMsg.Message,
+
+		SourceAddr: logMsg.SourceAddr,
+	})
+	if err != nil {
+		return errors.Wrap(err, "encoding log message")
+	}
+	line = append(line, '\n')
+
+	err = f.writeLine(logMsg.AppName, line)
+	if err != nil && errors.Cause(err) == os.ErrClosed {
+		// The file was rotated while we were writing to it. Retry
+		// with the new file.
+		err = f.writeLine(logMsg.AppName, line)
+	}
+	return err
+}
+
+func (f *FileDataStore) writeLine(appName string, line []byte) error {
+	lf, err := f.getFile(appName)
+	if err != nil {
+		return errors.Wrap(err, "getting log file")
+	}
+
+	lf.mut.Lock()
+	defer lf.mut.Unlock()
+	if _, err := lf.fd.Write(line); err != nil {
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == os.ErrClosed {
+			return errors.Wrap(os.ErrClosed, "writing log message")
+		}
+		return errors.Wrap(err, "writing log message")
+	}
+	if f.cfg.GetFsyncPolicy() == config.FsyncAlways {
+		if err := lf.fd.Sync(); err != nil {
+			return errors.Wrap(err, "syncing log file")
+		}
+	}
+	return nil
+}
+
+// archiveFile compresses src into dst and removes src.
+func archiveFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "opening log file")
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.Wrap(err, "creating archive")
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return errors.Wrap(err, "compressing log file")
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return errors.Wrap(err, "compressing log file")
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return errors.Wrap(err, "syncing archive")
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return errors.Wrap(err, "closing archive")
+	}
+	return os.Remove(src)
+}
+
+// rotateLog moves the active log file of an application aside and
+// compresses it. New messages are written to a fresh file.
+func (f *FileDataStore) rotateLog(appName string) error {
+	logPath, err := f.logPath(appName)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "fetching log file info")
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+
+	rotated := fmt.Sprintf("%s.%d", logPath, time.Now().UnixNano())
+	f.mut.Lock()
+	if lf, ok := f.files[appName]; ok {
+		lf.mut.Lock()
+		lf.fd.Close()
+		lf.mut.Unlock()
+		delete(f.files, appName)
+	}
+	err = os.Rename(logPath, rotated)
+	f.mut.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "renaming log file")
+	}
+	return archiveFile(rotated, rotated+archiveSuffix)
+}
+
+// Rotate compresses the active log file of every application and
+// removes archives that contain no messages newer than olderThan.
+func (f *FileDataStore) Rotate(olderThan time.Time) error {
+	logs, err := f.List()
+	if err != nil {
+		return errors.Wrap(err, "listing logs")
+	}
+
+	var errs []string
+	for _, val := range logs {
+		appName := val["log_name"]
+		if err := f.rotateApp(appName, olderThan); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", appName, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to rotate logs: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// rotateApp compresses the active log file of an application, and
+// removes its archives that contain no messages newer than olderThan.
+func (f *FileDataStore) rotateApp(appName string, olderThan time.Time) error {
+	if err := f.rotateLog(appName); err != nil {
+		return err
+	}
+	archives, err := f.archives(appName)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, archive := range archives {
+		// Archives are never written to after rotation, so their
+		// modification time is the time of their newest message.
+		if archive.modTime.Before(olderThan) {
+			if err := os.Remove(archive.path); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Delete removes the active log file and the archives of an
+// application. If olderThan is set, the log is rotated instead, and
+// only the archives holding no newer messages are removed.
+func (f *FileDataStore) Delete(binaryName string, olderThan time.Time) error {
+	logPath, err := f.logPath(binaryName)
+	if err != nil {
+		// No log can be stored under an invalid name.
+		return common.LogNotFoundErr
+	}
+	archives, err := f.archives(binaryName)
+	if err != nil {
+		return errors.Wrap(err, "listing archives")
+	}
+	if !olderThan.IsZero() {
+		if _, err := os.Stat(logPath); os.IsNotExist(err) && len(archives) == 0 {
+			return common.LogNotFoundErr
+		}
+		return errors.Wrap(f.rotateApp(binaryName, olderThan), "rotating log")
+	}
+
+	f.mut.Lock()
+	if lf, ok := f.files[binaryName]; ok {
+		lf.mut.Lock()
+		lf.fd.Close()
+		lf.mut.Unlock()
+		delete(f.files, binaryName)
+	}
+	err = os.Remove(logPath)
+	f.mut.Unlock()
+	found := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing log file")
+	}
+	for _, archive := range archives {
+		if err := os.Remove(archive.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "removing archive")
+		}
+		found = true
+	}
+	if !found {
+		return common.LogNotFoundErr
+	}
+	return nil
+}
+
+// Metadata reads all records of a log, including its archives, to
+// summarize them. The size is the length of the messages, not of the
+// files holding them.
+func (f *FileDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	reader := &fileReader{
+		datastore: f,
+		params:    params.QueryParams{AppName: binaryName},
+	}
+	if err := reader.init(); err != nil {
+		// No log can be stored under an invalid name.
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	defer reader.closeCurrent()
+
+	ret := common.LogMetadata{}
+	for {
+		if reader.scanner == nil || !reader.scanner.Scan() {
+			if reader.scanner != nil {
+				if err := reader.scanner.Err(); err != nil {
+					return common.LogMetadata{}, errors.Wrap(err, "reading log file")
+				}
+			}
+			if err := reader.nextFile(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return common.LogMetadata{}, err
+			}
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal(reader.scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if ret.Count == 0 || rec.Timestamp.Before(ret.FirstTimestamp) {
+			ret.FirstTimestamp = rec.Timestamp
+		}
+		if ret.Count == 0 || rec.Timestamp.After(ret.LastTimestamp) {
+			ret.LastTimestamp = rec.Timestamp
+		}
+		ret.Count++
+		ret.Size += int64(len(rec.Message))
+	}
+	if ret.Count == 0 {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	return ret, nil
+}
+
+type archive struct {
+	path      string
+	rotatedAt int64
+	modTime   time.Time
+}
+
+// archives returns the rotated files of an application, oldest first.
+func (f *FileDataStore) archives(appName string) ([]archive, error) {
+	logPath, err := f.logPath(appName)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(logPath + ".*" + archiveSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing archives")
+	}
+	ret := []archive{}
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, logPath+"."), archiveSuffix)
+		rotatedAt, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching archive info")
+		}
+		ret = append(ret, archive{
+			path:      match,
+			rotatedAt: rotatedAt,
+			modTime:   info.ModTime(),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].rotatedAt < ret[j].rotatedAt
+	})
+	return ret, nil
+}
+
+// HealthCheck verifies the base directory is still accessible.
+func (f *FileDataStore) HealthCheck(ctx context.Context) error {
+	info, err := os.Stat(f.cfg.BaseDir)
+	if err != nil {
+		return errors.Wrap(err, "checking base directory")
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", f.cfg.BaseDir)
+	}
+	return nil
+}
+
+func (f *FileDataStore) ResultReader(ctx context.Context, p params.QueryParams) common.Reader {
+	return &fileReader{
+		datastore: f,
+		params:    p,
+		cursor:    p.Cursor,
+	}
+}
+
+func (f *FileDataStore) List() ([]map[string]string, error) {
+	entries, err := ioutil.ReadDir(f.cfg.BaseDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	seen := map[string]bool{}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		idx := strings.Index(name, logSuffix)
+		if idx <= 0 {
+			continue
+		}
+		rest := name[idx+len(logSuffix):]
+		if rest != "" && !strings.HasSuffix(rest, archiveSuffix) {
+			continue
+		}
+		appName := name[:idx]
+		if seen[appName] {
+			continue
+		}
+		seen[appName] = true
+		names = append(names, appName)
+	}
+	sort.Strings(names)
+
+	ret := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, map[string]string{"log_name": name})
+	}
+	return ret, nil
+}
+
+// fileReader streams the archives of an application, oldest first,
+// followed by its active log file, returning the messages that match
+// the query parameters.
+type fileReader struct {
+	datastore *FileDataStore
+	params    params.QueryParams
+
+	files   []string
+	started bool
+
+	current *os.File
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+
+	// after, if set, skips all messages up to and including this
+	// timestamp.
+	after  *time.Time
+	cursor string
+	// read is the number of messages returned so far.
+	read int
+}
+
+func (f *fileReader) init() error {
+	logPath, err := f.datastore.logPath(f.params.AppName)
+	if err != nil {
+		return err
+	}
+	if f.params.Cursor != "" {
+		cursor, err := common.DecodeCursor(f.params.Cursor)
+		if err != nil {
+			return errors.Wrap(err, "parsing cursor")
+		}
+		after := time.Unix(0, cursor.Timestamp)
+		f.after = &after
+	}
+	archives, err := f.datastore.archives(f.params.AppName)
+	if err != nil {
+		return err
+	}
+	for _, archive := range archives {
+		if !f.params.StartDate.IsZero() && archive.modTime.Before(f.params.StartDate) {
+			// all messages in this archive are older than the
+			// requested start date.
+			continue
+		}
+		if f.after != nil && !archive.modTime.After(*f.after) {
+			continue
+		}
+		f.files = append(f.files, archive.path)
+	}
+	if _, err := os.Stat(logPath); err == nil {
+		f.files = append(f.files, logPath)
+	}
+	return nil
+}
+
+func (f *fileReader) closeCurrent() {
+	if f.gz != nil {
+		f.gz.Close()
+		f.gz = nil
+	}
+	if f.current != nil {
+		f.current.Close()
+		f.current = nil
+	}
+	f.scanner = nil
+}
+
+// nextFile opens the next file in the list. It returns io.EOF when
+// there are no more files to read.
+func (f *fileReader) nextFile() error {
+	f.closeCurrent()
+	if len(f.files) == 0 {
+		return io.EOF
+	}
+	path := f.files[0]
+	f.files = f.files[1:]
+
+	fd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// rotated or expired since we listed it.
+			return f.nextFile()
+		}
+		return errors.Wrap(err, "opening log file")
+	}
+	f.current = fd
+	var src io.Reader = fd
+	if strings.HasSuffix(path, archiveSuffix) {
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			f.closeCurrent()
+			return errors.Wrap(err, "opening archive")
+		}
+		f.gz = gz
+		src = gz
+	}
+	f.scanner = bufio.NewScanner(src)
+	f.scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	return nil
+}
+
+func (f *fileReader) matches(rec record) bool {
+	if !f.params.StartDate.IsZero() && rec.Timestamp.Before(f.params.StartDate) {
+		return false
+	}
+	if !f.params.EndDate.IsZero() && rec.Timestamp.After(f.params.EndDate) {
+		return false
+	}
+	if f.params.Hostname != "" && rec.Hostname != f.params.Hostname {
+		return false
+	}
+	if f.params.SourceAddr != "" && rec.SourceAddr != f.params.SourceAddr {
+		return false
+	}
+	if f.params.Severity != nil && rec.Severity > *f.params.Severity {
+		return false
+	}
+	if f.params.Facility != nil && rec.Facility != *f.params.Facility {
+		return false
+	}
+	if f.after != nil && !rec.Timestamp.After(*f.after) {
+		return false
+	}
+	return true
+}
+
+var _ common.Reader = (*fileReader)(nil)
+
+func (f *fileReader) ReadNext() ([]byte, error) {
+	if !f.started {
+		if err := common.CheckReadParams(f.params); err != nil {
+			return nil, err
+		}
+		f.started = true
+		if err := f.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+		if err := f.nextFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	for buf.Len() < readChunkSize {
+		if f.scanner == nil {
+			break
+		}
+		if f.params.Limit > 0 && f.read >= f.params.Limit {
+			f.closeCurrent()
+			break
+		}
+		if !f.scanner.Scan() {
+			if err := f.scanner.Err(); err != nil {
+				f.closeCurrent()
+				return nil, errors.Wrap(err, "reading log file")
+			}
+			if err := f.nextFile(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			continue
+		}
+
+		var rec record
+		if err := json.Unmarshal(f.scanner.Bytes(), &rec); err != nil {
+			// Most likely a partially written record at the end of
+			// the active log file.
+			continue
+		}
+		if !f.matches(rec) {
+			continue
+		}
+		f.read++
+		f.cursor = common.EncodeCursor(common.Cursor{Timestamp: rec.Timestamp.UnixNano()})
+		buf.WriteString(rec.Message)
+		if len(rec.Message) > 0 && rec.Message[len(rec.Message)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+
+	if buf.Len() == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *fileReader) Cursor() string {
+	return f.cursor
+}
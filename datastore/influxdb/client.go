@@ -0,0 +1,342 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/pkg/errors"
+)
+
+// gzipTransport compresses the body of requests sent to the InfluxDB
+// write endpoint. Other requests are passed on untouched.
+type gzipTransport struct {
+	base http.RoundTripper
+	// writePath is the path of the write endpoint.
+	writePath string
+}
+
+func (g *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.URL.Path != g.writePath || req.Header.Get("Content-Encoding") != "" {
+		return g.base.RoundTrip(req)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	zw := gzip.NewWriter(buf)
+	_, err := io.Copy(zw, req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "compressing request body")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "compressing request body")
+	}
+
+	// A RoundTripper must not modify the request it was given.
+	body := buf.Bytes()
+	compressed := req.Clone(req.Context())
+	compressed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	compressed.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	compressed.ContentLength = int64(len(body))
+	compressed.Header.Set("Content-Encoding", "gzip")
+	return g.base.RoundTrip(compressed)
+}
+
+// pathTransport sends requests to different paths than the ones the
+// client uses, for proxies that expose InfluxDB under other paths.
+type pathTransport struct {
+	base http.RoundTripper
+	// paths maps the path used by the client to the one the request
+	// is sent to.
+	paths map[string]string
+}
+
+func (p *pathTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	newPath, ok := p.paths[req.URL.Path]
+	if !ok {
+		return p.base.RoundTrip(req)
+	}
+	rewritten := req.Clone(req.Context())
+	rewritten.URL.Path = newPath
+	rewritten.URL.RawPath = ""
+	return p.base.RoundTrip(rewritten)
+}
+
+// httpClient is an InfluxDB client sending its requests through the
+// given transport. The influxdb1-client does not allow setting the
+// transport it uses, so this is a copy of its HTTP client, down to
+// the parameters it sends.
+type httpClient struct {
+	url        url.URL
+	username   string
+	password   string
+	httpClient *http.Client
+	// writeTimeout, if set, is the maximum time a write may take.
+	// Queries are not limited, as reading a log can take a while.
+	writeTimeout time.Duration
+}
+
+var _ client.Client = (*httpClient)(nil)
+
+func newHTTPClient(conf client.HTTPConfig, transport http.RoundTripper, writeTimeout time.Duration) (client.Client, error) {
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing influxdb URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported protocol scheme %q", u.Scheme)
+	}
+	return &httpClient{
+		url:      *u,
+		username: conf.Username,
+		password: conf.Password,
+		httpClient: &http.Client{
+			Transport: transport,
+		},
+		writeTimeout: writeTimeout,
+	}, nil
+}
+
+// newTransport returns the transport used by the influxdb1-client.
+func newTransport(tlsCfg *tls.Config) *http.Transport {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{},
+	}
+	if tlsCfg != nil {
+		tr.TLSClientConfig = tlsCfg
+	}
+	return tr
+}
+
+func (c *httpClient) newRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
+	u := c.url
+	u.Path = path.Join(u.Path, endpoint)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "InfluxDBClient")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+func (c *httpClient) Ping(timeout time.Duration) (time.Duration, string, error) {
+	now := time.Now()
+	req, err := c.newRequest("GET", "ping", nil)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "creating ping request")
+	}
+	if timeout > 0 {
+		params := req.URL.Query()
+		params.Set("wait_for_leader", fmt.Sprintf("%.0fs", timeout.Seconds()))
+		req.URL.RawQuery = params.Encode()
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "reading ping response")
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, "", fmt.Errorf("%s", body)
+	}
+	return time.Since(now), resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+func (c *httpClient) Write(bp client.BatchPoints) error {
+	buf := bytes.NewBuffer([]byte{})
+	for _, pt := range bp.Points() {
+		buf.WriteString(pt.PrecisionString(bp.Precision()))
+		buf.WriteByte('\n')
+	}
+
+	req, err := c.newRequest("POST", "write", buf)
+	if err != nil {
+		return errors.Wrap(err, "creating write request")
+	}
+	req.Header.Set("Content-Type", "")
+	params := req.URL.Query()
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	params.Set("consistency", bp.WriteConsistency())
+	req.URL.RawQuery = params.Encode()
+	if c.writeTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.writeTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading write response")
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", body)
+	}
+	return nil
+}
+
+func (c *httpClient) queryRequest(q client.Query, chunked bool) (*http.Request, error) {
+	jsonParameters, err := json.Marshal(q.Parameters)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding query parameters")
+	}
+	req, err := c.newRequest("POST", "query", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating query request")
+	}
+	req.Header.Set("Content-Type", "")
+
+	params := req.URL.Query()
+	params.Set("q", q.Command)
+	params.Set("db", q.Database)
+	if q.RetentionPolicy != "" {
+		params.Set("rp", q.RetentionPolicy)
+	}
+	params.Set("params", string(jsonParameters))
+	if q.Precision != "" {
+		params.Set("epoch", q.Precision)
+	}
+	if chunked {
+		params.Set("chunked", "true")
+		if q.ChunkSize > 0 {
+			params.Set("chunk_size", strconv.Itoa(q.ChunkSize))
+		}
+	}
+	req.URL.RawQuery = params.Encode()
+	return req, nil
+}
+
+// checkResponse returns an error if the response was not sent by
+// InfluxDB, but by a proxy in front of it.
+func checkResponse(resp *http.Response) error {
+	if resp.Header.Get("X-Influxdb-Version") == "" && resp.StatusCode >= http.StatusInternalServerError {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("received status code %d from downstream server, with response body: %q", resp.StatusCode, body)
+	}
+	if cType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); cType != "application/json" {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("expected json response, got %q, with status: %v and response body: %q", cType, resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (c *httpClient) Query(q client.Query) (*client.Response, error) {
+	if q.Chunked {
+		resp, err := c.QueryAsChunk(q)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Close()
+		var response client.Response
+		for {
+			r, err := resp.NextResponse()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			response.Results = append(response.Results, r.Results...)
+			if r.Err != "" {
+				response.Err = r.Err
+				break
+			}
+		}
+		return &response, nil
+	}
+
+	req, err := c.queryRequest(q, false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var response client.Response
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&response); err != nil {
+		if err != io.EOF || resp.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("unable to decode json: received status code %d err: %s", resp.StatusCode, err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK && response.Error() == nil {
+		return &response, fmt.Errorf("received status code %d from server", resp.StatusCode)
+	}
+	return &response, nil
+}
+
+func (c *httpClient) QueryAsChunk(q client.Query) (*client.ChunkedResponse, error) {
+	return c.QueryAsChunkContext(context.Background(), q)
+}
+
+// QueryAsChunkContext is QueryAsChunk, with the request bound to ctx.
+// Once ctx is done, reading the response fails.
+func (c *httpClient) QueryAsChunkContext(ctx context.Context, q client.Query) (*client.ChunkedResponse, error) {
+	req, err := c.queryRequest(q, true)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return client.NewChunkedResponse(resp.Body), nil
+}
+
+func (c *httpClient) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"os"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/pkg/errors"
+)
+
+// debugWriteFileMaxBytes is the size after which the debug write
+// file is truncated.
+const debugWriteFileMaxBytes = 100 * 1024 * 1024
+
+// writeDebugFile appends the line protocol of a batch to the debug
+// write file, with nanosecond timestamps, so it can be replayed using
+// "influx write". The file is truncated once the batch would grow it
+// over debugWriteFileMaxBytes.
+func writeDebugFile(path string, bp client.BatchPoints) error {
+	buf := bytes.NewBuffer([]byte{})
+	for _, pt := range bp.Points() {
+		buf.WriteString(pt.PrecisionString("ns"))
+		buf.WriteByte('\n')
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if info, err := os.Stat(path); err == nil {
+		if info.Size()+int64(buf.Len()) > debugWriteFileMaxBytes {
+			flags |= os.O_TRUNC
+		}
+	}
+	fd, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening debug write file")
+	}
+	defer fd.Close()
+	if _, err := buf.WriteTo(fd); err != nil {
+		return errors.Wrap(err, "writing debug write file")
+	}
+	return nil
+}
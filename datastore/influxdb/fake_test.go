@@ -0,0 +1,380 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// fakePoint is a point stored by fakeInfluxDB.
+type fakePoint struct {
+	policy string
+	series string
+	time   int64
+	values map[string]interface{}
+}
+
+// fakeInfluxDB is an InfluxDB server holding its points in memory. Like
+// InfluxDB, points of a series with the same time overwrite each
+// other. It only understands the statements sent by the datastore, and
+// the conditions comparing the time, or a tag or field to a value,
+// along with the limit, offset and order of queries.
+type fakeInfluxDB struct {
+	*httptest.Server
+
+	mut sync.Mutex
+	// defaultPolicy is the retention policy written to and read from
+	// when none is given.
+	defaultPolicy string
+	// points holds the points of each measurement, by retention
+	// policy, series and time.
+	points map[string]map[string]fakePoint
+	// queries holds the queries received.
+	queries []string
+	// writes is the number of write requests received, and
+	// writeBytes the size of their bodies, as sent.
+	writes     int
+	writeBytes int
+	// unexpected holds the paths of the requests sent to no endpoint.
+	unexpected []string
+}
+
+// newFakeInfluxDB starts a fake InfluxDB server, which must be closed
+// once done.
+func newFakeInfluxDB() *fakeInfluxDB {
+	return newFakeInfluxDBWithPaths("/write", "/query")
+}
+
+// newFakeInfluxDBWithPaths starts a fake InfluxDB server serving its
+// write and query endpoints on the given paths, like a proxy would.
+// Requests sent to other paths are recorded, and fail.
+func newFakeInfluxDBWithPaths(writePath, queryPath string) *fakeInfluxDB {
+	f := &fakeInfluxDB{
+		defaultPolicy: "autogen",
+		points:        map[string]map[string]fakePoint{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(writePath, f.write)
+	mux.HandleFunc(queryPath, f.query)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		f.mut.Lock()
+		f.unexpected = append(f.unexpected, r.URL.Path)
+		f.mut.Unlock()
+		http.NotFound(w, r)
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeInfluxDB) write(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sent := len(body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body, err = ioutil.ReadAll(zr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	points, err := models.ParsePointsWithPrecision(body, time.Now(), "ns")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.writes++
+	f.writeBytes += sent
+	policy := r.URL.Query().Get("rp")
+	if policy == "" {
+		policy = f.defaultPolicy
+	}
+	for _, pt := range points {
+		values := map[string]interface{}{}
+		for _, tag := range pt.Tags() {
+			values[string(tag.Key)] = string(tag.Value)
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for key, val := range fields {
+			values[key] = val
+		}
+		name := string(pt.Name())
+		if f.points[name] == nil {
+			f.points[name] = map[string]fakePoint{}
+		}
+		ns := pt.Time().UnixNano()
+		f.points[name][fmt.Sprintf("%s/%s/%d", policy, pt.Key(), ns)] = fakePoint{
+			policy: policy,
+			series: string(pt.Key()),
+			time:   ns,
+			values: values,
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	fakeSelectRegex    = regexp.MustCompile(`^select (\S+) from (?:"(?:[^"\\]|\\.)+"\."((?:[^"\\]|\\.)+)"\.)?"((?:[^"\\]|\\.)+)"`)
+	fakeDeleteRegex    = regexp.MustCompile(`^delete from "((?:[^"\\]|\\.)+)"`)
+	fakeDropRegex      = regexp.MustCompile(`^drop measurement "((?:[^"\\]|\\.)+)"`)
+	fakeConditionRegex = regexp.MustCompile(`time (>=|>|<=|<) (\d+)`)
+	fakeTagRegex       = regexp.MustCompile(`"?(\w+)"?='((?:[^'\\]|\\.)*)'`)
+	fakeSeverityRegex  = regexp.MustCompile(`severity =~ /\^\[0-(\d)\]\$/`)
+	fakeLimitRegex     = regexp.MustCompile(` limit (\d+)`)
+	fakeOffsetRegex    = regexp.MustCompile(` offset (\d+)`)
+	fakeUnescaper      = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\'`, `'`)
+)
+
+func (f *fakeInfluxDB) query(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Version", "1.8.10-fake")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.queries = append(f.queries, q)
+	results := []map[string]interface{}{}
+	for idx, statement := range strings.Split(q, "; ") {
+		result := map[string]interface{}{"statement_id": idx}
+		if series := f.statement(statement); series != nil {
+			result["series"] = []map[string]interface{}{series}
+		}
+		results = append(results, result)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// statement runs a statement, and returns the series it selects, if
+// any. Statements it does not understand, such as CREATE DATABASE,
+// succeed without results.
+func (f *fakeInfluxDB) statement(q string) map[string]interface{} {
+	if strings.HasPrefix(q, "SHOW MEASUREMENTS") {
+		names := []string{}
+		for name := range f.points {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return nil
+		}
+		sort.Strings(names)
+		values := [][]interface{}{}
+		for _, name := range names {
+			values = append(values, []interface{}{name})
+		}
+		return map[string]interface{}{
+			"name":    "measurements",
+			"columns": []string{"name"},
+			"values":  values,
+		}
+	}
+	if match := fakeDropRegex.FindStringSubmatch(q); match != nil {
+		delete(f.points, fakeUnescaper.Replace(match[1]))
+		return nil
+	}
+	if match := fakeDeleteRegex.FindStringSubmatch(q); match != nil {
+		name := fakeUnescaper.Replace(match[1])
+		for key, pt := range f.points[name] {
+			if fakeMatches(q, pt) {
+				delete(f.points[name], key)
+			}
+		}
+		return nil
+	}
+	match := fakeSelectRegex.FindStringSubmatch(q)
+	if match == nil {
+		return nil
+	}
+	policy := fakeUnescaper.Replace(match[2])
+	if policy == "" {
+		policy = f.defaultPolicy
+	}
+	name := fakeUnescaper.Replace(match[3])
+	rows := []fakePoint{}
+	for _, pt := range f.points[name] {
+		if pt.policy == policy && fakeMatches(q, pt) {
+			rows = append(rows, pt)
+		}
+	}
+
+	// Rows with the same time are sorted by series, like InfluxDB
+	// does.
+	sort.Slice(rows, func(a, b int) bool {
+		if rows[a].time != rows[b].time {
+			return rows[a].time < rows[b].time
+		}
+		return rows[a].series < rows[b].series
+	})
+	if len(rows) == 0 {
+		return nil
+	}
+	// Aggregates return a single row.
+	switch match[1] {
+	case "count(message)":
+		return fakeSeries(name, []string{"time", "count"}, [][]interface{}{{0, len(rows)}})
+	case "first(message)":
+		return fakeSeries(name, []string{"time", "first"}, [][]interface{}{{rows[0].time, rows[0].values["message"]}})
+	case "last(message)":
+		last := rows[len(rows)-1]
+		return fakeSeries(name, []string{"time", "last"}, [][]interface{}{{last.time, last.values["message"]}})
+	}
+
+	if strings.Contains(q, " order by time desc") {
+		for left, right := 0, len(rows)-1; left < right; left, right = left+1, right-1 {
+			rows[left], rows[right] = rows[right], rows[left]
+		}
+	}
+	if m := fakeOffsetRegex.FindStringSubmatch(q); m != nil {
+		offset, _ := strconv.Atoi(m[1])
+		if offset > len(rows) {
+			offset = len(rows)
+		}
+		rows = rows[offset:]
+	}
+	if m := fakeLimitRegex.FindStringSubmatch(q); m != nil {
+		limit, _ := strconv.Atoi(m[1])
+		if limit < len(rows) {
+			rows = rows[:limit]
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	columns := strings.Split(match[1], ",")
+	values := [][]interface{}{}
+	for _, row := range rows {
+		val := []interface{}{}
+		for _, column := range columns {
+			if column == "time" {
+				val = append(val, row.time)
+			} else {
+				val = append(val, row.values[column])
+			}
+		}
+		values = append(values, val)
+	}
+	return fakeSeries(name, columns, values)
+}
+
+func fakeSeries(name string, columns []string, values [][]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":    name,
+		"columns": columns,
+		"values":  values,
+	}
+}
+
+// fakeMatches returns true if pt matches the time, tag and severity
+// conditions of q.
+func fakeMatches(q string, pt fakePoint) bool {
+	for _, m := range fakeConditionRegex.FindAllStringSubmatch(q, -1) {
+		bound, _ := strconv.ParseInt(m[2], 10, 64)
+		switch m[1] {
+		case ">=":
+			if pt.time < bound {
+				return false
+			}
+		case ">":
+			if pt.time <= bound {
+				return false
+			}
+		case "<=":
+			if pt.time > bound {
+				return false
+			}
+		case "<":
+			if pt.time >= bound {
+				return false
+			}
+		}
+	}
+	for _, m := range fakeTagRegex.FindAllStringSubmatch(q, -1) {
+		if pt.values[m[1]] != fakeUnescaper.Replace(m[2]) {
+			return false
+		}
+	}
+	if m := fakeSeverityRegex.FindStringSubmatch(q); m != nil {
+		severity, _ := pt.values["severity"].(string)
+		if severity == "" || severity > m[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// count returns the number of points held in measurement.
+func (f *fakeInfluxDB) count(measurement string) int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return len(f.points[measurement])
+}
+
+// received returns true if the query q was received.
+func (f *fakeInfluxDB) received(q string) bool {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for _, val := range f.queries {
+		if val == q {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForQuery waits for a query starting with prefix to be received,
+// for at most timeout.
+func (f *fakeInfluxDB) waitForQuery(prefix string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		f.mut.Lock()
+		for _, q := range f.queries {
+			if strings.HasPrefix(q, prefix) {
+				f.mut.Unlock()
+				return true
+			}
+		}
+		f.mut.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/metrics"
+)
+
+const (
+	// otherHostname is the hostname tag value of the messages of
+	// hosts over the limit of the hostname guard.
+	otherHostname = "other"
+	// sourceHostnameField is the field holding the hostname of the
+	// messages the hostname guard stored with another one.
+	sourceHostnameField = "source_hostname"
+)
+
+type hostnameRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// hostnameEntry is a hostname used as tag value, and the last time it
+// was seen.
+type hostnameEntry struct {
+	hostname string
+	lastSeen time.Time
+}
+
+// hostnameGuard limits the distinct hostname tag values of each
+// measurement, to keep series cardinality under control.
+type hostnameGuard struct {
+	database     string
+	rules        []hostnameRule
+	maxHostnames int
+	idleTime     time.Duration
+
+	mut sync.Mutex
+	// order holds the hostnames of each measurement, least recently
+	// seen first, and entries indexes them by hostname.
+	order   map[string]*list.List
+	entries map[string]map[string]*list.Element
+}
+
+func newHostnameGuard(cfg config.HostnameGuard, database string) (*hostnameGuard, error) {
+	rules := make([]hostnameRule, 0, len(cfg.Rules))
+	for _, ruleCfg := range cfg.Rules {
+		re, err := regexp.Compile(ruleCfg.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compiling pattern %q", ruleCfg.Pattern)
+		}
+		rules = append(rules, hostnameRule{re: re, replacement: ruleCfg.Replacement})
+	}
+	return &hostnameGuard{
+		database:     database,
+		rules:        rules,
+		maxHostnames: cfg.MaxHostnames,
+		idleTime:     cfg.GetIdleTime(),
+		order:        map[string]*list.List{},
+		entries:      map[string]map[string]*list.Element{},
+	}, nil
+}
+
+// normalize returns the hostname tag value of a message of measurement
+// sent by hostname. Once a measurement holds the maximum number of
+// hostnames, a new one only replaces the least recently seen if that
+// one has been idle for long enough, otherwise "other" is returned.
+func (h *hostnameGuard) normalize(measurement, hostname string, now time.Time) string {
+	for _, rule := range h.rules {
+		if !rule.re.MatchString(hostname) {
+			continue
+		}
+		normalized := rule.re.ReplaceAllString(hostname, rule.replacement)
+		if normalized != hostname {
+			metrics.InfluxDBHostnamesNormalized.WithLabelValues(h.database, "rule").Inc()
+			hostname = normalized
+		}
+		break
+	}
+	if h.maxHostnames == 0 {
+		return hostname
+	}
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	order, ok := h.order[measurement]
+	if !ok {
+		order = list.New()
+		h.order[measurement] = order
+		h.entries[measurement] = map[string]*list.Element{}
+	}
+	entries := h.entries[measurement]
+	if elem, ok := entries[hostname]; ok {
+		elem.Value.(*hostnameEntry).lastSeen = now
+		order.MoveToBack(elem)
+		return hostname
+	}
+	if order.Len() >= h.maxHostnames {
+		oldest := order.Front().Value.(*hostnameEntry)
+		if now.Sub(oldest.lastSeen) < h.idleTime {
+			metrics.InfluxDBHostnamesNormalized.WithLabelValues(h.database, "overflow").Inc()
+			return otherHostname
+		}
+		order.Remove(order.Front())
+		delete(entries, oldest.hostname)
+	}
+	entries[hostname] = order.PushBack(&hostnameEntry{hostname: hostname, lastSeen: now})
+	return hostname
+}
@@ -17,8 +17,16 @@ package influxdb
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,58 +38,228 @@ import (
 	"github.com/pkg/errors"
 
 	"coriolis-logger/config"
+	"coriolis-logger/datastore/archive"
 	"coriolis-logger/datastore/common"
 	"coriolis-logger/logging"
+	"coriolis-logger/metrics"
 	"coriolis-logger/params"
 )
 
 var log = loggo.GetLogger("coriolis.logger.datastore.influxdb")
 
-func NewInfluxDBDatastore(ctx context.Context, cfg *config.InfluxDB) (common.DataStore, error) {
+// healthCheckTimeout is the time we wait for InfluxDB to answer a
+// ping, if the health check context has no deadline.
+const healthCheckTimeout = 5 * time.Second
+
+// retentionPolicyName is the name of the retention policy created
+// when retention_duration is set.
+const retentionPolicyName = "coriolis_logger"
+
+// sourceAddrTag is the tag holding the IP address messages were
+// received from.
+const sourceAddrTag = "source_addr"
+
+// msgIDTag is the tag holding the MSGID of RFC5424 messages.
+const msgIDTag = "msg_id"
+
+// downsampledPolicyName is the name of the retention policy the
+// warnings and more severe messages are also written to, when
+// downsampling is enabled.
+const downsampledPolicyName = "coriolis_logger_downsampled"
+
+const (
+	// reconnectAfterFailures is the number of consecutive failed
+	// writes after which we reconnect to InfluxDB.
+	reconnectAfterFailures = 1
+	// minReconnectBackoff and maxReconnectBackoff bound the time we
+	// wait between attempts to reconnect.
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 60 * time.Second
+)
+
+// NewInfluxDBDatastore returns an InfluxDB datastore. If clusterID is
+// set, every point is tagged with it.
+func NewInfluxDBDatastore(ctx context.Context, cfg *config.InfluxDB, clusterID string) (common.DataStore, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, errors.Wrap(err, "validating influx config")
 	}
 
 	store := &InfluxDBDataStore{
-		cfg:    cfg,
-		points: []*client.Point{},
-		ctx:    ctx,
-		closed: make(chan struct{}),
-		quit:   make(chan struct{}),
+		cfg:           cfg,
+		clusterID:     clusterID,
+		points:        []*client.Point{},
+		ctx:           ctx,
+		closed:        make(chan struct{}),
+		quit:          make(chan struct{}),
+		retentionDone: make(chan struct{}),
+	}
+
+	extractors, err := newTagExtractors(cfg.TagExtractors)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting tag extractors")
+	}
+	store.extractors = extractors
+
+	if cfg.HostnameGuard != nil {
+		guard, err := newHostnameGuard(*cfg.HostnameGuard, cfg.Database)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting hostname guard")
+		}
+		store.hostnames = guard
+	}
+
+	if cfg.Archive != nil {
+		archiver, err := archive.NewArchiver(cfg.Archive)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting archiver")
+		}
+		store.archiver = archiver
+	}
+
+	if cfg.SpoolDir != "" {
+		spool, err := newSpool(cfg.SpoolDir, cfg.GetSpoolMaxSize())
+		if err != nil {
+			return nil, errors.Wrap(err, "opening spool")
+		}
+		store.spool = spool
 	}
 
 	if err := store.connect(); err != nil {
 		return nil, errors.Wrap(err, "connecting to influxdb")
 	}
+	if cfg.UDPAddress != "" {
+		udpCon, err := client.NewUDPClient(client.UDPConfig{
+			Addr:        cfg.UDPAddress,
+			PayloadSize: cfg.GetUDPPayloadSize(),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "getting influxdb UDP client")
+		}
+		store.udpCon = udpCon
+	}
+	if !cfg.SkipDBCreate {
+		if err := store.createDatabase(); err != nil {
+			return nil, errors.Wrap(err, "creating influxdb database")
+		}
+	}
 	return store, nil
 }
 
 var _ common.DataStore = (*InfluxDBDataStore)(nil)
 
 type InfluxDBDataStore struct {
-	cfg    *config.InfluxDB
+	cfg *config.InfluxDB
+	// clusterID is added as the cluster tag of every point, if set.
+	clusterID string
+	// con is replaced when reconnecting, so it is only accessed
+	// through connection() and setConnection().
 	con    client.Client
+	conMut sync.RWMutex
+	// udpCon, if set, is used for writes instead of con. The client
+	// splits batches in datagrams of at most udp_payload_size bytes.
+	udpCon client.Client
 	mut    sync.Mutex
 	points []*client.Point
 	ctx    context.Context
 	closed chan struct{}
 	quit   chan struct{}
+	// archiver, if set, receives logs before they are rotated out
+	// of InfluxDB.
+	archiver *archive.Archiver
+	// extractors holds the tag extractors of each application.
+	extractors map[string][]*tagExtractor
+	// hostnames, if set, limits the distinct hostname tag values.
+	hostnames *hostnameGuard
+	// retentionDone is closed once the retention worker returns.
+	retentionDone chan struct{}
+	// spool, if set, keeps the logs that could not be written on
+	// disk, until InfluxDB is reachable again.
+	spool *spool
+
+	// failures is the number of consecutive failed writes. Once it
+	// reaches reconnectAfterFailures, writes are paused until retryAt,
+	// when we reconnect. backoff is the last time we waited. They are
+	// guarded by mut.
+	failures int
+	backoff  time.Duration
+	retryAt  time.Time
+	// dropped is the number of buffered points dropped because
+	// InfluxDB was unreachable for too long.
+	dropped uint64
+	// pointTimes keeps messages of a series with the same timestamp
+	// from overwriting each other. It is guarded by mut.
+	pointTimes common.PointTimes
+
+	// stats holds the write statistics returned by Metrics().
+	stats    InfluxDBMetrics
+	statsMut sync.Mutex
 }
 
-func (i *InfluxDBDataStore) doWork() {
-	var interval int
-	if i.cfg.WriteInterval == 0 {
-		interval = 1
+// InfluxDBMetrics holds the write statistics of an InfluxDB datastore.
+// They are also exported as Prometheus metrics, but are kept here for
+// callers that do not use Prometheus.
+type InfluxDBMetrics struct {
+	// Flushes is the number of batches written, or attempted to.
+	Flushes uint64
+	// FlushErrors is the number of batches that failed to be written.
+	FlushErrors uint64
+	// PointsFlushed is the number of points written.
+	PointsFlushed uint64
+	// LastFlushDuration is the time taken by the last write, and
+	// LastFlushError its error, if it failed.
+	LastFlushDuration time.Duration
+	LastFlushError    error
+}
+
+// recordFlush records the outcome of writing a batch of points.
+func (i *InfluxDBDataStore) recordFlush(points int, duration time.Duration, err error) {
+	metrics.InfluxDBFlushDuration.WithLabelValues(i.cfg.Database).Observe(duration.Seconds())
+	if err != nil {
+		metrics.InfluxDBFlushErrors.WithLabelValues(i.cfg.Database).Inc()
 	} else {
-		interval = i.cfg.WriteInterval
+		metrics.InfluxDBPointsFlushed.WithLabelValues(i.cfg.Database).Add(float64(points))
 	}
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
-	rotationTicker := time.NewTicker(1 * time.Hour)
+
+	i.statsMut.Lock()
+	defer i.statsMut.Unlock()
+	i.stats.Flushes++
+	if err != nil {
+		i.stats.FlushErrors++
+	} else {
+		i.stats.PointsFlushed += uint64(points)
+	}
+	i.stats.LastFlushDuration = duration
+	i.stats.LastFlushError = err
+}
+
+// Metrics returns a copy of the write statistics of the datastore.
+func (i *InfluxDBDataStore) Metrics() *InfluxDBMetrics {
+	i.statsMut.Lock()
+	defer i.statsMut.Unlock()
+	stats := i.stats
+	return &stats
+}
+
+func (i *InfluxDBDataStore) doWork() {
+	ticker := time.NewTicker(i.cfg.GetFlushInterval())
 	defer func() {
 		ticker.Stop()
-		rotationTicker.Stop()
+		<-i.retentionDone
+		// With a spool, pending logs are spooled if InfluxDB is
+		// unreachable, and replayed on the next start.
+		if err := i.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
+		if i.udpCon != nil {
+			i.udpCon.Close()
+		}
 		close(i.closed)
 	}()
+	if i.spool != nil && !i.spool.empty() {
+		if err := i.flush(); err != nil {
+			log.Errorf("failed to replay spooled logs: %v", err)
+		}
+	}
 	for {
 		select {
 		case <-i.ctx.Done():
@@ -90,15 +268,38 @@ func (i *InfluxDBDataStore) doWork() {
 			if err := i.flush(); err != nil {
 				log.Errorf("failed to flush logs to backend: %v", err)
 			}
+		case <-i.quit:
+			return
+		}
+	}
+}
+
+// enforceRetention deletes the logs older than the log retention
+// period, on start and then every hour. Rotating can take a while, so
+// it is done separately from flushing. With downsampling, the
+// retention policies discard old logs, as deleting them here would
+// also delete the downsampled ones.
+func (i *InfluxDBDataStore) enforceRetention() {
+	defer close(i.retentionDone)
+	if i.cfg.Downsampling != nil {
+		log.Infof("downsampling is enabled, leaving log retention to the retention policies")
+		return
+	}
+	rotationTicker := time.NewTicker(1 * time.Hour)
+	defer rotationTicker.Stop()
+	for {
+		retentionPeriod := i.cfg.GetLogRetention()
+		log.Infof("deleting logs older than %d days", retentionPeriod)
+		day := 24 * time.Hour
+		olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+		if err := i.Rotate(olderThan); err != nil {
+			log.Errorf("failed to rotate logs: %v", err)
+		}
+
+		select {
 		case <-rotationTicker.C:
-			retentionPeriod := i.cfg.GetLogRetention()
-			log.Infof("deleting logs older than %d days", retentionPeriod)
-			now := time.Now()
-			day := 24 * time.Hour
-			olderThan := now.Add(time.Duration(-retentionPeriod) * day)
-			if err := i.Rotate(olderThan); err != nil {
-				log.Errorf("failed to rotate logs: %v", err)
-			}
+		case <-i.ctx.Done():
+			return
 		case <-i.quit:
 			return
 		}
@@ -106,6 +307,7 @@ func (i *InfluxDBDataStore) doWork() {
 }
 
 func (i *InfluxDBDataStore) Start() error {
+	go i.enforceRetention()
 	go i.doWork()
 	return nil
 }
@@ -116,16 +318,138 @@ func (i *InfluxDBDataStore) Stop() error {
 	return nil
 }
 
+// stopping returns true once the datastore is shutting down.
+func (i *InfluxDBDataStore) stopping() bool {
+	select {
+	case <-i.ctx.Done():
+		return true
+	case <-i.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (i *InfluxDBDataStore) Wait() {
 	<-i.closed
 }
 
 func (i *InfluxDBDataStore) connect() error {
-	i.mut.Lock()
-	defer i.mut.Unlock()
+	con, err := i.newConnection()
+	if err != nil {
+		return err
+	}
+	i.setConnection(con)
+	return nil
+}
+
+// exec runs a query that returns no results.
+func (i *InfluxDBDataStore) exec(q, database string) error {
+	resp, err := i.connection().Query(client.NewQuery(q, database, "ns"))
+	if err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	if err := resp.Error(); err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	return nil
+}
+
+// hasDatabase returns true if the database is visible to our user.
+func (i *InfluxDBDataStore) hasDatabase() (bool, error) {
+	resp, err := i.connection().Query(client.NewQuery("SHOW DATABASES", "", "ns"))
+	if err != nil {
+		return false, errors.Wrap(err, "executing query")
+	}
+	if err := resp.Error(); err != nil {
+		return false, errors.Wrap(err, "executing query")
+	}
+	for _, result := range resp.Results {
+		for _, serie := range result.Series {
+			for _, value := range serie.Values {
+				if len(value) > 0 && value[0] == i.cfg.Database {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// isUnauthorized returns true if err was returned for a query our
+// user is not allowed to run, such as one requiring admin privileges.
+func isUnauthorized(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "not authorized") || strings.Contains(msg, "requires admin privilege")
+}
+
+// createDatabase creates the database, if missing, and its retention
+// policy, if retention_duration is set, so writes do not fail on a
+// fresh InfluxDB. Both require admin privileges, so if our user lacks
+// them, we log a warning and carry on with what exists.
+func (i *InfluxDBDataStore) createDatabase() error {
+	// CREATE DATABASE does nothing if the database exists.
+	q := fmt.Sprintf(`CREATE DATABASE %s`, quoteIdent(i.cfg.Database))
+	if err := i.exec(q, ""); err != nil {
+		exists, existsErr := i.hasDatabase()
+		if existsErr != nil {
+			return errors.Wrap(existsErr, "listing databases")
+		}
+		if !exists {
+			if !isUnauthorized(err) {
+				return err
+			}
+			log.Warningf("database %s does not exist and our user may not create it. Writes will fail until it is created: %v", i.cfg.Database, err)
+			return nil
+		}
+		log.Warningf("failed to create database %s, using the existing one: %v", i.cfg.Database, err)
+	}
+
+	if i.cfg.RetentionDuration == "" {
+		return nil
+	}
+	if err := i.createRetentionPolicy(retentionPolicyName, i.cfg.RetentionDuration, i.cfg.ShardDuration, true); err != nil {
+		return err
+	}
+	if i.cfg.Downsampling == nil {
+		return nil
+	}
+	downsampling := i.cfg.Downsampling
+	return i.createRetentionPolicy(downsampledPolicyName, downsampling.Duration, downsampling.ShardDuration, false)
+}
+
+// createRetentionPolicy creates a retention policy, or updates it if
+// it exists with other settings.
+func (i *InfluxDBDataStore) createRetentionPolicy(name, duration, shardDuration string, isDefault bool) error {
+	policy := fmt.Sprintf(
+		`RETENTION POLICY %s ON %s DURATION %s REPLICATION 1`,
+		quoteIdent(name), quoteIdent(i.cfg.Database), duration)
+	if shardDuration != "" {
+		policy += " SHARD DURATION " + shardDuration
+	}
+	if isDefault {
+		policy += " DEFAULT"
+	}
+	err := i.exec("CREATE "+policy, "")
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		// The policy exists with other settings, which CREATE does
+		// not change.
+		err = i.exec("ALTER "+policy, "")
+	}
+	if err != nil {
+		if isUnauthorized(err) {
+			log.Warningf("our user may not create retention policy %s, using the existing ones: %v", name, err)
+			return nil
+		}
+		return errors.Wrapf(err, "creating retention policy %s", name)
+	}
+	return nil
+}
+
+func (i *InfluxDBDataStore) newConnection() (client.Client, error) {
 	tlsCfg, err := i.cfg.TLSConfig()
 	if err != nil {
-		return errors.Wrap(err, "getting TLS config for influx client")
+		return nil, errors.Wrap(err, "getting TLS config for influx client")
 	}
 	conf := client.HTTPConfig{
 		Addr:      i.cfg.URL.String(),
@@ -133,112 +457,672 @@ func (i *InfluxDBDataStore) connect() error {
 		Password:  i.cfg.Password,
 		TLSConfig: tlsCfg,
 	}
-	con, err := client.NewHTTPClient(conf)
+	con, err := i.newClient(conf)
 	if err != nil {
-		return errors.Wrap(err, "getting influx connection")
+		return nil, errors.Wrap(err, "getting influx connection")
 	}
+	return con, nil
+}
+
+func (i *InfluxDBDataStore) connection() client.Client {
+	i.conMut.RLock()
+	defer i.conMut.RUnlock()
+	return i.con
+}
+
+// setConnection replaces the client, closing the previous one.
+func (i *InfluxDBDataStore) setConnection(con client.Client) {
+	i.conMut.Lock()
+	old := i.con
 	i.con = con
+	i.conMut.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// reconnect replaces the client with a new one, once InfluxDB answers
+// to pings. The caller must hold i.mut.
+func (i *InfluxDBDataStore) reconnect() error {
+	con, err := i.newConnection()
+	if err != nil {
+		return err
+	}
+	if _, _, err := con.Ping(healthCheckTimeout); err != nil {
+		con.Close()
+		return errors.Wrap(err, "pinging influxdb")
+	}
+	i.setConnection(con)
 	return nil
 }
 
-func (i *InfluxDBDataStore) flush() error {
-	i.mut.Lock()
-	defer i.mut.Unlock()
+// backOff pauses writes after consecutive failures, doubling the time
+// we wait on each failed attempt to reconnect, up to
+// maxReconnectBackoff. The caller must hold i.mut.
+func (i *InfluxDBDataStore) backOff() {
+	i.backoff *= 2
+	if i.backoff < minReconnectBackoff {
+		i.backoff = minReconnectBackoff
+	}
+	if i.backoff > maxReconnectBackoff {
+		i.backoff = maxReconnectBackoff
+	}
+	// Jitter keeps instances that lost InfluxDB at the same time from
+	// reconnecting all at once.
+	wait := i.backoff/2 + time.Duration(rand.Int63n(int64(i.backoff/2)+1))
+	i.retryAt = time.Now().Add(wait)
+	log.Warningf("influxdb unreachable after %d failed attempts, reconnecting in %s", i.failures, wait.Round(time.Millisecond))
+}
+
+// recordWriteResult tracks consecutive write failures, pausing writes
+// once there are too many. The caller must hold i.mut.
+func (i *InfluxDBDataStore) recordWriteResult(err error) {
+	if err == nil {
+		if i.failures >= reconnectAfterFailures {
+			log.Warningf("influxdb writes resumed after %d failures", i.failures)
+		}
+		i.failures = 0
+		i.backoff = 0
+		i.retryAt = time.Time{}
+		return
+	}
+	i.failures++
+	if i.failures >= reconnectAfterFailures {
+		i.backOff()
+	}
+}
+
+// dropOldPoints drops the oldest buffered points once there are more
+// than max_buffered_points, which only happens while InfluxDB can not
+// be written to. Points are spooled instead, if a spool is set. The
+// caller must hold i.mut.
+func (i *InfluxDBDataStore) dropOldPoints() {
+	maxPoints := i.cfg.GetMaxBufferedPoints()
+	if i.spool != nil || len(i.points) <= maxPoints {
+		return
+	}
+	// A tenth of the buffer is dropped at once, so we do not log
+	// every single dropped point.
+	count := len(i.points) - maxPoints + maxPoints/10
+	if count > len(i.points) {
+		count = len(i.points)
+	}
+	i.points = append([]*client.Point{}, i.points[count:]...)
+	i.dropped += uint64(count)
+	metrics.InfluxDBPointsDropped.WithLabelValues(i.cfg.Database).Add(float64(count))
+	log.Warningf("dropped %d buffered log messages, as influxdb is unreachable (%d dropped so far)", count, i.dropped)
+}
+
+// newClient returns an InfluxDB client. Our copy of the client of
+// influxdb1-client is always used, as its queries can be cancelled.
+func (i *InfluxDBDataStore) newClient(conf client.HTTPConfig) (client.Client, error) {
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing influxdb URL")
+	}
+	// The paths the client sends requests to.
+	writePath := path.Join("/", u.Path, "write")
+	queryPath := path.Join("/", u.Path, "query")
+	var transport http.RoundTripper = newTransport(conf.TLSConfig)
+	if i.cfg.WritePath != "" || i.cfg.QueryPath != "" {
+		paths := map[string]string{}
+		if i.cfg.WritePath != "" {
+			paths[writePath] = i.cfg.WritePath
+		}
+		if i.cfg.QueryPath != "" {
+			paths[queryPath] = i.cfg.QueryPath
+		}
+		transport = &pathTransport{
+			base:  transport,
+			paths: paths,
+		}
+	}
+	if i.cfg.CompressWrites {
+		transport = &gzipTransport{
+			base:      transport,
+			writePath: writePath,
+		}
+	}
+	return newHTTPClient(conf, transport, i.cfg.GetFlushTimeout())
+}
+
+// writePoints sends a batch of points to InfluxDB. With downsampling,
+// the warnings and more severe messages are written to the downsampled
+// retention policy as well, which keeps them once the default one
+// discarded them.
+func (i *InfluxDBDataStore) writePoints(points []*client.Point) error {
+	start := time.Now()
+	err := i.writeBatch(points, "")
+	if err == nil && i.cfg.Downsampling != nil {
+		if kept := downsampledPoints(points); len(kept) > 0 {
+			err = i.writeBatch(kept, downsampledPolicyName)
+		}
+	}
+	i.recordFlush(len(points), time.Since(start), err)
+	i.recordWriteResult(err)
+	if err != nil {
+		return errors.Wrap(err, "writing log line to influx")
+	}
+	return nil
+}
+
+// writeBatch writes points to a retention policy, or to the default
+// one if policy is empty.
+func (i *InfluxDBDataStore) writeBatch(points []*client.Point, policy string) error {
 	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  i.cfg.Database,
-		Precision: "ns",
+		Database:        i.cfg.Database,
+		RetentionPolicy: policy,
+		Precision:       "ns",
 	})
 	if err != nil {
 		return errors.Wrap(err, "getting influx batch point")
 	}
-	if i.points != nil && len(i.points) > 0 {
-		for _, val := range i.points {
-			bp.AddPoint(val)
+	bp.AddPoints(points)
+	if i.cfg.DebugWriteFile != "" {
+		if err := writeDebugFile(i.cfg.DebugWriteFile, bp); err != nil {
+			log.Warningf("failed to write batch to debug file: %v", err)
+		}
+	}
+	con := i.connection()
+	if i.udpCon != nil {
+		con = i.udpCon
+	}
+	return con.Write(bp)
+}
+
+// downsampledPoints returns the points of warnings and more severe
+// messages, which downsampling keeps.
+func downsampledPoints(points []*client.Point) []*client.Point {
+	ret := []*client.Point{}
+	for _, pt := range points {
+		severity, err := strconv.Atoi(pt.Tags()["severity"])
+		if err == nil && severity <= int(logging.Warning) {
+			ret = append(ret, pt)
+		}
+	}
+	return ret
+}
+
+// spoolPoints saves the pending points to the spool, after failing to
+// write them for the given reason.
+func (i *InfluxDBDataStore) spoolPoints(cause error) error {
+	if len(i.points) == 0 {
+		return cause
+	}
+	if err := i.spool.add(i.points); err != nil {
+		return errors.Wrapf(cause, "spooling logs failed (%v)", err)
+	}
+	log.Warningf("spooled %d log messages to disk (%d batches waiting): %v", len(i.points), len(i.spool.files), cause)
+	i.points = []*client.Point{}
+	return nil
+}
+
+func (i *InfluxDBDataStore) flush() error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.flushLocked()
+}
+
+// flushLocked writes all pending points to InfluxDB. The caller must
+// hold i.mut.
+func (i *InfluxDBDataStore) flushLocked() error {
+	defer func() {
+		metrics.InfluxDBPendingPoints.Set(float64(len(i.points)))
+	}()
+	if i.failures >= reconnectAfterFailures {
+		if time.Now().Before(i.retryAt) || i.stopping() {
+			// Points stay buffered until we reconnect, or are
+			// spooled, if a spool is set. We do not wait for
+			// InfluxDB when shutting down.
+			if i.spool != nil && len(i.points) > 0 {
+				return i.spoolPoints(fmt.Errorf("waiting to reconnect to influxdb"))
+			}
+			return nil
+		}
+		if err := i.reconnect(); err != nil {
+			i.failures++
+			i.backOff()
+			return errors.Wrap(err, "reconnecting to influxdb")
+		}
+	}
+	if i.spool != nil {
+		// Spooled logs are sent first, and new ones wait behind them,
+		// so logs are never written out of order.
+		if err := i.spool.replay(i.writePoints); err != nil {
+			return i.spoolPoints(errors.Wrap(err, "replaying spool"))
 		}
-		if err := i.con.Write(bp); err != nil {
-			return errors.Wrap(err, "writing log line to influx")
+	}
+	if len(i.points) == 0 {
+		return nil
+	}
+	if err := i.writePoints(i.points); err != nil {
+		if i.spool != nil {
+			return i.spoolPoints(err)
 		}
-		i.points = []*client.Point{}
+		return err
 	}
+	i.points = []*client.Point{}
 	return nil
 }
 
 func (i *InfluxDBDataStore) Write(logMsg logging.LogMessage) (err error) {
-	if len(i.points) >= 20000 {
-		if err := i.flush(); err != nil {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	// The batch size is checked while holding the lock, so concurrent
+	// writers never read the pending points while they are flushed.
+	// While writes are failing, points are only flushed by doWork(),
+	// so receiving logs is not slowed down by the failing writes.
+	if len(i.points) >= i.cfg.GetMaxBatchPoints() && i.failures == 0 {
+		if err := i.flushLocked(); err != nil {
 			return errors.Wrap(err, "flushing logs")
 		}
 	}
 
-	i.mut.Lock()
-	defer i.mut.Unlock()
 	tags := map[string]string{
 		"hostname": logMsg.Hostname,
 		"severity": logMsg.Severity.String(),
 		"facility": logMsg.Facility.String(),
 	}
+	for _, extractor := range i.extractors[logMsg.AppName] {
+		extractor.extract(logMsg.Message, tags)
+	}
+	if i.clusterID != "" {
+		tags["cluster"] = i.clusterID
+	}
+	if logMsg.SourceAddr != "" {
+		tags[sourceAddrTag] = logMsg.SourceAddr
+	}
+	if logMsg.MsgID != "" {
+		tags[msgIDTag] = logMsg.MsgID
+	}
 	fields := map[string]interface{}{
 		"message": logMsg.Message,
 	}
-
-	var tm time.Time = logMsg.Timestamp
-	if logMsg.RFC == logging.RFC3164 {
-		tm = time.Now()
+	if i.hostnames != nil {
+		hostname := i.hostnames.normalize(logMsg.AppName, logMsg.Hostname, time.Now())
+		if hostname != logMsg.Hostname {
+			tags["hostname"] = hostname
+			fields[sourceHostnameField] = logMsg.Hostname
+		}
 	}
-	pt, err := client.NewPoint(logMsg.AppName, tags, fields, tm)
+	for _, sdParam := range i.cfg.StructuredData {
+		value, ok := logMsg.StructuredData[sdParam.SDID][sdParam.Param]
+		if !ok {
+			continue
+		}
+		if sdParam.Tag {
+			tags[sdParam.GetName()] = value
+		} else {
+			fields[sdParam.GetName()] = value
+		}
+	}
+
+	measurement := measurementName(logMsg.AppName)
+	ts := i.pointTimes.Next(common.SeriesKey(measurement, tags), logMsg.Timestamp, time.Now())
+	pt, err := client.NewPoint(measurement, tags, fields, ts)
 	if err != nil {
 		return errors.Wrap(err, "adding new log message point")
 	}
 	i.points = append(i.points, pt)
+	i.dropOldPoints()
+	metrics.InfluxDBPendingPoints.Set(float64(len(i.points)))
 
 	return nil
 }
 
+// Rotate deletes the logs older than the given time. Failing to rotate
+// a log does not stop the others from being rotated. Pending points are
+// written first, so none of the deleted logs are written afterwards.
 func (i *InfluxDBDataStore) Rotate(olderThan time.Time) error {
+	if err := i.flush(); err != nil {
+		log.Warningf("failed to flush logs before rotating: %v", err)
+	}
 	logList, err := i.List()
 	if err != nil {
 		return errors.Wrap(err, "listing logs")
 	}
+
+	var errs []string
 	for _, val := range logList {
 		for _, logName := range val {
-			q := fmt.Sprintf(`delete from "%s" where time < %d`, logName, olderThan.UnixNano())
-			influxQ := client.NewQuery(q, i.cfg.Database, "ns")
-			resp, err := i.con.Query(influxQ)
-			if err != nil {
-				return errors.Wrap(err, "executing query")
-			}
-			if resp.Err != "" {
-				return fmt.Errorf("error executing query: %s", resp.Err)
+			if err := i.rotateLog(logName, olderThan); err != nil {
+				log.Errorf("failed to rotate log %q: %v", logName, err)
+				errs = append(errs, fmt.Sprintf("%s: %v", logName, err))
 			}
 		}
 	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to rotate logs: %s", strings.Join(errs, "; "))
+	}
 	return nil
 }
 
-func (i *InfluxDBDataStore) ResultReader(p params.QueryParams) common.Reader {
-	return &influxDBReader{
-		datastore: i,
-		params:    p,
+// Delete drops the measurement holding a log, or only deletes its
+// points older than olderThan, if set, archiving them first like
+// Rotate does. Pending points are written first, so they do not
+// recreate it.
+func (i *InfluxDBDataStore) Delete(binaryName string, olderThan time.Time) error {
+	if err := i.flush(); err != nil {
+		log.Warningf("failed to flush logs before deleting %q: %v", binaryName, err)
+	}
+	logList, err := i.List()
+	if err != nil {
+		return errors.Wrap(err, "listing logs")
 	}
+	if !common.HasLog(logList, binaryName) {
+		return common.LogNotFoundErr
+	}
+	if !olderThan.IsZero() {
+		return i.rotateLog(binaryName, olderThan)
+	}
+
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	q := fmt.Sprintf(`drop measurement %s`, quoteIdent(binaryName))
+	influxQ := client.NewQuery(q, i.cfg.Database, "ns")
+	resp, err := i.connection().Query(influxQ)
+	if err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	if err := resp.Error(); err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	return nil
 }
 
-func (i *InfluxDBDataStore) List() ([]map[string]string, error) {
-	query := client.NewQuery("SHOW MEASUREMENTS", i.cfg.Database, "ns")
-	resp, err := i.con.QueryAsChunk(query)
+// Metadata counts the messages of a log, and fetches the timestamps of
+// the first and last ones. Pending points are written first, so they
+// are included, but messages that were archived are not.
+func (i *InfluxDBDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	if err := validLogName(binaryName); err != nil {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	i.flush()
+	measurement := quoteIdent(binaryName)
+	q := fmt.Sprintf(
+		`select count(message) from %s; select first(message) from %s; select last(message) from %s`,
+		measurement, measurement, measurement)
+	resp, err := i.connection().Query(client.NewQuery(q, i.cfg.Database, "ns"))
 	if err != nil {
-		return nil, errors.Wrap(err, "listing logs")
+		return common.LogMetadata{}, errors.Wrap(err, "executing query")
 	}
-	ret := []map[string]string{}
+	if err := resp.Error(); err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "executing query")
+	}
+	if len(resp.Results) != 3 {
+		return common.LogMetadata{}, fmt.Errorf("unexpected number of results: %d", len(resp.Results))
+	}
+
+	// Each statement returns a single row, of the time and the
+	// selected value. There are no rows if the log does not exist.
+	rows := make([][]interface{}, 0, 3)
+	for _, result := range resp.Results {
+		if len(result.Series) == 0 || len(result.Series[0].Values) == 0 || len(result.Series[0].Values[0]) < 2 {
+			return common.LogMetadata{}, common.LogNotFoundErr
+		}
+		rows = append(rows, result.Series[0].Values[0])
+	}
+	ret := common.LogMetadata{}
+	if count, ok := rows[0][1].(json.Number); ok {
+		ret.Count, _ = count.Int64()
+	}
+	if stamp, ok := rows[1][0].(json.Number); ok {
+		if ns, err := stamp.Int64(); err == nil {
+			ret.FirstTimestamp = time.Unix(0, ns)
+		}
+	}
+	if stamp, ok := rows[2][0].(json.Number); ok {
+		if ns, err := stamp.Int64(); err == nil {
+			ret.LastTimestamp = time.Unix(0, ns)
+		}
+	}
+	return ret, nil
+}
+
+// rotateLog deletes messages older than olderThan from a log. If
+// archiving is enabled, only messages that were successfully archived
+// are deleted.
+func (i *InfluxDBDataStore) rotateLog(logName string, olderThan time.Time) error {
+	cutoff := olderThan.UnixNano()
+	if i.archiver != nil {
+		last, err := i.archiveLog(logName, olderThan)
+		if err != nil {
+			return errors.Wrap(err, "archiving log")
+		}
+		if last.IsZero() {
+			// nothing to rotate
+			return nil
+		}
+		cutoff = last.UnixNano() + 1
+	}
+
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	q := fmt.Sprintf(`delete from %s where time < %d`, quoteIdent(logName), cutoff)
+	influxQ := client.NewQuery(q, i.cfg.Database, "ns")
+	resp, err := i.connection().Query(influxQ)
+	if err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	if err := resp.Error(); err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	return nil
+}
+
+// archiveLog uploads all messages of a log that are older than
+// olderThan to the archive. It returns the timestamp of the newest
+// archived message, or a zero time if there was nothing to archive.
+func (i *InfluxDBDataStore) archiveLog(logName string, olderThan time.Time) (time.Time, error) {
+	export, err := i.archiver.NewExport(logName)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "creating export")
+	}
+	defer export.Close()
+
+	q := fmt.Sprintf(
+		`select time,hostname,severity,facility,message,source_addr from %s where time < %d`,
+		quoteIdent(logName), olderThan.UnixNano())
+	influxQ := client.NewQuery(q, i.cfg.Database, "ns")
+	influxQ.ChunkSize = 20000
+	resp, err := i.connection().QueryAsChunk(influxQ)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "executing query")
+	}
+	defer resp.Close()
+
 	for {
 		r, err := resp.NextResponse()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, errors.Wrap(err, "fetching response")
+			return time.Time{}, errors.Wrap(err, "reading results")
 		}
-		if r.Err != "" {
-			return nil, fmt.Errorf("error executing query: %s", r.Err)
+		if err := r.Error(); err != nil {
+			return time.Time{}, errors.Wrap(err, "reading results")
+		}
+		for _, result := range r.Results {
+			for _, serie := range result.Series {
+				for _, val := range serie.Values {
+					rec, err := valuesToRecord(val)
+					if err != nil {
+						return time.Time{}, errors.Wrap(err, "reading results")
+					}
+					if err := export.Add(rec); err != nil {
+						return time.Time{}, errors.Wrap(err, "exporting results")
+					}
+				}
+			}
+		}
+	}
+
+	if err := export.Upload(); err != nil {
+		return time.Time{}, err
+	}
+	return export.Last(), nil
+}
+
+// valuesToRecord converts a row of time, hostname, severity, facility,
+// message and source address values to an archive record.
+func valuesToRecord(val []interface{}) (archive.Record, error) {
+	if len(val) != 6 {
+		return archive.Record{}, fmt.Errorf("unexpected number of columns: %d", len(val))
+	}
+	stamp, ok := val[0].(json.Number)
+	if !ok {
+		return archive.Record{}, fmt.Errorf("invalid timestamp %v", val[0])
+	}
+	ns, err := stamp.Int64()
+	if err != nil {
+		return archive.Record{}, errors.Wrap(err, "parsing timestamp")
+	}
+	rec := archive.Record{
+		Timestamp: time.Unix(0, ns),
+	}
+	rec.Hostname, _ = val[1].(string)
+	if severity, ok := val[2].(string); ok {
+		level, _ := strconv.Atoi(severity)
+		rec.Severity = logging.Severity(level)
+	}
+	if facility, ok := val[3].(string); ok {
+		code, _ := strconv.Atoi(facility)
+		rec.Facility = logging.Facility(code)
+	}
+	rec.Message, _ = val[4].(string)
+	rec.SourceAddr, _ = val[5].(string)
+	return rec, nil
+}
+
+// HealthCheck pings the InfluxDB server.
+func (i *InfluxDBDataStore) HealthCheck(ctx context.Context) error {
+	timeout := healthCheckTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if _, _, err := i.connection().Ping(timeout); err != nil {
+		return errors.Wrap(err, "pinging influxdb")
+	}
+	return nil
+}
+
+func (i *InfluxDBDataStore) ResultReader(ctx context.Context, p params.QueryParams) common.Reader {
+	return &influxDBReader{
+		ctx:       ctx,
+		datastore: i,
+		params:    p,
+		cursor:    p.Cursor,
+		segments:  i.querySegments(p, time.Now()),
+	}
+}
+
+// querySegment is the part of the requested time range held by a
+// retention policy.
+type querySegment struct {
+	// policy is the retention policy read. If empty, the default one
+	// is read.
+	policy string
+	// from, if set, is the start of the segment, and to, if set, the
+	// end, which is excluded.
+	from time.Time
+	to   time.Time
+}
+
+// querySegments splits the time range of a query between the retention
+// policies holding it, in the order they are read. Messages newer than
+// the hot window are read from the full retention policy, older ones
+// from the downsampled one. Without downsampling, the default retention
+// policy holds everything.
+func (i *InfluxDBDataStore) querySegments(p params.QueryParams, now time.Time) []querySegment {
+	if i.cfg.Downsampling == nil {
+		return []querySegment{{}}
+	}
+	cutoff := now.Add(-i.cfg.GetHotWindow())
+	segments := []querySegment{}
+	if p.StartDate.IsZero() || p.StartDate.Before(cutoff) {
+		segments = append(segments, querySegment{policy: downsampledPolicyName, to: cutoff})
+	}
+	if p.EndDate.IsZero() || !p.EndDate.Before(cutoff) {
+		segments = append(segments, querySegment{policy: retentionPolicyName, from: cutoff})
+	}
+	if p.Order == params.OrderDesc {
+		for left, right := 0, len(segments)-1; left < right; left, right = left+1, right-1 {
+			segments[left], segments[right] = segments[right], segments[left]
+		}
+	}
+	return segments
+}
+
+func (i *InfluxDBDataStore) List() ([]map[string]string, error) {
+	return i.listMeasurements("SHOW MEASUREMENTS")
+}
+
+var _ common.FilteredLister = (*InfluxDBDataStore)(nil)
+var _ common.FieldsSelector = (*InfluxDBDataStore)(nil)
+
+func (i *InfluxDBDataStore) SelectsFields() bool {
+	return true
+}
+
+// ListWithFilter lists the logs matching p. The prefix or pattern is
+// matched by InfluxDB, along with the pagination. SHOW MEASUREMENTS
+// takes a single condition though, so if both are set, only the prefix
+// is matched by InfluxDB, and the rest is done here.
+func (i *InfluxDBDataStore) ListWithFilter(p params.ListParams) ([]map[string]string, error) {
+	pattern := p.Pattern
+	if p.Prefix != "" {
+		if p.Pattern != "" {
+			q := fmt.Sprintf("SHOW MEASUREMENTS WITH MEASUREMENT =~ %s", quoteRegex("^"+regexp.QuoteMeta(p.Prefix)))
+			logs, err := i.listMeasurements(q)
+			if err != nil {
+				return nil, err
+			}
+			return common.FilterLogs(logs, params.ListParams{
+				Pattern: p.Pattern,
+				Limit:   p.Limit,
+				Offset:  p.Offset,
+			})
+		}
+		pattern = "^" + regexp.QuoteMeta(p.Prefix)
+	}
+	if pattern != "" {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, errors.Wrap(err, "compiling pattern")
+		}
+	}
+
+	q := "SHOW MEASUREMENTS"
+	if pattern != "" {
+		q += " WITH MEASUREMENT =~ " + quoteRegex(pattern)
+	}
+	if p.Limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", p.Limit)
+	}
+	if p.Offset > 0 {
+		q += fmt.Sprintf(" OFFSET %d", p.Offset)
+	}
+	return i.listMeasurements(q)
+}
+
+// listMeasurements returns the measurements listed by a SHOW
+// MEASUREMENTS query, as logs.
+func (i *InfluxDBDataStore) listMeasurements(q string) ([]map[string]string, error) {
+	query := client.NewQuery(q, i.cfg.Database, "ns")
+	resp, err := i.connection().QueryAsChunk(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	ret := []map[string]string{}
+	for {
+		r, err := resp.NextResponse()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.Wrap(err, "fetching response")
+		}
+		if r.Err != "" {
+			return nil, fmt.Errorf("error executing query: %s", r.Err)
 		}
 		for _, result := range r.Results {
 			for _, serie := range result.Series {
@@ -255,7 +1139,7 @@ func (i *InfluxDBDataStore) List() ([]map[string]string, error) {
 }
 
 func (i *InfluxDBDataStore) Query(q client.Query) (*client.ChunkedResponse, error) {
-	resp, err := i.con.QueryAsChunk(q)
+	resp, err := i.connection().QueryAsChunk(q)
 	if err != nil {
 		return nil, err
 	}
@@ -263,23 +1147,255 @@ func (i *InfluxDBDataStore) Query(q client.Query) (*client.ChunkedResponse, erro
 }
 
 type influxDBReader struct {
+	ctx       context.Context
 	datastore *InfluxDBDataStore
 	params    params.QueryParams
 
 	result *client.ChunkedResponse
-	done   bool
+	// queryCtx is the context of the query, and cancel stops it,
+	// closing result.
+	queryCtx context.Context
+	cancel   context.CancelFunc
+	done     bool
+	cursor   string
+
+	// after is the cursor reading resumes from, once applied by
+	// applyCursor(). When reading oldest first, lastTime is the time of
+	// the last row returned, and ties the number of rows returned with
+	// that time, including the ones the cursor skipped.
+	after        common.Cursor
+	afterApplied bool
+	lastTime     int64
+	ties         int
+
+	// segments are the parts of the requested time range read from
+	// each retention policy, in the order they are read, and segment
+	// is the index of the one being read. read is the number of rows
+	// returned from it.
+	segments []querySegment
+	segment  int
+	read     int
+
+	// archived reads the part of the requested log that has already
+	// been rotated out to the archive, if any.
+	archived    *archive.Reader
+	archiveDone bool
 }
 
-func (i *influxDBReader) prepareQuery() (string, error) {
-	if i.params.AppName == "" {
-		return "", fmt.Errorf("missing application name")
+// initArchive prepares reading archived messages, if archiving is
+// enabled and the requested time range predates the oldest message
+// still held in InfluxDB.
+func (i *influxDBReader) initArchive() error {
+	i.archiveDone = true
+	if i.datastore.archiver == nil || i.params.AppName == "" {
+		return nil
 	}
-	undefinedDate := time.Time{}
-	q := fmt.Sprintf(`select time,severity,message from "%s"`, i.params.AppName)
-	if !i.params.StartDate.Equal(undefinedDate) || !i.params.EndDate.Equal(undefinedDate) || i.params.Hostname != "" {
-		q += ` where `
+	// The archive can only be read oldest first, from the start of
+	// the requested range.
+	if i.params.Order == params.OrderDesc || i.params.Offset > 0 {
+		return nil
+	}
+	// Archived messages do not hold their structured data.
+	if len(i.params.StructuredData) > 0 {
+		return nil
 	}
 
+	if err := validLogName(i.params.AppName); err != nil {
+		return err
+	}
+	q := fmt.Sprintf(`select first(message) from %s`, quoteIdent(i.params.AppName))
+	resp, err := i.datastore.connection().Query(client.NewQuery(q, i.datastore.cfg.Database, "ns"))
+	if err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	if err := resp.Error(); err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+
+	// A zero value means InfluxDB holds no messages for this log, so
+	// anything we have is in the archive.
+	var oldest time.Time
+	for _, result := range resp.Results {
+		for _, serie := range result.Series {
+			for _, val := range serie.Values {
+				if stamp, ok := val[0].(json.Number); ok {
+					if ns, err := stamp.Int64(); err == nil {
+						oldest = time.Unix(0, ns)
+					}
+				}
+			}
+		}
+	}
+
+	if !oldest.IsZero() {
+		if !i.params.StartDate.IsZero() && !i.params.StartDate.Before(oldest) {
+			return nil
+		}
+		if i.params.Cursor != "" {
+			cursor, err := common.DecodeCursor(i.params.Cursor)
+			if err != nil {
+				return errors.Wrap(err, "parsing cursor")
+			}
+			if cursor.Timestamp >= oldest.UnixNano() {
+				return nil
+			}
+		}
+	}
+	i.archived = i.datastore.archiver.NewReader(i.params, oldest)
+	i.archiveDone = false
+	return nil
+}
+
+// readArchived returns the next chunk of archived messages. Once the
+// archive is exhausted, the reader continues where it left off with
+// messages from InfluxDB.
+func (i *influxDBReader) readArchived() ([]byte, error) {
+	data, err := i.archived.ReadNext()
+	if err == nil {
+		if cursor := i.archived.Cursor(); cursor != "" {
+			i.cursor = cursor
+		}
+		return data, nil
+	}
+	if err != io.EOF {
+		return nil, errors.Wrap(err, "reading archive")
+	}
+
+	if cursor := i.archived.Cursor(); cursor != "" {
+		i.params.Cursor = cursor
+	}
+	if i.params.Limit > 0 {
+		i.params.Limit -= i.archived.Read()
+		if i.params.Limit <= 0 {
+			i.done = true
+		}
+	}
+	i.archived = nil
+	i.archiveDone = true
+	return nil, io.EOF
+}
+
+// fieldAllowed returns true if field may be returned to the user.
+func (i *influxDBReader) fieldAllowed(field string) bool {
+	for _, val := range i.params.AllowedFields {
+		if val == field {
+			return true
+		}
+	}
+	return false
+}
+
+// selectFields returns the columns we query. The message is always
+// selected, as InfluxDB needs at least one field besides the tags, but
+// it is only returned if allowed.
+func (i *influxDBReader) selectFields() string {
+	if len(i.params.AllowedFields) == 0 {
+		return "time,severity,message"
+	}
+	fields := []string{params.FieldTime}
+	for _, tag := range []string{params.FieldHostname, params.FieldSeverity, params.FieldFacility} {
+		if i.fieldAllowed(tag) {
+			fields = append(fields, tag)
+		}
+	}
+	fields = append(fields, params.FieldMessage)
+	if i.datastore.hostnames != nil && i.fieldAllowed(params.FieldHostname) {
+		fields = append(fields, sourceHostnameField)
+	}
+	return strings.Join(fields, ",")
+}
+
+// formatLine returns a result row as a log line. Unless the allowed
+// fields are limited, only the message is returned.
+func (i *influxDBReader) formatLine(columns []string, val []interface{}) []byte {
+	if len(i.params.AllowedFields) == 0 {
+		line, _ := val[2].(string)
+		if i.params.JSON {
+			js, _ := json.Marshal(map[string]string{params.FieldMessage: line})
+			return js
+		}
+		return []byte(line)
+	}
+	values := map[string]string{}
+	for idx, column := range columns {
+		if idx >= len(val) {
+			break
+		}
+		switch v := val[idx].(type) {
+		case json.Number:
+			if ns, err := v.Int64(); err == nil && column == params.FieldTime {
+				values[column] = time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+			}
+		case string:
+			values[column] = v
+		}
+	}
+	// Messages stored with a normalized hostname are returned with
+	// their own.
+	if source := values[sourceHostnameField]; source != "" {
+		values[params.FieldHostname] = source
+	}
+	if i.params.JSON {
+		record := map[string]string{}
+		for _, field := range params.QueryFields {
+			if i.fieldAllowed(field) {
+				record[field] = values[field]
+			}
+		}
+		js, _ := json.Marshal(record)
+		return js
+	}
+	parts := []string{}
+	for _, field := range params.QueryFields {
+		if i.fieldAllowed(field) {
+			parts = append(parts, values[field])
+		}
+	}
+	return []byte(strings.Join(parts, " "))
+}
+
+// structuredDataOptions returns the conditions matching the structured
+// data filters. Only the structured data we store may be filtered on.
+func (i *influxDBReader) structuredDataOptions() ([]string, error) {
+	names := make([]string, 0, len(i.params.StructuredData))
+	for name := range i.params.StructuredData {
+		names = append(names, name)
+	}
+	// Sorted, so identical requests send identical queries.
+	sort.Strings(names)
+
+	options := []string{}
+	for _, name := range names {
+		stored := false
+		for _, sdParam := range i.datastore.cfg.StructuredData {
+			if sdParam.GetName() == name {
+				stored = true
+				break
+			}
+		}
+		if !stored {
+			return nil, fmt.Errorf("structured data %q is not stored", name)
+		}
+		options = append(options, fmt.Sprintf(`%s=%s`, quoteIdent(name), quoteLiteral(i.params.StructuredData[name])))
+	}
+	return options, nil
+}
+
+// source returns the measurement holding the log, qualified with the
+// retention policy of the segment being read, if any.
+func (i *influxDBReader) source() string {
+	measurement := quoteIdent(i.params.AppName)
+	policy := i.segments[i.segment].policy
+	if policy == "" {
+		return measurement
+	}
+	return fmt.Sprintf(`%s.%s.%s`, quoteIdent(i.datastore.cfg.Database), quoteIdent(policy), measurement)
+}
+
+// conditions returns the where clause selecting the requested messages
+// of the segment being read, if any.
+func (i *influxDBReader) conditions() (string, error) {
+	undefinedDate := time.Time{}
 	options := []string{}
 
 	if !i.params.StartDate.Equal(undefinedDate) {
@@ -294,59 +1410,403 @@ func (i *influxDBReader) prepareQuery() (string, error) {
 			fmt.Sprintf(`time <= %d`, i.params.EndDate.UnixNano()))
 
 	}
+	segment := i.segments[i.segment]
+	if !segment.from.IsZero() {
+		options = append(options, fmt.Sprintf(`time >= %d`, segment.from.UnixNano()))
+	}
+	if !segment.to.IsZero() {
+		options = append(options, fmt.Sprintf(`time < %d`, segment.to.UnixNano()))
+	}
 	if i.params.Hostname != "" {
-		options = append(options, fmt.Sprintf(`hostname='%s'`, i.params.Hostname))
+		hostname := quoteLiteral(i.params.Hostname)
+		if i.datastore.hostnames != nil {
+			options = append(options, fmt.Sprintf(`(hostname=%s or %s=%s)`, hostname, sourceHostnameField, hostname))
+		} else {
+			options = append(options, fmt.Sprintf(`hostname=%s`, hostname))
+		}
+	}
+	if i.params.SourceAddr != "" {
+		options = append(options, fmt.Sprintf(`%s=%s`, sourceAddrTag, quoteLiteral(i.params.SourceAddr)))
+	}
+	if i.params.MsgID != "" {
+		options = append(options, fmt.Sprintf(`%s=%s`, msgIDTag, quoteLiteral(i.params.MsgID)))
+	}
+	if i.params.Severity != nil {
+		// severity is stored as a tag, and InfluxQL does not allow
+		// range comparisons on tags. Severity levels are single digits,
+		// so we match them with a character class instead.
+		options = append(options, fmt.Sprintf(`severity =~ /^[0-%d]$/`, *i.params.Severity))
+	}
+	if i.params.Facility != nil {
+		options = append(options, fmt.Sprintf(`facility='%s'`, i.params.Facility.String()))
+	}
+	if i.params.ClusterID != "" {
+		options = append(options, fmt.Sprintf(`cluster=%s`, quoteLiteral(i.params.ClusterID)))
+	}
+	sdOptions, err := i.structuredDataOptions()
+	if err != nil {
+		return "", err
+	}
+	options = append(options, sdOptions...)
+	if i.params.Cursor != "" {
+		cursor, err := common.DecodeCursor(i.params.Cursor)
+		if err != nil {
+			return "", errors.Wrap(err, "parsing cursor")
+		}
+		if cursor.Skip > 0 {
+			// The rows with the time of the cursor are read again,
+			// and the ones already returned skipped.
+			options = append(options, fmt.Sprintf(`time >= %d`, cursor.Timestamp))
+		} else {
+			options = append(options, fmt.Sprintf(`time > %d`, cursor.Timestamp))
+		}
 	}
 
-	if len(options) > 0 {
-		q += strings.Join(options, ` and `)
+	if len(options) == 0 {
+		return "", nil
+	}
+	return ` where ` + strings.Join(options, ` and `), nil
+}
+
+func (i *influxDBReader) prepareQuery() (string, error) {
+	if err := validLogName(i.params.AppName); err != nil {
+		return "", err
+	}
+	conditions, err := i.conditions()
+	if err != nil {
+		return "", err
+	}
+	q := fmt.Sprintf(`select %s from %s%s`, i.selectFields(), i.source(), conditions)
+	limit := i.params.Limit
+	if i.params.Order == params.OrderDesc {
+		q += ` order by time desc`
+		if limit > 0 {
+			// Rows the cursor skips are only dropped once read.
+			limit += i.after.Skip
+		}
+	}
+	if limit > 0 {
+		q += fmt.Sprintf(` limit %d`, limit)
+	}
+	if i.params.Offset > 0 {
+		q += fmt.Sprintf(` offset %d`, i.params.Offset)
 	}
 
 	return q, nil
 }
 
+// countSkipped returns the number of messages of the segment being read
+// the offset skipped, when none were returned from it.
+func (i *influxDBReader) countSkipped() (int, error) {
+	conditions, err := i.conditions()
+	if err != nil {
+		return 0, err
+	}
+	q := fmt.Sprintf(`select count(message) from %s%s`, i.source(), conditions)
+	resp, err := i.datastore.connection().Query(client.NewQuery(q, i.datastore.cfg.Database, "ns"))
+	if err != nil {
+		return 0, errors.Wrap(err, "executing query")
+	}
+	if err := resp.Error(); err != nil {
+		return 0, errors.Wrap(err, "executing query")
+	}
+	for _, result := range resp.Results {
+		for _, serie := range result.Series {
+			for _, val := range serie.Values {
+				if count, ok := val[1].(json.Number); ok {
+					if n, err := count.Int64(); err == nil {
+						return int(n), nil
+					}
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// nextSegment moves on to the next segment once one is exhausted, with
+// what is left of the limit and offset. It returns false if there is
+// nothing left to read.
+func (i *influxDBReader) nextSegment() (bool, error) {
+	if i.segment+1 >= len(i.segments) {
+		return false, nil
+	}
+	if i.params.Limit > 0 {
+		i.params.Limit -= i.read
+		if i.params.Limit <= 0 {
+			return false, nil
+		}
+	}
+	if i.params.Offset > 0 {
+		if i.read > 0 {
+			// Rows are only returned once the offset is consumed.
+			i.params.Offset = 0
+		} else {
+			skipped, err := i.countSkipped()
+			if err != nil {
+				return false, errors.Wrap(err, "counting skipped messages")
+			}
+			i.params.Offset -= skipped
+			if i.params.Offset < 0 {
+				i.params.Offset = 0
+			}
+		}
+	}
+	i.segment++
+	i.read = 0
+	return true, nil
+}
+
+// applyCursor prepares resuming from the cursor, before the first
+// query. The rows with the time of the cursor that were already
+// returned are skipped by the offset when reading oldest first, and
+// dropped by readDescending() otherwise.
+func (i *influxDBReader) applyCursor() error {
+	i.afterApplied = true
+	if i.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(i.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	i.after = cursor
+	i.lastTime = cursor.Timestamp
+	i.ties = cursor.Skip
+	if i.params.Order != params.OrderDesc {
+		i.params.Offset += cursor.Skip
+	}
+	return nil
+}
+
+// startQuery queries the segment being read.
+func (i *influxDBReader) startQuery() error {
+	i.datastore.flush()
+	query, err := i.prepareQuery()
+	if err != nil {
+		return errors.Wrap(err, "preparing query")
+	}
+	if err := i.query(query); err != nil {
+		return errors.Wrap(err, "executing query")
+	}
+	return nil
+}
+
 var _ common.Reader = (*influxDBReader)(nil)
 
 func (i *influxDBReader) ReadNext() ([]byte, error) {
+	if !i.archiveDone {
+		if i.archived == nil {
+			if err := i.initArchive(); err != nil {
+				return nil, errors.Wrap(err, "preparing archive reader")
+			}
+		}
+		if i.archived != nil {
+			data, err := i.readArchived()
+			if err != io.EOF {
+				return data, err
+			}
+		}
+	}
+	if i.done || len(i.segments) == 0 {
+		return nil, io.EOF
+	}
+
 	if i.result == nil {
-		i.datastore.flush()
-		query, err := i.prepareQuery()
-		if err != nil {
-			return nil, errors.Wrap(err, "preparing query")
+		if !i.afterApplied {
+			if err := i.applyCursor(); err != nil {
+				return nil, err
+			}
 		}
-		influxQ := client.NewQuery(query, i.datastore.cfg.Database, "ns")
-		influxQ.ChunkSize = 20000
-		resp, err := i.datastore.con.QueryAsChunk(influxQ)
-		if err != nil {
-			return nil, errors.Wrap(err, "executing query")
+		if err := i.startQuery(); err != nil {
+			return nil, err
 		}
-		i.result = resp
+	}
+
+	if i.params.Order == params.OrderDesc {
+		return i.readDescending()
 	}
 
 	res, err := i.result.NextResponse()
 	if err != nil {
+		i.cancel()
 		if err == io.EOF {
-			return nil, err
+			// Segments are read in time order, so the next one
+			// continues where this one ended.
+			more, segmentErr := i.nextSegment()
+			if segmentErr != nil {
+				return nil, segmentErr
+			}
+			if !more {
+				i.done = true
+				return nil, err
+			}
+			i.result = nil
+			return i.ReadNext()
+		}
+		if ctxErr := i.queryCtx.Err(); ctxErr != nil {
+			return nil, errors.Wrap(ctxErr, "reading results")
 		}
 		return nil, errors.Wrap(err, "reading results")
 	}
-	newline := []byte("\n")
 	buf := bytes.NewBuffer([]byte{})
+	for _, r := range i.lines(res) {
+		i.advance(r.time)
+		if _, err := buf.Write(r.line); err != nil {
+			return nil, errors.Wrap(err, "reading value")
+		}
+	}
+	contents := buf.Bytes()
+	buf.Reset()
+	return contents, nil
+}
+
+// chunkQuerier is implemented by clients whose chunked queries can be
+// cancelled.
+type chunkQuerier interface {
+	QueryAsChunkContext(ctx context.Context, q client.Query) (*client.ChunkedResponse, error)
+}
+
+// query runs the query of the reader. The query is stopped, and its
+// response closed, once the reader context is done, the query
+// timeout expires, or all results were read.
+func (i *influxDBReader) query(query string) error {
+	influxQ := client.NewQuery(query, i.datastore.cfg.Database, "ns")
+	influxQ.ChunkSize = i.datastore.cfg.GetQueryChunkSize()
+
+	ctx := i.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, i.datastore.cfg.GetQueryTimeout())
+	con := i.datastore.connection()
+	var resp *client.ChunkedResponse
+	var err error
+	if querier, ok := con.(chunkQuerier); ok {
+		resp, err = querier.QueryAsChunkContext(queryCtx, influxQ)
+	} else {
+		resp, err = con.QueryAsChunk(influxQ)
+	}
+	if err != nil {
+		cancel()
+		if ctxErr := queryCtx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	go func() {
+		<-queryCtx.Done()
+		resp.Close()
+	}()
+	i.result = resp
+	i.queryCtx = queryCtx
+	i.cancel = cancel
+	return nil
+}
+
+// row is a result row, as a log line.
+type row struct {
+	time int64
+	line []byte
+}
+
+// lines returns the rows of a response as log lines.
+func (i *influxDBReader) lines(res *client.Response) []row {
+	ret := []row{}
 	for _, result := range res.Results {
 		for _, serie := range result.Series {
 			for _, val := range serie.Values {
-				line := []byte(val[2].(string))
-				if len(line) > 0 && line[len(line)-1] != newline[0] {
-					line = append(line, []byte("\n")...)
+				var ns int64
+				if stamp, ok := val[0].(json.Number); ok {
+					ns, _ = stamp.Int64()
 				}
-				_, err := buf.Write(line)
-				if err != nil {
-					return nil, errors.Wrap(err, "reading value")
+				i.read++
+				line := i.formatLine(serie.Columns, val)
+				if len(line) > 0 && line[len(line)-1] != '\n' {
+					line = append(line, '\n')
 				}
+				ret = append(ret, row{time: ns, line: line})
 			}
 		}
 	}
-	contents := buf.Bytes()
-	buf.Reset()
-	return contents, nil
+	return ret
+}
+
+// advance moves the cursor to a row returned, with the given time.
+// Rows with the same time are told apart by the number of them that
+// were returned.
+func (i *influxDBReader) advance(ns int64) {
+	if ns == i.lastTime {
+		i.ties++
+	} else {
+		i.lastTime = ns
+		i.ties = 1
+	}
+	i.cursor = common.EncodeCursor(common.Cursor{Timestamp: ns, Skip: i.ties})
+}
+
+// readDescending reads all the selected rows, newest first, and
+// returns them in a single chunk, oldest first. The number of rows
+// is bounded by the limit, which downloads always set.
+func (i *influxDBReader) readDescending() ([]byte, error) {
+	i.done = true
+	// nextSegment() takes the rows read off the limit.
+	limit := i.params.Limit
+	rows := []row{}
+	for {
+		res, err := i.result.NextResponse()
+		if err != nil {
+			if err == io.EOF {
+				// Segments are read newest first as well.
+				i.cancel()
+				more, segmentErr := i.nextSegment()
+				if segmentErr != nil {
+					return nil, segmentErr
+				}
+				if !more {
+					break
+				}
+				if err := i.startQuery(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			i.cancel()
+			if ctxErr := i.queryCtx.Err(); ctxErr != nil {
+				return nil, errors.Wrap(ctxErr, "reading results")
+			}
+			return nil, errors.Wrap(err, "reading results")
+		}
+		rows = append(rows, i.lines(res)...)
+	}
+	i.cancel()
+	for left, right := 0, len(rows)-1; left < right; left, right = left+1, right-1 {
+		rows[left], rows[right] = rows[right], rows[left]
+	}
+	// The rows with the time of the cursor already returned come
+	// first. More rows were read to make up for them, so only the
+	// newest ones are kept.
+	skip := 0
+	for skip < len(rows) && skip < i.after.Skip && rows[skip].time == i.after.Timestamp {
+		skip++
+	}
+	rows = rows[skip:]
+	if limit > 0 && len(rows) > limit {
+		rows = rows[len(rows)-limit:]
+	}
+	if len(rows) == 0 {
+		return nil, io.EOF
+	}
+	// The newest rows are read, so none with the time of the last one
+	// is left behind.
+	i.cursor = common.EncodeCursor(common.Cursor{Timestamp: rows[len(rows)-1].time})
+	buf := bytes.NewBuffer([]byte{})
+	for _, r := range rows {
+		buf.Write(r.line)
+	}
+	return buf.Bytes(), nil
+}
+
+func (i *influxDBReader) Cursor() string {
+	return i.cursor
 }
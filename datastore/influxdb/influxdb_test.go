@@ -0,0 +1,947 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// newTestDatastore returns a datastore writing to fake, which is not
+// started, so points are only written when flushed.
+func newTestDatastore(t *testing.T, fake *fakeInfluxDB) *InfluxDBDataStore {
+	return newTestDatastoreContext(context.Background(), t, fake)
+}
+
+func newTestDatastoreContext(ctx context.Context, t *testing.T, fake *fakeInfluxDB) *InfluxDBDataStore {
+	t.Helper()
+	store, err := NewInfluxDBDatastore(ctx, &config.InfluxDB{
+		URL:          config.InfluxURL(fake.URL),
+		Database:     "logs",
+		SkipDBCreate: true,
+	}, "")
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	return store.(*InfluxDBDataStore)
+}
+
+// readAll reads all the messages selected by p, along with the cursor
+// returned once done.
+func readAll(t *testing.T, store *InfluxDBDataStore, p params.QueryParams) ([]string, string) {
+	t.Helper()
+	reader := store.ResultReader(context.Background(), p)
+	var data []byte
+	for {
+		chunk, err := reader.ReadNext()
+		data = append(data, chunk...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read messages: %v", err)
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	return lines, reader.Cursor()
+}
+
+func testMessage(ts time.Time, message string) logging.LogMessage {
+	return logging.LogMessage{
+		Timestamp: ts,
+		Hostname:  "coriolis",
+		Facility:  logging.UserLevelMessages,
+		Severity:  logging.Informational,
+		AppName:   "coriolis-worker",
+		Message:   message,
+		RFC:       logging.RFC3164,
+	}
+}
+
+func TestWriteSameSecondMessages(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	// RFC3164 timestamps only have second precision.
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	for _, message := range []string{"first", "second", "third"} {
+		if err := store.Write(testMessage(ts, message)); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if count := fake.count("coriolis-worker"); count != 3 {
+		t.Fatalf("expected 3 points, got %d", count)
+	}
+
+	lines, _ := readAll(t, store, params.QueryParams{AppName: "coriolis-worker"})
+	expected := []string{"first", "second", "third"}
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestWriteKeepsSubSecondTimestamps(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 123456000, time.UTC)
+	if err := store.Write(testMessage(ts, "precise")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	fake.mut.Lock()
+	defer fake.mut.Unlock()
+	for _, pt := range fake.points["coriolis-worker"] {
+		if pt.time != ts.UnixNano() {
+			t.Fatalf("expected point at %d, got %d", ts.UnixNano(), pt.time)
+		}
+	}
+}
+
+func TestWriteSameSubSecondMessages(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 123456000, time.UTC)
+	for _, message := range []string{"first", "second"} {
+		logMsg := testMessage(ts, message)
+		logMsg.RFC = logging.RFC5424
+		if err := store.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if count := fake.count("coriolis-worker"); count != 2 {
+		t.Fatalf("expected 2 points, got %d", count)
+	}
+	lines, _ := readAll(t, store, params.QueryParams{AppName: "coriolis-worker"})
+	if strings.Join(lines, "|") != "first|second" {
+		t.Fatalf("expected both messages, got %q", lines)
+	}
+}
+
+// writeTiedMessages writes messages from several hosts at the same
+// precise time, which InfluxDB keeps as points with the same time in
+// different series, between two messages at other times.
+func writeTiedMessages(t *testing.T, store *InfluxDBDataStore) time.Time {
+	t.Helper()
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 123456000, time.UTC)
+	messages := []logging.LogMessage{testMessage(ts.Add(-time.Second), "before")}
+	for _, host := range []string{"host-a", "host-b", "host-c", "host-d"} {
+		logMsg := testMessage(ts, host)
+		logMsg.Hostname = host
+		messages = append(messages, logMsg)
+	}
+	messages = append(messages, testMessage(ts.Add(time.Second), "after"))
+	for _, logMsg := range messages {
+		if err := store.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	return ts
+}
+
+// readPages reads the messages selected by p a page at a time, resuming
+// from the cursor of the previous page.
+func readPages(t *testing.T, store *InfluxDBDataStore, p params.QueryParams) [][]string {
+	t.Helper()
+	pages := [][]string{}
+	for len(pages) < 10 {
+		lines, cursor := readAll(t, store, p)
+		if len(lines) == 0 {
+			return pages
+		}
+		pages = append(pages, lines)
+		p.Cursor = cursor
+	}
+	t.Fatalf("expected reading to end, got %q", pages)
+	return nil
+}
+
+func TestCursorTiedTimestamps(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+	writeTiedMessages(t, store)
+
+	tests := []struct {
+		limit    int
+		expected string
+	}{
+		{1, "[[before] [host-a] [host-b] [host-c] [host-d] [after]]"},
+		{2, "[[before host-a] [host-b host-c] [host-d after]]"},
+		{3, "[[before host-a host-b] [host-c host-d after]]"},
+	}
+	for _, tt := range tests {
+		pages := readPages(t, store, params.QueryParams{
+			AppName: "coriolis-worker",
+			Limit:   tt.limit,
+		})
+		if got := fmt.Sprint(pages); got != tt.expected {
+			t.Errorf("limit %d: expected %s, got %s", tt.limit, tt.expected, got)
+		}
+	}
+}
+
+func TestCursorTiedTimestampsDescending(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+	ts := writeTiedMessages(t, store)
+
+	// Resuming newest first from a cursor set while reading oldest
+	// first drops the messages already returned.
+	cursor := common.EncodeCursor(common.Cursor{Timestamp: ts.UnixNano(), Skip: 2})
+	tests := []struct {
+		limit    int
+		expected string
+	}{
+		{1, "after"},
+		{2, "host-d|after"},
+		{5, "host-c|host-d|after"},
+		{0, "host-c|host-d|after"},
+	}
+	for _, tt := range tests {
+		lines, next := readAll(t, store, params.QueryParams{
+			AppName: "coriolis-worker",
+			Order:   params.OrderDesc,
+			Limit:   tt.limit,
+			Cursor:  cursor,
+		})
+		if got := strings.Join(lines, "|"); got != tt.expected {
+			t.Errorf("limit %d: expected %q, got %q", tt.limit, tt.expected, got)
+		}
+		lines, _ = readAll(t, store, params.QueryParams{AppName: "coriolis-worker", Cursor: next})
+		if len(lines) != 0 {
+			t.Errorf("limit %d: expected no messages after the newest, got %q", tt.limit, lines)
+		}
+	}
+
+	// Resuming from the cursor of the newest messages only returns
+	// those written since.
+	lines, next := readAll(t, store, params.QueryParams{
+		AppName: "coriolis-worker",
+		Order:   params.OrderDesc,
+		Limit:   2,
+		Cursor:  common.EncodeCursor(common.Cursor{Timestamp: ts.Add(-time.Second).UnixNano()}),
+	})
+	if strings.Join(lines, "|") != "host-d|after" {
+		t.Fatalf("expected the newest messages, got %q", lines)
+	}
+	if err := store.Write(testMessage(ts.Add(2*time.Second), "latest")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	lines, _ = readAll(t, store, params.QueryParams{
+		AppName: "coriolis-worker",
+		Order:   params.OrderDesc,
+		Limit:   2,
+		Cursor:  next,
+	})
+	if strings.Join(lines, "|") != "latest" {
+		t.Fatalf("expected the message written since, got %q", lines)
+	}
+}
+
+func TestCursorWithoutSkip(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+	ts := writeTiedMessages(t, store)
+
+	// Cursors without a tiebreaker resume after all the messages with
+	// their time, as they did before.
+	cursor := common.EncodeCursor(common.Cursor{Timestamp: ts.UnixNano()})
+	lines, _ := readAll(t, store, params.QueryParams{
+		AppName: "coriolis-worker",
+		Cursor:  cursor,
+	})
+	if strings.Join(lines, "|") != "after" {
+		t.Fatalf("expected the message after the cursor, got %q", lines)
+	}
+}
+
+func TestPrepareQueryCursor(t *testing.T) {
+	tests := []struct {
+		cursor   common.Cursor
+		order    string
+		expected string
+	}{
+		{
+			common.Cursor{Timestamp: 42},
+			params.OrderAsc,
+			`select time,severity,message from "coriolis-worker" where time > 42 limit 2`,
+		},
+		{
+			common.Cursor{Timestamp: 42, Skip: 3},
+			params.OrderAsc,
+			`select time,severity,message from "coriolis-worker" where time >= 42 limit 2 offset 3`,
+		},
+		{
+			common.Cursor{Timestamp: 42, Skip: 3},
+			params.OrderDesc,
+			`select time,severity,message from "coriolis-worker" where time >= 42 order by time desc limit 5`,
+		},
+	}
+	for _, tt := range tests {
+		store := &InfluxDBDataStore{cfg: &config.InfluxDB{}}
+		reader := store.ResultReader(context.Background(), params.QueryParams{
+			AppName: "coriolis-worker",
+			Cursor:  common.EncodeCursor(tt.cursor),
+			Order:   tt.order,
+			Limit:   2,
+		}).(*influxDBReader)
+		if err := reader.applyCursor(); err != nil {
+			t.Fatalf("failed to apply cursor: %v", err)
+		}
+		q, err := reader.prepareQuery()
+		if err != nil {
+			t.Fatalf("failed to prepare query: %v", err)
+		}
+		if q != tt.expected {
+			t.Errorf("expected query %q, got %q", tt.expected, q)
+		}
+	}
+}
+
+func TestCanceledDatastoreFlushesPendingPoints(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	store := newTestDatastoreContext(ctx, t, fake)
+	if err := store.Start(); err != nil {
+		t.Fatalf("failed to start datastore: %v", err)
+	}
+
+	// Rotating the logs on start flushes them as well.
+	if !fake.waitForQuery("SHOW MEASUREMENTS", 5*time.Second) {
+		t.Fatalf("logs were not rotated on start")
+	}
+	// Messages written right before shutdown, such as the ones the
+	// syslog worker drains, are flushed before the datastore stops.
+	if err := store.Write(testMessage(time.Now(), "last words")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	cancel()
+	store.Wait()
+	if count := fake.count("coriolis-worker"); count != 1 {
+		t.Fatalf("expected 1 point, got %d", count)
+	}
+}
+
+func TestRotateDeletesOlderMessages(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	now := time.Now()
+	if err := store.Write(testMessage(now.Add(-time.Hour), "old")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.Write(testMessage(now.Add(time.Hour), "new")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	// Pending points are written before rotating.
+	if err := store.Rotate(now); err != nil {
+		t.Fatalf("failed to rotate logs: %v", err)
+	}
+	lines, _ := readAll(t, store, params.QueryParams{AppName: "coriolis-worker"})
+	if strings.Join(lines, "|") != "new" {
+		t.Fatalf("expected only the new message to be kept, got %q", lines)
+	}
+
+	if err := store.Rotate(now.Add(2 * time.Hour)); err != nil {
+		t.Fatalf("failed to rotate logs: %v", err)
+	}
+	lines, _ = readAll(t, store, params.QueryParams{AppName: "coriolis-worker"})
+	if len(lines) != 0 {
+		t.Fatalf("expected all messages to be deleted, got %q", lines)
+	}
+}
+
+func TestDeleteDropsMeasurement(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	for _, logMsg := range []logging.LogMessage{testMessage(time.Now(), "worker"), testMessage(time.Now(), "api")} {
+		if logMsg.Message == "api" {
+			logMsg.AppName = "coriolis-api"
+		}
+		if err := store.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	// Pending points are written before deleting.
+	if err := store.Delete("coriolis-worker", time.Time{}); err != nil {
+		t.Fatalf("failed to delete log: %v", err)
+	}
+	if !fake.received(`drop measurement "coriolis-worker"`) {
+		t.Fatalf("expected the measurement to be dropped, got queries %q", fake.queries)
+	}
+	if count := fake.count("coriolis-worker"); count != 0 {
+		t.Fatalf("expected the log to be deleted, got %d points", count)
+	}
+	if count := fake.count("coriolis-api"); count != 1 {
+		t.Fatalf("expected other logs to be kept, got %d points", count)
+	}
+}
+
+func TestDeleteOlderMessages(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	now := time.Now()
+	if err := store.Write(testMessage(now.Add(-time.Hour), "old")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.Write(testMessage(now.Add(time.Hour), "new")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.Delete("coriolis-worker", now); err != nil {
+		t.Fatalf("failed to delete messages: %v", err)
+	}
+	expected := fmt.Sprintf(`delete from "coriolis-worker" where time < %d`, now.UnixNano())
+	if !fake.received(expected) {
+		t.Fatalf("expected query %q, got queries %q", expected, fake.queries)
+	}
+	lines, _ := readAll(t, store, params.QueryParams{AppName: "coriolis-worker"})
+	if strings.Join(lines, "|") != "new" {
+		t.Fatalf("expected only the new message to be kept, got %q", lines)
+	}
+}
+
+func TestDeleteUnknownLog(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	if err := store.Delete("coriolis-worker", time.Time{}); err != common.LogNotFoundErr {
+		t.Fatalf("expected %v, got %v", common.LogNotFoundErr, err)
+	}
+	for _, q := range fake.queries {
+		if strings.HasPrefix(q, "drop") || strings.HasPrefix(q, "delete") {
+			t.Fatalf("unexpected query %q", q)
+		}
+	}
+}
+
+func TestStructuredData(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store, err := NewInfluxDBDatastore(context.Background(), &config.InfluxDB{
+		URL:          config.InfluxURL(fake.URL),
+		Database:     "logs",
+		SkipDBCreate: true,
+		StructuredData: []config.StructuredDataParam{
+			{SDID: "coriolis@32473", Param: "task_id"},
+			{SDID: "coriolis@32473", Param: "user", Name: "username", Tag: true},
+		},
+	}, "")
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	influx := store.(*InfluxDBDataStore)
+
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 1000, time.UTC)
+	for idx, taskID := range []string{`abc"123`, `it's \ done`, ""} {
+		logMsg := testMessage(ts.Add(time.Duration(idx)*time.Second), fmt.Sprintf("message %d", idx))
+		if taskID != "" {
+			logMsg.StructuredData = map[string]map[string]string{
+				"coriolis@32473": {"task_id": taskID, "user": "admin"},
+				"other":          {"task_id": "ignored"},
+			}
+		}
+		if err := influx.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if err := influx.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	// Only the configured parameters are stored, as fields or tags.
+	fake.mut.Lock()
+	for _, pt := range fake.points["coriolis-worker"] {
+		_, hasTaskID := pt.values["task_id"]
+		_, hasUser := pt.values["username"]
+		if pt.values["message"] == "message 2" {
+			if hasTaskID || hasUser {
+				t.Errorf("unexpected structured data in %v", pt.values)
+			}
+			continue
+		}
+		if !hasTaskID || !hasUser {
+			t.Errorf("missing structured data in %v", pt.values)
+		}
+		if !strings.Contains(pt.series, "username=admin") {
+			t.Errorf("expected username to be a tag of series %q", pt.series)
+		}
+	}
+	fake.mut.Unlock()
+
+	for taskID, expected := range map[string]string{`abc"123`: "message 0", `it's \ done`: "message 1", "ignored": ""} {
+		lines, _ := readAll(t, influx, params.QueryParams{
+			AppName:        "coriolis-worker",
+			StructuredData: map[string]string{"task_id": taskID},
+		})
+		if strings.Join(lines, "|") != expected {
+			t.Errorf("task_id %q: expected %q, got %q", taskID, expected, lines)
+		}
+	}
+	lines, _ := readAll(t, influx, params.QueryParams{
+		AppName:        "coriolis-worker",
+		StructuredData: map[string]string{"username": "admin"},
+	})
+	if strings.Join(lines, "|") != "message 0|message 1" {
+		t.Errorf("expected the messages of admin, got %q", lines)
+	}
+
+	// Parameters which are not stored can not be filtered on.
+	reader := influx.ResultReader(context.Background(), params.QueryParams{
+		AppName:        "coriolis-worker",
+		StructuredData: map[string]string{"other": "value"},
+	})
+	if _, err := reader.ReadNext(); err == nil || err == io.EOF {
+		t.Errorf("expected filtering on structured data which is not stored to fail, got %v", err)
+	}
+}
+
+func TestDownsamplingKeepsAllWarnings(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	fake.defaultPolicy = retentionPolicyName
+	ds, err := NewInfluxDBDatastore(context.Background(), &config.InfluxDB{
+		URL:               config.InfluxURL(fake.URL),
+		Database:          "logs",
+		SkipDBCreate:      true,
+		RetentionDuration: "1h",
+		Downsampling:      &config.Downsampling{Duration: "26w"},
+	}, "")
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	store := ds.(*InfluxDBDataStore)
+
+	// Messages of the same series within the same second, older than
+	// the hot window, so they are read from the downsampled policy.
+	ts := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	severities := []logging.Severity{logging.Error, logging.Informational, logging.Warning, logging.Debug, logging.Warning}
+	for idx, severity := range severities {
+		logMsg := testMessage(ts.Add(time.Duration(idx+1)*time.Millisecond), fmt.Sprintf("message %d", idx))
+		logMsg.Severity = severity
+		if err := store.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	fake.mut.Lock()
+	kept := map[int64]bool{}
+	for _, pt := range fake.points["coriolis-worker"] {
+		if pt.policy == downsampledPolicyName {
+			kept[pt.time] = true
+		}
+	}
+	fake.mut.Unlock()
+	for idx, severity := range severities {
+		at := ts.Add(time.Duration(idx+1) * time.Millisecond).UnixNano()
+		if kept[at] != (severity <= logging.Warning) {
+			t.Errorf("message %d with severity %d: expected kept to be %v at its own time", idx, severity, severity <= logging.Warning)
+		}
+	}
+	if count := fake.count("coriolis-worker"); count != len(severities)+3 {
+		t.Fatalf("expected %d points, got %d", len(severities)+3, count)
+	}
+
+	lines, _ := readAll(t, store, params.QueryParams{AppName: "coriolis-worker", StartDate: ts})
+	if strings.Join(lines, "|") != "message 0|message 2|message 4" {
+		t.Fatalf("expected all the warnings and errors, got %q", lines)
+	}
+}
+
+func TestRotateFailure(t *testing.T) {
+	fake := newFakeInfluxDB()
+	store := newTestDatastore(t, fake)
+	if err := store.Write(testMessage(time.Now(), "message")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	fake.Close()
+	if err := store.Rotate(time.Now()); err == nil {
+		t.Fatalf("expected rotating logs to fail once InfluxDB is unreachable")
+	}
+}
+
+// testQuery returns the query the reader of p sends to InfluxDB.
+func testQuery(t *testing.T, p params.QueryParams) string {
+	t.Helper()
+	store := &InfluxDBDataStore{cfg: &config.InfluxDB{}}
+	reader := store.ResultReader(context.Background(), p).(*influxDBReader)
+	q, err := reader.prepareQuery()
+	if err != nil {
+		t.Fatalf("failed to prepare query: %v", err)
+	}
+	return q
+}
+
+func TestPrepareQuerySeverity(t *testing.T) {
+	tests := []struct {
+		severity *logging.Severity
+		expected string
+	}{
+		{nil, `select time,severity,message from "coriolis-worker"`},
+		{severityPtr(logging.Emergency), `select time,severity,message from "coriolis-worker" where severity =~ /^[0-0]$/`},
+		{severityPtr(logging.Error), `select time,severity,message from "coriolis-worker" where severity =~ /^[0-3]$/`},
+		{severityPtr(logging.Debug), `select time,severity,message from "coriolis-worker" where severity =~ /^[0-7]$/`},
+	}
+	for _, tt := range tests {
+		q := testQuery(t, params.QueryParams{AppName: "coriolis-worker", Severity: tt.severity})
+		if q != tt.expected {
+			t.Errorf("expected query %q, got %q", tt.expected, q)
+		}
+	}
+}
+
+func TestReadSeverity(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	ts := time.Now()
+	for idx, severity := range []logging.Severity{logging.Error, logging.Warning, logging.Debug} {
+		logMsg := testMessage(ts.Add(time.Duration(idx)*time.Second), severity.String())
+		logMsg.Severity = severity
+		if err := store.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	lines, _ := readAll(t, store, params.QueryParams{
+		AppName:  "coriolis-worker",
+		Severity: severityPtr(logging.Warning),
+	})
+	if strings.Join(lines, "|") != "3|4" {
+		t.Fatalf("expected the error and warning messages, got %q", lines)
+	}
+}
+
+func severityPtr(severity logging.Severity) *logging.Severity {
+	return &severity
+}
+
+func TestPrepareQueryFacility(t *testing.T) {
+	tests := []struct {
+		facility *logging.Facility
+		expected string
+	}{
+		{nil, `select time,severity,message from "coriolis-worker"`},
+		{facilityPtr(logging.KernelMessages), `select time,severity,message from "coriolis-worker" where facility='0'`},
+		{facilityPtr(logging.LocalUse0), `select time,severity,message from "coriolis-worker" where facility='16'`},
+	}
+	for _, tt := range tests {
+		q := testQuery(t, params.QueryParams{AppName: "coriolis-worker", Facility: tt.facility})
+		if q != tt.expected {
+			t.Errorf("expected query %q, got %q", tt.expected, q)
+		}
+	}
+
+	// Facilities are combined with the other filters.
+	q := testQuery(t, params.QueryParams{
+		AppName:  "coriolis-worker",
+		Severity: severityPtr(logging.Error),
+		Facility: facilityPtr(logging.LocalUse0),
+	})
+	expected := `select time,severity,message from "coriolis-worker" where severity =~ /^[0-3]$/ and facility='16'`
+	if q != expected {
+		t.Errorf("expected query %q, got %q", expected, q)
+	}
+}
+
+func TestReadFacility(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	ts := time.Now()
+	for idx, facility := range []logging.Facility{logging.UserLevelMessages, logging.LocalUse0, logging.LocalUse1} {
+		logMsg := testMessage(ts.Add(time.Duration(idx)*time.Second), facility.String())
+		logMsg.Facility = facility
+		if err := store.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	lines, _ := readAll(t, store, params.QueryParams{
+		AppName:  "coriolis-worker",
+		Facility: facilityPtr(logging.LocalUse0),
+	})
+	if strings.Join(lines, "|") != "16" {
+		t.Fatalf("expected the local0 message, got %q", lines)
+	}
+}
+
+func facilityPtr(facility logging.Facility) *logging.Facility {
+	return &facility
+}
+
+func TestReadJSON(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 1000, time.UTC)
+	logMsg := testMessage(ts, "Traceback:\n  File \"worker.py\", line 42")
+	logMsg.Hostname = "coriolis worker"
+	if err := store.Write(logMsg); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.Write(testMessage(ts.Add(time.Second), "done")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	lines, _ := readAll(t, store, params.QueryParams{
+		AppName:       "coriolis-worker",
+		AllowedFields: []string{params.FieldTime, params.FieldHostname, params.FieldMessage},
+		JSON:          true,
+	})
+	if len(lines) != 2 {
+		t.Fatalf("expected a line for each message, got %q", lines)
+	}
+	var record map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("failed to decode %q: %v", lines[0], err)
+	}
+	expected := map[string]string{
+		params.FieldTime:     ts.Format(time.RFC3339Nano),
+		params.FieldHostname: "coriolis worker",
+		params.FieldMessage:  logMsg.Message,
+	}
+	if fmt.Sprint(record) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, record)
+	}
+
+	// Only the message is returned unless fields are selected.
+	lines, _ = readAll(t, store, params.QueryParams{AppName: "coriolis-worker", JSON: true})
+	if len(lines) != 2 || lines[1] != `{"message":"done"}` {
+		t.Fatalf("expected the messages as JSON, got %q", lines)
+	}
+}
+
+// writeTypicalLogs writes messages like the ones of a coriolis worker
+// to a datastore writing to fake, and returns the number of bytes sent.
+func writeTypicalLogs(t *testing.T, compress bool) (int, []string) {
+	t.Helper()
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store, err := NewInfluxDBDatastore(context.Background(), &config.InfluxDB{
+		URL:            config.InfluxURL(fake.URL),
+		Database:       "logs",
+		SkipDBCreate:   true,
+		CompressWrites: compress,
+	}, "")
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	influx := store.(*InfluxDBDataStore)
+
+	// Sub-second timestamps are kept as is, so the order of the
+	// messages does not depend on the time they are written at.
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 1000, time.UTC)
+	for idx := 0; idx < 500; idx++ {
+		msg := fmt.Sprintf("Task %d: replicating disk /dev/sdb of instance 9d1c2f5a-migration, %d%% done", idx%7, idx%100)
+		if err := influx.Write(testMessage(ts.Add(time.Duration(idx)*time.Millisecond), msg)); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if err := influx.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	lines, _ := readAll(t, influx, params.QueryParams{AppName: "coriolis-worker"})
+	fake.mut.Lock()
+	defer fake.mut.Unlock()
+	return fake.writeBytes, lines
+}
+
+func TestCompressWrites(t *testing.T) {
+	plainSize, plainLines := writeTypicalLogs(t, false)
+	compressedSize, compressedLines := writeTypicalLogs(t, true)
+	t.Logf("sent %d bytes uncompressed, %d bytes compressed", plainSize, compressedSize)
+	if compressedSize*5 > plainSize {
+		t.Fatalf("expected compression to save at least 80%%, sent %d bytes instead of %d", compressedSize, plainSize)
+	}
+	// The compressed points are stored like the others.
+	if len(compressedLines) != 500 || strings.Join(compressedLines, "\n") != strings.Join(plainLines, "\n") {
+		t.Fatalf("expected the same 500 messages to be stored, got %d", len(compressedLines))
+	}
+}
+
+func TestCustomEndpointPaths(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		fake := newFakeInfluxDBWithPaths("/influxdb/write", "/influxdb/query")
+		store, err := NewInfluxDBDatastore(context.Background(), &config.InfluxDB{
+			URL:            config.InfluxURL(fake.URL),
+			Database:       "logs",
+			SkipDBCreate:   true,
+			WritePath:      "/influxdb/write",
+			QueryPath:      "/influxdb/query",
+			CompressWrites: compress,
+		}, "")
+		if err != nil {
+			t.Fatalf("failed to create datastore: %v", err)
+		}
+		influx := store.(*InfluxDBDataStore)
+		if err := influx.Write(testMessage(time.Now(), "proxied")); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+		if err := influx.flush(); err != nil {
+			t.Fatalf("compress %v: failed to flush: %v", compress, err)
+		}
+		lines, _ := readAll(t, influx, params.QueryParams{AppName: "coriolis-worker"})
+		fake.Close()
+		if strings.Join(lines, "|") != "proxied" {
+			t.Fatalf("compress %v: expected the message to be read back, got %q", compress, lines)
+		}
+		if len(fake.unexpected) > 0 {
+			t.Fatalf("compress %v: requests sent to the default paths: %v", compress, fake.unexpected)
+		}
+	}
+}
+
+func TestDefaultEndpointPathsFailBehindProxy(t *testing.T) {
+	fake := newFakeInfluxDBWithPaths("/influxdb/write", "/influxdb/query")
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+	if err := store.Write(testMessage(time.Now(), "lost")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.flush(); err == nil {
+		t.Fatalf("expected writing to the default path to fail")
+	}
+	fake.mut.Lock()
+	defer fake.mut.Unlock()
+	if len(fake.unexpected) != 1 || fake.unexpected[0] != "/write" {
+		t.Fatalf("expected a request to /write, got %v", fake.unexpected)
+	}
+}
+
+func TestConcurrentWritesWithThresholdFlushes(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store, err := NewInfluxDBDatastore(context.Background(), &config.InfluxDB{
+		URL:          config.InfluxURL(fake.URL),
+		Database:     "logs",
+		SkipDBCreate: true,
+		// Writers flush every few messages, while the ticker flushes
+		// concurrently.
+		MaxBatchPoints: 7,
+		FlushInterval:  "1ms",
+	}, "")
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	influx := store.(*InfluxDBDataStore)
+	if err := influx.Start(); err != nil {
+		t.Fatalf("failed to start datastore: %v", err)
+	}
+
+	const writers, perWriter = 32, 200
+	base := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for idx := 0; idx < perWriter; idx++ {
+				// Each message has a distinct sub-second timestamp.
+				ts := base.Add(time.Duration(writer*perWriter+idx)*time.Microsecond + 1)
+				if err := influx.Write(testMessage(ts, fmt.Sprintf("%d-%d", writer, idx))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(writer)
+	}
+	// Readers flush pending points as well.
+	stopFlushing := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-stopFlushing:
+				return
+			default:
+				influx.flush()
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("writers deadlocked")
+	}
+	close(stopFlushing)
+	<-flushed
+	close(errs)
+	for err := range errs {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := influx.Stop(); err != nil {
+		t.Fatalf("failed to stop datastore: %v", err)
+	}
+	if count := fake.count("coriolis-worker"); count != writers*perWriter {
+		t.Fatalf("expected %d points, got %d", writers*perWriter, count)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxLogNameLength is the longest log name we accept. RFC5424 limits
+// the APP-NAME to 48 characters, but RFC3164 tags are not limited.
+const maxLogNameLength = 255
+
+var (
+	identEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	literalEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+)
+
+// quoteIdent returns an InfluxQL identifier, such as a measurement or
+// database name, quoted and escaped.
+func quoteIdent(name string) string {
+	return `"` + identEscaper.Replace(name) + `"`
+}
+
+// quoteRegex returns an InfluxQL regular expression literal, escaping
+// the slashes that would end it.
+func quoteRegex(pattern string) string {
+	var b strings.Builder
+	b.WriteString(`/`)
+	for idx := 0; idx < len(pattern); idx++ {
+		switch pattern[idx] {
+		case '\\':
+			// Escaped characters, including slashes, are kept as is.
+			b.WriteByte(pattern[idx])
+			if idx+1 < len(pattern) {
+				idx++
+				b.WriteByte(pattern[idx])
+			}
+		case '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteByte(pattern[idx])
+		}
+	}
+	b.WriteString(`/`)
+	return b.String()
+}
+
+// quoteLiteral returns an InfluxQL string literal, used to compare
+// tag values, quoted and escaped.
+func quoteLiteral(value string) string {
+	return `'` + literalEscaper.Replace(value) + `'`
+}
+
+// validLogName returns an error if name can not be the name of a log
+// we store. Log names are the APP-NAME of syslog messages, which only
+// holds printable ASCII characters, without spaces.
+func validLogName(name string) error {
+	if name == "" {
+		return fmt.Errorf("missing application name")
+	}
+	if len(name) > maxLogNameLength {
+		return fmt.Errorf("invalid log name %q: longer than %d characters", name, maxLogNameLength)
+	}
+	for _, c := range []byte(name) {
+		if c < '!' || c > '~' {
+			return fmt.Errorf("invalid log name %q", name)
+		}
+	}
+	return nil
+}
+
+// measurementName returns the measurement the logs of an application
+// are written to. Characters a syslog APP-NAME may not hold are
+// replaced, so every log we write passes validLogName() and can be
+// queried back.
+func measurementName(appName string) string {
+	if len(appName) > maxLogNameLength {
+		appName = appName[:maxLogNameLength]
+	}
+	return strings.Map(func(r rune) rune {
+		if r < '!' || r > '~' {
+			return '_'
+		}
+		return r
+	}, appName)
+}
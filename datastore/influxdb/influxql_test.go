@@ -0,0 +1,135 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/params"
+)
+
+func TestValidLogName(t *testing.T) {
+	valid := []string{"coriolis-worker", "nginx", "app.v2_beta", `quote"d`, "semi;colon"}
+	for _, name := range valid {
+		if err := validLogName(name); err != nil {
+			t.Errorf("expected %q to be valid, got %v", name, err)
+		}
+	}
+	invalid := []string{"", "foo; DROP DATABASE logs", "tab\tname", "new\nline", "nul\x00", "ünicode", strings.Repeat("a", maxLogNameLength+1)}
+	for _, name := range invalid {
+		if err := validLogName(name); err == nil {
+			t.Errorf("expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestQuoting(t *testing.T) {
+	tests := []struct {
+		quote    func(string) string
+		value    string
+		expected string
+	}{
+		{quoteIdent, `coriolis-worker`, `"coriolis-worker"`},
+		{quoteIdent, `foo"; DROP DATABASE "logs`, `"foo\"; DROP DATABASE \"logs"`},
+		{quoteIdent, `back\slash`, `"back\\slash"`},
+		{quoteLiteral, `web-1`, `'web-1'`},
+		{quoteLiteral, `web' or hostname='x`, `'web\' or hostname=\'x'`},
+		{quoteLiteral, `trailing\`, `'trailing\\'`},
+		{quoteRegex, `^a/b`, `/^a\/b/`},
+		{quoteRegex, `^a\/b`, `/^a\/b/`},
+	}
+	for _, tt := range tests {
+		if quoted := tt.quote(tt.value); quoted != tt.expected {
+			t.Errorf("expected %q to be quoted as %s, got %s", tt.value, tt.expected, quoted)
+		}
+	}
+}
+
+func TestPrepareQueryRejectsHostileLogNames(t *testing.T) {
+	for _, name := range []string{"", "foo; DROP DATABASE logs", "foo\nbar"} {
+		store := &InfluxDBDataStore{cfg: &config.InfluxDB{}}
+		reader := store.ResultReader(context.Background(), params.QueryParams{AppName: name}).(*influxDBReader)
+		if q, err := reader.prepareQuery(); err == nil {
+			t.Errorf("expected log name %q to be rejected, got query %q", name, q)
+		}
+	}
+}
+
+func TestPrepareQueryEscapesValues(t *testing.T) {
+	q := testQuery(t, params.QueryParams{
+		AppName:  `quote"d`,
+		Hostname: `web' or hostname='x`,
+		MsgID:    `id\`,
+	})
+	expected := `select time,severity,message from "quote\"d" where hostname='web\' or hostname=\'x' and msg_id='id\\'`
+	if q != expected {
+		t.Fatalf("expected query %q, got %q", expected, q)
+	}
+}
+
+func TestMeasurementName(t *testing.T) {
+	tests := map[string]string{
+		"coriolis-worker":         "coriolis-worker",
+		"foo; DROP DATABASE logs": "foo;_DROP_DATABASE_logs",
+		"new\nline":               "new_line",
+		"ünicode":                 "_nicode",
+	}
+	for appName, expected := range tests {
+		name := measurementName(appName)
+		if name != expected {
+			t.Errorf("expected %q to be written to %q, got %q", appName, expected, name)
+		}
+		if err := validLogName(name); err != nil {
+			t.Errorf("measurement %q of %q can not be queried: %v", name, appName, err)
+		}
+	}
+	if name := measurementName(strings.Repeat("a", maxLogNameLength+10)); len(name) != maxLogNameLength {
+		t.Errorf("expected long names to be truncated to %d characters, got %d", maxLogNameLength, len(name))
+	}
+}
+
+func TestWriteHostileNamesCanBeReadBack(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+
+	logMsg := testMessage(time.Now(), "hostile")
+	logMsg.AppName = `evil app"; DROP`
+	logMsg.Hostname = `web' or '1'='1`
+	if err := store.Write(logMsg); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	logs, err := store.List()
+	if err != nil {
+		t.Fatalf("failed to list logs: %v", err)
+	}
+	if len(logs) != 1 || logs[0]["log_name"] != `evil_app";_DROP` {
+		t.Fatalf("unexpected logs %v", logs)
+	}
+	lines, _ := readAll(t, store, params.QueryParams{
+		AppName:  logs[0]["log_name"],
+		Hostname: logMsg.Hostname,
+	})
+	if strings.Join(lines, "|") != "hostile" {
+		t.Fatalf("expected the message to be read back, got %q", lines)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/pkg/errors"
+)
+
+// spoolFileExt is the extension of spool files. Files being written
+// have a ".tmp" suffix appended, and are ignored.
+const spoolFileExt = ".lp"
+
+// spoolFile is a batch of points saved in the spool.
+type spoolFile struct {
+	name string
+	size int64
+}
+
+// spool keeps batches of points that could not be written to InfluxDB
+// on disk, in line protocol, one file per batch. File names start with
+// the time they were written at, so sorting them gives the order the
+// batches must be replayed in. The spool is not safe for concurrent use.
+type spool struct {
+	dir     string
+	maxSize int64
+	// files holds the spooled batches, oldest first.
+	files []spoolFile
+	size  int64
+	// seq tells apart files written within the same nanosecond.
+	seq int
+}
+
+// newSpool opens the spool in dir, creating the directory if needed.
+// Batches left over from a previous run are kept, to be replayed.
+func newSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating spool dir")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading spool dir")
+	}
+	s := &spool{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(entry.Name(), spoolFileExt) {
+			continue
+		}
+		s.files = append(s.files, spoolFile{name: entry.Name(), size: entry.Size()})
+		s.size += entry.Size()
+	}
+	sort.Slice(s.files, func(a, b int) bool {
+		return s.files[a].name < s.files[b].name
+	})
+	if len(s.files) > 0 {
+		log.Infof("found %d spooled batches (%d bytes) to replay", len(s.files), s.size)
+	}
+	return s, nil
+}
+
+// empty returns true if there are no batches waiting to be replayed.
+func (s *spool) empty() bool {
+	return len(s.files) == 0
+}
+
+// add saves a batch of points. If the spool grows over its maximum
+// size, the oldest batches are dropped.
+func (s *spool) add(points []*client.Point) error {
+	buf := bytes.NewBuffer([]byte{})
+	for _, pt := range points {
+		buf.WriteString(pt.PrecisionString("ns"))
+		buf.WriteByte('\n')
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spoolFileExt)
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "writing spool file")
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "writing spool file")
+	}
+	s.files = append(s.files, spoolFile{name: name, size: int64(buf.Len())})
+	s.size += int64(buf.Len())
+	s.evict()
+	return nil
+}
+
+// evict removes the oldest batches until the spool fits its maximum
+// size.
+func (s *spool) evict() {
+	var dropped int
+	for s.size > s.maxSize && len(s.files) > 0 {
+		if err := os.Remove(filepath.Join(s.dir, s.files[0].name)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove spool file %s: %v", s.files[0].name, err)
+			return
+		}
+		s.size -= s.files[0].size
+		s.files = s.files[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		log.Warningf("spool is full. Dropped the %d oldest batches", dropped)
+	}
+}
+
+// replay sends the spooled batches, oldest first, removing each one
+// once it is sent. It stops at the first batch that fails, so batches
+// are never sent out of order.
+func (s *spool) replay(send func([]*client.Point) error) error {
+	if s.empty() {
+		return nil
+	}
+	var replayed int
+	for len(s.files) > 0 {
+		file := s.files[0]
+		path := filepath.Join(s.dir, file.name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "reading spool file")
+		}
+		parsed, err := models.ParsePointsWithPrecision(data, time.Now(), "ns")
+		if err != nil {
+			// A damaged file would block the spool forever.
+			log.Errorf("dropping unreadable spool file %s: %v", file.name, err)
+		} else {
+			points := make([]*client.Point, len(parsed))
+			for idx, pt := range parsed {
+				points[idx] = client.NewPointFrom(pt)
+			}
+			if err := send(points); err != nil {
+				return errors.Wrapf(err, "replaying spool file %s", file.name)
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "removing spool file")
+		}
+		s.size -= file.size
+		s.files = s.files[1:]
+		replayed++
+	}
+	log.Infof("replayed %d spooled batches", replayed)
+	return nil
+}
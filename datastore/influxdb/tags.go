@@ -0,0 +1,104 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+)
+
+// tagExtractor adds tags to the points of an application, from the
+// named groups of a regular expression matched against the message.
+type tagExtractor struct {
+	re      *regexp.Regexp
+	maxTags int
+
+	mut sync.Mutex
+	// values holds the distinct values seen so far, for each tag.
+	values map[string]map[string]struct{}
+}
+
+func newTagExtractor(cfg config.TagExtractor) (*tagExtractor, error) {
+	re, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "compiling pattern")
+	}
+	return &tagExtractor{
+		re:      re,
+		maxTags: cfg.GetMaxTags(),
+		values:  map[string]map[string]struct{}{},
+	}, nil
+}
+
+// allow returns true if value can be used for the tag key, without
+// going over the maximum number of distinct values.
+func (t *tagExtractor) allow(key, value string) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	seen, ok := t.values[key]
+	if !ok {
+		seen = map[string]struct{}{}
+		t.values[key] = seen
+	}
+	if _, ok := seen[value]; ok {
+		return true
+	}
+	if len(seen) >= t.maxTags {
+		return false
+	}
+	seen[value] = struct{}{}
+	return true
+}
+
+// extract adds the tags found in message to tags. Existing tags
+// are never overwritten.
+func (t *tagExtractor) extract(message string, tags map[string]string) {
+	match := t.re.FindStringSubmatch(message)
+	if match == nil {
+		return
+	}
+	for idx, key := range t.re.SubexpNames() {
+		if key == "" || match[idx] == "" {
+			continue
+		}
+		if _, ok := tags[key]; ok {
+			continue
+		}
+		if !t.allow(key, match[idx]) {
+			log.Debugf("dropping tag %q: too many distinct values", key)
+			continue
+		}
+		tags[key] = match[idx]
+	}
+}
+
+// newTagExtractors returns the configured tag extractors, indexed by
+// application name.
+func newTagExtractors(cfg []config.TagExtractor) (map[string][]*tagExtractor, error) {
+	ret := map[string][]*tagExtractor{}
+	for _, extractorCfg := range cfg {
+		extractor, err := newTagExtractor(extractorCfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting tag extractor for %q", extractorCfg.App)
+		}
+		ret[extractorCfg.App] = append(ret[extractorCfg.App], extractor)
+	}
+	return ret, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+)
+
+// nginxAccessPattern matches the nginx combined log format, followed by
+// the request time.
+const nginxAccessPattern = `^\S+ \S+ \S+ \[[^\]]+\] "(?P<method>[A-Z]+) [^"]*" (?P<status>\d{3}) \d+ "[^"]*" "[^"]*" request_time=[\d.]+$`
+
+const nginxAccessLine = `192.0.2.10 - - [15/Oct/2026:10:00:00 +0000] "GET /api/v1/logs HTTP/1.1" 404 153 "-" "curl/7.68.0" request_time=0.042`
+
+func TestTagExtractorNginxAccessLog(t *testing.T) {
+	extractor, err := newTagExtractor(config.TagExtractor{App: "nginx", Pattern: nginxAccessPattern})
+	if err != nil {
+		t.Fatalf("failed to create tag extractor: %v", err)
+	}
+	tags := map[string]string{"hostname": "web-1"}
+	extractor.extract(nginxAccessLine, tags)
+	if tags["status"] != "404" {
+		t.Fatalf("expected status tag %q, got %q", "404", tags["status"])
+	}
+	if tags["method"] != "GET" {
+		t.Fatalf("expected method tag %q, got %q", "GET", tags["method"])
+	}
+
+	// Messages that do not match add no tags.
+	tags = map[string]string{}
+	extractor.extract("worker started", tags)
+	if len(tags) != 0 {
+		t.Fatalf("expected no tags, got %v", tags)
+	}
+}
+
+func TestTagExtractorKeepsExistingTags(t *testing.T) {
+	extractor, err := newTagExtractor(config.TagExtractor{App: "nginx", Pattern: `host=(?P<hostname>\S+)`})
+	if err != nil {
+		t.Fatalf("failed to create tag extractor: %v", err)
+	}
+	tags := map[string]string{"hostname": "web-1"}
+	extractor.extract("host=web-2", tags)
+	if tags["hostname"] != "web-1" {
+		t.Fatalf("expected hostname tag to be kept, got %q", tags["hostname"])
+	}
+}
+
+func TestTagExtractorMaxTags(t *testing.T) {
+	extractor, err := newTagExtractor(config.TagExtractor{App: "nginx", Pattern: `status=(?P<status>\d+)`, MaxTags: 2})
+	if err != nil {
+		t.Fatalf("failed to create tag extractor: %v", err)
+	}
+	for _, status := range []int{200, 404, 500, 200} {
+		tags := map[string]string{}
+		extractor.extract(fmt.Sprintf("status=%d", status), tags)
+		_, ok := tags["status"]
+		// Values already seen are still added once the limit is
+		// reached, new ones are not.
+		if expected := status != 500; ok != expected {
+			t.Fatalf("status %d: expected tag added to be %v, got %v", status, expected, ok)
+		}
+	}
+}
+
+func TestWriteExtractedTags(t *testing.T) {
+	fake := newFakeInfluxDB()
+	defer fake.Close()
+	store := newTestDatastore(t, fake)
+	extractors, err := newTagExtractors([]config.TagExtractor{{App: "nginx", Pattern: nginxAccessPattern}})
+	if err != nil {
+		t.Fatalf("failed to create tag extractors: %v", err)
+	}
+	store.extractors = extractors
+
+	for _, app := range []string{"nginx", "coriolis-worker"} {
+		logMsg := testMessage(time.Now(), nginxAccessLine)
+		logMsg.AppName = app
+		if err := store.Write(logMsg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if err := store.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	fake.mut.Lock()
+	defer fake.mut.Unlock()
+	if len(fake.points["nginx"]) != 1 || len(fake.points["coriolis-worker"]) != 1 {
+		t.Fatalf("expected a point in each log, got %v", fake.points)
+	}
+	for _, pt := range fake.points["nginx"] {
+		if pt.values["status"] != "404" {
+			t.Fatalf("expected status tag %q, got %v", "404", pt.values["status"])
+		}
+	}
+	// Only the messages of the configured application are tagged.
+	for _, pt := range fake.points["coriolis-worker"] {
+		if _, ok := pt.values["status"]; ok {
+			t.Fatalf("unexpected status tag on message of another application")
+		}
+	}
+}
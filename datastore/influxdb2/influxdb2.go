@@ -0,0 +1,482 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.influxdb2")
+
+const (
+	// readChunkSize is the number of records fetched by a reader on
+	// each call to ReadNext().
+	readChunkSize = 20000
+)
+
+func NewInfluxDB2Datastore(ctx context.Context, cfg *config.InfluxDB2) (common.DataStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating influxdb2 config")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config for influx client")
+	}
+	opts := influxdb2.DefaultOptions().
+		SetTLSConfig(tlsCfg).
+		SetPrecision(time.Nanosecond)
+	con := influxdb2.NewClientWithOptions(cfg.URL.String(), cfg.Token, opts)
+
+	return &InfluxDB2DataStore{
+		cfg:    cfg,
+		con:    con,
+		points: []*write.Point{},
+		ctx:    ctx,
+		closed: make(chan struct{}),
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+var _ common.DataStore = (*InfluxDB2DataStore)(nil)
+
+type InfluxDB2DataStore struct {
+	cfg    *config.InfluxDB2
+	con    influxdb2.Client
+	mut    sync.Mutex
+	points []*write.Point
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+	// pointTimes keeps messages of a series with the same timestamp
+	// from overwriting each other. It is guarded by mut.
+	pointTimes common.PointTimes
+}
+
+func (i *InfluxDB2DataStore) doWork() {
+	var interval int
+	if i.cfg.WriteInterval == 0 {
+		interval = 1
+	} else {
+		interval = i.cfg.WriteInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	rotationTicker := time.NewTicker(1 * time.Hour)
+	defer func() {
+		ticker.Stop()
+		rotationTicker.Stop()
+		if err := i.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
+		i.con.Close()
+		close(i.closed)
+	}()
+	for {
+		select {
+		case <-i.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := i.flush(); err != nil {
+				log.Errorf("failed to flush logs to backend: %v", err)
+			}
+		case <-rotationTicker.C:
+			retentionPeriod := i.cfg.GetLogRetention()
+			log.Infof("deleting logs older than %d days", retentionPeriod)
+			day := 24 * time.Hour
+			olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+			if err := i.Rotate(olderThan); err != nil {
+				log.Errorf("failed to rotate logs: %v", err)
+			}
+		case <-i.quit:
+			return
+		}
+	}
+}
+
+func (i *InfluxDB2DataStore) Start() error {
+	ready, err := i.con.Ready(i.ctx)
+	if err != nil {
+		return errors.Wrap(err, "connecting to influxdb")
+	}
+	if !ready {
+		return fmt.Errorf("influxdb is not ready")
+	}
+	go i.doWork()
+	return nil
+}
+
+func (i *InfluxDB2DataStore) Stop() error {
+	close(i.quit)
+	i.Wait()
+	return nil
+}
+
+func (i *InfluxDB2DataStore) Wait() {
+	<-i.closed
+}
+
+func (i *InfluxDB2DataStore) flush() error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.flushLocked()
+}
+
+// flushLocked writes all pending points in a single request. The
+// caller must hold i.mut.
+func (i *InfluxDB2DataStore) flushLocked() error {
+	if len(i.points) == 0 {
+		return nil
+	}
+	writeAPI := i.con.WriteAPIBlocking(i.cfg.Org, i.cfg.Bucket)
+	if err := writeAPI.WritePoint(i.ctx, i.points...); err != nil {
+		return errors.Wrap(err, "writing log lines to influx")
+	}
+	i.points = []*write.Point{}
+	return nil
+}
+
+func (i *InfluxDB2DataStore) Write(logMsg logging.LogMessage) error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+
+	tags := map[string]string{
+		"hostname": logMsg.Hostname,
+		"severity": logMsg.Severity.String(),
+		"facility": logMsg.Facility.String(),
+	}
+	if logMsg.SourceAddr != "" {
+		tags["source_addr"] = logMsg.SourceAddr
+	}
+	fields := map[string]interface{}{
+		"message": logMsg.Message,
+	}
+
+	ts := i.pointTimes.Next(common.SeriesKey(logMsg.AppName, tags), logMsg.Timestamp, time.Now())
+	i.points = append(i.points, influxdb2.NewPoint(logMsg.AppName, tags, fields, ts))
+
+	if len(i.points) >= i.cfg.GetMaxBatchPoints() {
+		if err := i.flushLocked(); err != nil {
+			return errors.Wrap(err, "flushing logs")
+		}
+	}
+	return nil
+}
+
+// Rotate deletes all messages older than olderThan, from all logs.
+func (i *InfluxDB2DataStore) Rotate(olderThan time.Time) error {
+	err := i.con.DeleteAPI().DeleteWithName(
+		i.ctx, i.cfg.Org, i.cfg.Bucket, time.Unix(0, 0), olderThan, "")
+	if err != nil {
+		return errors.Wrap(err, "deleting old logs")
+	}
+	return nil
+}
+
+// Delete removes the points of the measurement holding a log older
+// than olderThan, or all of them if it is zero. Pending points are
+// written first, so they do not recreate it.
+func (i *InfluxDB2DataStore) Delete(binaryName string, olderThan time.Time) error {
+	if err := i.flush(); err != nil {
+		log.Warningf("failed to flush logs before deleting %q: %v", binaryName, err)
+	}
+	logs, err := i.List()
+	if err != nil {
+		return errors.Wrap(err, "listing logs")
+	}
+	if !common.HasLog(logs, binaryName) {
+		return common.LogNotFoundErr
+	}
+	if olderThan.IsZero() {
+		olderThan = time.Now()
+	}
+	predicate := fmt.Sprintf("_measurement=%s", fluxString(binaryName))
+	err = i.con.DeleteAPI().DeleteWithName(
+		i.ctx, i.cfg.Org, i.cfg.Bucket, time.Unix(0, 0), olderThan, predicate)
+	if err != nil {
+		return errors.Wrap(err, "deleting log")
+	}
+	return nil
+}
+
+// Metadata counts the messages of a log, sums their length, and
+// fetches the timestamps of the first and last ones, in a single query.
+// Pending points are written first, so they are included.
+func (i *InfluxDB2DataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	i.flush()
+	q := fmt.Sprintf(`import "strings"
+data = from(bucket: %s)
+  |> range(start: %s)
+  |> filter(fn: (r) => r._measurement == %s and r._field == "message")
+  |> group()
+data |> count() |> yield(name: "count")
+data |> first() |> yield(name: "first")
+data |> last() |> yield(name: "last")
+data |> map(fn: (r) => ({r with _value: strings.strlen(v: r._value)})) |> sum() |> yield(name: "size")`,
+		fluxString(i.cfg.Bucket), fluxTime(time.Unix(0, 0)), fluxString(binaryName))
+	result, err := i.con.QueryAPI(i.cfg.Org).Query(i.ctx, q)
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "executing query")
+	}
+	defer result.Close()
+
+	ret := common.LogMetadata{}
+	var found bool
+	for result.Next() {
+		record := result.Record()
+		switch record.ValueByKey("result") {
+		case "count":
+			ret.Count, _ = record.Value().(int64)
+		case "first":
+			ret.FirstTimestamp = record.Time()
+			found = true
+		case "last":
+			ret.LastTimestamp = record.Time()
+		case "size":
+			ret.Size, _ = record.Value().(int64)
+		}
+	}
+	if err := result.Err(); err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "reading results")
+	}
+	if !found {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	return ret, nil
+}
+
+// HealthCheck queries the health of the InfluxDB server.
+func (i *InfluxDB2DataStore) HealthCheck(ctx context.Context) error {
+	health, err := i.con.Health(ctx)
+	if err != nil {
+		return errors.Wrap(err, "checking influxdb health")
+	}
+	if health.Status != domain.HealthCheckStatusPass {
+		msg := string(health.Status)
+		if health.Message != nil {
+			msg = *health.Message
+		}
+		return fmt.Errorf("influxdb is unhealthy: %s", msg)
+	}
+	return nil
+}
+
+func (i *InfluxDB2DataStore) ResultReader(ctx context.Context, p params.QueryParams) common.Reader {
+	return &influxDB2Reader{
+		datastore: i,
+		params:    p,
+		cursor:    p.Cursor,
+	}
+}
+
+func (i *InfluxDB2DataStore) List() ([]map[string]string, error) {
+	q := fmt.Sprintf(
+		"import \"influxdata/influxdb/schema\"\nschema.measurements(bucket: %s)",
+		fluxString(i.cfg.Bucket))
+	result, err := i.con.QueryAPI(i.cfg.Org).Query(i.ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	defer result.Close()
+
+	ret := []map[string]string{}
+	for result.Next() {
+		if name, ok := result.Record().Value().(string); ok {
+			ret = append(ret, map[string]string{"log_name": name})
+		}
+	}
+	if err := result.Err(); err != nil {
+		return nil, errors.Wrap(err, "fetching response")
+	}
+	return ret, nil
+}
+
+// fluxString returns s as a quoted Flux string literal.
+func fluxString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// fluxTime returns t as a Flux time literal.
+func fluxTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// influxDB2Reader pages through a log, querying at most readChunkSize
+// records at a time, starting after the last record returned.
+type influxDB2Reader struct {
+	datastore *InfluxDB2DataStore
+	params    params.QueryParams
+
+	// after is the timestamp of the last message returned.
+	after   time.Time
+	started bool
+	done    bool
+	cursor  string
+	// read is the number of messages returned so far.
+	read int
+}
+
+// init flushes pending messages and positions the reader after the
+// cursor it was created with, if any.
+func (i *influxDB2Reader) init() error {
+	i.started = true
+	i.datastore.flush()
+	if i.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(i.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	i.after = time.Unix(0, cursor.Timestamp)
+	return nil
+}
+
+func (i *influxDB2Reader) chunkSize() int {
+	if i.params.Limit > 0 && i.params.Limit-i.read < readChunkSize {
+		return i.params.Limit - i.read
+	}
+	return readChunkSize
+}
+
+func (i *influxDB2Reader) prepareQuery() (string, error) {
+	if i.params.AppName == "" {
+		return "", fmt.Errorf("missing application name")
+	}
+
+	// range() requires a start time. Logs can not predate the epoch.
+	start := time.Unix(0, 0)
+	if !i.params.StartDate.IsZero() {
+		start = i.params.StartDate
+	}
+	if !i.after.IsZero() && !i.after.Before(start) {
+		start = i.after.Add(time.Nanosecond)
+	}
+	rng := fmt.Sprintf("start: %s", fluxTime(start))
+	if !i.params.EndDate.IsZero() {
+		// The stop time of range() is exclusive.
+		rng += fmt.Sprintf(", stop: %s", fluxTime(i.params.EndDate.Add(time.Nanosecond)))
+	}
+
+	filters := []string{
+		fmt.Sprintf(`r._measurement == %s`, fluxString(i.params.AppName)),
+		`r._field == "message"`,
+	}
+	if i.params.Hostname != "" {
+		filters = append(filters, fmt.Sprintf(`r.hostname == %s`, fluxString(i.params.Hostname)))
+	}
+	if i.params.SourceAddr != "" {
+		filters = append(filters, fmt.Sprintf(`r.source_addr == %s`, fluxString(i.params.SourceAddr)))
+	}
+	if i.params.Severity != nil {
+		// severity is stored as a string tag. Severity levels are
+		// single digits, so we match them with a character class.
+		filters = append(filters, fmt.Sprintf(`r.severity =~ /^[0-%d]$/`, *i.params.Severity))
+	}
+	if i.params.Facility != nil {
+		filters = append(filters, fmt.Sprintf(`r.facility == %s`, fluxString(i.params.Facility.String())))
+	}
+
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(%s)
+  |> filter(fn: (r) => %s)
+  |> group()
+  |> sort(columns: ["_time"])
+  |> limit(n: %d)`,
+		fluxString(i.datastore.cfg.Bucket), rng,
+		strings.Join(filters, " and "), i.chunkSize())
+	return q, nil
+}
+
+var _ common.Reader = (*influxDB2Reader)(nil)
+
+func (i *influxDB2Reader) ReadNext() ([]byte, error) {
+	if i.done {
+		return nil, io.EOF
+	}
+
+	if !i.started {
+		if err := common.CheckReadParams(i.params); err != nil {
+			return nil, err
+		}
+		if err := i.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+	}
+
+	chunkSize := i.chunkSize()
+	query, err := i.prepareQuery()
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing query")
+	}
+	result, err := i.datastore.con.QueryAPI(i.datastore.cfg.Org).Query(i.datastore.ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "executing query")
+	}
+	defer result.Close()
+
+	buf := bytes.NewBuffer([]byte{})
+	var count int
+	for result.Next() {
+		record := result.Record()
+		message, ok := record.Value().(string)
+		if !ok {
+			continue
+		}
+		count++
+		i.after = record.Time()
+		if _, err := buf.WriteString(message); err != nil {
+			return nil, errors.Wrap(err, "reading value")
+		}
+		if len(message) > 0 && message[len(message)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	if err := result.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading results")
+	}
+	i.read += count
+	if count > 0 {
+		i.cursor = common.EncodeCursor(common.Cursor{Timestamp: i.after.UnixNano()})
+	}
+
+	if count < chunkSize || (i.params.Limit > 0 && i.read >= i.params.Limit) {
+		i.done = true
+	}
+	if count == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (i *influxDB2Reader) Cursor() string {
+	return i.cursor
+}
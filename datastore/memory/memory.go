@@ -0,0 +1,410 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+const (
+	// readChunkSize is the number of messages returned by a reader on
+	// each call to ReadNext().
+	readChunkSize = 20000
+)
+
+// entry is a log message held in memory.
+type entry struct {
+	// seq is the position of the message in the log of its
+	// application, starting at 1.
+	seq       uint64
+	timestamp int64
+	hostname  string
+	severity  logging.Severity
+	facility  logging.Facility
+	message   string
+	source    string
+}
+
+// ring holds the last messages of an application.
+type ring struct {
+	entries []entry
+	// next is the index the next message is written at.
+	next int
+	// lastSeq is the sequence number of the newest message.
+	lastSeq uint64
+}
+
+func (r *ring) add(e entry) {
+	r.lastSeq++
+	e.seq = r.lastSeq
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// discardBefore discards the oldest messages, up to the first one
+// logged at or after timestamp.
+func (r *ring) discardBefore(timestamp int64) {
+	first := r.firstSeq()
+	seq := first
+	for ; seq <= r.lastSeq && r.get(seq).timestamp < timestamp; seq++ {
+	}
+	if seq == first {
+		return
+	}
+	entries := make([]entry, 0, cap(r.entries))
+	for ; seq <= r.lastSeq; seq++ {
+		entries = append(entries, r.get(seq))
+	}
+	r.entries = entries
+	r.next = 0
+}
+
+// firstSeq returns the sequence number of the oldest message held.
+func (r *ring) firstSeq() uint64 {
+	return r.lastSeq - uint64(len(r.entries)) + 1
+}
+
+// get returns the message with the given sequence number, which must
+// be between firstSeq() and lastSeq.
+func (r *ring) get(seq uint64) entry {
+	offset := int(seq - r.firstSeq())
+	if len(r.entries) < cap(r.entries) {
+		return r.entries[offset]
+	}
+	return r.entries[(r.next+offset)%len(r.entries)]
+}
+
+// NewMemoryDatastore returns a datastore keeping the last messages of
+// each application in memory. Nothing is persisted, so it is only
+// meant for development and testing.
+func NewMemoryDatastore(ctx context.Context, cfg *config.Memory) (common.DataStore, error) {
+	if cfg != nil {
+		if err := cfg.Validate(); err != nil {
+			return nil, errors.Wrap(err, "validating memory config")
+		}
+	}
+
+	return &MemoryDataStore{
+		maxMessages: cfg.GetMaxMessages(),
+		logs:        map[string]*ring{},
+		ctx:         ctx,
+		closed:      make(chan struct{}),
+		quit:        make(chan struct{}),
+	}, nil
+}
+
+var _ common.DataStore = (*MemoryDataStore)(nil)
+
+// MemoryDataStore keeps the last max_messages messages of each
+// application in a ring buffer.
+type MemoryDataStore struct {
+	maxMessages int
+
+	mut    sync.Mutex
+	logs   map[string]*ring
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+}
+
+func (m *MemoryDataStore) doWork() {
+	defer close(m.closed)
+	select {
+	case <-m.ctx.Done():
+	case <-m.quit:
+	}
+}
+
+func (m *MemoryDataStore) Start() error {
+	go m.doWork()
+	return nil
+}
+
+func (m *MemoryDataStore) Stop() error {
+	close(m.quit)
+	m.Wait()
+	return nil
+}
+
+func (m *MemoryDataStore) Wait() {
+	<-m.closed
+}
+
+func (m *MemoryDataStore) Write(logMsg logging.LogMessage) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	log, ok := m.logs[logMsg.AppName]
+	if !ok {
+		log = &ring{
+			entries: make([]entry, 0, m.maxMessages),
+		}
+		m.logs[logMsg.AppName] = log
+	}
+	log.add(entry{
+		timestamp: logMsg.Timestamp.UnixNano(),
+		hostname:  logMsg.Hostname,
+		severity:  logMsg.Severity,
+		facility:  logMsg.Facility,
+		message:   logMsg.Message,
+		source:    logMsg.SourceAddr,
+	})
+	return nil
+}
+
+// Rotate does nothing. Old messages are discarded as new ones arrive.
+func (m *MemoryDataStore) Rotate(olderThan time.Time) error {
+	return nil
+}
+
+// Delete discards the messages of a log older than olderThan, or all
+// of them if it is zero. Only the oldest messages held are discarded,
+// up to the first one that is recent enough, so the sequence numbers
+// of the remaining ones do not change.
+func (m *MemoryDataStore) Delete(binaryName string, olderThan time.Time) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	log, ok := m.logs[binaryName]
+	if !ok {
+		return common.LogNotFoundErr
+	}
+	if !olderThan.IsZero() {
+		log.discardBefore(olderThan.UnixNano())
+		if len(log.entries) > 0 {
+			return nil
+		}
+	}
+	delete(m.logs, binaryName)
+	return nil
+}
+
+// Metadata summarizes the messages held for a log. Messages may arrive
+// out of order, so all of them are looked at.
+func (m *MemoryDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	log, ok := m.logs[binaryName]
+	if !ok || len(log.entries) == 0 {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	first, last := log.entries[0].timestamp, log.entries[0].timestamp
+	var size int64
+	for _, e := range log.entries {
+		if e.timestamp < first {
+			first = e.timestamp
+		}
+		if e.timestamp > last {
+			last = e.timestamp
+		}
+		size += int64(len(e.message))
+	}
+	return common.LogMetadata{
+		FirstTimestamp: time.Unix(0, first),
+		LastTimestamp:  time.Unix(0, last),
+		Count:          int64(len(log.entries)),
+		Size:           size,
+	}, nil
+}
+
+// HealthCheck always succeeds, as there is nothing that can fail.
+func (m *MemoryDataStore) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryDataStore) ResultReader(ctx context.Context, params params.QueryParams) common.Reader {
+	return &memoryReader{
+		datastore: m,
+		params:    params,
+		cursor:    params.Cursor,
+	}
+}
+
+func (m *MemoryDataStore) List() ([]map[string]string, error) {
+	m.mut.Lock()
+	names := make([]string, 0, len(m.logs))
+	for name := range m.logs {
+		names = append(names, name)
+	}
+	m.mut.Unlock()
+
+	sort.Strings(names)
+	ret := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, map[string]string{"log_name": name})
+	}
+	return ret, nil
+}
+
+// memoryReader returns the messages of an application held when it
+// started reading, oldest first. Messages are matched against the
+// query by their timestamp, regardless of the order they arrived in.
+type memoryReader struct {
+	datastore *MemoryDataStore
+	params    params.QueryParams
+
+	// lastSeq is the sequence number of the last message looked at,
+	// and endSeq the one of the newest message when we started.
+	lastSeq uint64
+	endSeq  uint64
+	started bool
+	done    bool
+	cursor  string
+	// read is the number of messages returned so far.
+	read int
+}
+
+// init positions the reader after the cursor it was created with, if
+// any.
+func (m *memoryReader) init() error {
+	m.started = true
+	m.datastore.mut.Lock()
+	if log, ok := m.datastore.logs[m.params.AppName]; ok {
+		m.endSeq = log.lastSeq
+	}
+	m.datastore.mut.Unlock()
+
+	if m.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(m.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	seq, err := strconv.ParseUint(cursor.Key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	m.lastSeq = seq
+	return nil
+}
+
+func (m *memoryReader) chunkSize() int {
+	if m.params.Limit > 0 && m.params.Limit-m.read < readChunkSize {
+		return m.params.Limit - m.read
+	}
+	return readChunkSize
+}
+
+func (m *memoryReader) matches(e entry) bool {
+	if !m.params.StartDate.IsZero() && e.timestamp < m.params.StartDate.UnixNano() {
+		return false
+	}
+	if !m.params.EndDate.IsZero() && e.timestamp > m.params.EndDate.UnixNano() {
+		return false
+	}
+	if m.params.Hostname != "" && e.hostname != m.params.Hostname {
+		return false
+	}
+	if m.params.SourceAddr != "" && e.source != m.params.SourceAddr {
+		return false
+	}
+	if m.params.Severity != nil && e.severity > *m.params.Severity {
+		return false
+	}
+	if m.params.Facility != nil && e.facility != *m.params.Facility {
+		return false
+	}
+	return true
+}
+
+var _ common.Reader = (*memoryReader)(nil)
+
+func (m *memoryReader) ReadNext() ([]byte, error) {
+	if m.done {
+		return nil, io.EOF
+	}
+
+	if !m.started {
+		if m.params.AppName == "" {
+			return nil, fmt.Errorf("missing application name")
+		}
+		if err := common.CheckReadParams(m.params); err != nil {
+			return nil, err
+		}
+		if err := m.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+	}
+
+	m.datastore.mut.Lock()
+	log, ok := m.datastore.logs[m.params.AppName]
+	if !ok {
+		m.datastore.mut.Unlock()
+		m.done = true
+		return nil, io.EOF
+	}
+	// Messages discarded since the last call are skipped.
+	if first := log.firstSeq(); m.lastSeq < first-1 {
+		m.lastSeq = first - 1
+	}
+
+	chunkSize := m.chunkSize()
+	buf := bytes.NewBuffer([]byte{})
+	var count int
+	var timestamp int64
+	for m.lastSeq < m.endSeq && count < chunkSize {
+		m.lastSeq++
+		e := log.get(m.lastSeq)
+		if !m.matches(e) {
+			continue
+		}
+		buf.WriteString(e.message)
+		if len(e.message) > 0 && e.message[len(e.message)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		timestamp = e.timestamp
+		count++
+	}
+	m.datastore.mut.Unlock()
+
+	if m.lastSeq >= m.endSeq {
+		m.done = true
+	}
+	m.read += count
+	if count > 0 {
+		m.cursor = common.EncodeCursor(common.Cursor{
+			Timestamp: timestamp,
+			Key:       strconv.FormatUint(m.lastSeq, 10),
+		})
+	}
+	if m.params.Limit > 0 && m.read >= m.params.Limit {
+		m.done = true
+	}
+	if count == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *memoryReader) Cursor() string {
+	return m.cursor
+}
@@ -0,0 +1,347 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package multi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.multi")
+
+const (
+	// maxPendingMessages is the number of messages queued for each
+	// datastore. Messages are dropped for a datastore that falls
+	// this far behind, so it does not hold back the others.
+	maxPendingMessages = 20000
+)
+
+// Child is a datastore managed by the multi datastore.
+type Child struct {
+	Name  string
+	Store common.DataStore
+}
+
+// NewMultiDatastore returns a datastore that writes logs to all the
+// given datastores, and serves queries from the primary one, falling
+// back to the secondaries, in order, if the primary fails.
+//
+// The multi datastore stops the children itself, after writing all
+// queued messages to them, so they should not be bound to ctx.
+func NewMultiDatastore(ctx context.Context, primary Child, secondaries ...Child) (common.DataStore, error) {
+	if primary.Store == nil {
+		return nil, fmt.Errorf("missing primary datastore")
+	}
+	children := []*child{}
+	for _, c := range append([]Child{primary}, secondaries...) {
+		children = append(children, &child{
+			name:  c.Name,
+			store: c.Store,
+			queue: make(chan logging.LogMessage, maxPendingMessages),
+			done:  make(chan struct{}),
+		})
+	}
+	return &MultiDatastore{
+		children: children,
+		ctx:      ctx,
+		stop:     make(chan struct{}),
+		closed:   make(chan struct{}),
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+var _ common.DataStore = (*MultiDatastore)(nil)
+
+// MultiDatastore fans out logs to several datastores
+type MultiDatastore struct {
+	// children holds the datastores, starting with the primary.
+	children []*child
+
+	ctx context.Context
+	// stop signals the child workers to write the messages left in
+	// their queue and return.
+	stop   chan struct{}
+	closed chan struct{}
+	quit   chan struct{}
+}
+
+// child writes the messages queued for a datastore.
+type child struct {
+	name  string
+	store common.DataStore
+	queue chan logging.LogMessage
+	// dropped counts the messages dropped because the queue was full.
+	dropped uint64
+	done    chan struct{}
+}
+
+func (c *child) write(msg logging.LogMessage) {
+	if dropped := atomic.SwapUint64(&c.dropped, 0); dropped > 0 {
+		log.Warningf("dropped %d log messages for datastore %s, as the queue was full", dropped, c.name)
+	}
+	if err := c.store.Write(msg); err != nil {
+		log.Errorf("failed to write log message to datastore %s: %v", c.name, err)
+	}
+}
+
+func (c *child) run(stop <-chan struct{}) {
+	defer close(c.done)
+	for {
+		select {
+		case msg := <-c.queue:
+			c.write(msg)
+		case <-stop:
+			for {
+				select {
+				case msg := <-c.queue:
+					c.write(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *MultiDatastore) doWork() {
+	defer close(m.closed)
+
+	select {
+	case <-m.ctx.Done():
+	case <-m.quit:
+	}
+
+	close(m.stop)
+	for _, c := range m.children {
+		<-c.done
+	}
+	for _, c := range m.children {
+		if err := c.store.Stop(); err != nil {
+			log.Errorf("failed to stop datastore %s: %v", c.name, err)
+		}
+	}
+}
+
+// Write queues the message for every datastore. A datastore that is
+// slow or failing does not delay the others.
+func (m *MultiDatastore) Write(logMsg logging.LogMessage) error {
+	for _, c := range m.children {
+		select {
+		case c.queue <- logMsg:
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// Rotate removes old logs from all datastores.
+func (m *MultiDatastore) Rotate(olderThan time.Time) error {
+	var ret error
+	for _, c := range m.children {
+		if err := c.store.Rotate(olderThan); err != nil {
+			log.Errorf("failed to rotate logs in datastore %s: %v", c.name, err)
+			if ret == nil {
+				ret = errors.Wrapf(err, "rotating logs in %s", c.name)
+			}
+		}
+	}
+	return ret
+}
+
+// Delete removes the messages of a log from all datastores. It only
+// returns LogNotFoundErr if none of them has the log.
+func (m *MultiDatastore) Delete(binaryName string, olderThan time.Time) error {
+	var ret error
+	found := false
+	for _, c := range m.children {
+		err := c.store.Delete(binaryName, olderThan)
+		if err == nil {
+			found = true
+			continue
+		}
+		if err == common.LogNotFoundErr {
+			continue
+		}
+		log.Errorf("failed to delete log %s in datastore %s: %v", binaryName, c.name, err)
+		if ret == nil {
+			ret = errors.Wrapf(err, "deleting log in %s", c.name)
+		}
+	}
+	if ret == nil && !found {
+		return common.LogNotFoundErr
+	}
+	return ret
+}
+
+// HealthCheck checks all datastores, and fails if any of them does.
+func (m *MultiDatastore) HealthCheck(ctx context.Context) error {
+	failed := []string{}
+	for _, c := range m.children {
+		if err := c.store.HealthCheck(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", c.name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (m *MultiDatastore) ResultReader(ctx context.Context, p params.QueryParams) common.Reader {
+	return &multiReader{
+		ctx:      ctx,
+		children: m.children,
+		params:   p,
+	}
+}
+
+func (m *MultiDatastore) List() ([]map[string]string, error) {
+	var ret error
+	for _, c := range m.children {
+		logs, err := c.store.List()
+		if err == nil {
+			return logs, nil
+		}
+		log.Warningf("failed to list logs in datastore %s: %v", c.name, err)
+		if ret == nil {
+			ret = errors.Wrapf(err, "listing logs in %s", c.name)
+		}
+	}
+	return nil, ret
+}
+
+var _ common.FilteredLister = (*MultiDatastore)(nil)
+var _ common.FieldsSelector = (*MultiDatastore)(nil)
+
+// SelectsFields returns true if all datastores do, as logs are read
+// from any of them.
+func (m *MultiDatastore) SelectsFields() bool {
+	for _, c := range m.children {
+		if !common.SelectsFields(c.store) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListWithFilter lists the matching logs of the first datastore that
+// can answer, like List().
+func (m *MultiDatastore) ListWithFilter(p params.ListParams) ([]map[string]string, error) {
+	var ret error
+	for _, c := range m.children {
+		logs, err := common.ListWithFilter(c.store, p)
+		if err == nil {
+			return logs, nil
+		}
+		log.Warningf("failed to list logs in datastore %s: %v", c.name, err)
+		if ret == nil {
+			ret = errors.Wrapf(err, "listing logs in %s", c.name)
+		}
+	}
+	return nil, ret
+}
+
+// Metadata returns the metadata of a log from the first datastore
+// that can answer, like List().
+func (m *MultiDatastore) Metadata(binaryName string) (common.LogMetadata, error) {
+	var ret error
+	for _, c := range m.children {
+		metadata, err := c.store.Metadata(binaryName)
+		if err == nil || err == common.LogNotFoundErr {
+			return metadata, err
+		}
+		log.Warningf("failed to fetch log metadata in datastore %s: %v", c.name, err)
+		if ret == nil {
+			ret = errors.Wrapf(err, "fetching log metadata in %s", c.name)
+		}
+	}
+	return common.LogMetadata{}, ret
+}
+
+func (m *MultiDatastore) Start() error {
+	for idx, c := range m.children {
+		if err := c.store.Start(); err != nil {
+			for _, started := range m.children[:idx] {
+				started.store.Stop()
+			}
+			return errors.Wrapf(err, "starting datastore %s", c.name)
+		}
+	}
+	for _, c := range m.children {
+		go c.run(m.stop)
+	}
+	go m.doWork()
+	return nil
+}
+
+func (m *MultiDatastore) Stop() error {
+	close(m.quit)
+	m.Wait()
+	return nil
+}
+
+func (m *MultiDatastore) Wait() {
+	<-m.closed
+}
+
+// multiReader reads from the primary datastore. If it fails before
+// returning any logs, the next datastore is tried. Errors after the
+// first chunk are returned as is, as the datastores may not agree
+// on the cursor.
+type multiReader struct {
+	ctx      context.Context
+	children []*child
+	params   params.QueryParams
+
+	current int
+	reader  common.Reader
+	started bool
+}
+
+func (m *multiReader) ReadNext() ([]byte, error) {
+	for {
+		if m.reader == nil {
+			m.reader = m.children[m.current].store.ResultReader(m.ctx, m.params)
+		}
+		data, err := m.reader.ReadNext()
+		if err == nil || err == io.EOF || m.started || m.current == len(m.children)-1 {
+			m.started = m.started || err == nil
+			return data, err
+		}
+		log.Warningf("failed to read logs from datastore %s, trying %s: %v",
+			m.children[m.current].name, m.children[m.current+1].name, err)
+		m.current++
+		m.reader = nil
+	}
+}
+
+func (m *multiReader) Cursor() string {
+	if m.reader == nil {
+		return ""
+	}
+	return m.reader.Cursor()
+}
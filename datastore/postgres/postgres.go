@@ -0,0 +1,590 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.postgres")
+
+const (
+	// maxPendingMessages is the number of buffered messages after which
+	// a write will trigger a flush, regardless of the write interval.
+	maxPendingMessages = 20000
+	// readChunkSize is the number of rows fetched by a reader on each
+	// call to ReadNext().
+	readChunkSize = 20000
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS logs (
+		id BIGSERIAL PRIMARY KEY,
+		binary_name TEXT NOT NULL,
+		hostname TEXT NOT NULL,
+		severity SMALLINT NOT NULL,
+		facility SMALLINT NOT NULL,
+		timestamp TIMESTAMPTZ NOT NULL,
+		message TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS logs_binary_name_timestamp_idx ON logs (binary_name, timestamp)`,
+	// Added after the table was first created, so the tables of
+	// older releases are migrated.
+	`ALTER TABLE logs ADD COLUMN IF NOT EXISTS source_addr TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE logs ADD COLUMN IF NOT EXISTS structured_data JSONB`,
+	`ALTER TABLE logs ADD COLUMN IF NOT EXISTS msg_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE logs ADD COLUMN IF NOT EXISTS cluster_id TEXT NOT NULL DEFAULT ''`,
+}
+
+// NewPostgresDatastore returns a PostgreSQL datastore. If clusterID is
+// set, it is stored with every message.
+func NewPostgresDatastore(ctx context.Context, cfg *config.Postgres, clusterID string) (common.DataStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating postgres config")
+	}
+
+	db, err := sql.Open("postgres", cfg.ConnectionString())
+	if err != nil {
+		return nil, errors.Wrap(err, "opening postgres connection")
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "connecting to postgres")
+	}
+
+	store := &PostgresDataStore{
+		cfg:       cfg,
+		db:        db,
+		messages:  []logging.LogMessage{},
+		ctx:       ctx,
+		closed:    make(chan struct{}),
+		quit:      make(chan struct{}),
+		clusterID: clusterID,
+	}
+
+	if err := store.createSchema(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "creating schema")
+	}
+	return store, nil
+}
+
+var _ common.DataStore = (*PostgresDataStore)(nil)
+
+type PostgresDataStore struct {
+	cfg      *config.Postgres
+	db       *sql.DB
+	mut      sync.Mutex
+	messages []logging.LogMessage
+	ctx      context.Context
+	closed   chan struct{}
+	quit     chan struct{}
+
+	// timescale is true if the logs table is a TimescaleDB
+	// hypertable.
+	timescale bool
+	// clusterID is stored as the cluster_id of every message.
+	clusterID string
+}
+
+func (p *PostgresDataStore) createSchema() error {
+	for _, stmt := range schema {
+		if _, err := p.db.ExecContext(p.ctx, stmt); err != nil {
+			return errors.Wrap(err, "executing schema statement")
+		}
+	}
+
+	timescale, err := p.useTimescale()
+	if err != nil {
+		return errors.Wrap(err, "checking for timescaledb")
+	}
+	if !timescale {
+		return nil
+	}
+	if err := p.createHypertable(); err != nil {
+		return errors.Wrap(err, "setting up timescaledb")
+	}
+	p.timescale = true
+	return nil
+}
+
+func (p *PostgresDataStore) doWork() {
+	var interval int
+	if p.cfg.WriteInterval == 0 {
+		interval = 1
+	} else {
+		interval = p.cfg.WriteInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	rotationTicker := time.NewTicker(1 * time.Hour)
+	defer func() {
+		ticker.Stop()
+		rotationTicker.Stop()
+		if err := p.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
+		p.db.Close()
+		close(p.closed)
+	}()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.flush(); err != nil {
+				log.Errorf("failed to flush logs to backend: %v", err)
+			}
+		case <-rotationTicker.C:
+			if p.timescale {
+				// Old chunks are dropped by the retention policy.
+				continue
+			}
+			retentionPeriod := p.cfg.GetLogRetention()
+			log.Infof("deleting logs older than %d days", retentionPeriod)
+			day := 24 * time.Hour
+			olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+			if err := p.Rotate(olderThan); err != nil {
+				log.Errorf("failed to rotate logs: %v", err)
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *PostgresDataStore) Start() error {
+	go p.doWork()
+	return nil
+}
+
+func (p *PostgresDataStore) Stop() error {
+	close(p.quit)
+	p.Wait()
+	return nil
+}
+
+func (p *PostgresDataStore) Wait() {
+	<-p.closed
+}
+
+func (p *PostgresDataStore) flush() error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.flushLocked()
+}
+
+// flushLocked writes all pending messages to the database using
+// COPY. The caller must hold p.mut.
+func (p *PostgresDataStore) flushLocked() error {
+	if len(p.messages) == 0 {
+		return nil
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	stmt, err := tx.Prepare(pq.CopyIn(
+		"logs", "binary_name", "hostname", "severity",
+		"facility", "timestamp", "message", "source_addr",
+		"structured_data", "msg_id", "cluster_id"))
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "preparing statement")
+	}
+	for _, msg := range p.messages {
+		// The structured data of messages without any is NULL.
+		var structuredData interface{}
+		if len(msg.StructuredData) > 0 {
+			encoded, err := json.Marshal(msg.StructuredData)
+			if err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return errors.Wrap(err, "encoding structured data")
+			}
+			structuredData = string(encoded)
+		}
+		if _, err := stmt.Exec(
+			msg.AppName, msg.Hostname, int(msg.Severity),
+			int(msg.Facility), msg.Timestamp, msg.Message, msg.SourceAddr,
+			structuredData, msg.MsgID, p.clusterID); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return errors.Wrap(err, "copying log message")
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return errors.Wrap(err, "flushing copy statement")
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "closing statement")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+	p.messages = []logging.LogMessage{}
+	return nil
+}
+
+func (p *PostgresDataStore) Write(logMsg logging.LogMessage) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	p.messages = append(p.messages, logMsg)
+	if len(p.messages) >= maxPendingMessages {
+		if err := p.flushLocked(); err != nil {
+			return errors.Wrap(err, "flushing logs")
+		}
+	}
+	return nil
+}
+
+func (p *PostgresDataStore) Rotate(olderThan time.Time) error {
+	if p.timescale {
+		return p.dropChunks(olderThan)
+	}
+	if _, err := p.db.Exec(`DELETE FROM logs WHERE timestamp < $1`, olderThan); err != nil {
+		return errors.Wrap(err, "deleting old logs")
+	}
+	return nil
+}
+
+// Delete removes the rows of a log older than olderThan, or all of
+// them if it is zero. Pending messages are written first, so they do
+// not recreate it.
+func (p *PostgresDataStore) Delete(binaryName string, olderThan time.Time) error {
+	if err := p.flush(); err != nil {
+		log.Warningf("failed to flush logs before deleting %q: %v", binaryName, err)
+	}
+	var res sql.Result
+	var err error
+	if olderThan.IsZero() {
+		res, err = p.db.Exec(`DELETE FROM logs WHERE binary_name = $1`, binaryName)
+	} else {
+		res, err = p.db.Exec(
+			`DELETE FROM logs WHERE binary_name = $1 AND timestamp < $2`, binaryName, olderThan)
+	}
+	if err != nil {
+		return errors.Wrap(err, "deleting log")
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "fetching deleted rows")
+	}
+	if deleted > 0 {
+		return nil
+	}
+	// Nothing may be old enough to be deleted from an existing log.
+	var exists bool
+	err = p.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM logs WHERE binary_name = $1)`, binaryName).Scan(&exists)
+	if err != nil {
+		return errors.Wrap(err, "checking log")
+	}
+	if !exists {
+		return common.LogNotFoundErr
+	}
+	return nil
+}
+
+// Metadata summarizes the rows of a log. Pending messages are written
+// first, so they are included.
+func (p *PostgresDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	p.flush()
+	var first, last sql.NullTime
+	ret := common.LogMetadata{}
+	err := p.db.QueryRow(
+		`SELECT COUNT(*), MIN(timestamp), MAX(timestamp), COALESCE(SUM(OCTET_LENGTH(message)), 0) FROM logs WHERE binary_name = $1`,
+		binaryName).Scan(&ret.Count, &first, &last, &ret.Size)
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "fetching log metadata")
+	}
+	if ret.Count == 0 {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	ret.FirstTimestamp = first.Time
+	ret.LastTimestamp = last.Time
+	return ret, nil
+}
+
+// HealthCheck pings the database server.
+func (p *PostgresDataStore) HealthCheck(ctx context.Context) error {
+	if err := p.db.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "pinging postgres")
+	}
+	return nil
+}
+
+func (p *PostgresDataStore) ResultReader(ctx context.Context, params params.QueryParams) common.Reader {
+	return &postgresReader{
+		datastore: p,
+		params:    params,
+		cursor:    params.Cursor,
+	}
+}
+
+func (p *PostgresDataStore) List() ([]map[string]string, error) {
+	rows, err := p.db.Query(`SELECT DISTINCT binary_name FROM logs ORDER BY binary_name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	defer rows.Close()
+
+	ret := []map[string]string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "fetching response")
+		}
+		ret = append(ret, map[string]string{"log_name": name})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "fetching response")
+	}
+	return ret, nil
+}
+
+// postgresReader pages through a log in timestamp order. Each call to
+// ReadNext() fetches at most readChunkSize rows, continuing after the
+// last (timestamp, id) pair seen in the previous chunk. With the desc
+// order, the newest messages are fetched at once, and returned oldest
+// first.
+type postgresReader struct {
+	datastore *PostgresDataStore
+	params    params.QueryParams
+
+	lastTimestamp time.Time
+	lastID        int64
+	// hasPosition is true once lastTimestamp and lastID point to a row,
+	// either read from the database or decoded from a cursor.
+	hasPosition bool
+	started     bool
+	done        bool
+	cursor      string
+	// read is the number of messages returned so far.
+	read int
+	// offsetApplied is true once a query skipped the offset.
+	offsetApplied bool
+}
+
+// init flushes pending messages and positions the reader after the
+// cursor it was created with, if any.
+func (p *postgresReader) init() error {
+	p.started = true
+	p.datastore.flush()
+	if p.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(p.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	id, err := strconv.ParseInt(cursor.Key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	p.lastTimestamp = time.Unix(0, cursor.Timestamp)
+	p.lastID = id
+	p.hasPosition = true
+	return nil
+}
+
+func (p *postgresReader) chunkSize() int {
+	if p.params.Limit > 0 && p.params.Limit-p.read < readChunkSize {
+		return p.params.Limit - p.read
+	}
+	return readChunkSize
+}
+
+func (p *postgresReader) prepareQuery() (string, []interface{}, error) {
+	if p.params.AppName == "" {
+		return "", nil, fmt.Errorf("missing application name")
+	}
+
+	args := []interface{}{p.params.AppName}
+	conditions := []string{"binary_name = $1"}
+	addCondition := func(cond string, val interface{}) {
+		args = append(args, val)
+		conditions = append(conditions, fmt.Sprintf(cond, len(args)))
+	}
+
+	if !p.params.StartDate.IsZero() {
+		addCondition("timestamp >= $%d", p.params.StartDate)
+	}
+	if !p.params.EndDate.IsZero() {
+		addCondition("timestamp <= $%d", p.params.EndDate)
+	}
+	if p.params.Hostname != "" {
+		addCondition("hostname = $%d", p.params.Hostname)
+	}
+	if p.params.SourceAddr != "" {
+		addCondition("source_addr = $%d", p.params.SourceAddr)
+	}
+	if p.params.Severity != nil {
+		addCondition("severity <= $%d", int(*p.params.Severity))
+	}
+	if p.params.Facility != nil {
+		addCondition("facility = $%d", int(*p.params.Facility))
+	}
+	if p.params.MsgID != "" {
+		addCondition("msg_id = $%d", p.params.MsgID)
+	}
+	if p.params.ClusterID != "" {
+		addCondition("cluster_id = $%d", p.params.ClusterID)
+	}
+	// Structured data parameters are matched by name, in any of the
+	// elements of a message. Sorted, so identical requests send
+	// identical queries.
+	sdNames := make([]string, 0, len(p.params.StructuredData))
+	for name := range p.params.StructuredData {
+		sdNames = append(sdNames, name)
+	}
+	sort.Strings(sdNames)
+	for _, name := range sdNames {
+		args = append(args, name, p.params.StructuredData[name])
+		conditions = append(conditions, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM jsonb_each(structured_data) AS sd WHERE sd.value ->> $%d = $%d)",
+			len(args)-1, len(args)))
+	}
+	if p.hasPosition {
+		args = append(args, p.lastTimestamp, p.lastID)
+		conditions = append(
+			conditions,
+			fmt.Sprintf("(timestamp, id) > ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	q := fmt.Sprintf(
+		`SELECT id, timestamp, message FROM logs WHERE %s`, strings.Join(conditions, " AND "))
+	if p.params.Order == params.OrderDesc {
+		q += ` ORDER BY timestamp DESC, id DESC`
+		if p.params.Limit > 0 {
+			q += fmt.Sprintf(` LIMIT %d`, p.params.Limit)
+		}
+	} else {
+		q += fmt.Sprintf(` ORDER BY timestamp, id LIMIT %d`, p.chunkSize())
+	}
+	// The offset only applies to the first chunk, the following ones
+	// continue after the last row read.
+	if p.params.Offset > 0 && !p.offsetApplied {
+		q += fmt.Sprintf(` OFFSET %d`, p.params.Offset)
+	}
+	return q, args, nil
+}
+
+var _ common.Reader = (*postgresReader)(nil)
+
+// postgresRow is a row returned by the query of a postgresReader.
+type postgresRow struct {
+	id        int64
+	timestamp time.Time
+	message   string
+}
+
+func (p *postgresReader) ReadNext() ([]byte, error) {
+	if p.done {
+		return nil, io.EOF
+	}
+
+	if !p.started {
+		if err := p.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+	}
+
+	chunkSize := p.chunkSize()
+	query, args, err := p.prepareQuery()
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing query")
+	}
+	rows, err := p.datastore.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "executing query")
+	}
+	defer rows.Close()
+	p.offsetApplied = true
+
+	results := []postgresRow{}
+	for rows.Next() {
+		var row postgresRow
+		if err := rows.Scan(&row.id, &row.timestamp, &row.message); err != nil {
+			return nil, errors.Wrap(err, "reading results")
+		}
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading results")
+	}
+	if p.params.Order == params.OrderDesc {
+		// All the newest messages were fetched.
+		p.done = true
+		for left, right := 0, len(results)-1; left < right; left, right = left+1, right-1 {
+			results[left], results[right] = results[right], results[left]
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	for _, row := range results {
+		p.lastID, p.lastTimestamp = row.id, row.timestamp
+		p.hasPosition = true
+		if _, err := buf.WriteString(row.message); err != nil {
+			return nil, errors.Wrap(err, "reading value")
+		}
+		if len(row.message) > 0 && row.message[len(row.message)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	count := len(results)
+	p.read += count
+	if count > 0 {
+		p.cursor = common.EncodeCursor(common.Cursor{
+			Timestamp: p.lastTimestamp.UnixNano(),
+			Key:       strconv.FormatInt(p.lastID, 10),
+		})
+	}
+
+	if count < chunkSize || (p.params.Limit > 0 && p.read >= p.params.Limit) {
+		p.done = true
+	}
+	if count == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (p *postgresReader) Cursor() string {
+	return p.cursor
+}
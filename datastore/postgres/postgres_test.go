@@ -0,0 +1,76 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package postgres
+
+import (
+	"fmt"
+	"testing"
+
+	"coriolis-logger/params"
+)
+
+func TestPrepareQuery(t *testing.T) {
+	tests := []struct {
+		params   params.QueryParams
+		expected string
+		args     []interface{}
+	}{
+		{
+			params.QueryParams{Limit: 10},
+			`SELECT id, timestamp, message FROM logs WHERE binary_name = $1 ORDER BY timestamp, id LIMIT 10`,
+			[]interface{}{"coriolis-worker"},
+		},
+		{
+			params.QueryParams{Limit: 10, Offset: 5},
+			`SELECT id, timestamp, message FROM logs WHERE binary_name = $1 ORDER BY timestamp, id LIMIT 10 OFFSET 5`,
+			[]interface{}{"coriolis-worker"},
+		},
+		{
+			params.QueryParams{Limit: 10, Offset: 5, Order: params.OrderDesc},
+			`SELECT id, timestamp, message FROM logs WHERE binary_name = $1 ORDER BY timestamp DESC, id DESC LIMIT 10 OFFSET 5`,
+			[]interface{}{"coriolis-worker"},
+		},
+		{
+			params.QueryParams{MsgID: "ID47", ClusterID: "cluster-a"},
+			`SELECT id, timestamp, message FROM logs WHERE binary_name = $1 AND msg_id = $2 AND cluster_id = $3 ORDER BY timestamp, id LIMIT 20000`,
+			[]interface{}{"coriolis-worker", "ID47", "cluster-a"},
+		},
+	}
+	for _, tt := range tests {
+		tt.params.AppName = "coriolis-worker"
+		reader := &postgresReader{params: tt.params}
+		q, args, err := reader.prepareQuery()
+		if err != nil {
+			t.Fatalf("%+v: failed to prepare query: %v", tt.params, err)
+		}
+		if q != tt.expected {
+			t.Errorf("%+v: expected query %q, got %q", tt.params, tt.expected, q)
+		}
+		if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+			t.Errorf("%+v: expected arguments %v, got %v", tt.params, tt.args, args)
+		}
+	}
+
+	// The offset only applies to the first chunk.
+	reader := &postgresReader{params: params.QueryParams{AppName: "coriolis-worker", Offset: 5}, offsetApplied: true}
+	q, _, err := reader.prepareQuery()
+	if err != nil {
+		t.Fatalf("failed to prepare query: %v", err)
+	}
+	expected := `SELECT id, timestamp, message FROM logs WHERE binary_name = $1 ORDER BY timestamp, id LIMIT 20000`
+	if q != expected {
+		t.Errorf("expected query %q, got %q", expected, q)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+)
+
+// hasTimescale returns true if the timescaledb extension is installed
+// in the database.
+func (p *PostgresDataStore) hasTimescale() (bool, error) {
+	var installed bool
+	err := p.db.QueryRowContext(p.ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&installed)
+	if err != nil {
+		return false, errors.Wrap(err, "checking for timescaledb extension")
+	}
+	return installed, nil
+}
+
+// useTimescale returns true if the logs table should be a hypertable.
+func (p *PostgresDataStore) useTimescale() (bool, error) {
+	switch p.cfg.GetTimescale() {
+	case config.TimescaleDisabled:
+		return false, nil
+	case config.TimescaleEnabled:
+		installed, err := p.hasTimescale()
+		if err != nil {
+			return false, err
+		}
+		if !installed {
+			return false, fmt.Errorf("timescale is enabled, but the timescaledb extension is not installed")
+		}
+		return true, nil
+	default:
+		return p.hasTimescale()
+	}
+}
+
+// createHypertable turns the logs table into a hypertable partitioned
+// on the timestamp column, sets up compression of old chunks and a
+// retention policy dropping chunks older than the log retention
+// period. Existing plain tables are converted, which moves their rows
+// into chunks and may take a while on large tables.
+func (p *PostgresDataStore) createHypertable() error {
+	var isHypertable, compressionEnabled bool
+	err := p.db.QueryRowContext(p.ctx,
+		`SELECT compression_enabled FROM timescaledb_information.hypertables
+		WHERE hypertable_schema = current_schema() AND hypertable_name = 'logs'`).Scan(&compressionEnabled)
+	switch err {
+	case nil:
+		isHypertable = true
+	case sql.ErrNoRows:
+	default:
+		return errors.Wrap(err, "fetching hypertable details")
+	}
+
+	if !isHypertable {
+		log.Infof("converting logs table to a timescaledb hypertable")
+		// Unique indexes on a hypertable must include the partitioning
+		// column. Rows are paged by (timestamp, id), so the primary key
+		// on id alone is not needed.
+		if _, err := p.db.ExecContext(p.ctx, `ALTER TABLE logs DROP CONSTRAINT IF EXISTS logs_pkey`); err != nil {
+			return errors.Wrap(err, "dropping primary key")
+		}
+		if _, err := p.db.ExecContext(p.ctx,
+			`SELECT create_hypertable('logs', 'timestamp', chunk_time_interval => INTERVAL '1 day', migrate_data => TRUE)`); err != nil {
+			return errors.Wrap(err, "creating hypertable")
+		}
+	}
+
+	if !compressionEnabled {
+		if _, err := p.db.ExecContext(p.ctx,
+			`ALTER TABLE logs SET (timescaledb.compress, timescaledb.compress_segmentby = 'binary_name', timescaledb.compress_orderby = 'timestamp, id')`); err != nil {
+			return errors.Wrap(err, "enabling compression")
+		}
+	}
+
+	// Policies are replaced, so changes to the config are applied on
+	// the next start.
+	compressAfter := fmt.Sprintf("%d days", p.cfg.GetCompressAfter())
+	if _, err := p.db.ExecContext(p.ctx, `SELECT remove_compression_policy('logs', if_exists => TRUE)`); err != nil {
+		return errors.Wrap(err, "removing compression policy")
+	}
+	if _, err := p.db.ExecContext(p.ctx, `SELECT add_compression_policy('logs', $1::interval)`, compressAfter); err != nil {
+		return errors.Wrap(err, "adding compression policy")
+	}
+
+	retention := fmt.Sprintf("%d days", p.cfg.GetLogRetention())
+	if _, err := p.db.ExecContext(p.ctx, `SELECT remove_retention_policy('logs', if_exists => TRUE)`); err != nil {
+		return errors.Wrap(err, "removing retention policy")
+	}
+	if _, err := p.db.ExecContext(p.ctx, `SELECT add_retention_policy('logs', $1::interval)`, retention); err != nil {
+		return errors.Wrap(err, "adding retention policy")
+	}
+	return nil
+}
+
+// dropChunks removes the chunks holding only logs older than the given
+// time. Rows in chunks that also hold newer logs are kept until the
+// whole chunk expires.
+func (p *PostgresDataStore) dropChunks(olderThan time.Time) error {
+	if _, err := p.db.Exec(`SELECT drop_chunks('logs', older_than => $1::timestamptz)`, olderThan); err != nil {
+		return errors.Wrap(err, "dropping old chunks")
+	}
+	return nil
+}
@@ -0,0 +1,517 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package redis
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.redis")
+
+const (
+	// maxPendingMessages is the number of buffered messages after which
+	// a write will trigger a flush, regardless of the write interval.
+	maxPendingMessages = 20000
+	// readChunkSize is the number of stream entries fetched by a reader
+	// on each XRANGE call.
+	readChunkSize = 10000
+	// scanCount is the number of keys we ask redis to look at on
+	// each SCAN call.
+	scanCount = 1000
+)
+
+func NewRedisDatastore(ctx context.Context, cfg *config.Redis) (common.DataStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating redis config")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config")
+	}
+
+	client := goredis.NewClient(&goredis.Options{
+		Addr:      cfg.Address,
+		Password:  cfg.Password,
+		DB:        cfg.DB,
+		TLSConfig: tlsCfg,
+	})
+
+	return &RedisDataStore{
+		cfg:      cfg,
+		client:   client,
+		prefix:   cfg.GetKeyPrefix(),
+		messages: []logging.LogMessage{},
+		ctx:      ctx,
+		closed:   make(chan struct{}),
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+var _ common.DataStore = (*RedisDataStore)(nil)
+
+// RedisDataStore keeps the logs of each application in a redis
+// stream, capped at roughly max_len entries. Entry IDs are assigned
+// by redis, so they reflect the time a message was stored.
+type RedisDataStore struct {
+	cfg      *config.Redis
+	client   *goredis.Client
+	prefix   string
+	mut      sync.Mutex
+	messages []logging.LogMessage
+	ctx      context.Context
+	closed   chan struct{}
+	quit     chan struct{}
+}
+
+func (r *RedisDataStore) streamKey(appName string) string {
+	return r.prefix + appName
+}
+
+func (r *RedisDataStore) doWork() {
+	var interval int
+	if r.cfg.WriteInterval == 0 {
+		interval = 1
+	} else {
+		interval = r.cfg.WriteInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	rotationTicker := time.NewTicker(1 * time.Hour)
+	defer func() {
+		ticker.Stop()
+		rotationTicker.Stop()
+		if err := r.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
+		r.client.Close()
+		close(r.closed)
+	}()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				log.Errorf("failed to flush logs to backend: %v", err)
+			}
+		case <-rotationTicker.C:
+			retentionPeriod := r.cfg.GetLogRetention()
+			log.Infof("deleting logs older than %d days", retentionPeriod)
+			day := 24 * time.Hour
+			olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+			if err := r.Rotate(olderThan); err != nil {
+				log.Errorf("failed to rotate logs: %v", err)
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *RedisDataStore) Start() error {
+	if err := r.client.Ping(r.ctx).Err(); err != nil {
+		return errors.Wrap(err, "connecting to redis")
+	}
+	go r.doWork()
+	return nil
+}
+
+func (r *RedisDataStore) Stop() error {
+	close(r.quit)
+	r.Wait()
+	return nil
+}
+
+func (r *RedisDataStore) Wait() {
+	<-r.closed
+}
+
+func (r *RedisDataStore) flush() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.flushLocked()
+}
+
+// flushLocked adds all pending messages to their streams, in a single
+// pipeline. The caller must hold r.mut.
+func (r *RedisDataStore) flushLocked() error {
+	if len(r.messages) == 0 {
+		return nil
+	}
+
+	// Use a background context, so pending messages are still
+	// written once our context is canceled.
+	ctx := context.Background()
+	maxLen := r.cfg.GetMaxLen()
+	pipe := r.client.Pipeline()
+	for _, msg := range r.messages {
+		pipe.XAdd(ctx, &goredis.XAddArgs{
+			Stream:       r.streamKey(msg.AppName),
+			MaxLenApprox: maxLen,
+			Values: []interface{}{
+				"timestamp", msg.Timestamp.UnixNano(),
+				"hostname", msg.Hostname,
+				"priority", msg.Priority,
+				"severity", int(msg.Severity),
+				"facility", int(msg.Facility),
+				"proc_id", msg.ProcID,
+				"msg_id", msg.MsgID,
+				"message", msg.Message,
+				"source_addr", msg.SourceAddr,
+			},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	// Messages are not retried, as a failed pipeline may have been
+	// partially applied.
+	r.messages = []logging.LogMessage{}
+	if err != nil {
+		return errors.Wrap(err, "adding messages to streams")
+	}
+	return nil
+}
+
+func (r *RedisDataStore) Write(logMsg logging.LogMessage) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.messages = append(r.messages, logMsg)
+	if len(r.messages) >= maxPendingMessages {
+		if err := r.flushLocked(); err != nil {
+			return errors.Wrap(err, "flushing logs")
+		}
+	}
+	return nil
+}
+
+// streamKeys returns the keys of all log streams.
+func (r *RedisDataStore) streamKeys() ([]string, error) {
+	seen := map[string]bool{}
+	keys := []string{}
+	iter := r.client.Scan(r.ctx, 0, r.prefix+"*", scanCount).Iterator()
+	for iter.Next(r.ctx) {
+		key := iter.Val()
+		// SCAN may return the same key more than once.
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanning keys")
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Rotate deletes all entries added before olderThan from all log
+// streams. This relies on XTRIM MINID, available since redis 6.2.
+func (r *RedisDataStore) Rotate(olderThan time.Time) error {
+	keys, err := r.streamKeys()
+	if err != nil {
+		return errors.Wrap(err, "listing streams")
+	}
+	minID := strconv.FormatInt(olderThan.UnixNano()/int64(time.Millisecond), 10)
+	for _, key := range keys {
+		if err := r.client.Do(r.ctx, "XTRIM", key, "MINID", minID).Err(); err != nil {
+			return errors.Wrapf(err, "trimming %q", key)
+		}
+	}
+	return nil
+}
+
+// Delete removes the stream holding a log, or only trims the entries
+// added before olderThan, if set. Pending messages are written first,
+// so they do not recreate it.
+func (r *RedisDataStore) Delete(binaryName string, olderThan time.Time) error {
+	if err := r.flush(); err != nil {
+		log.Warningf("failed to flush logs before deleting %q: %v", binaryName, err)
+	}
+	if !olderThan.IsZero() {
+		key := r.streamKey(binaryName)
+		exists, err := r.client.Exists(r.ctx, key).Result()
+		if err != nil {
+			return errors.Wrap(err, "checking stream")
+		}
+		if exists == 0 {
+			return common.LogNotFoundErr
+		}
+		minID := strconv.FormatInt(olderThan.UnixNano()/int64(time.Millisecond), 10)
+		if err := r.client.Do(r.ctx, "XTRIM", key, "MINID", minID).Err(); err != nil {
+			return errors.Wrapf(err, "trimming %q", key)
+		}
+		return nil
+	}
+	deleted, err := r.client.Del(r.ctx, r.streamKey(binaryName)).Result()
+	if err != nil {
+		return errors.Wrap(err, "deleting stream")
+	}
+	if deleted == 0 {
+		return common.LogNotFoundErr
+	}
+	return nil
+}
+
+// entryTimestamp returns the time a stream entry was logged at.
+func entryTimestamp(entry goredis.XMessage) time.Time {
+	timestamp, _ := strconv.ParseInt(fmt.Sprintf("%v", entry.Values["timestamp"]), 10, 64)
+	return time.Unix(0, timestamp)
+}
+
+// Metadata summarizes the stream holding a log. The first and last
+// timestamps are the ones of the oldest and newest entries stored,
+// and the size is the memory used by the stream. Pending messages are
+// written first, so they are included.
+func (r *RedisDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	r.flush()
+	key := r.streamKey(binaryName)
+	count, err := r.client.XLen(r.ctx, key).Result()
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "fetching stream length")
+	}
+	if count == 0 {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	first, err := r.client.XRangeN(r.ctx, key, "-", "+", 1).Result()
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "fetching first entry")
+	}
+	last, err := r.client.XRevRangeN(r.ctx, key, "+", "-", 1).Result()
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "fetching last entry")
+	}
+	if len(first) == 0 || len(last) == 0 {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	size, err := r.client.MemoryUsage(r.ctx, key).Result()
+	if err != nil {
+		log.Warningf("failed to fetch memory usage of %q: %v", key, err)
+	}
+	return common.LogMetadata{
+		FirstTimestamp: entryTimestamp(first[0]),
+		LastTimestamp:  entryTimestamp(last[0]),
+		Count:          count,
+		Size:           size,
+	}, nil
+}
+
+// HealthCheck pings the redis server.
+func (r *RedisDataStore) HealthCheck(ctx context.Context) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return errors.Wrap(err, "pinging redis")
+	}
+	return nil
+}
+
+func (r *RedisDataStore) ResultReader(ctx context.Context, params params.QueryParams) common.Reader {
+	return &redisReader{
+		datastore: r,
+		params:    params,
+		cursor:    params.Cursor,
+	}
+}
+
+func (r *RedisDataStore) List() ([]map[string]string, error) {
+	keys, err := r.streamKeys()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	ret := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, map[string]string{
+			"log_name": strings.TrimPrefix(key, r.prefix),
+		})
+	}
+	return ret, nil
+}
+
+// nextID returns the smallest stream entry ID greater than id.
+func nextID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid stream ID %q", id)
+	}
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream ID %q", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream ID %q", id)
+	}
+	if seq == math.MaxUint64 {
+		return fmt.Sprintf("%d-0", ms+1), nil
+	}
+	return fmt.Sprintf("%d-%d", ms, seq+1), nil
+}
+
+// redisReader pages through a log stream with XRANGE. Stream entries
+// are filtered by hostname, severity and facility after being fetched.
+type redisReader struct {
+	datastore *RedisDataStore
+	params    params.QueryParams
+
+	// start and end are the XRANGE bounds of the next chunk.
+	start   string
+	end     string
+	started bool
+	done    bool
+	cursor  string
+	// read is the number of messages returned so far.
+	read int
+}
+
+// init flushes pending messages and computes the range of stream
+// entries to read, resuming after the cursor, if any.
+func (r *redisReader) init() error {
+	r.started = true
+	r.datastore.flush()
+
+	r.start = "-"
+	if !r.params.StartDate.IsZero() {
+		r.start = strconv.FormatInt(r.params.StartDate.UnixNano()/int64(time.Millisecond), 10)
+	}
+	r.end = "+"
+	if !r.params.EndDate.IsZero() {
+		r.end = strconv.FormatInt(r.params.EndDate.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	if r.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(r.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	start, err := nextID(cursor.Key)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	r.start = start
+	return nil
+}
+
+func (r *redisReader) matches(values map[string]interface{}) bool {
+	if r.params.Hostname != "" && values["hostname"] != r.params.Hostname {
+		return false
+	}
+	if r.params.SourceAddr != "" && values["source_addr"] != r.params.SourceAddr {
+		return false
+	}
+	if r.params.Severity != nil {
+		severity, err := strconv.Atoi(fmt.Sprintf("%v", values["severity"]))
+		if err != nil || severity > int(*r.params.Severity) {
+			return false
+		}
+	}
+	if r.params.Facility != nil {
+		facility, err := strconv.Atoi(fmt.Sprintf("%v", values["facility"]))
+		if err != nil || facility != int(*r.params.Facility) {
+			return false
+		}
+	}
+	return true
+}
+
+var _ common.Reader = (*redisReader)(nil)
+
+func (r *redisReader) ReadNext() ([]byte, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	if !r.started {
+		if r.params.AppName == "" {
+			return nil, fmt.Errorf("missing application name")
+		}
+		if err := common.CheckReadParams(r.params); err != nil {
+			return nil, err
+		}
+		if err := r.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+	}
+
+	key := r.datastore.streamKey(r.params.AppName)
+	buf := bytes.NewBuffer([]byte{})
+	var count int
+	// Keep reading until a chunk yields messages matching the filters,
+	// or the stream is exhausted.
+	for count == 0 && !r.done {
+		entries, err := r.datastore.client.XRangeN(
+			r.datastore.ctx, key, r.start, r.end, readChunkSize).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "executing query")
+		}
+		if len(entries) < readChunkSize {
+			r.done = true
+		}
+		for _, entry := range entries {
+			start, err := nextID(entry.ID)
+			if err != nil {
+				return nil, errors.Wrap(err, "reading results")
+			}
+			r.start = start
+			if !r.matches(entry.Values) {
+				continue
+			}
+			message, _ := entry.Values["message"].(string)
+			if _, err := buf.WriteString(message); err != nil {
+				return nil, errors.Wrap(err, "reading value")
+			}
+			if len(message) > 0 && message[len(message)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+			count++
+			timestamp, _ := strconv.ParseInt(fmt.Sprintf("%v", entry.Values["timestamp"]), 10, 64)
+			r.cursor = common.EncodeCursor(common.Cursor{
+				Timestamp: timestamp,
+				Key:       entry.ID,
+			})
+			if r.params.Limit > 0 && r.read+count >= r.params.Limit {
+				r.done = true
+				break
+			}
+		}
+	}
+	r.read += count
+
+	if count == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *redisReader) Cursor() string {
+	return r.cursor
+}
@@ -0,0 +1,582 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	// registers the sqlite3 database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+var log = loggo.GetLogger("coriolis.logger.datastore.sqlite")
+
+const (
+	// maxPendingMessages is the number of buffered messages after which
+	// a write will trigger a flush, regardless of the write interval.
+	maxPendingMessages = 20000
+	// readChunkSize is the number of rows fetched by a reader on each
+	// call to ReadNext().
+	readChunkSize = 20000
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS logs (
+		binary_name TEXT NOT NULL,
+		hostname TEXT NOT NULL,
+		severity INTEGER NOT NULL,
+		facility INTEGER NOT NULL,
+		timestamp INTEGER NOT NULL,
+		message TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS logs_binary_name_idx ON logs (binary_name)`,
+	`CREATE INDEX IF NOT EXISTS logs_timestamp_idx ON logs (timestamp)`,
+}
+
+// addedColumns holds the definitions of the columns added after the
+// logs table was first created, by name, so the tables of older
+// releases are migrated.
+var addedColumns = []struct {
+	name       string
+	definition string
+}{
+	{name: "source_addr", definition: "TEXT NOT NULL DEFAULT ''"},
+	{name: "structured_data", definition: "TEXT"},
+	{name: "msg_id", definition: "TEXT NOT NULL DEFAULT ''"},
+	{name: "cluster_id", definition: "TEXT NOT NULL DEFAULT ''"},
+}
+
+// NewSQLiteDatastore returns a SQLite datastore. If clusterID is set,
+// it is stored with every message.
+func NewSQLiteDatastore(ctx context.Context, cfg *config.SQLite, clusterID string) (common.DataStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating sqlite config")
+	}
+
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", cfg.Path)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening sqlite database")
+	}
+
+	return &SQLiteDataStore{
+		cfg:       cfg,
+		db:        db,
+		messages:  []logging.LogMessage{},
+		ctx:       ctx,
+		closed:    make(chan struct{}),
+		quit:      make(chan struct{}),
+		clusterID: clusterID,
+	}, nil
+}
+
+var _ common.DataStore = (*SQLiteDataStore)(nil)
+
+type SQLiteDataStore struct {
+	cfg      *config.SQLite
+	db       *sql.DB
+	mut      sync.Mutex
+	messages []logging.LogMessage
+	ctx      context.Context
+	closed   chan struct{}
+	quit     chan struct{}
+
+	// clusterID is stored as the cluster_id of every message.
+	clusterID string
+}
+
+func (s *SQLiteDataStore) createSchema() error {
+	for _, stmt := range schema {
+		if _, err := s.db.ExecContext(s.ctx, stmt); err != nil {
+			return errors.Wrap(err, "executing schema statement")
+		}
+	}
+	for _, column := range addedColumns {
+		var count int
+		row := s.db.QueryRowContext(
+			s.ctx, `SELECT COUNT(*) FROM pragma_table_info('logs') WHERE name = ?`, column.name)
+		if err := row.Scan(&count); err != nil {
+			return errors.Wrapf(err, "checking for column %s", column.name)
+		}
+		if count > 0 {
+			continue
+		}
+		stmt := fmt.Sprintf(`ALTER TABLE logs ADD COLUMN %s %s`, column.name, column.definition)
+		if _, err := s.db.ExecContext(s.ctx, stmt); err != nil {
+			return errors.Wrapf(err, "adding column %s", column.name)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteDataStore) doWork() {
+	var interval int
+	if s.cfg.WriteInterval == 0 {
+		interval = 1
+	} else {
+		interval = s.cfg.WriteInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	rotationTicker := time.NewTicker(1 * time.Hour)
+	defer func() {
+		ticker.Stop()
+		rotationTicker.Stop()
+		if err := s.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
+		s.db.Close()
+		close(s.closed)
+	}()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				log.Errorf("failed to flush logs to backend: %v", err)
+			}
+		case <-rotationTicker.C:
+			retentionPeriod := s.cfg.GetLogRetention()
+			log.Infof("deleting logs older than %d days", retentionPeriod)
+			day := 24 * time.Hour
+			olderThan := time.Now().Add(time.Duration(-retentionPeriod) * day)
+			if err := s.Rotate(olderThan); err != nil {
+				log.Errorf("failed to rotate logs: %v", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *SQLiteDataStore) Start() error {
+	if err := s.createSchema(); err != nil {
+		return errors.Wrap(err, "creating schema")
+	}
+	go s.doWork()
+	return nil
+}
+
+func (s *SQLiteDataStore) Stop() error {
+	close(s.quit)
+	s.Wait()
+	return nil
+}
+
+func (s *SQLiteDataStore) Wait() {
+	<-s.closed
+}
+
+func (s *SQLiteDataStore) flush() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.flushLocked()
+}
+
+// flushLocked inserts all pending messages in a single transaction.
+// The caller must hold s.mut.
+func (s *SQLiteDataStore) flushLocked() error {
+	if len(s.messages) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	stmt, err := tx.Prepare(
+		`INSERT INTO logs (binary_name, hostname, severity, facility, timestamp, message, source_addr, structured_data, msg_id, cluster_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "preparing statement")
+	}
+	defer stmt.Close()
+
+	for _, msg := range s.messages {
+		// The structured data is stored as JSON, and is NULL for
+		// messages without any.
+		var structuredData interface{}
+		if len(msg.StructuredData) > 0 {
+			encoded, err := json.Marshal(msg.StructuredData)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "encoding structured data")
+			}
+			structuredData = string(encoded)
+		}
+		if _, err := stmt.Exec(
+			msg.AppName, msg.Hostname, int(msg.Severity),
+			int(msg.Facility), msg.Timestamp.UnixNano(), msg.Message, msg.SourceAddr,
+			structuredData, msg.MsgID, s.clusterID); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "inserting log message")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+	s.messages = []logging.LogMessage{}
+	return nil
+}
+
+func (s *SQLiteDataStore) Write(logMsg logging.LogMessage) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.messages = append(s.messages, logMsg)
+	if len(s.messages) >= maxPendingMessages {
+		if err := s.flushLocked(); err != nil {
+			return errors.Wrap(err, "flushing logs")
+		}
+	}
+	return nil
+}
+
+// Rotate deletes all messages older than olderThan, and reclaims the
+// space they used on disk.
+func (s *SQLiteDataStore) Rotate(olderThan time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM logs WHERE timestamp < ?`, olderThan.UnixNano()); err != nil {
+		return errors.Wrap(err, "deleting old logs")
+	}
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return errors.Wrap(err, "vacuuming database")
+	}
+	return nil
+}
+
+// Delete removes the rows of a log older than olderThan, or all of
+// them if it is zero. Pending messages are written first, so they do
+// not recreate it.
+func (s *SQLiteDataStore) Delete(binaryName string, olderThan time.Time) error {
+	if err := s.flush(); err != nil {
+		log.Warningf("failed to flush logs before deleting %q: %v", binaryName, err)
+	}
+	var res sql.Result
+	var err error
+	if olderThan.IsZero() {
+		res, err = s.db.Exec(`DELETE FROM logs WHERE binary_name = ?`, binaryName)
+	} else {
+		res, err = s.db.Exec(
+			`DELETE FROM logs WHERE binary_name = ? AND timestamp < ?`, binaryName, olderThan.UnixNano())
+	}
+	if err != nil {
+		return errors.Wrap(err, "deleting log")
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "fetching deleted rows")
+	}
+	if deleted > 0 {
+		return nil
+	}
+	// Nothing may be old enough to be deleted from an existing log.
+	var exists bool
+	err = s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM logs WHERE binary_name = ?)`, binaryName).Scan(&exists)
+	if err != nil {
+		return errors.Wrap(err, "checking log")
+	}
+	if !exists {
+		return common.LogNotFoundErr
+	}
+	return nil
+}
+
+// Metadata summarizes the rows of a log. Pending messages are written
+// first, so they are included.
+func (s *SQLiteDataStore) Metadata(binaryName string) (common.LogMetadata, error) {
+	s.flush()
+	var first, last sql.NullInt64
+	ret := common.LogMetadata{}
+	err := s.db.QueryRow(
+		`SELECT COUNT(*), MIN(timestamp), MAX(timestamp), COALESCE(SUM(LENGTH(CAST(message AS BLOB))), 0) FROM logs WHERE binary_name = ?`,
+		binaryName).Scan(&ret.Count, &first, &last, &ret.Size)
+	if err != nil {
+		return common.LogMetadata{}, errors.Wrap(err, "fetching log metadata")
+	}
+	if ret.Count == 0 {
+		return common.LogMetadata{}, common.LogNotFoundErr
+	}
+	ret.FirstTimestamp = time.Unix(0, first.Int64)
+	ret.LastTimestamp = time.Unix(0, last.Int64)
+	return ret, nil
+}
+
+// HealthCheck verifies the database can be queried.
+func (s *SQLiteDataStore) HealthCheck(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "pinging sqlite")
+	}
+	return nil
+}
+
+func (s *SQLiteDataStore) ResultReader(ctx context.Context, params params.QueryParams) common.Reader {
+	return &sqliteReader{
+		datastore: s,
+		params:    params,
+		cursor:    params.Cursor,
+	}
+}
+
+func (s *SQLiteDataStore) List() ([]map[string]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT binary_name FROM logs ORDER BY binary_name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	defer rows.Close()
+
+	ret := []map[string]string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "fetching response")
+		}
+		ret = append(ret, map[string]string{"log_name": name})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "fetching response")
+	}
+	return ret, nil
+}
+
+// sqliteReader pages through a log by rowid. Each call to ReadNext()
+// fetches at most readChunkSize rows, continuing after the last rowid
+// seen in the previous chunk. With the desc order, the newest messages
+// are fetched at once, and returned oldest first.
+type sqliteReader struct {
+	datastore *SQLiteDataStore
+	params    params.QueryParams
+
+	lastRowID int64
+	started   bool
+	done      bool
+	cursor    string
+	// read is the number of messages returned so far.
+	read int
+	// offsetApplied is true once a query skipped the offset.
+	offsetApplied bool
+}
+
+// init flushes pending messages and positions the reader after the
+// cursor it was created with, if any.
+func (s *sqliteReader) init() error {
+	s.started = true
+	s.datastore.flush()
+	if s.params.Cursor == "" {
+		return nil
+	}
+	cursor, err := common.DecodeCursor(s.params.Cursor)
+	if err != nil {
+		return errors.Wrap(err, "parsing cursor")
+	}
+	rowID, err := strconv.ParseInt(cursor.Key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	s.lastRowID = rowID
+	return nil
+}
+
+func (s *sqliteReader) chunkSize() int {
+	if s.params.Limit > 0 && s.params.Limit-s.read < readChunkSize {
+		return s.params.Limit - s.read
+	}
+	return readChunkSize
+}
+
+func (s *sqliteReader) prepareQuery() (string, []interface{}, error) {
+	if s.params.AppName == "" {
+		return "", nil, fmt.Errorf("missing application name")
+	}
+
+	conditions := []string{"binary_name = ?", "rowid > ?"}
+	args := []interface{}{s.params.AppName, s.lastRowID}
+
+	if !s.params.StartDate.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, s.params.StartDate.UnixNano())
+	}
+	if !s.params.EndDate.IsZero() {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, s.params.EndDate.UnixNano())
+	}
+	if s.params.Hostname != "" {
+		conditions = append(conditions, "hostname = ?")
+		args = append(args, s.params.Hostname)
+	}
+	if s.params.SourceAddr != "" {
+		conditions = append(conditions, "source_addr = ?")
+		args = append(args, s.params.SourceAddr)
+	}
+	if s.params.Severity != nil {
+		conditions = append(conditions, "severity <= ?")
+		args = append(args, int(*s.params.Severity))
+	}
+	if s.params.Facility != nil {
+		conditions = append(conditions, "facility = ?")
+		args = append(args, int(*s.params.Facility))
+	}
+	if s.params.MsgID != "" {
+		conditions = append(conditions, "msg_id = ?")
+		args = append(args, s.params.MsgID)
+	}
+	if s.params.ClusterID != "" {
+		conditions = append(conditions, "cluster_id = ?")
+		args = append(args, s.params.ClusterID)
+	}
+	// The JSON1 extension is not compiled in, so structured data
+	// parameters are matched on their encoded "name":"value" pair,
+	// in any of the elements of a message. Sorted, so identical
+	// requests send identical queries.
+	sdNames := make([]string, 0, len(s.params.StructuredData))
+	for name := range s.params.StructuredData {
+		sdNames = append(sdNames, name)
+	}
+	sort.Strings(sdNames)
+	for _, name := range sdNames {
+		encodedName, err := json.Marshal(name)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "encoding structured data name")
+		}
+		encodedValue, err := json.Marshal(s.params.StructuredData[name])
+		if err != nil {
+			return "", nil, errors.Wrap(err, "encoding structured data value")
+		}
+		conditions = append(conditions, "instr(structured_data, ?) > 0")
+		args = append(args, string(encodedName)+":"+string(encodedValue))
+	}
+
+	q := fmt.Sprintf(
+		`SELECT rowid, timestamp, message FROM logs WHERE %s`, strings.Join(conditions, " AND "))
+	limit := s.chunkSize()
+	if s.params.Order == params.OrderDesc {
+		q += ` ORDER BY rowid DESC`
+		// SQLite needs a limit to accept an offset, which -1 lifts.
+		limit = -1
+		if s.params.Limit > 0 {
+			limit = s.params.Limit
+		}
+	} else {
+		q += ` ORDER BY rowid`
+	}
+	q += fmt.Sprintf(` LIMIT %d`, limit)
+	// The offset only applies to the first chunk, the following ones
+	// continue after the last row read.
+	if s.params.Offset > 0 && !s.offsetApplied {
+		q += fmt.Sprintf(` OFFSET %d`, s.params.Offset)
+	}
+	return q, args, nil
+}
+
+var _ common.Reader = (*sqliteReader)(nil)
+
+// sqliteRow is a row returned by the query of a sqliteReader.
+type sqliteRow struct {
+	rowID     int64
+	timestamp int64
+	message   string
+}
+
+func (s *sqliteReader) ReadNext() ([]byte, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+
+	if !s.started {
+		if err := s.init(); err != nil {
+			return nil, errors.Wrap(err, "preparing reader")
+		}
+	}
+
+	chunkSize := s.chunkSize()
+	query, args, err := s.prepareQuery()
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing query")
+	}
+	rows, err := s.datastore.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "executing query")
+	}
+	defer rows.Close()
+	s.offsetApplied = true
+
+	results := []sqliteRow{}
+	for rows.Next() {
+		var row sqliteRow
+		if err := rows.Scan(&row.rowID, &row.timestamp, &row.message); err != nil {
+			return nil, errors.Wrap(err, "reading results")
+		}
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading results")
+	}
+	if s.params.Order == params.OrderDesc {
+		// All the newest messages were fetched.
+		s.done = true
+		for left, right := 0, len(results)-1; left < right; left, right = left+1, right-1 {
+			results[left], results[right] = results[right], results[left]
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	var timestamp int64
+	for _, row := range results {
+		s.lastRowID, timestamp = row.rowID, row.timestamp
+		if _, err := buf.WriteString(row.message); err != nil {
+			return nil, errors.Wrap(err, "reading value")
+		}
+		if len(row.message) > 0 && row.message[len(row.message)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	count := len(results)
+	s.read += count
+	if count > 0 {
+		s.cursor = common.EncodeCursor(common.Cursor{
+			Timestamp: timestamp,
+			Key:       strconv.FormatInt(s.lastRowID, 10),
+		})
+	}
+
+	if count < chunkSize || (s.params.Limit > 0 && s.read >= s.params.Limit) {
+		s.done = true
+	}
+	if count == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *sqliteReader) Cursor() string {
+	return s.cursor
+}
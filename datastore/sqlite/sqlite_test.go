@@ -0,0 +1,181 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// newTestDatastore returns a started datastore, storing messages in a
+// temporary database, with clusterID.
+func newTestDatastore(t *testing.T, clusterID string) *SQLiteDataStore {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "coriolis-logger-sqlite")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	store, err := NewSQLiteDatastore(context.Background(), &config.SQLite{
+		Path: filepath.Join(dir, "logs.db"),
+	}, clusterID)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	if err := store.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to start datastore: %v", err)
+	}
+	return store.(*SQLiteDataStore)
+}
+
+// stop stops store, and removes its database.
+func stop(t *testing.T, store *SQLiteDataStore) {
+	t.Helper()
+	if err := store.Stop(); err != nil {
+		t.Errorf("failed to stop datastore: %v", err)
+	}
+	os.RemoveAll(filepath.Dir(store.cfg.Path))
+}
+
+// writeMessages writes a message for each of msgIDs, one second apart,
+// numbered from 1.
+func writeMessages(t *testing.T, store *SQLiteDataStore, msgIDs ...string) {
+	t.Helper()
+	ts := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	for idx, msgID := range msgIDs {
+		err := store.Write(logging.LogMessage{
+			Timestamp: ts.Add(time.Duration(idx) * time.Second),
+			Hostname:  "coriolis",
+			Severity:  logging.Informational,
+			AppName:   "coriolis-worker",
+			MsgID:     msgID,
+			Message:   fmt.Sprint(idx + 1),
+			RFC:       logging.RFC5424,
+		})
+		if err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+}
+
+// readAll reads all the messages selected by p.
+func readAll(t *testing.T, store *SQLiteDataStore, p params.QueryParams) []string {
+	t.Helper()
+	reader := store.ResultReader(context.Background(), p)
+	var data []byte
+	for {
+		chunk, err := reader.ReadNext()
+		data = append(data, chunk...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read messages: %v", err)
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestReadOrderAndOffset(t *testing.T) {
+	store := newTestDatastore(t, "")
+	defer stop(t, store)
+	writeMessages(t, store, "", "", "", "", "")
+
+	tests := []struct {
+		params   params.QueryParams
+		expected string
+	}{
+		{params.QueryParams{Limit: 2}, "1|2"},
+		{params.QueryParams{Limit: 2, Offset: 1}, "2|3"},
+		{params.QueryParams{Offset: 3}, "4|5"},
+		// The newest messages are still returned oldest first.
+		{params.QueryParams{Limit: 2, Order: params.OrderDesc}, "4|5"},
+		{params.QueryParams{Limit: 2, Offset: 1, Order: params.OrderDesc}, "3|4"},
+		{params.QueryParams{Offset: 3, Order: params.OrderDesc}, "1|2"},
+	}
+	for _, tt := range tests {
+		tt.params.AppName = "coriolis-worker"
+		lines := readAll(t, store, tt.params)
+		if strings.Join(lines, "|") != tt.expected {
+			t.Errorf("%+v: expected %q, got %q", tt.params, tt.expected, lines)
+		}
+	}
+}
+
+func TestReadDescendingCursor(t *testing.T) {
+	store := newTestDatastore(t, "")
+	defer stop(t, store)
+	writeMessages(t, store, "", "", "")
+
+	p := params.QueryParams{AppName: "coriolis-worker", Limit: 1}
+	reader := store.ResultReader(context.Background(), p)
+	if _, err := reader.ReadNext(); err != nil {
+		t.Fatalf("failed to read messages: %v", err)
+	}
+	// Messages following the cursor are selected newest first, and
+	// the next cursor points to the newest one.
+	p.Cursor = reader.Cursor()
+	p.Order = params.OrderDesc
+	reader = store.ResultReader(context.Background(), p)
+	data, err := reader.ReadNext()
+	if err != nil || string(data) != "3\n" {
+		t.Fatalf("expected the newest message, got %q (%v)", data, err)
+	}
+	p.Cursor = reader.Cursor()
+	if lines := readAll(t, store, p); lines != nil {
+		t.Fatalf("expected no messages after the newest one, got %q", lines)
+	}
+}
+
+func TestReadMsgID(t *testing.T) {
+	store := newTestDatastore(t, "")
+	defer stop(t, store)
+	writeMessages(t, store, "ID47", "", "ID47", "ID48")
+
+	lines := readAll(t, store, params.QueryParams{AppName: "coriolis-worker", MsgID: "ID47"})
+	if strings.Join(lines, "|") != "1|3" {
+		t.Fatalf("expected the ID47 messages, got %q", lines)
+	}
+}
+
+func TestReadClusterID(t *testing.T) {
+	store := newTestDatastore(t, "cluster-a")
+	defer stop(t, store)
+	writeMessages(t, store, "", "")
+
+	lines := readAll(t, store, params.QueryParams{AppName: "coriolis-worker", ClusterID: "cluster-a"})
+	if strings.Join(lines, "|") != "1|2" {
+		t.Fatalf("expected the messages of the cluster, got %q", lines)
+	}
+	lines = readAll(t, store, params.QueryParams{AppName: "coriolis-worker", ClusterID: "cluster-b"})
+	if lines != nil {
+		t.Fatalf("expected no messages of another cluster, got %q", lines)
+	}
+}
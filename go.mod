@@ -5,13 +5,29 @@ go 1.13
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/databus23/keystone v0.0.0-20180111110916-350fd0e663cd
-	github.com/google/uuid v1.1.1
-	github.com/gophercloud/gophercloud v0.6.0 // indirect
+	github.com/elastic/go-elasticsearch/v8 v8.0.0
+	github.com/go-redis/redis/v8 v8.4.4
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/golang/protobuf v1.4.3
+	github.com/google/uuid v1.1.2
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
 	github.com/gorilla/websocket v1.4.1
+	github.com/influxdata/influxdb-client-go/v2 v2.2.0
 	github.com/influxdata/influxdb1-client v0.0.0-20190809212627-fc22c7df067e
 	github.com/juju/loggo v0.0.0-20190526231331-6e530bcce5d8
-	github.com/pkg/errors v0.8.1
+	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.11.0
+	github.com/minio/minio-go/v6 v6.0.44
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.2.1
+	github.com/segmentio/kafka-go v0.4.8
+	github.com/swaggest/openapi-go v0.2.13
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/sys v0.0.0-20210112080510-489259a85091
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	google.golang.org/grpc v1.34.0
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/mcuadros/go-syslog.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
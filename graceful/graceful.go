@@ -0,0 +1,99 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package graceful allows restarting coriolis-logger without closing its
+// listening sockets. The running process starts a new copy of itself,
+// handing it the sockets as extra file descriptors, before shutting down.
+package graceful
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// inheritedFilesEnv holds the names and descriptor numbers of the files
+// passed to a new process, as a comma separated list of name:fd pairs.
+const inheritedFilesEnv = "CORIOLIS_LOGGER_INHERITED_FDS"
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string]*os.File
+)
+
+func loadInherited() {
+	inherited = map[string]*os.File{}
+	value := os.Getenv(inheritedFilesEnv)
+	if value == "" {
+		return
+	}
+	// Make sure the variable does not leak into processes we
+	// may start later on.
+	os.Unsetenv(inheritedFilesEnv)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil || fd < 3 {
+			continue
+		}
+		inherited[parts[0]] = os.NewFile(uintptr(fd), parts[0])
+	}
+}
+
+// Inherited returns the file registered under name by the parent
+// process, or nil if there is none. A file can only be claimed once.
+func Inherited(name string) *os.File {
+	inheritOnce.Do(loadInherited)
+	file := inherited[name]
+	delete(inherited, name)
+	return file
+}
+
+// Restart starts a new copy of the running binary, with the same
+// arguments, passing it files. The new process retrieves them using
+// Inherited(), with the same names.
+func Restart(files map[string]*os.File) (*os.Process, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "finding executable")
+	}
+
+	pairs := []string{}
+	extraFiles := []*os.File{}
+	for name, file := range files {
+		// Descriptors 0, 1 and 2 are stdin, stdout and stderr.
+		fd := len(extraFiles) + 3
+		extraFiles = append(extraFiles, file)
+		pairs = append(pairs, fmt.Sprintf("%s:%d", name, fd))
+	}
+
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", inheritedFilesEnv, strings.Join(pairs, ",")))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = extraFiles
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "starting new process")
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package grpctest implements a LogService server which records the
+// messages it receives, for testing the gRPC writer.
+package grpctest
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	grpcgo "google.golang.org/grpc"
+
+	pb "coriolis-logger/proto"
+)
+
+// NewServer starts a LogService server listening on address. Use
+// "127.0.0.1:0" to listen on a random port.
+func NewServer(address string, opts ...grpcgo.ServerOption) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating listener")
+	}
+	srv := &Server{
+		listener: listener,
+		server:   grpcgo.NewServer(opts...),
+	}
+	pb.RegisterLogServiceServer(srv.server, srv)
+	go srv.server.Serve(listener)
+	return srv, nil
+}
+
+// Server records all log messages streamed to it.
+type Server struct {
+	pb.UnimplementedLogServiceServer
+
+	listener net.Listener
+	server   *grpcgo.Server
+
+	mut      sync.Mutex
+	messages []*pb.LogMessage
+}
+
+// Address returns the address the server listens on.
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Messages returns the messages received so far.
+func (s *Server) Messages() []*pb.LogMessage {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	ret := make([]*pb.LogMessage, len(s.messages))
+	copy(ret, s.messages)
+	return ret
+}
+
+// StreamLogs records received messages, acknowledging each of them.
+func (s *Server) StreamLogs(stream pb.LogService_StreamLogsServer) error {
+	var received uint64
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.mut.Lock()
+		s.messages = append(s.messages, msg)
+		s.mut.Unlock()
+
+		received++
+		if err := stream.Send(&pb.StreamLogsResponse{Received: received}); err != nil {
+			return err
+		}
+	}
+}
+
+// Stop closes all streams and stops the server.
+func (s *Server) Stop() {
+	s.server.Stop()
+}
@@ -15,24 +15,57 @@
 package logging
 
 import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/juju/loggo"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"coriolis-logger/metrics"
 )
 
 var log = loggo.GetLogger("coriolis-logger.logging")
 
-type aggregateWriter struct {
+// AggregateWriter writes log messages to all of its writers.
+type AggregateWriter struct {
+	// mut guards writers and durations, as writers may be added
+	// while messages are written.
+	mut     sync.RWMutex
 	writers []Writer
+	// durations holds the write duration observer of each writer,
+	// looked up once, so writing a message does not have to.
+	durations []prometheus.Observer
+}
+
+// writerName returns the name writer durations are reported under,
+// which is the type of the writer.
+func writerName(writer Writer) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", writer), "*")
 }
 
-func NewAggregateWriter(writer ...Writer) Writer {
-	wr := &aggregateWriter{
-		writers: writer,
+func NewAggregateWriter(writer ...Writer) *AggregateWriter {
+	wr := &AggregateWriter{}
+	for _, val := range writer {
+		wr.AddWriter(val)
 	}
 	return wr
 }
 
-func (a *aggregateWriter) Write(msg LogMessage) (err error) {
+// AddWriter adds a writer, which receives all messages written from
+// now on.
+func (a *AggregateWriter) AddWriter(writer Writer) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.writers = append(a.writers, writer)
+	a.durations = append(a.durations, metrics.WriteDuration.WithLabelValues(writerName(writer)))
+}
+
+func (a *AggregateWriter) Write(msg LogMessage) (err error) {
+	a.mut.RLock()
+	defer a.mut.RUnlock()
 	errs := []error{}
 	defer func() {
 		if len(errs) > 0 {
@@ -41,8 +74,11 @@ func (a *aggregateWriter) Write(msg LogMessage) (err error) {
 		}
 		return
 	}()
-	for _, val := range a.writers {
-		if err := val.Write(msg); err != nil {
+	for idx, val := range a.writers {
+		start := time.Now()
+		err := val.Write(msg)
+		a.durations[idx].Observe(time.Since(start).Seconds())
+		if err != nil {
 			errs = append(errs, err)
 			log.Errorf("failed to write log message: %q", err)
 		}
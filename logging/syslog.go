@@ -17,6 +17,7 @@ package logging
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -76,6 +77,84 @@ const (
 	LocalUse7
 )
 
+// facilityNames maps the keywords commonly used by syslog
+// implementations to facility codes.
+var facilityNames = map[string]Facility{
+	"kern":     KernelMessages,
+	"user":     UserLevelMessages,
+	"mail":     MailSystem,
+	"daemon":   SystemDaemons,
+	"auth":     AuthMessages,
+	"syslog":   InternalSyslogMessage,
+	"lpr":      LinePrinterSubsystem,
+	"news":     NetworkNewsSubsystem,
+	"uucp":     UUCPSubsystem,
+	"cron":     ClockDaemon,
+	"authpriv": AuthMessages2,
+	"ftp":      FTPDaemon,
+	"ntp":      NTPSubsystem,
+	"security": LogAudit,
+	"console":  LogAlert,
+	"clock":    ClockDaemon2,
+	"local0":   LocalUse0,
+	"local1":   LocalUse1,
+	"local2":   LocalUse2,
+	"local3":   LocalUse3,
+	"local4":   LocalUse4,
+	"local5":   LocalUse5,
+	"local6":   LocalUse6,
+	"local7":   LocalUse7,
+}
+
+// ParseFacility returns the facility identified by either its
+// numeric code (0-23) or its keyword (kern, user, local0, etc).
+func ParseFacility(facility string) (Facility, error) {
+	if code, err := strconv.Atoi(facility); err == nil {
+		if code < int(KernelMessages) || code > int(LocalUse7) {
+			return 0, fmt.Errorf("invalid facility %q", facility)
+		}
+		return Facility(code), nil
+	}
+	if ret, ok := facilityNames[strings.ToLower(facility)]; ok {
+		return ret, nil
+	}
+	return 0, fmt.Errorf("invalid facility %q", facility)
+}
+
+// severityNames maps the keywords commonly used by syslog
+// implementations, and their long forms, to severity levels.
+var severityNames = map[string]Severity{
+	"emerg":         Emergency,
+	"emergency":     Emergency,
+	"panic":         Emergency,
+	"alert":         Alert,
+	"crit":          Critical,
+	"critical":      Critical,
+	"err":           Error,
+	"error":         Error,
+	"warning":       Warning,
+	"warn":          Warning,
+	"notice":        Notice,
+	"info":          Informational,
+	"informational": Informational,
+	"debug":         Debug,
+}
+
+// ParseSeverity returns the severity identified by either its
+// numeric level (0-7) or its keyword (err, warning, info, etc).
+func ParseSeverity(severity string) (Severity, error) {
+	if level, err := strconv.Atoi(severity); err == nil {
+		if level < int(Emergency) || level > int(Debug) {
+			return UnknownSeverity, fmt.Errorf("invalid severity %q", severity)
+		}
+		return Severity(level), nil
+	}
+	if ret, ok := severityNames[strings.ToLower(severity)]; ok {
+		return ret, nil
+	}
+	return UnknownSeverity, fmt.Errorf("invalid severity %q", severity)
+}
+
 const (
 	RFC5424 RFCVersion = "rfc5424"
 	RFC3164 RFCVersion = "rfc3164"
@@ -83,6 +162,9 @@ const (
 
 const (
 	DefaultSeverityLevel = Informational
+	// UnparsedAppName is the application name of the messages that
+	// failed to parse, stored as is.
+	UnparsedAppName = "unparsed"
 )
 
 type LogMessage struct {
@@ -93,8 +175,84 @@ type LogMessage struct {
 	Severity  Severity
 	AppName   string
 	ProcID    int
+	MsgID     string
 	Message   string
 	RFC       RFCVersion
+	// StructuredData holds the parameters of the RFC5424 structured
+	// data elements of the message, by SD-ID.
+	StructuredData map[string]map[string]string
+	// Unparsed is set for messages that failed to parse, and were
+	// stored as is, by RawToLogMessage.
+	Unparsed bool
+	// TimestampInferred is set for messages whose timestamp was not
+	// fully set by their sender, such as RFC3164 messages, which have
+	// no year, or messages that got the time they were received at.
+	TimestampInferred bool
+	// SourceAddr is the IP address the message was received from,
+	// which, unlike Hostname, is not set by the sender. It is empty
+	// for messages received on unix sockets.
+	SourceAddr string
+}
+
+// parseStructuredData parses the STRUCTURED-DATA part of an RFC5424
+// message, such as [id@32473 key="value"][other key="value"]. The nil
+// value "-" has no elements.
+func parseStructuredData(data string) (map[string]map[string]string, error) {
+	if data == "" || data == "-" {
+		return nil, nil
+	}
+	ret := map[string]map[string]string{}
+	for data != "" {
+		if data[0] != '[' {
+			return nil, fmt.Errorf("expected start of SD-ELEMENT")
+		}
+		data = data[1:]
+		end := strings.IndexAny(data, " ]")
+		if end <= 0 {
+			return nil, fmt.Errorf("invalid SD-ID")
+		}
+		id := data[:end]
+		data = data[end:]
+		params := map[string]string{}
+		for data != "" && data[0] == ' ' {
+			data = data[1:]
+			eq := strings.Index(data, `="`)
+			if eq <= 0 {
+				return nil, fmt.Errorf("invalid SD-PARAM in %q", id)
+			}
+			name := data[:eq]
+			data = data[eq+2:]
+			var value strings.Builder
+			closed := false
+			for idx := 0; idx < len(data); idx++ {
+				c := data[idx]
+				if c == '\\' && idx+1 < len(data) {
+					// Only ", \ and ] are escaped. A backslash before
+					// any other character is kept.
+					switch data[idx+1] {
+					case '"', '\\', ']':
+						idx++
+						c = data[idx]
+					}
+				} else if c == '"' {
+					data = data[idx+1:]
+					closed = true
+					break
+				}
+				value.WriteByte(c)
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated PARAM-VALUE in %q", id)
+			}
+			params[name] = value.String()
+		}
+		if data == "" || data[0] != ']' {
+			return nil, fmt.Errorf("unterminated SD-ELEMENT %q", id)
+		}
+		data = data[1:]
+		ret[id] = params
+	}
+	return ret, nil
 }
 
 func validateMessage(msg map[string]interface{}, rfc RFCVersion) bool {
@@ -156,6 +314,13 @@ func SyslogToLogMessage(msg map[string]interface{}) (LogMessage, error) {
 		if parsedProcID != "" && parsedProcID != "-" {
 			procID, _ = strconv.Atoi(parsedProcID)
 		}
+		msgID := msg["msg_id"].(string)
+		if msgID == "-" {
+			msgID = ""
+		}
+		// Messages with malformed structured data are still stored,
+		// without it.
+		structuredData, _ := parseStructuredData(msg["structured_data"].(string))
 		return LogMessage{
 			Timestamp: msg["timestamp"].(time.Time),
 			Hostname:  msg["hostname"].(string),
@@ -165,9 +330,30 @@ func SyslogToLogMessage(msg map[string]interface{}) (LogMessage, error) {
 			AppName:   msg["app_name"].(string),
 			Message:   msg["message"].(string),
 			ProcID:    procID,
+			MsgID:     msgID,
 			RFC:       rfc,
+
+			StructuredData: structuredData,
 		}, nil
 	default:
 		return LogMessage{}, fmt.Errorf("failed to parse log message")
 	}
 }
+
+// RawToLogMessage returns a message that failed to parse, received from
+// hostname at the given time. The payload is kept as is, with the info
+// severity and the user facility.
+func RawToLogMessage(payload, hostname string, received time.Time) LogMessage {
+	return LogMessage{
+		Timestamp: received,
+		Hostname:  hostname,
+		Priority:  int(UserLevelMessages)*8 + int(DefaultSeverityLevel),
+		Facility:  UserLevelMessages,
+		Severity:  DefaultSeverityLevel,
+		AppName:   UnparsedAppName,
+		Message:   payload,
+		Unparsed:  true,
+
+		TimestampInferred: true,
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package logging
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStructuredData(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected map[string]map[string]string
+	}{
+		{"", nil},
+		{"-", nil},
+		{`[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"]`, map[string]map[string]string{
+			"exampleSDID@32473": {"iut": "3", "eventSource": "Application", "eventID": "1011"},
+		}},
+		// Several elements, and an element without parameters.
+		{`[exampleSDID@32473 iut="3"][examplePriority@32473 class="high"][timeQuality]`, map[string]map[string]string{
+			"exampleSDID@32473":     {"iut": "3"},
+			"examplePriority@32473": {"class": "high"},
+			"timeQuality":           {},
+		}},
+		// Escaped quotes, backslashes and brackets.
+		{`[coriolis@32473 cmd="echo \"hello world\"" path="C:\\Windows\\Temp" list="[a\]"]`, map[string]map[string]string{
+			"coriolis@32473": {"cmd": `echo "hello world"`, "path": `C:\Windows\Temp`, "list": "[a]"},
+		}},
+		// Values ending with an escaped backslash, or a quote.
+		{`[coriolis@32473 dir="C:\\" quoted="say \"hi\""]`, map[string]map[string]string{
+			"coriolis@32473": {"dir": `C:\`, "quoted": `say "hi"`},
+		}},
+		// A backslash before other characters is kept.
+		{`[coriolis@32473 regex="^\d+\.\d+$"]`, map[string]map[string]string{
+			"coriolis@32473": {"regex": `^\d+\.\d+$`},
+		}},
+		// Empty values, spaces, equal signs, and UTF-8.
+		{`[meta empty="" spaced="a b  c" query="k=v&x=y" lang="héllo wörld"]`, map[string]map[string]string{
+			"meta": {"empty": "", "spaced": "a b  c", "query": "k=v&x=y", "lang": "héllo wörld"},
+		}},
+		// Brackets and what looks like other parameters within values.
+		{`[origin ip="10.0.0.1" software="fake] [x y=\"z\""][meta sequenceId="42"]`, map[string]map[string]string{
+			"origin": {"ip": "10.0.0.1", "software": `fake] [x y="z"`},
+			"meta":   {"sequenceId": "42"},
+		}},
+	}
+	for _, tt := range tests {
+		parsed, err := parseStructuredData(tt.data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.data, tt.expected, parsed)
+		}
+	}
+}
+
+func TestParseStructuredDataErrors(t *testing.T) {
+	invalid := []string{
+		`exampleSDID@32473 iut="3"]`,
+		`[ iut="3"]`,
+		`[]`,
+		`[exampleSDID@32473 iut="3"`,
+		`[exampleSDID@32473 iut="3]`,
+		`[exampleSDID@32473 iut="3\"]`,
+		`[exampleSDID@32473 iut=3]`,
+		`[exampleSDID@32473 ="3"]`,
+		`[exampleSDID@32473 iut="3"] [other a="b"]`,
+		`[exampleSDID@32473 iut="3"]trailing`,
+	}
+	for _, data := range invalid {
+		if parsed, err := parseStructuredData(data); err == nil {
+			t.Errorf("%s: expected an error, got %v", data, parsed)
+		}
+	}
+}
+
+// rfc5424Message returns a message parsed by the RFC5424 syslog parser,
+// holding data as its structured data.
+func rfc5424Message(data string) map[string]interface{} {
+	return map[string]interface{}{
+		"timestamp":       time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC),
+		"hostname":        "web-1",
+		"priority":        13,
+		"facility":        1,
+		"severity":        5,
+		"app_name":        "coriolis-worker",
+		"version":         1,
+		"proc_id":         "1234",
+		"msg_id":          "ID47",
+		"structured_data": data,
+		"message":         "migration started",
+	}
+}
+
+func TestSyslogToLogMessageStructuredData(t *testing.T) {
+	logMsg, err := SyslogToLogMessage(rfc5424Message(`[coriolis@32473 task_id="abc\"123" user="admin"]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]map[string]string{
+		"coriolis@32473": {"task_id": `abc"123`, "user": "admin"},
+	}
+	if !reflect.DeepEqual(logMsg.StructuredData, expected) {
+		t.Fatalf("expected structured data %v, got %v", expected, logMsg.StructuredData)
+	}
+	if logMsg.MsgID != "ID47" || logMsg.ProcID != 1234 || logMsg.Message != "migration started" {
+		t.Fatalf("unexpected message %+v", logMsg)
+	}
+
+	// Malformed structured data is dropped, the message is kept.
+	logMsg, err = SyslogToLogMessage(rfc5424Message(`[coriolis@32473 task_id="abc]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logMsg.StructuredData != nil || logMsg.Message != "migration started" {
+		t.Fatalf("expected the message to be kept without structured data, got %+v", logMsg)
+	}
+}
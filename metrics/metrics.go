@@ -0,0 +1,202 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package metrics holds the Prometheus collectors exported by
+// coriolis-logger.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "coriolis_logger"
+
+var (
+	// LogMessages counts the syslog messages received, by application,
+	// hostname and severity.
+	LogMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "log_messages_total",
+		Help:      "Number of syslog messages received.",
+	}, []string{"app", "hostname", "severity"})
+
+	// MessagesReceived counts the syslog messages received by the
+	// syslog server, by application, severity and facility.
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Number of syslog messages received, by application, severity and facility.",
+	}, []string{"app", "severity", "facility"})
+
+	// WriteDuration observes how long each writer takes to accept a
+	// log message.
+	WriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "write_duration_seconds",
+		Help:      "Time taken by each writer to accept a log message.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"writer"})
+
+	// InfluxDBFlushDuration observes how long writing a batch of
+	// points to InfluxDB takes, InfluxDBFlushErrors counts the batches
+	// that failed to be written, and InfluxDBPointsFlushed the points
+	// written, by database.
+	InfluxDBFlushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "influxdb_flush_duration_seconds",
+		Help:      "Time taken to write a batch of points to InfluxDB.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"database"})
+	InfluxDBFlushErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "influxdb_flush_errors_total",
+		Help:      "Number of batches of points that failed to be written to InfluxDB.",
+	}, []string{"database"})
+	InfluxDBPointsFlushed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "influxdb_points_flushed_total",
+		Help:      "Number of points written to InfluxDB.",
+	}, []string{"database"})
+	// InfluxDBPointsDropped is the number of buffered points dropped
+	// while InfluxDB could not be written to, by database.
+	InfluxDBPointsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "influxdb_points_dropped_total",
+		Help:      "Number of buffered points dropped while InfluxDB was unreachable.",
+	}, []string{"database"})
+	// InfluxDBHostnamesNormalized is the number of messages stored
+	// with another hostname than their own by the hostname guard, by
+	// database and reason, which is either "rule" or "overflow".
+	InfluxDBHostnamesNormalized = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "influxdb_hostnames_normalized_total",
+		Help:      "Number of messages stored with a normalized hostname.",
+	}, []string{"database", "reason"})
+	// InfluxDBPendingPoints is the number of points waiting to be
+	// written to InfluxDB.
+	InfluxDBPendingPoints = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "influxdb_pending_points",
+		Help:      "Number of points waiting to be written to InfluxDB.",
+	})
+
+	// WebsocketConnections is the number of connected web socket
+	// clients.
+	WebsocketConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Number of connected web socket clients.",
+	})
+	// SyslogConnections is the number of open syslog stream
+	// connections.
+	SyslogConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "syslog_connections",
+		Help:      "Number of open syslog stream connections.",
+	})
+	// SyslogMaxConnections is the maximum number of open syslog stream
+	// connections, or 0 if there is no limit.
+	SyslogMaxConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "syslog_max_connections",
+		Help:      "Maximum number of open syslog stream connections, or 0 if unlimited.",
+	})
+	// SyslogConnectionsRejected is the number of syslog stream
+	// connections closed because max_connections were already open.
+	SyslogConnectionsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syslog_connections_rejected_total",
+		Help:      "Number of syslog stream connections rejected because of max_connections.",
+	})
+	// SyslogTLSHandshakeFailures is the number of syslog clients that
+	// failed the TLS handshake.
+	SyslogTLSHandshakeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syslog_tls_handshake_failures_total",
+		Help:      "Number of syslog clients that failed the TLS handshake.",
+	})
+	// SyslogQueueSaturation is the ratio of the queue of syslog
+	// messages waiting for a worker that is in use.
+	SyslogQueueSaturation = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "syslog_queue_saturation",
+		Help:      "Ratio of the queue of syslog messages waiting for a worker that is in use.",
+	})
+	// SyslogUnparsedMessages is the number of syslog messages that
+	// failed to parse, and were stored as is, by source host.
+	SyslogUnparsedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syslog_unparsed_messages_total",
+		Help:      "Number of syslog messages stored as is, as they failed to parse.",
+	}, []string{"source"})
+	// SyslogMessagesTruncated is the number of syslog messages larger
+	// than max_message_size, by the truncation policy applied to them.
+	SyslogMessagesTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syslog_messages_truncated_total",
+		Help:      "Number of syslog messages larger than max_message_size.",
+	}, []string{"policy"})
+	// SyslogMessagesRateLimited is the number of syslog messages
+	// dropped because their source exceeded max_messages_per_second.
+	SyslogMessagesRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syslog_messages_rate_limited_total",
+		Help:      "Number of syslog messages dropped by the rate limit of their source.",
+	})
+	// GELFIncompleteMessages is the number of chunked GELF messages
+	// discarded before all of their chunks were received.
+	GELFIncompleteMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gelf_incomplete_messages_total",
+		Help:      "Number of chunked GELF messages discarded before all of their chunks were received.",
+	})
+
+	// WebsocketReplayBufferSize is the number of messages held for
+	// replay to new web socket clients, and
+	// WebsocketReplayBufferCapacity the most it can hold.
+	WebsocketReplayBufferSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_replay_buffer_size",
+		Help:      "Number of messages held for replay to new web socket clients.",
+	})
+	WebsocketReplayBufferCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_replay_buffer_capacity",
+		Help:      "Maximum number of messages held for replay to new web socket clients.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(LogMessages)
+	prometheus.MustRegister(MessagesReceived)
+	prometheus.MustRegister(WriteDuration)
+	prometheus.MustRegister(InfluxDBFlushDuration)
+	prometheus.MustRegister(InfluxDBFlushErrors)
+	prometheus.MustRegister(InfluxDBPointsFlushed)
+	prometheus.MustRegister(InfluxDBPointsDropped)
+	prometheus.MustRegister(InfluxDBHostnamesNormalized)
+	prometheus.MustRegister(InfluxDBPendingPoints)
+	prometheus.MustRegister(WebsocketConnections)
+	prometheus.MustRegister(SyslogConnections)
+	prometheus.MustRegister(SyslogMaxConnections)
+	prometheus.MustRegister(SyslogConnectionsRejected)
+	prometheus.MustRegister(SyslogTLSHandshakeFailures)
+	prometheus.MustRegister(SyslogMessagesRateLimited)
+	prometheus.MustRegister(GELFIncompleteMessages)
+	prometheus.MustRegister(SyslogMessagesTruncated)
+	prometheus.MustRegister(SyslogUnparsedMessages)
+	prometheus.MustRegister(SyslogQueueSaturation)
+	prometheus.MustRegister(WebsocketReplayBufferSize)
+	prometheus.MustRegister(WebsocketReplayBufferCapacity)
+}
@@ -14,7 +14,36 @@
 
 package params
 
-import "time"
+import (
+	"time"
+
+	"coriolis-logger/logging"
+)
+
+// Fields that may be returned for each message, in the order they
+// are written.
+const (
+	FieldTime     = "time"
+	FieldHostname = "hostname"
+	FieldSeverity = "severity"
+	FieldFacility = "facility"
+	FieldMessage  = "message"
+)
+
+// QueryFields holds all the fields that may be set in AllowedFields.
+var QueryFields = []string{
+	FieldTime,
+	FieldHostname,
+	FieldSeverity,
+	FieldFacility,
+	FieldMessage,
+}
+
+// Orders in which messages may be selected.
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
 
 // QueryParams represents log filter parameters for log readers
 type QueryParams struct {
@@ -22,5 +51,58 @@ type QueryParams struct {
 	StartDate time.Time
 	EndDate   time.Time
 	AppName   string
-	Severity  int
+	// Severity, if set, limits results to messages with a severity
+	// level at or below (more severe than) the given level.
+	Severity *logging.Severity
+	// Facility, if set, limits results to messages logged with the
+	// given facility.
+	Facility *logging.Facility
+	// SourceAddr, if set, limits results to messages received from
+	// the given IP address.
+	SourceAddr string
+	// MsgID, if set, limits results to the RFC5424 messages with the
+	// given MSGID, which identifies the type of a message.
+	MsgID string
+	// Limit is the maximum number of messages returned. A value of 0
+	// means no limit.
+	Limit int
+	// Offset is the number of matching messages skipped before the
+	// first one returned.
+	Offset int
+	// Order is the end of the log messages are selected from. With
+	// OrderDesc, the newest messages are selected, but they are still
+	// returned oldest first. Defaults to OrderAsc.
+	Order string
+	// Cursor, if set, resumes reading after the position returned by
+	// a previous reader.
+	Cursor string
+	// ClusterID, if set, limits results to messages stored by the
+	// coriolis-logger instance with that cluster_id.
+	ClusterID string
+	// StructuredData, if set, limits results to messages whose stored
+	// structured data parameters have the given values, by name.
+	StructuredData map[string]string
+	// AllowedFields, if set, limits the fields returned for each
+	// message. Readers return only the message text otherwise.
+	AllowedFields []string
+	// JSON, if set, has the readers of datastores that select fields
+	// return each message as a JSON object holding those fields, on
+	// its own line, instead of the fields separated by spaces.
+	JSON bool
+}
+
+// ListParams represents the filters and pagination of log listings.
+type ListParams struct {
+	// Prefix, if set, limits results to the logs whose name starts
+	// with it.
+	Prefix string
+	// Pattern, if set, is a regular expression the names of the
+	// returned logs must match.
+	Pattern string
+	// Limit is the maximum number of logs returned. A value of 0
+	// means no limit.
+	Limit int
+	// Offset is the number of matching logs, sorted by name, skipped
+	// before the first one returned.
+	Offset int
 }
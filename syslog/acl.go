@@ -0,0 +1,80 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// sourceACL selects the source IPs stream connections are accepted
+// from.
+type sourceACL struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func newSourceACL(allowed, denied []string) (*sourceACL, error) {
+	acl := &sourceACL{}
+	var err error
+	if acl.allowed, err = parseCIDRs(allowed); err != nil {
+		return nil, errors.Wrap(err, "parsing allowed_cidrs")
+	}
+	if acl.denied, err = parseCIDRs(denied); err != nil {
+		return nil, errors.Wrap(err, "parsing denied_cidrs")
+	}
+	return acl, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, network)
+	}
+	return ret, nil
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits returns true if connections from addr are accepted. If the
+// allowlist is set, only the IPs it holds are accepted, even if they
+// are also denied. Otherwise, all IPs but the denied ones are. Peers
+// without an IP, on unix sockets, are always accepted. A nil ACL
+// accepts all connections.
+func (a *sourceACL) permits(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	if len(a.allowed) > 0 {
+		return contains(a.allowed, tcpAddr.IP)
+	}
+	return !contains(a.denied, tcpAddr.IP)
+}
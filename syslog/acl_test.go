@@ -0,0 +1,143 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 514}
+}
+
+func TestSourceACLPermits(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		denied   []string
+		addr     net.Addr
+		expected bool
+	}{
+		{"empty lists allow all", nil, nil, tcpAddr("192.0.2.1"), true},
+		{"ipv4 host allowed", []string{"192.0.2.1/32"}, nil, tcpAddr("192.0.2.1"), true},
+		{"ipv4 host not allowed", []string{"192.0.2.1/32"}, nil, tcpAddr("192.0.2.2"), false},
+		{"ipv4 subnet first address", []string{"10.1.0.0/16"}, nil, tcpAddr("10.1.0.0"), true},
+		{"ipv4 subnet last address", []string{"10.1.0.0/16"}, nil, tcpAddr("10.1.255.255"), true},
+		{"ipv4 outside subnet", []string{"10.1.0.0/16"}, nil, tcpAddr("10.2.0.1"), false},
+		{"ipv4 mapped ipv6 address", []string{"10.0.0.0/8"}, nil, tcpAddr("::ffff:10.0.0.1"), true},
+		{"ipv4 denied", nil, []string{"198.51.100.0/24"}, tcpAddr("198.51.100.7"), false},
+		{"ipv4 not denied", nil, []string{"198.51.100.0/24"}, tcpAddr("198.51.101.7"), true},
+		{"ipv6 host allowed", []string{"2001:db8::1/128"}, nil, tcpAddr("2001:db8::1"), true},
+		{"ipv6 host not allowed", []string{"2001:db8::1/128"}, nil, tcpAddr("2001:db8::2"), false},
+		{"ipv6 subnet", []string{"2001:db8:1::/48"}, nil, tcpAddr("2001:db8:1:ffff::1"), true},
+		{"ipv6 outside subnet", []string{"2001:db8:1::/48"}, nil, tcpAddr("2001:db8:2::1"), false},
+		{"ipv6 denied", nil, []string{"fe80::/10"}, tcpAddr("fe80::1"), false},
+		{"ipv6 not denied", nil, []string{"fe80::/10"}, tcpAddr("2001:db8::1"), true},
+		{"ipv6 address in ipv4 allowlist", []string{"10.0.0.0/8"}, nil, tcpAddr("2001:db8::1"), false},
+		{"ipv4 address in ipv6 denylist", nil, []string{"2001:db8::/32"}, tcpAddr("10.0.0.1"), true},
+		{"allowlist wins over denylist", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, tcpAddr("10.1.0.1"), true},
+		{"denylist ignored with an allowlist", []string{"10.0.0.0/8"}, []string{"192.0.2.0/24"}, tcpAddr("192.0.2.1"), false},
+		{"unix sockets are accepted", []string{"10.0.0.0/8"}, nil, &net.UnixAddr{Name: "/dev/log", Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		acl, err := newSourceACL(tt.allowed, tt.denied)
+		if err != nil {
+			t.Errorf("%s: failed to parse ACL: %v", tt.name, err)
+			continue
+		}
+		if permitted := acl.permits(tt.addr); permitted != tt.expected {
+			t.Errorf("%s: expected %s to be permitted: %v, got %v", tt.name, tt.addr, tt.expected, permitted)
+		}
+	}
+
+	var acl *sourceACL
+	if !acl.permits(tcpAddr("192.0.2.1")) {
+		t.Errorf("expected a nil ACL to permit all connections")
+	}
+}
+
+func TestNewSourceACLInvalid(t *testing.T) {
+	for _, cidr := range []string{"", "10.0.0.1", "10.0.0.0/33", "2001:db8::/129", "localhost/8"} {
+		if _, err := newSourceACL([]string{cidr}, nil); err == nil {
+			t.Errorf("expected allowed CIDR %q to be rejected", cidr)
+		}
+		if _, err := newSourceACL(nil, []string{cidr}); err == nil {
+			t.Errorf("expected denied CIDR %q to be rejected", cidr)
+		}
+	}
+}
+
+func TestInvalidCIDRsFailFast(t *testing.T) {
+	cfg := testSyslogConfig("rfc3164")
+	cfg.AllowedCIDRs = []string{"10.0.0.0/8", "2001:db8::/32"}
+	cfg.DeniedCIDRs = []string{"192.0.2.0/24"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected valid CIDRs to pass validation, got %v", err)
+	}
+	cfg.AllowedCIDRs = []string{"10.0.0.0/33"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected an invalid allowed CIDR to fail validation")
+	}
+	cfg.AllowedCIDRs = nil
+	cfg.DeniedCIDRs = []string{"10.0.0.1"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected an invalid denied CIDR to fail validation")
+	}
+}
+
+func TestDeniedConnectionsAreClosed(t *testing.T) {
+	cfg := testSyslogConfig("rfc3164")
+	cfg.DeniedCIDRs = []string{"127.0.0.0/8"}
+	writer := newRecordingWriter()
+	worker, address := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("<13>Oct 15 10:00:00 web-1 nginx[1234]: denied\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// The connection is closed, or reset, as the message was not
+	// read.
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the denied connection to be closed")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("expected the denied connection to be closed, got %v", err)
+	}
+	select {
+	case logMsg := <-writer.messages:
+		t.Fatalf("unexpected message %q from a denied source", logMsg.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAllowedConnectionsAreServed(t *testing.T) {
+	cfg := testSyslogConfig("rfc3164")
+	// The allowlist takes precedence.
+	cfg.AllowedCIDRs = []string{"127.0.0.1/32"}
+	cfg.DeniedCIDRs = []string{"127.0.0.0/8"}
+	writer := newRecordingWriter()
+	worker, address := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+
+	send(t, address, "<13>Oct 15 10:00:00 web-1 nginx[1234]: allowed\n")
+	if logMsg := writer.next(t); logMsg.Message != "allowed" {
+		t.Fatalf("expected message %q, got %q", "allowed", logMsg.Message)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+
+	"coriolis-logger/config"
+)
+
+// maxFrameLengthDigits is the maximum number of digits of the length of
+// an octet counted frame.
+const maxFrameLengthDigits = 10
+
+// framing is the way messages are delimited on a stream connection, as
+// described in RFC 6587.
+type framing int
+
+const (
+	// framingAuto detects the framing from the first message received
+	// on a connection.
+	framingAuto framing = iota
+	// framingOctetCounting prefixes each message with its length.
+	framingOctetCounting
+	// framingNonTransparent ends each message with a LF or a NUL.
+	framingNonTransparent
+)
+
+// framingOf returns the framing used by stream connections receiving
+// messages in logFormat, unless set by mode. It is detected on each
+// connection, except for RFC 3164 messages, which are delimited by LF,
+// as they may not start with a PRI.
+func framingOf(logFormat format.Format, mode config.FramingMode) framing {
+	switch mode {
+	case config.OctetCountFraming:
+		return framingOctetCounting
+	case config.NewlineFraming:
+		return framingNonTransparent
+	case config.AutoFraming:
+		return framingAuto
+	}
+	if logFormat == syslog.RFC3164 {
+		return framingNonTransparent
+	}
+	return framingAuto
+}
+
+// frameSplitter splits the data received on a stream connection into
+// messages, refusing messages larger than maxFrameSize.
+type frameSplitter struct {
+	framing      framing
+	maxFrameSize int
+}
+
+func newFrameSplitter(framing framing, maxFrameSize int) *frameSplitter {
+	return &frameSplitter{
+		framing:      framing,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// split is a bufio.SplitFunc. When detecting the framing, a connection
+// starting with a digit is octet counted, as messages with a PRI start
+// with "<".
+func (f *frameSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	if f.framing == framingAuto {
+		if data[0] >= '0' && data[0] <= '9' {
+			f.framing = framingOctetCounting
+		} else {
+			f.framing = framingNonTransparent
+		}
+	}
+	if f.framing == framingOctetCounting {
+		return f.splitOctetCounted(data, atEOF)
+	}
+	return f.splitNonTransparent(data, atEOF)
+}
+
+func (f *frameSplitter) splitOctetCounted(data []byte, atEOF bool) (int, []byte, error) {
+	idx := bytes.IndexByte(data, ' ')
+	if idx < 0 {
+		if len(data) > maxFrameLengthDigits {
+			return 0, nil, fmt.Errorf("invalid octet counted frame")
+		}
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	length, err := strconv.Atoi(string(data[:idx]))
+	if err != nil || length <= 0 {
+		return 0, nil, fmt.Errorf("invalid frame length %q", data[:idx])
+	}
+	if length > f.maxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds max_frame_size", length)
+	}
+	end := idx + 1 + length
+	if len(data) < end {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	return end, data[idx+1 : end], nil
+}
+
+func (f *frameSplitter) splitNonTransparent(data []byte, atEOF bool) (int, []byte, error) {
+	if idx := bytes.IndexAny(data, "\n\x00"); idx >= 0 {
+		if idx > f.maxFrameSize {
+			return 0, nil, fmt.Errorf("frame exceeds max_frame_size")
+		}
+		return idx + 1, bytes.TrimSuffix(data[:idx], []byte("\r")), nil
+	}
+	if len(data) > f.maxFrameSize {
+		return 0, nil, fmt.Errorf("frame exceeds max_frame_size")
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+
+	"coriolis-logger/config"
+)
+
+// chunkReader returns the data it holds at most size bytes at a time,
+// like a connection receiving small packets.
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := c.size
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(c.data) {
+		n = len(c.data)
+	}
+	copy(p, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// testChunkSizes are the sizes data is fed to the splitter in, so
+// frame lengths, messages and delimiters are split across reads.
+var testChunkSizes = []int{1, 2, 3, 5, 7, 64, 4096}
+
+// scanFrames splits data received chunkSize bytes at a time, the way
+// stream connections are scanned.
+func scanFrames(frm framing, maxFrameSize int, data string, chunkSize int) ([]string, error) {
+	scanner := bufio.NewScanner(&chunkReader{data: []byte(data), size: chunkSize})
+	// A small initial buffer, so it is grown while scanning.
+	scanner.Buffer(make([]byte, 16), maxFrameSize+maxFrameLengthDigits+1)
+	scanner.Split(newFrameSplitter(frm, maxFrameSize).split)
+	frames := []string{}
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	return frames, scanner.Err()
+}
+
+func TestFrameSplitter(t *testing.T) {
+	long := "<13>" + strings.Repeat("x", 500)
+	tests := []struct {
+		name     string
+		framing  framing
+		data     string
+		expected []string
+	}{
+		{
+			name:     "octet counted",
+			framing:  framingOctetCounting,
+			data:     octetCounted("<13>1 - host app - - - first") + octetCounted("<13>1 - host app - - - second"),
+			expected: []string{"<13>1 - host app - - - first", "<13>1 - host app - - - second"},
+		},
+		{
+			name:     "octet counted with newlines in messages",
+			framing:  framingOctetCounting,
+			data:     octetCounted("<13>1 - host app - - - line 1\nline 2") + octetCounted("<13>1 - host app - - - \x00nul"),
+			expected: []string{"<13>1 - host app - - - line 1\nline 2", "<13>1 - host app - - - \x00nul"},
+		},
+		{
+			name:     "octet counted long message",
+			framing:  framingOctetCounting,
+			data:     octetCounted(long) + octetCounted("<13>short"),
+			expected: []string{long, "<13>short"},
+		},
+		{
+			name:     "newline",
+			framing:  framingNonTransparent,
+			data:     "<13>first\n<13>second\r\n<13>third\x00<13>last",
+			expected: []string{"<13>first", "<13>second", "<13>third", "<13>last"},
+		},
+		{
+			name:     "newline long message",
+			framing:  framingNonTransparent,
+			data:     long + "\n<13>short\n",
+			expected: []string{long, "<13>short"},
+		},
+		{
+			name:     "auto detects octet counting",
+			framing:  framingAuto,
+			data:     octetCounted("<13>1 - host app - - - a\nb") + octetCounted("<13>c"),
+			expected: []string{"<13>1 - host app - - - a\nb", "<13>c"},
+		},
+		{
+			name:     "auto detects newlines",
+			framing:  framingAuto,
+			data:     "<13>first\n<13>12 digits later\n",
+			expected: []string{"<13>first", "<13>12 digits later"},
+		},
+	}
+	for _, tt := range tests {
+		for _, size := range testChunkSizes {
+			frames, err := scanFrames(tt.framing, config.DefaultSyslogMaxFrameSize, tt.data, size)
+			if err != nil {
+				t.Errorf("%s, in chunks of %d bytes: unexpected error: %v", tt.name, size, err)
+				continue
+			}
+			if len(frames) != len(tt.expected) {
+				t.Errorf("%s, in chunks of %d bytes: expected frames %q, got %q", tt.name, size, tt.expected, frames)
+				continue
+			}
+			for idx := range frames {
+				if frames[idx] != tt.expected[idx] {
+					t.Errorf("%s, in chunks of %d bytes: expected frames %q, got %q", tt.name, size, tt.expected, frames)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestFrameSplitterErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing framing
+		data    string
+		// frames is the number of frames read before the error.
+		frames int
+	}{
+		{"truncated frame", framingOctetCounting, octetCounted("<13>first") + "20 <13>second", 1},
+		{"truncated length", framingOctetCounting, octetCounted("<13>first") + "12", 1},
+		{"invalid length", framingOctetCounting, "abc <13>message", 0},
+		{"zero length", framingOctetCounting, "0 " + octetCounted("<13>message"), 0},
+		{"length without a space", framingOctetCounting, "12345678901<13>message", 0},
+		{"frame over max_frame_size", framingOctetCounting, octetCounted(strings.Repeat("x", 65)), 0},
+		{"line over max_frame_size", framingNonTransparent, strings.Repeat("x", 65) + "\n", 0},
+		{"unterminated line over max_frame_size", framingNonTransparent, "<13>ok\n" + strings.Repeat("x", 65), 1},
+	}
+	for _, tt := range tests {
+		for _, size := range testChunkSizes {
+			frames, err := scanFrames(tt.framing, 64, tt.data, size)
+			if err == nil {
+				t.Errorf("%s, in chunks of %d bytes: expected an error, got frames %q", tt.name, size, frames)
+				continue
+			}
+			if len(frames) != tt.frames {
+				t.Errorf("%s, in chunks of %d bytes: expected %d frames before the error, got %q", tt.name, size, tt.frames, frames)
+			}
+		}
+	}
+}
+
+func TestFrameSplitterKeepsFraming(t *testing.T) {
+	// The framing is detected once per connection: later messages
+	// starting with a digit are not taken for octet counted frames.
+	frames, err := scanFrames(framingAuto, 64, "<13>first\n2 ab\n", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(frames, "|") != "<13>first|2 ab" {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+}
+
+func TestFramingOf(t *testing.T) {
+	tests := []struct {
+		mode     config.FramingMode
+		rfc3164  bool
+		expected framing
+	}{
+		{"", false, framingAuto},
+		{"", true, framingNonTransparent},
+		{config.AutoFraming, true, framingAuto},
+		{config.OctetCountFraming, false, framingOctetCounting},
+		{config.OctetCountFraming, true, framingOctetCounting},
+		{config.NewlineFraming, false, framingNonTransparent},
+	}
+	for _, tt := range tests {
+		var logFormat format.Format = syslog.RFC5424
+		if tt.rfc3164 {
+			logFormat = syslog.RFC3164
+		}
+		if got := framingOf(logFormat, tt.mode); got != tt.expected {
+			t.Errorf("%q, rfc3164 %v: expected framing %v, got %v", tt.mode, tt.rfc3164, tt.expected, got)
+		}
+	}
+}
+
+func TestChunkedDelivery(t *testing.T) {
+	cfg := testSyslogConfig("rfc5424")
+	writer := newRecordingWriter()
+	worker, address := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+
+	data := octetCounted("<13>1 2026-10-15T10:00:00Z web-1 app 1 - - first") +
+		octetCounted("<13>1 2026-10-15T10:00:01Z web-1 app 1 - - second\nline")
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	// Sent a byte at a time, each in its own segment.
+	conn.(*net.TCPConn).SetNoDelay(true)
+	for _, c := range []byte(data) {
+		if _, err := conn.Write([]byte{c}); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	for _, expected := range []string{"first", "second\nline"} {
+		if logMsg := writer.next(t); logMsg.Message != expected {
+			t.Fatalf("expected message %q, got %q", expected, logMsg.Message)
+		}
+	}
+}
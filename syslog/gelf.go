@@ -0,0 +1,303 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-logger/logging"
+	"coriolis-logger/metrics"
+)
+
+const (
+	// gelfChunkTimeout is the time all the chunks of a message must be
+	// received in, as mandated by the GELF spec.
+	gelfChunkTimeout = 5 * time.Second
+	// gelfMaxChunks is the maximum number of chunks of a message.
+	gelfMaxChunks = 128
+	// gelfChunkHeaderSize is the size of the header of a chunk: the
+	// magic bytes, a message ID, the sequence number of the chunk and
+	// the number of chunks of the message.
+	gelfChunkHeaderSize = 12
+	// gelfMaxPendingMessages is the maximum number of messages whose
+	// chunks are being reassembled. Chunks of other messages are
+	// dropped until some of them are complete, or time out.
+	gelfMaxPendingMessages = 1024
+	// gelfAppName is the application name of the messages that have
+	// neither an _application field, nor a facility.
+	gelfAppName = "gelf"
+	// gelfSDID is the SD-ID the additional fields of GELF messages are
+	// stored under, in their structured data.
+	gelfSDID = "gelf"
+)
+
+var (
+	gelfChunkMagic = []byte{0x1e, 0x0f}
+	gelfGzipMagic  = []byte{0x1f, 0x8b}
+)
+
+// gelfOptions are the settings of a GELF listener. handler is called
+// with each message received.
+type gelfOptions struct {
+	handler func(logging.LogMessage)
+}
+
+// gelfChunks holds the chunks of a message received so far.
+type gelfChunks struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// gelfAssembler reassembles chunked GELF messages, by sender and
+// message ID. It is only used by the goroutine receiving them.
+type gelfAssembler struct {
+	maxSize int
+	pending map[string]*gelfChunks
+}
+
+func newGELFAssembler(maxSize int) *gelfAssembler {
+	return &gelfAssembler{
+		maxSize: maxSize,
+		pending: map[string]*gelfChunks{},
+	}
+}
+
+// add adds a chunk received from client, and returns the payload of
+// its message once all of its chunks were received.
+func (a *gelfAssembler) add(chunk []byte, client string, now time.Time) ([]byte, error) {
+	if len(chunk) <= gelfChunkHeaderSize {
+		return nil, fmt.Errorf("chunk too short")
+	}
+	seq := int(chunk[10])
+	count := int(chunk[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil, fmt.Errorf("invalid chunk %d of %d", seq, count)
+	}
+	key := client + "/" + string(chunk[2:10])
+	msg, ok := a.pending[key]
+	if !ok {
+		if len(a.pending) >= gelfMaxPendingMessages {
+			metrics.GELFIncompleteMessages.Inc()
+			return nil, fmt.Errorf("too many chunked messages pending")
+		}
+		msg = &gelfChunks{
+			chunks:  make([][]byte, count),
+			started: now,
+		}
+		a.pending[key] = msg
+	}
+	if len(msg.chunks) != count {
+		delete(a.pending, key)
+		metrics.GELFIncompleteMessages.Inc()
+		return nil, fmt.Errorf("chunk count changed from %d to %d", len(msg.chunks), count)
+	}
+	if msg.chunks[seq] != nil {
+		// Duplicated datagram.
+		return nil, nil
+	}
+	payload := chunk[gelfChunkHeaderSize:]
+	msg.size += len(payload)
+	if msg.size > a.maxSize {
+		delete(a.pending, key)
+		metrics.GELFIncompleteMessages.Inc()
+		return nil, fmt.Errorf("chunked message larger than %d bytes", a.maxSize)
+	}
+	// The read buffer is reused for the next datagram.
+	msg.chunks[seq] = append([]byte(nil), payload...)
+	msg.received++
+	if msg.received < count {
+		return nil, nil
+	}
+	delete(a.pending, key)
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+// expire discards the messages whose chunks were not all received in
+// time.
+func (a *gelfAssembler) expire(now time.Time) {
+	for key, msg := range a.pending {
+		if now.Sub(msg.started) < gelfChunkTimeout {
+			continue
+		}
+		log.Debugf("discarding GELF message %q: received %d of %d chunks", key, msg.received, len(msg.chunks))
+		metrics.GELFIncompleteMessages.Inc()
+		delete(a.pending, key)
+	}
+}
+
+// decompressGELF returns the JSON payload of a message, decompressed
+// if it is gzip or zlib compressed. Payloads are limited to maxSize
+// bytes once decompressed.
+func decompressGELF(payload []byte, maxSize int) ([]byte, error) {
+	var reader io.Reader
+	var err error
+	switch {
+	case bytes.HasPrefix(payload, gelfGzipMagic):
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) > 1 && payload[0]&0x0f == 8 && (int(payload[0])<<8|int(payload[1]))%31 == 0:
+		// A zlib header, with the deflate compression method.
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing message")
+	}
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing message")
+	}
+	if len(decompressed) > maxSize {
+		return nil, fmt.Errorf("decompressed message larger than %d bytes", maxSize)
+	}
+	return decompressed, nil
+}
+
+// gelfToLogMessage maps the fields of a GELF message to a log message.
+// The _application field is the application name, falling back to the
+// deprecated facility field, and the other additional fields are
+// stored in the structured data. full_message, if set, is preferred to
+// short_message.
+func gelfToLogMessage(payload []byte, now time.Time) (logging.LogMessage, error) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return logging.LogMessage{}, errors.Wrap(err, "decoding message")
+	}
+
+	shortMessage, _ := fields["short_message"].(string)
+	if shortMessage == "" {
+		return logging.LogMessage{}, fmt.Errorf("missing short_message")
+	}
+	logMsg := logging.LogMessage{
+		Timestamp: now,
+		Facility:  logging.UserLevelMessages,
+		// The GELF spec defaults to the alert level.
+		Severity: logging.Alert,
+		AppName:  gelfAppName,
+		Message:  shortMessage,
+
+		TimestampInferred: true,
+	}
+	if fullMessage, ok := fields["full_message"].(string); ok && fullMessage != "" {
+		logMsg.Message = fullMessage
+	}
+	logMsg.Hostname, _ = fields["host"].(string)
+	if timestamp, ok := fields["timestamp"].(json.Number); ok {
+		seconds, err := strconv.ParseFloat(string(timestamp), 64)
+		if err != nil {
+			return logging.LogMessage{}, errors.Wrap(err, "parsing timestamp")
+		}
+		logMsg.Timestamp = time.Unix(0, int64(seconds*float64(time.Second)))
+		logMsg.TimestampInferred = false
+	}
+	if level, ok := fields["level"].(json.Number); ok {
+		severity, err := strconv.Atoi(string(level))
+		if err != nil || severity < int(logging.Emergency) || severity > int(logging.Debug) {
+			return logging.LogMessage{}, fmt.Errorf("invalid level %q", level)
+		}
+		logMsg.Severity = logging.Severity(severity)
+	}
+	if facility, ok := fields["facility"].(string); ok && facility != "" {
+		logMsg.AppName = facility
+	}
+	if app, ok := fields["_application"].(string); ok && app != "" {
+		logMsg.AppName = app
+	}
+	logMsg.Priority = int(logMsg.Facility)*8 + int(logMsg.Severity)
+
+	for name, value := range fields {
+		// _id is reserved by the GELF spec.
+		if !strings.HasPrefix(name, "_") || name == "_id" || name == "_application" {
+			continue
+		}
+		if logMsg.StructuredData == nil {
+			logMsg.StructuredData = map[string]map[string]string{gelfSDID: {}}
+		}
+		logMsg.StructuredData[gelfSDID][name[1:]] = fmt.Sprint(value)
+	}
+	return logMsg, nil
+}
+
+// receiveGELF receives GELF messages on a datagram socket. Chunks are
+// reassembled, and messages whose chunks were not all received in
+// time are discarded.
+func (s *server) receiveGELF(conn packetConn) {
+	defer s.wg.Done()
+	bufSize := datagramReadBufferSize
+	if s.maxFrameSize > bufSize {
+		bufSize = s.maxFrameSize
+	}
+	buf := make([]byte, bufSize)
+	assembler := newGELFAssembler(s.maxFrameSize)
+	for {
+		// Incomplete messages are discarded even when no other
+		// datagrams are received.
+		conn.SetReadDeadline(time.Now().Add(gelfChunkTimeout))
+		n, addr, err := conn.ReadFrom(buf)
+		now := time.Now()
+		assembler.expire(now)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			s.fail(errors.Wrapf(err, "listener %q: receiving datagrams on %s", conn.name, conn.LocalAddr()))
+			return
+		}
+		client := addr.String()
+		payload := buf[:n]
+		if bytes.HasPrefix(payload, gelfChunkMagic) {
+			payload, err = assembler.add(payload, client, now)
+			if err != nil {
+				log.Debugf("dropping GELF chunk from %q: %v", client, err)
+				continue
+			}
+			if payload == nil {
+				continue
+			}
+		}
+		payload, err = decompressGELF(payload, s.maxFrameSize)
+		if err != nil {
+			log.Debugf("dropping GELF message from %q: %v", client, err)
+			continue
+		}
+		logMsg, err := gelfToLogMessage(payload, now)
+		if err != nil {
+			log.Debugf("dropping GELF message from %q: %v", client, err)
+			continue
+		}
+		logMsg.SourceAddr = sourceIP(addr)
+		conn.gelf.handler(logMsg)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// sourceKey identifies a rate limited source. app is only set when
+// sources are limited by application name as well as IP.
+type sourceKey struct {
+	ip  string
+	app string
+}
+
+func (k sourceKey) String() string {
+	if k.app == "" {
+		return k.ip
+	}
+	return fmt.Sprintf("%s (%s)", k.ip, k.app)
+}
+
+// sourceEntry is the rate limiter of a source, along with the number
+// of its messages dropped since the last time it was reported.
+type sourceEntry struct {
+	key      sourceKey
+	limiter  *rate.Limiter
+	dropped  int
+	reported time.Time
+}
+
+// sourceLimiter limits the rate of the messages received from each
+// source, with a token bucket. It keeps the limiters of at most
+// maxSources sources, evicting the least recently seen one when a new
+// source shows up. A limit of 0 allows all messages.
+type sourceLimiter struct {
+	mut            sync.Mutex
+	limit          rate.Limit
+	burst          int
+	maxSources     int
+	byApp          bool
+	reportInterval time.Duration
+
+	// order holds the sources, least recently seen first, and entries
+	// indexes them by key.
+	order   *list.List
+	entries map[sourceKey]*list.Element
+}
+
+func newSourceLimiter(cfg config.Syslog) *sourceLimiter {
+	l := &sourceLimiter{
+		order:   list.New(),
+		entries: map[sourceKey]*list.Element{},
+	}
+	l.configure(cfg)
+	return l
+}
+
+// configure applies the rate limit settings of cfg. The sources
+// already tracked keep the tokens they have left, unless they are now
+// keyed differently.
+func (l *sourceLimiter) configure(cfg config.Syslog) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	limit := rate.Limit(cfg.MaxMessagesPerSecond)
+	burst := cfg.GetBurstSize()
+	if limit == 0 || cfg.RateLimitByApp != l.byApp {
+		l.order.Init()
+		l.entries = map[sourceKey]*list.Element{}
+	}
+	l.limit = limit
+	l.burst = burst
+	l.maxSources = cfg.GetRateLimitMaxSources()
+	l.byApp = cfg.RateLimitByApp
+	l.reportInterval = cfg.GetRateLimitReportInterval()
+	for elem := l.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*sourceEntry)
+		entry.limiter.SetLimit(limit)
+		entry.limiter.SetBurst(burst)
+	}
+	for l.order.Len() > l.maxSources {
+		l.evictOldest()
+	}
+}
+
+func (l *sourceLimiter) evictOldest() {
+	oldest := l.order.Remove(l.order.Front()).(*sourceEntry)
+	delete(l.entries, oldest.key)
+}
+
+// allow returns false if a message of app, received from ip, must be
+// dropped, as its source exceeded its allowance. If messages of the
+// source were dropped since it was last reported, at least
+// reportInterval ago, their number is returned in dropped, along with
+// the source, and the count is reset. Messages without an IP, received
+// on unix sockets, are always allowed.
+func (l *sourceLimiter) allow(ip, app string, now time.Time) (ok bool, dropped int, source sourceKey) {
+	if ip == "" {
+		return true, 0, source
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.limit == 0 {
+		return true, 0, source
+	}
+
+	key := sourceKey{ip: ip}
+	if l.byApp {
+		key.app = app
+	}
+	elem, found := l.entries[key]
+	if found {
+		l.order.MoveToBack(elem)
+	} else {
+		if l.order.Len() >= l.maxSources {
+			l.evictOldest()
+		}
+		elem = l.order.PushBack(&sourceEntry{
+			key:     key,
+			limiter: rate.NewLimiter(l.limit, l.burst),
+		})
+		l.entries[key] = elem
+	}
+	entry := elem.Value.(*sourceEntry)
+	ok = entry.limiter.AllowN(now, 1)
+	if !ok {
+		entry.dropped++
+	}
+	if entry.dropped > 0 && now.Sub(entry.reported) >= l.reportInterval {
+		dropped = entry.dropped
+		entry.dropped = 0
+		entry.reported = now
+	}
+	return ok, dropped, key
+}
+
+// rateLimitReport returns the message recording that dropped messages
+// of source were dropped, along the lines of logMsg, the message of
+// the source that triggered the report.
+func rateLimitReport(logMsg logging.LogMessage, source sourceKey, dropped int, now time.Time) logging.LogMessage {
+	return logging.LogMessage{
+		Timestamp:  now,
+		Hostname:   logMsg.Hostname,
+		Priority:   int(logging.InternalSyslogMessage)*8 + int(logging.Warning),
+		Facility:   logging.InternalSyslogMessage,
+		Severity:   logging.Warning,
+		AppName:    logMsg.AppName,
+		RFC:        logMsg.RFC,
+		SourceAddr: logMsg.SourceAddr,
+		Message: fmt.Sprintf(
+			"rate limit engaged, %d messages dropped from %s", dropped, source),
+	}
+}
+
+// sourceIP returns the IP of addr, the address of the sender of a
+// message, or an empty string if it has none, as for unix sockets.
+func sourceIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,259 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+const (
+	// relpMaxNumberLength is the maximum number of digits of the
+	// transaction number and data length of a RELP frame.
+	relpMaxNumberLength = 9
+	// relpMaxCommandLength is the maximum length of a RELP command.
+	relpMaxCommandLength = 32
+	// relpOffers are the offers we answer the open command with. Only
+	// the syslog command is supported.
+	relpOffers = "relp_version=0\nrelp_software=coriolis-logger\ncommands=syslog"
+)
+
+// relpOptions are the settings of a RELP listener. handler is called
+// with each message received, and returns once it was written, or
+// failed to be.
+type relpOptions struct {
+	windowSize     int
+	maxCommandSize int
+	handler        func(format.LogParts) error
+}
+
+// relpFrame is a RELP command, or response.
+type relpFrame struct {
+	txnr    int
+	command string
+	data    []byte
+}
+
+func (f relpFrame) bytes() []byte {
+	buf := bytes.NewBufferString(fmt.Sprintf("%d %s %d", f.txnr, f.command, len(f.data)))
+	if len(f.data) > 0 {
+		buf.WriteByte(' ')
+		buf.Write(f.data)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// readRELPToken reads up to maxLen bytes, until a space or a LF. It
+// returns the bytes read, and the delimiter.
+func readRELPToken(r *bufio.Reader, maxLen int) (string, byte, error) {
+	var token []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+		if c == ' ' || c == '\n' {
+			if len(token) == 0 {
+				return "", 0, fmt.Errorf("invalid RELP frame")
+			}
+			return string(token), c, nil
+		}
+		if len(token) == maxLen {
+			return "", 0, fmt.Errorf("invalid RELP frame")
+		}
+		token = append(token, c)
+	}
+}
+
+// readRELPNumber reads a transaction number or a data length.
+func readRELPNumber(r *bufio.Reader) (int, byte, error) {
+	token, delim, err := readRELPToken(r, relpMaxNumberLength)
+	if err != nil {
+		return 0, 0, err
+	}
+	num, err := strconv.Atoi(token)
+	if err != nil || num < 0 {
+		return 0, 0, fmt.Errorf("invalid RELP number %q", token)
+	}
+	return num, delim, nil
+}
+
+// readRELPFrame reads a frame, made of a transaction number, a command
+// and the length of the data, separated by spaces, followed by the
+// data, if any, and a LF.
+func readRELPFrame(r *bufio.Reader, maxDataLen int) (relpFrame, error) {
+	var frame relpFrame
+	txnr, delim, err := readRELPNumber(r)
+	if err != nil {
+		return frame, err
+	}
+	if delim != ' ' {
+		return frame, fmt.Errorf("invalid RELP frame")
+	}
+	frame.txnr = txnr
+	frame.command, delim, err = readRELPToken(r, relpMaxCommandLength)
+	if err != nil {
+		return frame, err
+	}
+	if delim != ' ' {
+		return frame, fmt.Errorf("invalid RELP frame")
+	}
+	dataLen, delim, err := readRELPNumber(r)
+	if err != nil {
+		return frame, err
+	}
+	if dataLen > maxDataLen {
+		return frame, fmt.Errorf("RELP command of %d bytes exceeds relp_max_command_size", dataLen)
+	}
+	if delim == '\n' {
+		if dataLen != 0 {
+			return frame, fmt.Errorf("invalid RELP frame")
+		}
+		return frame, nil
+	}
+	frame.data = make([]byte, dataLen)
+	if _, err := io.ReadFull(r, frame.data); err != nil {
+		return frame, err
+	}
+	trailer, err := r.ReadByte()
+	if err != nil {
+		return frame, err
+	}
+	if trailer != '\n' {
+		return frame, fmt.Errorf("invalid RELP frame trailer")
+	}
+	return frame, nil
+}
+
+// relpSession is the state of a RELP connection.
+type relpSession struct {
+	server *server
+	conn   net.Conn
+	client string
+	ip     string
+	opts   relpOptions
+	open   bool
+}
+
+// respond writes a response to the command with the given transaction
+// number.
+func (r *relpSession) respond(txnr int, data string) error {
+	r.conn.SetWriteDeadline(time.Now().Add(r.server.readTimeout))
+	rsp := relpFrame{txnr: txnr, command: "rsp", data: []byte(data)}
+	_, err := r.conn.Write(rsp.bytes())
+	return err
+}
+
+// handle executes a command, and responds to it. It returns false once
+// the session is closed.
+func (r *relpSession) handle(frame relpFrame) (bool, error) {
+	switch frame.command {
+	case "open":
+		r.open = true
+		return true, r.respond(frame.txnr, "200 OK\n"+relpOffers)
+	case "close":
+		return false, r.respond(frame.txnr, "")
+	case "syslog":
+		if !r.open {
+			return true, r.respond(frame.txnr, "500 session not open")
+		}
+		msg := bytes.TrimRight(frame.data, "\r\n\x00")
+		logParts := r.server.parseLogParts(msg, r.client, r.ip, syslog.Automatic)
+		if err := r.opts.handler(logParts); err != nil {
+			log.Warningf("failed to write RELP message from %q: %v", r.client, err)
+			return true, r.respond(frame.txnr, "500 "+strings.Replace(err.Error(), "\n", " ", -1))
+		}
+		return true, r.respond(frame.txnr, "200 OK")
+	default:
+		return true, r.respond(frame.txnr, fmt.Sprintf("500 unsupported command %q", frame.command))
+	}
+}
+
+// serveRELP serves a RELP connection. Commands are read ahead, up to
+// the window size, and handled in order, each message being
+// acknowledged once written. When draining, the commands already
+// received are handled before the server closes the session.
+func (s *server) serveRELP(conn net.Conn, opts relpOptions) {
+	defer s.closeConn(conn)
+	client := remoteAddr(conn)
+
+	frames := make(chan relpFrame, opts.windowSize)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(frames)
+		reader := bufio.NewReader(deadlineReader{conn: conn, server: s})
+		for {
+			frame, err := readRELPFrame(reader, opts.maxCommandSize)
+			if err != nil {
+				readErr = err
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-done:
+				return
+			}
+			if frame.command == "close" {
+				return
+			}
+		}
+	}()
+
+	session := &relpSession{
+		server: s,
+		conn:   conn,
+		client: client,
+		ip:     sourceIP(conn.RemoteAddr()),
+		opts:   opts,
+	}
+	for frame := range frames {
+		open, err := session.handle(frame)
+		if err != nil {
+			log.Warningf("failed to respond to RELP client %q: %v", client, err)
+			return
+		}
+		if !open {
+			return
+		}
+	}
+
+	// frames is closed once the reader is done, so readErr is set.
+	if s.isDraining() {
+		serverClose := relpFrame{command: "serverclose"}
+		conn.SetWriteDeadline(time.Now().Add(s.readTimeout))
+		conn.Write(serverClose.bytes())
+		return
+	}
+	if readErr == io.EOF {
+		return
+	}
+	if netErr, ok := readErr.(net.Error); ok && netErr.Timeout() {
+		log.Debugf("closing idle RELP connection from %q", client)
+		return
+	}
+	log.Warningf("closing RELP connection from %q: %v", client, readErr)
+}
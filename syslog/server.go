@@ -0,0 +1,515 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+
+	"coriolis-logger/metrics"
+)
+
+const datagramReadBufferSize = 64 * 1024
+
+// stopDrainTimeout is the maximum amount of time stream connections
+// are given to handle the messages they already received, when the
+// server is stopped.
+const stopDrainTimeout = 5 * time.Second
+
+// server receives syslog messages on stream listeners and packet
+// connections, and passes them to handler once parsed. Unlike the
+// go-syslog server, it can serve listeners created elsewhere, such
+// as the ones inherited from a parent process, and it can stop
+// accepting connections while letting established ones drain.
+type server struct {
+	handler func(format.LogParts)
+	// readTimeout is the maximum time a stream connection may stay
+	// idle, and maxFrameSize the maximum size of a message received
+	// on one.
+	readTimeout  time.Duration
+	maxFrameSize int
+	// keepRaw is set to keep the payload of the messages that fail to
+	// parse along with their parts, to store them as is.
+	keepRaw bool
+	// rfc3164Location is the timezone of the RFC 3164 timestamps
+	// lacking one. Timestamps off by more than maxClockSkew, if set,
+	// are replaced by the time messages were received at.
+	rfc3164Location *time.Location
+	maxClockSkew    time.Duration
+	// acl selects the source IPs stream connections are accepted
+	// from, if set.
+	acl *sourceACL
+	// maxConns is the maximum number of open stream connections, if
+	// set. Connections over it are closed after rejectDelay.
+	maxConns    int32
+	rejectDelay time.Duration
+	// onError is called when a listener or connection stops receiving
+	// messages because of an error, other than being closed.
+	onError func(error)
+
+	listeners   []streamListener
+	packetConns []packetConn
+
+	// connCount is the number of open stream connections. It is
+	// updated atomically.
+	connCount int32
+
+	mut   sync.Mutex
+	conns map[net.Conn]struct{}
+	// closing is set once we stop accepting connections and receiving
+	// datagrams.
+	closing bool
+	// draining is set once established stream connections stop
+	// waiting for new data, and only handle what was already received.
+	draining bool
+
+	// wg tracks the accept and receive loops.
+	wg sync.WaitGroup
+	// connWg tracks established stream connections.
+	connWg sync.WaitGroup
+}
+
+// streamListener is a listener, along with its name, and the format
+// and framing of the messages received on its connections. relp is set
+// for RELP listeners.
+type streamListener struct {
+	net.Listener
+	name    string
+	format  format.Format
+	framing framing
+	relp    *relpOptions
+}
+
+// packetConn is a datagram socket, along with its name and the format
+// of the messages received on it. gelf is set for GELF listeners.
+type packetConn struct {
+	net.PacketConn
+	name   string
+	format format.Format
+	gelf   *gelfOptions
+}
+
+func newServer(readTimeout time.Duration, maxFrameSize int, handler func(format.LogParts), onError func(error)) *server {
+	return &server{
+		handler:      handler,
+		onError:      onError,
+		readTimeout:  readTimeout,
+		maxFrameSize: maxFrameSize,
+		conns:        map[net.Conn]struct{}{},
+
+		rfc3164Location: time.UTC,
+	}
+}
+
+func (s *server) isDraining() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.draining
+}
+
+// rawPartKey is the key of the rawMessage in the parts of a message
+// that failed to parse, when the server keeps them.
+const rawPartKey = "raw"
+
+// sourcePartKey is the key of the IP address a message was received
+// from, in the parts of the message.
+const sourcePartKey = "source_addr"
+
+// rawMessage is a message as it was received, from the host named
+// hostname.
+type rawMessage struct {
+	payload  string
+	hostname string
+	received time.Time
+}
+
+// deadlineReader reads from a stream connection, failing reads once the
+// connection stays idle for longer than the read timeout of the server.
+type deadlineReader struct {
+	conn   net.Conn
+	server *server
+}
+
+func (d deadlineReader) Read(data []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.server.readTimeout))
+	// Draining the connections may have happened before we set the
+	// deadline, in which case we must not wait for new data.
+	if d.server.isDraining() {
+		d.conn.SetReadDeadline(time.Now())
+	}
+	return d.conn.Read(data)
+}
+
+// fail reports an error that stopped a listener or connection, unless
+// we are closing them.
+func (s *server) fail(err error) {
+	s.mut.Lock()
+	closing := s.closing
+	s.mut.Unlock()
+	if !closing && s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// addListener adds a listener named name, receiving messages in
+// logFormat, delimited by connFraming.
+func (s *server) addListener(name string, listener net.Listener, logFormat format.Format, connFraming framing) {
+	s.listeners = append(s.listeners, streamListener{
+		Listener: listener,
+		name:     name,
+		format:   logFormat,
+		framing:  connFraming,
+	})
+}
+
+// addRELPListener adds a listener serving RELP sessions.
+func (s *server) addRELPListener(name string, listener net.Listener, opts relpOptions) {
+	s.listeners = append(s.listeners, streamListener{
+		Listener: listener,
+		name:     name,
+		format:   syslog.Automatic,
+		relp:     &opts,
+	})
+}
+
+// addPacketConn adds a datagram socket named name, receiving messages
+// in logFormat.
+func (s *server) addPacketConn(name string, conn net.PacketConn, logFormat format.Format) {
+	// The datagrams received on unix sockets come with the
+	// credentials of their sender, when the platform supports it.
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if err := enablePassCred(unixConn); err != nil {
+			log.Warningf("failed to enable peer credentials on listener %q: %v", name, err)
+		}
+	}
+	s.packetConns = append(s.packetConns, packetConn{
+		PacketConn: conn,
+		name:       name,
+		format:     logFormat,
+	})
+}
+
+// addGELFConn adds a datagram socket receiving GELF messages.
+func (s *server) addGELFConn(name string, conn net.PacketConn, opts gelfOptions) {
+	s.packetConns = append(s.packetConns, packetConn{
+		PacketConn: conn,
+		name:       name,
+		gelf:       &opts,
+	})
+}
+
+// serve starts receiving messages on all listeners and connections.
+func (s *server) serve() {
+	for _, listener := range s.listeners {
+		s.wg.Add(1)
+		go s.accept(listener)
+	}
+	for _, conn := range s.packetConns {
+		s.wg.Add(1)
+		if conn.gelf != nil {
+			go s.receiveGELF(conn)
+		} else {
+			go s.receive(conn)
+		}
+	}
+}
+
+func (s *server) accept(listener streamListener) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			s.fail(errors.Wrapf(err, "listener %q: accepting connections on %s", listener.name, listener.Addr()))
+			return
+		}
+		if !s.acl.permits(conn.RemoteAddr()) {
+			log.Warningf("denied connection from %q on listener %q", remoteAddr(conn), listener.name)
+			conn.Close()
+			continue
+		}
+		if !s.reserveConn() {
+			metrics.SyslogConnectionsRejected.Inc()
+			log.Debugf("rejected connection from %q on listener %q: too many connections", remoteAddr(conn), listener.name)
+			// Clients reconnecting right away are slowed down. As no
+			// connection can be served anyway, the next ones wait in
+			// the backlog meanwhile.
+			if s.rejectDelay > 0 {
+				time.Sleep(s.rejectDelay)
+			}
+			conn.Close()
+			continue
+		}
+		s.mut.Lock()
+		s.conns[conn] = struct{}{}
+		s.mut.Unlock()
+		metrics.SyslogConnections.Inc()
+
+		s.connWg.Add(1)
+		if listener.relp != nil {
+			go s.serveRELP(conn, *listener.relp)
+			continue
+		}
+		go s.scan(conn, listener.format, listener.framing)
+	}
+}
+
+// reserveConn counts a new stream connection. It returns false if
+// the maximum number of connections are already open.
+func (s *server) reserveConn() bool {
+	for {
+		count := atomic.LoadInt32(&s.connCount)
+		if s.maxConns > 0 && count >= s.maxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.connCount, count, count+1) {
+			return true
+		}
+	}
+}
+
+// closeConn closes an established stream connection.
+func (s *server) closeConn(conn net.Conn) {
+	conn.Close()
+	s.mut.Lock()
+	delete(s.conns, conn)
+	s.mut.Unlock()
+	atomic.AddInt32(&s.connCount, -1)
+	metrics.SyslogConnections.Dec()
+	s.connWg.Done()
+}
+
+// remoteAddr returns the address of the peer of conn, if known.
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func (s *server) scan(conn net.Conn, logFormat format.Format, connFraming framing) {
+	defer s.closeConn(conn)
+
+	client := remoteAddr(conn)
+	ip := sourceIP(conn.RemoteAddr())
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// The handshake would otherwise happen on the first read,
+		// and its failures would be reported as read errors.
+		tlsConn.SetDeadline(time.Now().Add(s.readTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			if s.isDraining() {
+				return
+			}
+			metrics.SyslogTLSHandshakeFailures.Inc()
+			log.Warningf("TLS handshake with %q failed: %v", client, err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+	scanner := bufio.NewScanner(deadlineReader{conn: conn, server: s})
+	// Leave room for the length of octet counted frames.
+	scanner.Buffer(make([]byte, 4096), s.maxFrameSize+maxFrameLengthDigits+1)
+	scanner.Split(newFrameSplitter(connFraming, s.maxFrameSize).split)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		s.parse(scanner.Bytes(), client, ip, logFormat)
+	}
+	// Once draining, the connection is expected to time out, after
+	// the messages already received were handled.
+	err := scanner.Err()
+	if err == nil || s.isDraining() {
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		log.Debugf("closing idle connection from %q", client)
+		return
+	}
+	log.Warningf("closing connection from %q: %v", client, err)
+}
+
+func (s *server) receive(conn packetConn) {
+	defer s.wg.Done()
+	// Datagrams are read whole, up to the maximum size of a frame.
+	bufSize := datagramReadBufferSize
+	if s.maxFrameSize > bufSize {
+		bufSize = s.maxFrameSize
+	}
+	buf := make([]byte, bufSize)
+	unixConn, _ := conn.PacketConn.(*net.UnixConn)
+	var oob []byte
+	if unixConn != nil {
+		oob = make([]byte, credentialsOOBSize)
+	}
+	for {
+		var n, oobn int
+		var addr net.Addr
+		var err error
+		if unixConn != nil {
+			n, oobn, _, _, err = unixConn.ReadMsgUnix(buf, oob)
+		} else {
+			n, addr, err = conn.ReadFrom(buf)
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && (netErr.Temporary() || netErr.Timeout()) {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			s.fail(errors.Wrapf(err, "listener %q: receiving datagrams on %s", conn.name, conn.LocalAddr()))
+			return
+		}
+		// Ignore trailing control characters and NULs
+		for ; n > 0 && buf[n-1] < 32; n-- {
+		}
+		if n == 0 {
+			continue
+		}
+		ip := sourceIP(addr)
+		// The senders on unix sockets are usually unnamed, so the
+		// messages are recorded as received from the socket path.
+		var client string
+		if unixConn != nil {
+			client = conn.LocalAddr().String()
+		} else if addr != nil {
+			client = addr.String()
+		}
+		msg := buf[:n]
+		if split := conn.format.GetSplitFunc(); split != nil {
+			_, token, err := split(msg, true)
+			if err != nil {
+				continue
+			}
+			msg = token
+		}
+		logParts := s.parseLogParts(msg, client, ip, conn.format)
+		if creds := peerCredentials(oob[:oobn]); creds != "" {
+			logParts["client"] = fmt.Sprintf("%s (%s)", client, creds)
+		}
+		s.handler(logParts)
+	}
+}
+
+func (s *server) parse(line []byte, client, ip string, logFormat format.Format) {
+	s.handler(s.parseLogParts(line, client, ip, logFormat))
+}
+
+// parseLogParts parses a message received from client, whose IP
+// address is ip.
+func (s *server) parseLogParts(line []byte, client, ip string, logFormat format.Format) format.LogParts {
+	parser := logFormat.GetParser(line)
+	parseErr := parser.Parse()
+	if parseErr != nil {
+		log.Debugf("failed to parse message from %q: %v", client, parseErr)
+	}
+	logParts := parser.Dump()
+	now := time.Now()
+	if _, ok := logParts["content"]; ok {
+		s.fixRFC3164Timestamp(logParts, line, now)
+	}
+	logParts["client"] = client
+	logParts[sourcePartKey] = ip
+	hostname := client
+	if i := strings.Index(client, ":"); i > 1 {
+		hostname = client[:i]
+	}
+	if logParts["hostname"] == "" && (logFormat == syslog.RFC3164 || logFormat == syslog.Automatic) {
+		logParts["hostname"] = hostname
+	}
+	if parseErr != nil && s.keepRaw {
+		logParts[rawPartKey] = rawMessage{
+			payload:  string(line),
+			hostname: hostname,
+			received: now,
+		}
+	}
+	return logParts
+}
+
+// closeListeners stops accepting new connections and receiving
+// datagrams. Established stream connections are left open.
+func (s *server) closeListeners() {
+	s.mut.Lock()
+	s.closing = true
+	s.mut.Unlock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+	s.wg.Wait()
+}
+
+// closeConnections closes all established stream connections.
+func (s *server) closeConnections() {
+	s.mut.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mut.Unlock()
+	s.connWg.Wait()
+}
+
+// drain waits for established stream connections to be closed by
+// their peers, for at most timeout. Connections still open after
+// that are closed.
+func (s *server) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.closeConnections()
+	}
+}
+
+// drainConnections stops waiting for new data on established stream
+// connections, and waits for the messages they already received to be
+// handled, for at most timeout. Connections still open after that are
+// closed.
+func (s *server) drainConnections(timeout time.Duration) {
+	s.mut.Lock()
+	s.draining = true
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mut.Unlock()
+	s.drain(timeout)
+}
+
+// stop closes all listeners and connections, and waits for all
+// messages being parsed to be handled. Messages already received on
+// stream connections are handled before they are closed.
+func (s *server) stop() {
+	s.closeListeners()
+	s.drainConnections(stopDrainTimeout)
+}
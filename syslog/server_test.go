@@ -0,0 +1,123 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"coriolis-logger/metrics"
+)
+
+func TestReserveConn(t *testing.T) {
+	srv := &server{maxConns: 100}
+	for idx := 0; idx < 100; idx++ {
+		if !srv.reserveConn() {
+			t.Fatalf("connection %d rejected below the limit", idx+1)
+		}
+	}
+	if srv.reserveConn() {
+		t.Fatalf("expected the 101st connection to be rejected")
+	}
+	atomic.AddInt32(&srv.connCount, -1)
+	if !srv.reserveConn() {
+		t.Fatalf("expected a connection to be accepted once another one closed")
+	}
+
+	unlimited := &server{}
+	for idx := 0; idx < 1000; idx++ {
+		if !unlimited.reserveConn() {
+			t.Fatalf("connection %d rejected without a limit", idx+1)
+		}
+	}
+}
+
+// waitForConnCount waits for the worker to count expected open
+// connections.
+func waitForConnCount(t *testing.T, worker *SyslogWorker, expected int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&worker.server.connCount) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d open connections, got %d", expected, atomic.LoadInt32(&worker.server.connCount))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	cfg := testSyslogConfig("rfc3164")
+	cfg.MaxConnections = 100
+	writer := newRecordingWriter()
+	worker, address := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+
+	if limit := testutil.ToFloat64(metrics.SyslogMaxConnections); limit != 100 {
+		t.Fatalf("expected the connection limit metric to be 100, got %v", limit)
+	}
+	rejected := testutil.ToFloat64(metrics.SyslogConnectionsRejected)
+
+	conns := []net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for idx := 0; idx < 100; idx++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("connection %d failed: %v", idx+1, err)
+		}
+		conns = append(conns, conn)
+		fmt.Fprintf(conn, "<13>Oct 15 10:00:00 web-1 app[1]: message %d\n", idx+1)
+		writer.next(t)
+	}
+	waitForConnCount(t, worker, 100)
+
+	// The 101st connection is closed without being read.
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "<13>Oct 15 10:00:00 web-1 app[1]: message 101\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the 101st connection to be closed")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("expected the 101st connection to be closed, got %v", err)
+	}
+	select {
+	case logMsg := <-writer.messages:
+		t.Fatalf("unexpected message %q over the connection limit", logMsg.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if count := testutil.ToFloat64(metrics.SyslogConnectionsRejected); count != rejected+1 {
+		t.Fatalf("expected %v rejected connections, got %v", rejected+1, count)
+	}
+
+	// Once a connection is closed, new ones are accepted again.
+	conns[0].Close()
+	waitForConnCount(t, worker, 99)
+	send(t, address, "<13>Oct 15 10:00:00 web-1 app[1]: accepted again\n")
+	if logMsg := writer.next(t); logMsg.Message != "accepted again" {
+		t.Fatalf("expected message %q, got %q", "accepted again", logMsg.Message)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build !linux
+// +build !linux
+
+package syslog
+
+import (
+	"net"
+	"syscall"
+)
+
+// reusePort is a no-op on platforms other than linux.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return nil
+}
+
+// Peer credentials of datagrams are only read on Linux.
+const credentialsOOBSize = 0
+
+func enablePassCred(conn *net.UnixConn) error {
+	return nil
+}
+
+func peerCredentials(oob []byte) string {
+	return ""
+}
@@ -16,13 +16,21 @@ package syslog
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
 
-	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
 
 	"coriolis-logger/config"
+	"coriolis-logger/graceful"
 	"coriolis-logger/logging"
+	"coriolis-logger/metrics"
 	"coriolis-logger/worker"
 
 	"github.com/juju/loggo"
@@ -31,112 +39,647 @@ import (
 
 var log = loggo.GetLogger("coriolis.logger.syslog")
 
+const (
+	// InheritedSocketName is the name under which our socket is passed
+	// on to a new process during a graceful restart.
+	InheritedSocketName = "syslog"
+	// InheritedUDPSocketName is the name under which the additional
+	// UDP socket, enabled by listen_udp, is passed on.
+	InheritedUDPSocketName = "syslog-udp"
+	// InheritedUnixSocketName is the name under which the additional
+	// unix socket, enabled by unix_socket, is passed on.
+	InheritedUnixSocketName = "syslog-unix"
+	// InheritedTLSSocketName is the name under which the TCP socket
+	// of the TLS listener is passed on.
+	InheritedTLSSocketName = "syslog-tls"
+	// InheritedRELPSocketName is the name under which the socket of
+	// the RELP listener is passed on.
+	InheritedRELPSocketName = "syslog-relp"
+)
+
 func init() {
 	log.SetLogLevel(loggo.DEBUG)
 }
 
-func NewSyslogServer(ctx context.Context, cfg config.Syslog, writer logging.Writer, errChan chan error) (worker.SimpleWorker, error) {
+// drainTimeout is the maximum amount of time established TCP
+// connections are given to close on their own, after handing off
+// the listener to a new process.
+const drainTimeout = 30 * time.Second
+
+func NewSyslogServer(ctx context.Context, cfg config.Syslog, writer logging.Writer, errChan chan error) (*SyslogWorker, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, errors.Wrap(err, "validating syslog config")
 	}
 
-	channel := make(syslog.LogPartsChannel)
-	handler := syslog.NewChannelHandler(channel)
-	server := syslog.NewServer()
-	logFormat, err := cfg.LogFormat()
+	var worker *SyslogWorker
+	server := newServer(cfg.GetReadTimeout(), cfg.GetMaxFrameSize(), func(logParts format.LogParts) {
+		logMsg, ok := worker.toLogMessage(logParts)
+		if !ok || !worker.allow(logMsg) {
+			return
+		}
+		for _, msg := range worker.limitSize(logMsg) {
+			worker.enqueue(received{logMsg: msg})
+		}
+	}, func(err error) {
+		worker.setFailure(err)
+		select {
+		case errChan <- err:
+		case <-ctx.Done():
+		}
+	})
+
+	server.keepRaw = cfg.ParseMode == config.LenientParseMode
+	location, err := cfg.GetRFC3164Location()
 	if err != nil {
-		return nil, errors.Wrap(err, "getting log format")
+		return nil, errors.Wrap(err, "loading rfc3164_timezone")
+	}
+	server.rfc3164Location = location
+	server.maxClockSkew = cfg.GetMaxClockSkew()
+	if len(cfg.AllowedCIDRs) > 0 || len(cfg.DeniedCIDRs) > 0 {
+		acl, err := newSourceACL(cfg.AllowedCIDRs, cfg.DeniedCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		server.acl = acl
 	}
-	server.SetFormat(logFormat)
-	server.SetHandler(handler)
+	server.maxConns = int32(cfg.MaxConnections)
+	server.rejectDelay = cfg.GetRejectDelay()
+	metrics.SyslogMaxConnections.Set(float64(cfg.MaxConnections))
 
-	worker := &SyslogWorker{
-		server:  server,
-		logging: writer,
-		cfg:     cfg,
-		channel: channel,
-		ctx:     ctx,
-		errChan: errChan,
-		closed:  make(chan struct{}),
+	prefixRules, err := compilePrefixRules(cfg.PrefixStripRules)
+	if err != nil {
+		return nil, err
+	}
+
+	worker = &SyslogWorker{
+		server:         server,
+		prefixRules:    prefixRules,
+		appFieldSource: cfg.AppFieldSource,
+		limiter:        newSourceLimiter(cfg),
+		logging:        writer,
+		cfg:            cfg,
+		channel:        make(chan received, cfg.QueueDepth),
+		ctx:            ctx,
+		errChan:        errChan,
+		stopping:       make(chan struct{}),
+		closed:         make(chan struct{}),
 	}
 
 	return worker, nil
 }
 
+// compilePrefixRules compiles the prefix_strip_rules setting.
+func compilePrefixRules(rules map[string]string) (map[string]*regexp.Regexp, error) {
+	prefixRules := make(map[string]*regexp.Regexp, len(rules))
+	for app, pattern := range rules {
+		// Only a match at the start of the message is stripped.
+		rule, err := regexp.Compile("^(?:" + pattern + ")")
+		if err != nil {
+			return nil, errors.Wrapf(err, "compiling prefix strip rule for %q", app)
+		}
+		prefixRules[app] = rule
+	}
+	return prefixRules, nil
+}
+
+// received is a message received by the server. If done is set, the
+// result of writing the message is sent on it.
+type received struct {
+	logMsg logging.LogMessage
+	done   chan error
+}
+
 var _ worker.SimpleWorker = (*SyslogWorker)(nil)
 
 type SyslogWorker struct {
 	logging logging.Writer
 	cfg     config.Syslog
-	server  *syslog.Server
-	channel syslog.LogPartsChannel
-	ctx     context.Context
-	errChan chan error
-	closed  chan struct{}
+	server  *server
+	// prefixRules holds the compiled prefix_strip_rules, by app name,
+	// and appFieldSource the app_field_source setting. They may be
+	// changed by Reconfigure(), so they are guarded by rulesMut.
+	prefixRules    map[string]*regexp.Regexp
+	appFieldSource config.AppFieldSource
+	rulesMut       sync.RWMutex
+	channel        chan received
+	ctx            context.Context
+	errChan        chan error
+	// stopping is closed once the server is stopped, right before
+	// the channel is closed. The workers then write the messages left
+	// in it, and exit.
+	stopping chan struct{}
+	closed   chan struct{}
+	workers  sync.WaitGroup
+
+	// limiter drops the messages of the sources sending too many of
+	// them, over max_messages_per_second. Messages received over RELP
+	// are not limited.
+	limiter *sourceLimiter
+
+	// sockets holds the sockets of the listeners we receive
+	// messages on.
+	sockets []*socket
+	// handedOff is set once our sockets were passed on to a new
+	// process, which is now responsible for them.
+	handedOff bool
+
+	// failure is the error that stopped a listener from receiving
+	// messages, if any.
+	failure    error
+	failureMut sync.Mutex
 }
 
-func (s *SyslogWorker) doWork() {
-	for {
+func (s *SyslogWorker) setFailure(err error) {
+	s.failureMut.Lock()
+	defer s.failureMut.Unlock()
+	s.failure = err
+}
+
+// HealthCheck fails if a listener stopped receiving messages because
+// of an error, or once the worker is stopped.
+func (s *SyslogWorker) HealthCheck(ctx context.Context) error {
+	s.failureMut.Lock()
+	defer s.failureMut.Unlock()
+	if s.failure != nil {
+		return s.failure
+	}
+	select {
+	case <-s.stopping:
+		return fmt.Errorf("syslog worker is stopped")
+	default:
+		return nil
+	}
+}
+
+// startWorkers starts the workers writing the messages received, and
+// stops the server once our context is done.
+func (s *SyslogWorker) startWorkers() {
+	for i := 0; i < s.cfg.GetWorkerCount(); i++ {
+		s.workers.Add(1)
+		go s.doWork()
+	}
+	go func() {
 		select {
-		case logParts, ok := <-s.channel:
-			if !ok {
-				// channel was closed, exiting
-				return
-			}
-			logMsg, err := logging.SyslogToLogMessage(logParts)
-			if err != nil {
-				log.Errorf("failed to parse log message: %q", err)
-				continue
-			}
-			if err := s.logging.Write(logMsg); err != nil {
-				log.Errorf("failed to write log message: %q", err)
-				continue
-				// TODO (gsamfira): decide whether we want to stop the server
-				// when an error occurs here.
-			}
 		case <-s.ctx.Done():
+			// The workers keep writing the messages received while
+			// the server drains its connections. Stop() closes the
+			// channel once it is done.
 			s.Stop()
-			return
+		case <-s.stopping:
+		}
+	}()
+}
+
+// doWork writes the messages received, until the channel is closed.
+func (s *SyslogWorker) doWork() {
+	defer s.workers.Done()
+	for msg := range s.channel {
+		s.setQueueSaturation()
+		err := s.write(msg.logMsg)
+		if msg.done != nil {
+			msg.done <- err
 		}
 	}
 }
 
-func (s *SyslogWorker) Start() error {
-	if err := s.cleanStaleSocket(); err != nil {
-		return errors.Wrap(err, "removing socket")
+// enqueue passes a message on to the workers, unless they are stopped.
+func (s *SyslogWorker) enqueue(msg received) bool {
+	select {
+	case s.channel <- msg:
+		s.setQueueSaturation()
+		return true
+	case <-s.stopping:
+		// The workers are no longer reading from the channel.
+		return false
 	}
+}
 
-	switch s.cfg.Listener {
-	case config.UnixDgramListener:
-		if err := s.server.ListenUnixgram(s.cfg.Address); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("listening on unix socket %q", s.cfg.Address))
+// setQueueSaturation updates the ratio of the queue of messages
+// waiting for a worker that is in use.
+func (s *SyslogWorker) setQueueSaturation() {
+	if cap(s.channel) == 0 {
+		return
+	}
+	metrics.SyslogQueueSaturation.Set(float64(len(s.channel)) / float64(cap(s.channel)))
+}
+
+// toLogMessage returns the log message of the parts of a message
+// received. ok is false for messages that can not be parsed, which are
+// dropped, unless in lenient mode.
+func (s *SyslogWorker) toLogMessage(logParts format.LogParts) (logMsg logging.LogMessage, ok bool) {
+	if raw, ok := logParts[rawPartKey].(rawMessage); ok {
+		// In lenient mode, messages that failed to parse are stored
+		// as they were received.
+		metrics.SyslogUnparsedMessages.WithLabelValues(raw.hostname).Inc()
+		logMsg = logging.RawToLogMessage(raw.payload, raw.hostname, raw.received)
+	} else {
+		var err error
+		logMsg, err = logging.SyslogToLogMessage(logParts)
+		if err != nil {
+			log.Errorf("failed to parse log message: %q", err)
+			return logMsg, false
 		}
-	case config.TCPListener:
-		if err := s.server.ListenTCP(s.cfg.Address); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("listening on TCP %q", s.cfg.Address))
+		logMsg.TimestampInferred, _ = logParts[timestampPartKey].(bool)
+	}
+	logMsg.SourceAddr, _ = logParts[sourcePartKey].(string)
+	s.setAppName(&logMsg)
+	s.stripPrefix(&logMsg)
+	metrics.MessagesReceived.WithLabelValues(
+		logMsg.AppName, logMsg.Severity.String(), logMsg.Facility.String()).Inc()
+	return logMsg, true
+}
+
+// allow returns false if logMsg must be dropped, as its source
+// exceeded its rate limit. Once in a while, the number of messages of
+// a source that were dropped is recorded in a message of its own.
+func (s *SyslogWorker) allow(logMsg logging.LogMessage) bool {
+	now := time.Now()
+	ok, dropped, source := s.limiter.allow(logMsg.SourceAddr, logMsg.AppName, now)
+	if !ok {
+		metrics.SyslogMessagesRateLimited.Inc()
+	}
+	if dropped > 0 {
+		log.Warningf("rate limit engaged, %d messages dropped from %s", dropped, source)
+		s.enqueue(received{logMsg: rateLimitReport(logMsg, source, dropped, now)})
+	}
+	return ok
+}
+
+// limitSize returns the messages to write in place of logMsg, once
+// max_message_size is applied to it.
+func (s *SyslogWorker) limitSize(logMsg logging.LogMessage) []logging.LogMessage {
+	maxSize := s.cfg.MaxMessageSize
+	if maxSize == 0 || len(logMsg.Message) <= maxSize {
+		return []logging.LogMessage{logMsg}
+	}
+	policy := s.cfg.GetTruncationPolicy()
+	metrics.SyslogMessagesTruncated.WithLabelValues(string(policy)).Inc()
+	return limitMessageSize(logMsg, maxSize, policy)
+}
+
+// handleGELF passes a message received on a GELF listener on to the
+// workers. Unlike syslog messages, its application name is always
+// the one set by the sender.
+func (s *SyslogWorker) handleGELF(logMsg logging.LogMessage) {
+	s.stripPrefix(&logMsg)
+	metrics.MessagesReceived.WithLabelValues(
+		logMsg.AppName, logMsg.Severity.String(), logMsg.Facility.String()).Inc()
+	if !s.allow(logMsg) {
+		return
+	}
+	for _, msg := range s.limitSize(logMsg) {
+		s.enqueue(received{logMsg: msg})
+	}
+}
+
+// write writes a message.
+func (s *SyslogWorker) write(logMsg logging.LogMessage) error {
+	if err := s.logging.Write(logMsg); err != nil {
+		log.Errorf("failed to write log message: %q", err)
+		// TODO (gsamfira): decide whether we want to stop the server
+		// when an error occurs here.
+		return err
+	}
+	return nil
+}
+
+// handleAcked passes a message received over RELP to the workers, and
+// waits for it to be written. Once queued, a message is always handled,
+// as the channel is only closed after the server stopped. Messages
+// that can not be parsed or are dropped are acknowledged right away,
+// and split messages once all their parts were written.
+func (s *SyslogWorker) handleAcked(logParts format.LogParts) error {
+	logMsg, ok := s.toLogMessage(logParts)
+	if !ok {
+		return nil
+	}
+	msgs := s.limitSize(logMsg)
+	done := make(chan error, len(msgs))
+	for _, msg := range msgs {
+		if !s.enqueue(received{logMsg: msg, done: done}) {
+			return fmt.Errorf("syslog worker is stopped")
+		}
+	}
+	var err error
+	for range msgs {
+		if writeErr := <-done; writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// setAppName replaces the application name of logMsg with the field
+// selected by the app_field_source setting, if the message has it.
+func (s *SyslogWorker) setAppName(logMsg *logging.LogMessage) {
+	s.rulesMut.RLock()
+	source := s.appFieldSource
+	s.rulesMut.RUnlock()
+	switch source {
+	case config.MsgIDSource:
+		if logMsg.MsgID != "" {
+			logMsg.AppName = logMsg.MsgID
 		}
-	case config.UDPListener:
-		if err := s.server.ListenUDP(s.cfg.Address); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("listening on UDP %q", s.cfg.Address))
+	case config.ProcIDSource:
+		if logMsg.ProcID != 0 {
+			logMsg.AppName = strconv.Itoa(logMsg.ProcID)
 		}
 	}
+}
+
+// stripPrefix removes the prefix matched by the strip rule of the
+// application logMsg belongs to, if any.
+func (s *SyslogWorker) stripPrefix(logMsg *logging.LogMessage) {
+	s.rulesMut.RLock()
+	rule, ok := s.prefixRules[logMsg.AppName]
+	s.rulesMut.RUnlock()
+	if !ok {
+		return
+	}
+	if loc := rule.FindStringIndex(logMsg.Message); loc != nil {
+		logMsg.Message = logMsg.Message[loc[1]:]
+	}
+}
 
-	err := s.server.Boot()
+// Reconfigure applies the settings of cfg that can be changed while
+// running, which are app_field_source, prefix_strip_rules and the rate
+// limit settings. Changes
+// to the other syslog settings, such as the listeners or the
+// datastore, are logged and ignored, as they require a restart.
+func (s *SyslogWorker) Reconfigure(cfg *config.Config) error {
+	prefixRules, err := compilePrefixRules(cfg.Syslog.PrefixStripRules)
 	if err != nil {
-		return errors.Wrap(err, "starting syslog server")
+		return err
+	}
+	for _, setting := range s.cfg.RestartRequired(cfg.Syslog) {
+		log.Warningf("changing syslog setting %s requires a restart, ignoring it", setting)
+	}
+
+	s.rulesMut.Lock()
+	defer s.rulesMut.Unlock()
+	if s.appFieldSource != cfg.Syslog.AppFieldSource {
+		log.Infof("app_field_source changed from %q to %q", s.appFieldSource, cfg.Syslog.AppFieldSource)
 	}
-	go s.doWork()
+	s.appFieldSource = cfg.Syslog.AppFieldSource
+	s.prefixRules = prefixRules
+	log.Infof("loaded %d prefix strip rules", len(prefixRules))
+	s.limiter.configure(cfg.Syslog)
+	log.Infof("syslog rate limit set to %d messages per second", cfg.Syslog.MaxMessagesPerSecond)
 	return nil
 }
 
-func (s *SyslogWorker) cleanStaleSocket() error {
-	if s.cfg.Listener != config.UnixDgramListener {
+// listenConfig returns the config used to create our socket.
+func (s *SyslogWorker) listenConfig() net.ListenConfig {
+	lc := net.ListenConfig{}
+	if !s.cfg.IdleConnResetOnRestart {
+		lc.Control = reusePort
+	}
+	return lc
+}
+
+// socket is the socket of a listener. Depending on the listener type,
+// either listener or conn is set.
+type socket struct {
+	cfg      config.SyslogListener
+	listener net.Listener
+	conn     net.PacketConn
+}
+
+// isUnix returns true if the socket is a unix socket, which we create
+// and remove.
+func (s *socket) isUnix() bool {
+	return s.cfg.Type == config.UnixDgramListener || s.cfg.Type == config.UnixListener
+}
+
+// isStream returns true if the socket accepts stream connections.
+func (s *socket) isStream() bool {
+	switch s.cfg.Type {
+	case config.UnixDgramListener, config.UDPListener, config.GELFListener:
+		return false
+	}
+	return true
+}
+
+// legacyInheritedNames are the names the sockets of the listeners made
+// from the settings predating listeners are passed on under. They are
+// kept, so graceful restarts from older versions reuse them.
+var legacyInheritedNames = map[string]string{
+	config.MainListenerName: InheritedSocketName,
+	config.UDPListenerName:  InheritedUDPSocketName,
+	config.UnixListenerName: InheritedUnixSocketName,
+	config.TLSListenerName:  InheritedTLSSocketName,
+	config.RELPListenerName: InheritedRELPSocketName,
+}
+
+// inheritedName returns the name the socket of the listener named name
+// is passed on under, during a graceful restart.
+func inheritedName(name string) string {
+	if legacy, ok := legacyInheritedNames[name]; ok {
+		return legacy
+	}
+	return "syslog-" + name
+}
+
+// listen creates the socket of a listener, or reuses the one inherited
+// from the process that started us, during a graceful restart.
+func (s *SyslogWorker) listen(listenerCfg config.SyslogListener) (*socket, error) {
+	sock := &socket{cfg: listenerCfg}
+	if file := graceful.Inherited(inheritedName(listenerCfg.Name)); file != nil {
+		defer file.Close()
+		var err error
+		if sock.isStream() {
+			sock.listener, err = net.FileListener(file)
+		} else {
+			sock.conn, err = net.FilePacketConn(file)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "using inherited socket")
+		}
+		log.Infof("using socket of listener %q inherited from parent process", listenerCfg.Name)
+		return sock, nil
+	}
+
+	lc := s.listenConfig()
+	address := listenerCfg.GetAddress()
+	var err error
+	switch listenerCfg.Type {
+	case config.UnixDgramListener, config.UnixListener:
+		if err := removeSocket(address); err != nil {
+			return nil, err
+		}
+		if sock.isStream() {
+			var listener net.Listener
+			listener, err = net.Listen("unix", address)
+			if err == nil {
+				// The socket is removed by us on shutdown, but must
+				// be left in place when handed off to a new process.
+				listener.(*net.UnixListener).SetUnlinkOnClose(false)
+				sock.listener = listener
+			}
+		} else {
+			sock.conn, err = net.ListenPacket("unixgram", address)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("listening on unix socket %q", address))
+		}
+		if err := s.setSocketPermissions(address); err != nil {
+			return nil, err
+		}
+	case config.UDPListener, config.GELFListener:
+		sock.conn, err = lc.ListenPacket(s.ctx, "udp", address)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("listening on UDP %q", address))
+		}
+	default:
+		sock.listener, err = lc.Listen(s.ctx, "tcp", address)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("listening on TCP %q", address))
+		}
+	}
+	return sock, nil
+}
+
+// setSocketPermissions applies socket_mode, socket_owner and
+// socket_group to the unix socket we created at path.
+func (s *SyslogWorker) setSocketPermissions(path string) error {
+	if err := os.Chmod(path, s.cfg.GetSocketMode()); err != nil {
+		return errors.Wrap(err, "setting unix socket permissions")
+	}
+	uid, gid, err := s.cfg.SocketOwnership()
+	if err != nil {
+		return err
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return errors.Wrap(err, "setting unix socket ownership")
+	}
+	return nil
+}
+
+// addSocket passes the socket of a listener on to the server.
+func (s *SyslogWorker) addSocket(sock *socket) error {
+	name := sock.cfg.Name
+	if sock.cfg.Type == config.RELPListener {
+		s.server.addRELPListener(name, sock.listener, relpOptions{
+			windowSize:     s.cfg.GetRELPWindowSize(),
+			maxCommandSize: s.cfg.GetRELPMaxCommandSize(),
+			handler:        s.handleAcked,
+		})
 		return nil
 	}
-	if mode, err := os.Stat(s.cfg.Address); err == nil {
+	if sock.cfg.Type == config.GELFListener {
+		if conn, ok := sock.conn.(interface{ SetReadBuffer(int) error }); ok {
+			conn.SetReadBuffer(datagramReadBufferSize)
+		}
+		s.server.addGELFConn(name, sock.conn, gelfOptions{
+			handler: s.handleGELF,
+		})
+		return nil
+	}
+	logFormat, err := sock.cfg.LogFormat()
+	if err != nil {
+		return errors.Wrap(err, "getting log format")
+	}
+	if sock.conn != nil {
+		if conn, ok := sock.conn.(interface{ SetReadBuffer(int) error }); ok {
+			conn.SetReadBuffer(datagramReadBufferSize)
+		}
+		s.server.addPacketConn(name, sock.conn, logFormat)
+		return nil
+	}
+
+	listener := sock.listener
+	tlsCfg, err := sock.cfg.TLSServerConfig()
+	if err != nil {
+		return errors.Wrap(err, "getting TLS config")
+	}
+	if tlsCfg != nil {
+		reloader, err := newCertReloader(sock.cfg.TLS.CRT, sock.cfg.TLS.Key)
+		if err != nil {
+			return errors.Wrap(err, "loading TLS certificate")
+		}
+		tlsCfg.Certificates = nil
+		tlsCfg.GetCertificate = reloader.GetCertificate
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+	s.server.addListener(name, listener, logFormat, framingOf(logFormat, s.cfg.FramingMode))
+	return nil
+}
+
+// Start starts receiving messages on all listeners, each of them in
+// its own goroutine.
+func (s *SyslogWorker) Start() error {
+	for _, listenerCfg := range s.cfg.GetListeners() {
+		sock, err := s.listen(listenerCfg)
+		if err != nil {
+			return errors.Wrapf(err, "starting listener %q", listenerCfg.Name)
+		}
+		s.sockets = append(s.sockets, sock)
+		if err := s.addSocket(sock); err != nil {
+			return errors.Wrapf(err, "starting listener %q", listenerCfg.Name)
+		}
+	}
+	s.server.serve()
+	s.startWorkers()
+	return nil
+}
+
+// Files returns duplicates of the sockets we receive messages on, by
+// the name they are inherited under, to be passed on to a new process.
+func (s *SyslogWorker) Files() (map[string]*os.File, error) {
+	files := map[string]*os.File{}
+	for _, sock := range s.sockets {
+		name := inheritedName(sock.cfg.Name)
+		var filer interface{}
+		if sock.listener != nil {
+			filer = sock.listener
+		} else {
+			filer = sock.conn
+		}
+		fileSock, ok := filer.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, fmt.Errorf("socket can not be passed on")
+		}
+		file, err := fileSock.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, errors.Wrapf(err, "getting %s socket", name)
+		}
+		files[name] = file
+	}
+	return files, nil
+}
+
+func closeFiles(files map[string]*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// HandOff stops receiving new messages, after our socket was passed on
+// to a new process. Established TCP connections are given some time
+// to close on their own, unless idle_conn_reset_on_restart is set, in
+// which case they are closed right away.
+func (s *SyslogWorker) HandOff() {
+	s.handedOff = true
+	s.server.closeListeners()
+	if s.cfg.IdleConnResetOnRestart {
+		s.server.closeConnections()
+		return
+	}
+	log.Infof("waiting for syslog connections to close")
+	s.server.drain(drainTimeout)
+}
+
+// removeSocket removes the unix socket at path, if it exists.
+func removeSocket(path string) error {
+	if mode, err := os.Stat(path); err == nil {
 		if mode.Mode()&os.ModeSocket != 0 {
-			log.Infof("removing unix socket %q", s.cfg.Address)
-			if err := os.Remove(s.cfg.Address); err != nil {
+			log.Infof("removing unix socket %q", path)
+			if err := os.Remove(path); err != nil {
 				return errors.Wrap(err, "removing unix socket")
 			}
 		}
@@ -147,19 +690,23 @@ func (s *SyslogWorker) cleanStaleSocket() error {
 func (s *SyslogWorker) Stop() error {
 	log.Infof("stopping syslog worker")
 	defer close(s.closed)
-	select {
-	case _, ok := <-s.channel:
-		if ok {
-			close(s.channel)
-		}
-	default:
-		close(s.channel)
-	}
-	if err := s.server.Kill(); err != nil {
-		return errors.Wrap(err, "killing syslog server")
+	// Stop the server first, while the workers still handle the
+	// messages in flight, so nothing writes to the channel once it
+	// is closed. The workers then write the messages left in it.
+	s.server.stop()
+	close(s.stopping)
+	close(s.channel)
+	s.workers.Wait()
+	if s.handedOff {
+		return nil
 	}
-	if err := s.cleanStaleSocket(); err != nil {
-		return errors.Wrap(err, "removing socket")
+	for _, sock := range s.sockets {
+		if !sock.isUnix() {
+			continue
+		}
+		if err := removeSocket(sock.cfg.Address); err != nil {
+			return errors.Wrapf(err, "removing socket of listener %q", sock.cfg.Name)
+		}
 	}
 	return nil
 }
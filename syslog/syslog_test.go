@@ -0,0 +1,164 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// recordingWriter passes the messages written on to a channel.
+type recordingWriter struct {
+	messages chan logging.LogMessage
+}
+
+func newRecordingWriter() *recordingWriter {
+	return &recordingWriter{messages: make(chan logging.LogMessage, 1000)}
+}
+
+func (r *recordingWriter) Write(logMsg logging.LogMessage) error {
+	r.messages <- logMsg
+	return nil
+}
+
+// next returns the next message written, failing the test if there is
+// none within a few seconds.
+func (r *recordingWriter) next(t *testing.T) logging.LogMessage {
+	t.Helper()
+	select {
+	case logMsg := <-r.messages:
+		return logMsg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message written")
+	}
+	return logging.LogMessage{}
+}
+
+// testSyslogConfig returns the config of a syslog worker receiving
+// messages of logFormat on a TCP listener, bound to a random port.
+func testSyslogConfig(logFormat string) config.Syslog {
+	return config.Syslog{
+		Listeners: []config.SyslogListener{{
+			Type:    config.TCPListener,
+			Address: "127.0.0.1:0",
+			Format:  logFormat,
+		}},
+		DataStore: config.MemoryDatastore,
+		Memory:    &config.Memory{},
+	}
+}
+
+// startTestWorker starts a syslog worker, stopped once the test is
+// done, and returns the address of its first listener.
+func startTestWorker(t *testing.T, cfg config.Syslog, writer logging.Writer) (*SyslogWorker, string) {
+	t.Helper()
+	worker, err := NewSyslogServer(context.Background(), cfg, writer, make(chan error, 10))
+	if err != nil {
+		t.Fatalf("failed to create syslog worker: %v", err)
+	}
+	if err := worker.Start(); err != nil {
+		t.Fatalf("failed to start syslog worker: %v", err)
+	}
+	sock := worker.sockets[0]
+	if sock.listener != nil {
+		return worker, sock.listener.Addr().String()
+	}
+	return worker, sock.conn.LocalAddr().String()
+}
+
+// send sends data on a new TCP connection to address, and closes it.
+func send(t *testing.T, address, data string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	cfg := testSyslogConfig("rfc3164")
+	cfg.PrefixStripRules = map[string]string{"nginx": `nginx: `}
+	writer := newRecordingWriter()
+	worker, address := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+
+	send(t, address,
+		"<13>Oct 15 10:00:00 web-1 nginx[1234]: nginx: GET /index.html\n"+
+			"<13>Oct 15 10:00:01 web-1 haproxy[99]: nginx: GET /index.html\n"+
+			"<13>Oct 15 10:00:02 web-1 nginx[1234]: GET / nginx: done\n")
+
+	// Only the prefix of the messages of the application the rule
+	// is set for is stripped.
+	expected := []struct{ app, message string }{
+		{"nginx", "GET /index.html"},
+		{"haproxy", "nginx: GET /index.html"},
+		{"nginx", "GET / nginx: done"},
+	}
+	for _, exp := range expected {
+		logMsg := writer.next(t)
+		if logMsg.AppName != exp.app || logMsg.Message != exp.message {
+			t.Fatalf("expected %s message %q, got %s message %q", exp.app, exp.message, logMsg.AppName, logMsg.Message)
+		}
+	}
+}
+
+func TestReconfigurePrefixRules(t *testing.T) {
+	cfg := testSyslogConfig("rfc3164")
+	writer := newRecordingWriter()
+	worker, address := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+
+	reloaded := cfg
+	reloaded.PrefixStripRules = map[string]string{"nginx": `nginx: `}
+	if err := worker.Reconfigure(&config.Config{Syslog: reloaded}); err != nil {
+		t.Fatalf("failed to reconfigure syslog worker: %v", err)
+	}
+	send(t, address, "<13>Oct 15 10:00:00 web-1 nginx[1234]: nginx: GET /index.html\n")
+	if logMsg := writer.next(t); logMsg.Message != "GET /index.html" {
+		t.Fatalf("expected the prefix to be stripped, got %q", logMsg.Message)
+	}
+}
+
+func TestStructuredData(t *testing.T) {
+	cfg := testSyslogConfig("rfc5424")
+	writer := newRecordingWriter()
+	worker, address := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+
+	send(t, address, octetCounted(
+		`<13>1 2026-10-15T10:00:00Z web-1 coriolis-worker 1234 ID47 `+
+			`[coriolis@32473 task_id="abc\"123" path="C:\\Temp" list="[a\]"][meta sequenceId="42"] migration started`))
+	logMsg := writer.next(t)
+	expected := map[string]map[string]string{
+		"coriolis@32473": {"task_id": `abc"123`, "path": `C:\Temp`, "list": "[a]"},
+		"meta":           {"sequenceId": "42"},
+	}
+	if !reflect.DeepEqual(logMsg.StructuredData, expected) {
+		t.Fatalf("expected structured data %v, got %v", expected, logMsg.StructuredData)
+	}
+	if logMsg.Message != "migration started" {
+		t.Fatalf("expected message %q, got %q", "migration started", logMsg.Message)
+	}
+}
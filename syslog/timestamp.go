@@ -0,0 +1,115 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"bytes"
+	"time"
+)
+
+// timestampPartKey is the key set in the parts of a message whose
+// timestamp was inferred, rather than fully set by the sender.
+const timestampPartKey = "timestamp_inferred"
+
+// maxFutureTimestamp is how far in the future the timestamp of a
+// message without a year may be, when inferring its year, such as
+// for senders whose clock is ahead, or in another timezone.
+const maxFutureTimestamp = 24 * time.Hour
+
+// rfc3164Timestamp is the way the timestamp of an RFC 3164 message is
+// written.
+type rfc3164Timestamp int
+
+const (
+	// noTimestamp is used for messages without a timestamp, or with
+	// one that can not be parsed. They get the time they are parsed
+	// at.
+	noTimestamp rfc3164Timestamp = iota
+	// stampTimestamp is a timestamp such as "Jan  2 15:04:05", which
+	// has neither a year nor a timezone.
+	stampTimestamp
+	// rfc3339Timestamp is a complete RFC 3339 timestamp.
+	rfc3339Timestamp
+)
+
+// timestampOf returns the way the timestamp of the RFC 3164 message in
+// line is written. Like the parser, only RFC 3339 timestamps with a
+// numeric offset are recognized.
+func timestampOf(line []byte) rfc3164Timestamp {
+	if len(line) == 0 || line[0] != '<' {
+		return noTimestamp
+	}
+	end := bytes.IndexByte(line, '>')
+	if end < 0 {
+		return noTimestamp
+	}
+	header := line[end+1:]
+	if len(header) >= len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, string(header[:len(time.Stamp)])); err == nil {
+			return stampTimestamp
+		}
+	}
+	if len(header) >= len(time.RFC3339) {
+		if _, err := time.Parse(time.RFC3339, string(header[:len(time.RFC3339)])); err == nil {
+			return rfc3339Timestamp
+		}
+	}
+	return noTimestamp
+}
+
+// inferYear returns the time at which a message logged at ts, without
+// a year, was most likely sent, if received at now. ts is interpreted
+// in loc. The latest of the year after the one of now, the same and
+// the one before, that is at most maxFutureTimestamp after now, is
+// used. Messages logged on December 31st and received on January 1st
+// get the previous year, and the other way around, the next one.
+func inferYear(ts time.Time, loc *time.Location, now time.Time) time.Time {
+	var candidate time.Time
+	for year := now.Year() + 1; year >= now.Year()-1; year-- {
+		candidate = time.Date(
+			year, ts.Month(), ts.Day(), ts.Hour(), ts.Minute(),
+			ts.Second(), ts.Nanosecond(), loc)
+		if candidate.Sub(now) <= maxFutureTimestamp {
+			break
+		}
+	}
+	return candidate
+}
+
+// fixRFC3164Timestamp sets the timestamp of the parts of an RFC 3164
+// message parsed from line, and received at now. The year and the
+// timezone of timestamps lacking them are inferred. Timestamps off by
+// more than the maximum clock skew, if set, are replaced by now.
+func (s *server) fixRFC3164Timestamp(logParts map[string]interface{}, line []byte, now time.Time) {
+	ts, ok := logParts["timestamp"].(time.Time)
+	if !ok {
+		return
+	}
+	inferred := false
+	switch timestampOf(line) {
+	case stampTimestamp:
+		ts = inferYear(ts, s.rfc3164Location, now)
+		inferred = true
+	case noTimestamp:
+		ts = now
+		inferred = true
+	}
+	if s.maxClockSkew > 0 && (ts.Sub(now) > s.maxClockSkew || now.Sub(ts) > s.maxClockSkew) {
+		ts = now
+		inferred = true
+	}
+	logParts["timestamp"] = ts
+	logParts[timestampPartKey] = inferred
+}
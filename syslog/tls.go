@@ -0,0 +1,92 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// certReloader serves the certificate of the TLS listener, loading it
+// again once its files change, so it can be renewed without a restart.
+type certReloader struct {
+	crt string
+	key string
+
+	mut  sync.Mutex
+	cert *tls.Certificate
+	// modTime is the latest modification time of the certificate and
+	// key files, when they were last loaded.
+	modTime time.Time
+}
+
+func newCertReloader(crt, key string) (*certReloader, error) {
+	modTime, err := filesModTime(crt, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading certificate %q and key %q", crt, key)
+	}
+	return &certReloader{
+		crt:     crt,
+		key:     key,
+		cert:    &cert,
+		modTime: modTime,
+	}, nil
+}
+
+// filesModTime returns the latest modification time of paths.
+func filesModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "checking %q", path)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate returns the current certificate. If its files changed,
+// they are loaded again. Should that fail, as may happen while they are
+// being replaced, the previous certificate is kept until they change
+// again.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	modTime, err := filesModTime(c.crt, c.key)
+	if err != nil || modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	c.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(c.crt, c.key)
+	if err != nil {
+		log.Errorf("failed to reload TLS certificate %q: %v", c.crt, err)
+		return c.cert, nil
+	}
+	log.Infof("reloaded TLS certificate %q", c.crt)
+	c.cert = &cert
+	return c.cert, nil
+}
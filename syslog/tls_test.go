@@ -0,0 +1,301 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+
+	"coriolis-logger/config"
+)
+
+// testPKI holds the paths of a CA certificate, and of the certificates
+// and keys it signed, for the server and a client.
+type testPKI struct {
+	dir       string
+	caCert    string
+	serverCrt string
+	serverKey string
+	clientCrt string
+	clientKey string
+}
+
+// newTestPKI creates a CA, and the certificates it signed, in a
+// temporary directory, removed by cleanup.
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "syslog-tls")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	pki := &testPKI{dir: dir}
+
+	caKey := newTestKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "coriolis-logger test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	pki.caCert = pki.writePEM(t, "ca.crt", "CERTIFICATE", caDER)
+
+	pki.serverCrt, pki.serverKey = pki.issue(t, "server", ca, caKey, x509.ExtKeyUsageServerAuth)
+	pki.clientCrt, pki.clientKey = pki.issue(t, "client", ca, caKey, x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+func (p *testPKI) cleanup() {
+	os.RemoveAll(p.dir)
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+// issue creates a certificate for 127.0.0.1 and localhost, signed by
+// ca, and returns the paths of the certificate and its key.
+func (p *testPKI) issue(t *testing.T, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key := newTestKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create %s certificate: %v", name, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal %s key: %v", name, err)
+	}
+	return p.writePEM(t, name+".crt", "CERTIFICATE", der), p.writePEM(t, name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func (p *testPKI) writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(p.dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %q: %v", path, err)
+	}
+	return path
+}
+
+// clientConfig returns the TLS config of a client trusting the CA,
+// presenting the client certificate if withCert is set.
+func (p *testPKI) clientConfig(t *testing.T, withCert bool) *tls.Config {
+	t.Helper()
+	caPEM, err := ioutil.ReadFile(p.caCert)
+	if err != nil {
+		t.Fatalf("failed to read CA certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	cfg := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(p.clientCrt, p.clientKey)
+		if err != nil {
+			t.Fatalf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg
+}
+
+// listener returns the config of a TLS listener requiring client
+// certificates signed by the CA.
+func (p *testPKI) listener() config.SyslogListener {
+	return config.SyslogListener{
+		Type:    config.TCPListener,
+		Address: "127.0.0.1:0",
+		Format:  "rfc5424",
+		TLS: &config.TLSConfig{
+			CRT:    p.serverCrt,
+			Key:    p.serverKey,
+			CACert: p.caCert,
+		},
+	}
+}
+
+// servePipe serves the server end of an in-memory pipe over TLS, with
+// octet counted framing, and returns the client end, along with the
+// channel the parsed messages are sent on. done is closed once the
+// server closed the connection.
+func servePipe(t *testing.T, pki *testPKI) (client net.Conn, parts chan format.LogParts, done chan struct{}) {
+	t.Helper()
+	listenerCfg := pki.listener()
+	tlsCfg, err := listenerCfg.TLSServerConfig()
+	if err != nil {
+		t.Fatalf("failed to get TLS config: %v", err)
+	}
+	parts = make(chan format.LogParts, 10)
+	srv := newServer(time.Second, config.DefaultSyslogMaxFrameSize, func(logParts format.LogParts) {
+		parts <- logParts
+	}, nil)
+	serverConn, client := net.Pipe()
+	srv.reserveConn()
+	srv.connWg.Add(1)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.scan(tls.Server(serverConn, tlsCfg), syslog.RFC5424, framingOctetCounting)
+	}()
+	return client, parts, done
+}
+
+func TestTLSPipeDelivery(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.cleanup()
+	client, parts, done := servePipe(t, pki)
+
+	conn := tls.Client(client, pki.clientConfig(t, true))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	first := "<14>1 2026-10-15T10:00:00Z web-1 nginx 1234 - - GET /index.html"
+	second := "<11>1 2026-10-15T10:00:01Z web-1 nginx 1234 - - upstream timed out\nretrying"
+	// The frames are split across writes, to check partial frames are
+	// buffered until complete.
+	stream := octetCounted(first) + octetCounted(second)
+	for _, chunk := range []string{stream[:7], stream[7:40], stream[40:]} {
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			t.Fatalf("failed to send messages: %v", err)
+		}
+	}
+	for _, expected := range []string{"GET /index.html", "upstream timed out\nretrying"} {
+		select {
+		case logParts := <-parts:
+			if logParts["message"] != expected || logParts["app_name"] != "nginx" {
+				t.Fatalf("expected nginx message %q, got %v", expected, logParts)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %q not received", expected)
+		}
+	}
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection not closed")
+	}
+}
+
+func TestTLSPipeRequiresClientCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.cleanup()
+	client, parts, done := servePipe(t, pki)
+	defer client.Close()
+
+	clientCfg := pki.clientConfig(t, false)
+	go func() {
+		conn := tls.Client(client, clientCfg)
+		if err := conn.Handshake(); err != nil {
+			return
+		}
+		conn.Write([]byte(octetCounted("<14>1 2026-10-15T10:00:00Z web-1 nginx 1234 - - GET /")))
+	}()
+	// The server gives up on the connection once the handshake fails,
+	// without handling any message.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection without a client certificate not closed")
+	}
+	select {
+	case logParts := <-parts:
+		t.Fatalf("unexpected message received: %v", logParts)
+	default:
+	}
+}
+
+func TestTLSListenerAlongsidePlainTCP(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.cleanup()
+	cfg := testSyslogConfig("rfc5424")
+	cfg.Listeners = append(cfg.Listeners, pki.listener())
+	writer := newRecordingWriter()
+	worker, plainAddr := startTestWorker(t, cfg, writer)
+	defer worker.Stop()
+	tlsAddr := worker.sockets[1].listener.Addr().String()
+
+	conn, err := tls.Dial("tcp", tlsAddr, pki.clientConfig(t, true))
+	if err != nil {
+		t.Fatalf("failed to connect over TLS: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(octetCounted("<14>1 2026-10-15T10:00:00Z web-1 secure 1 - - over tls"))); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if logMsg := writer.next(t); logMsg.AppName != "secure" || logMsg.Message != "over tls" {
+		t.Fatalf("unexpected message received over TLS: %s %q", logMsg.AppName, logMsg.Message)
+	}
+
+	send(t, plainAddr, "<14>1 2026-10-15T10:00:01Z web-1 plain 1 - - over tcp\n")
+	if logMsg := writer.next(t); logMsg.AppName != "plain" || logMsg.Message != "over tcp" {
+		t.Fatalf("unexpected message received over TCP: %s %q", logMsg.AppName, logMsg.Message)
+	}
+
+	// Plain text connections are refused by the TLS listener.
+	send(t, tlsAddr, "<14>1 2026-10-15T10:00:02Z web-1 plain 1 - - not encrypted\n")
+	select {
+	case logMsg := <-writer.messages:
+		t.Fatalf("unexpected message received: %q", logMsg.Message)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// octetCounted returns msg as an octet counted frame.
+func octetCounted(msg string) string {
+	return strconv.Itoa(len(msg)) + " " + msg
+}
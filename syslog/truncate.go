@@ -0,0 +1,78 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// truncationMarker is appended to the text of the messages truncated
+// by the truncate policy.
+const truncationMarker = "...[truncated]"
+
+// runeBoundary returns the largest index, not greater than size, at
+// which text can be cut without splitting a UTF-8 sequence.
+func runeBoundary(text string, size int) int {
+	if size >= len(text) {
+		return len(text)
+	}
+	idx := size
+	for idx > 0 && !utf8.RuneStart(text[idx]) {
+		idx--
+	}
+	if idx == 0 {
+		// Not valid UTF-8, or a single rune larger than size.
+		return size
+	}
+	return idx
+}
+
+// limitMessageSize applies policy to logMsg, if its text is larger
+// than maxSize, and returns the messages to write, if any. The parts
+// of a split message are each logged a nanosecond after the previous
+// one, so they keep their order, and do not overwrite each other in
+// the datastores keying messages by time.
+func limitMessageSize(logMsg logging.LogMessage, maxSize int, policy config.TruncationPolicy) []logging.LogMessage {
+	if maxSize == 0 || len(logMsg.Message) <= maxSize {
+		return []logging.LogMessage{logMsg}
+	}
+	switch policy {
+	case config.DropPolicy:
+		return nil
+	case config.SplitPolicy:
+		ret := []logging.LogMessage{}
+		text := logMsg.Message
+		for idx := 0; text != ""; idx++ {
+			part := logMsg
+			end := runeBoundary(text, maxSize)
+			part.Message, text = text[:end], text[end:]
+			part.Timestamp = logMsg.Timestamp.Add(time.Duration(idx))
+			ret = append(ret, part)
+		}
+		return ret
+	default:
+		if maxSize <= len(truncationMarker) {
+			logMsg.Message = logMsg.Message[:runeBoundary(logMsg.Message, maxSize)]
+		} else {
+			end := runeBoundary(logMsg.Message, maxSize-len(truncationMarker))
+			logMsg.Message = logMsg.Message[:end] + truncationMarker
+		}
+		return []logging.LogMessage{logMsg}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package file
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+var log = loggo.GetLogger("coriolis.logger.writers.file")
+
+const (
+	logSuffix = ".log"
+	gzSuffix  = ".gz"
+	// rolledTimeFormat is the format of the timestamp appended to
+	// the name of rolled files.
+	rolledTimeFormat = "20060102T150405.000000000"
+)
+
+func NewFileWriter(cfg *config.FileWriter) (logging.Writer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating file writer config")
+	}
+	return &FileWriter{
+		cfg:   cfg,
+		files: map[string]*logFile{},
+	}, nil
+}
+
+var _ logging.Writer = (*FileWriter)(nil)
+
+// FileWriter appends log messages to one plain text file per
+// application, rolling files by size and daily.
+type FileWriter struct {
+	cfg   *config.FileWriter
+	mut   sync.Mutex
+	files map[string]*logFile
+}
+
+type logFile struct {
+	mut    sync.Mutex
+	path   string
+	fd     *os.File
+	size   int64
+	opened time.Time
+}
+
+// open opens the log file for appending, creating it if needed.
+func (l *logFile) open() error {
+	fd, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.Wrap(err, "opening log file")
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return errors.Wrap(err, "fetching log file info")
+	}
+	l.fd = fd
+	l.size = info.Size()
+	l.opened = info.ModTime()
+	if l.size == 0 {
+		l.opened = time.Now()
+	}
+	return nil
+}
+
+func sameDay(a, b time.Time) bool {
+	aYear, aMonth, aDay := a.Date()
+	bYear, bMonth, bDay := b.Date()
+	return aYear == bYear && aMonth == bMonth && aDay == bDay
+}
+
+// shouldRoll returns true if writing n more bytes to the file would
+// go over the size limit, or if the file was started on a previous day.
+func (l *logFile) shouldRoll(n int, maxBytes int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if maxBytes > 0 && l.size+int64(n) > maxBytes {
+		return true
+	}
+	return !sameDay(l.opened, time.Now())
+}
+
+// roll renames the current file with a timestamp suffix and opens a new
+// one. The name of the rolled file is returned.
+func (l *logFile) roll() (string, error) {
+	if err := l.fd.Close(); err != nil {
+		log.Warningf("failed to close log file %q: %v", l.path, err)
+	}
+	rolled := fmt.Sprintf("%s.%s", l.path, time.Now().Format(rolledTimeFormat))
+	if err := os.Rename(l.path, rolled); err != nil {
+		// Keep writing to the old file.
+		if openErr := l.open(); openErr != nil {
+			return "", errors.Wrap(openErr, "reopening log file")
+		}
+		return "", errors.Wrap(err, "renaming log file")
+	}
+	if err := l.open(); err != nil {
+		return "", err
+	}
+	return rolled, nil
+}
+
+// compressFile compresses src into src.gz and removes src.
+func compressFile(src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "opening rolled file")
+	}
+	defer in.Close()
+
+	dst := src + gzSuffix
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.Wrap(err, "creating compressed file")
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return errors.Wrap(err, "compressing rolled file")
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return errors.Wrap(err, "compressing rolled file")
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return errors.Wrap(err, "closing compressed file")
+	}
+	return os.Remove(src)
+}
+
+func (f *FileWriter) getFile(appName string) (*logFile, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if lf, ok := f.files[appName]; ok {
+		return lf, nil
+	}
+	if appName == "" || appName == "." || appName == ".." || filepath.Base(appName) != appName {
+		return nil, fmt.Errorf("invalid log name %q", appName)
+	}
+	lf := &logFile{
+		path: filepath.Join(f.cfg.Directory, appName+logSuffix),
+	}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	f.files[appName] = lf
+	return lf, nil
+}
+
+func (f *FileWriter) Write(logMsg logging.LogMessage) error {
+	lf, err := f.getFile(logMsg.AppName)
+	if err != nil {
+		return errors.Wrap(err, "getting log file")
+	}
+
+	line := logMsg.Message
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+
+	lf.mut.Lock()
+	defer lf.mut.Unlock()
+	if lf.shouldRoll(len(line), f.cfg.MaxBytes) {
+		rolled, err := lf.roll()
+		if err != nil {
+			log.Errorf("failed to roll log file %q: %v", lf.path, err)
+		} else if f.cfg.GZip {
+			go func() {
+				if err := compressFile(rolled); err != nil {
+					log.Errorf("failed to compress %q: %v", rolled, err)
+				}
+			}()
+		}
+	}
+	n, err := lf.fd.WriteString(line)
+	lf.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "writing log message")
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package grpc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+	grpcgo "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	pb "coriolis-logger/proto"
+	"coriolis-logger/worker"
+)
+
+var log = loggo.GetLogger("coriolis.logger.writers.grpc")
+
+const (
+	// initialBackoff is the time we wait before reopening a broken
+	// stream. It is doubled after every failed attempt, up to maxBackoff.
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+
+	// shutdownTimeout is the maximum amount of time we wait for the
+	// server to close the stream, after sending the last messages.
+	shutdownTimeout = 5 * time.Second
+)
+
+// Writer is the interface implemented by the gRPC writer
+type Writer interface {
+	worker.SimpleWorker
+	logging.Writer
+}
+
+func NewGRPCWriter(ctx context.Context, cfg *config.GRPCWriter) (Writer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating grpc writer config")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config")
+	}
+	creds := grpcgo.WithInsecure()
+	if tlsCfg != nil {
+		creds = grpcgo.WithTransportCredentials(credentials.NewTLS(tlsCfg))
+	}
+	// Dialing does not block. The connection is established in
+	// the background, and reestablished if it breaks.
+	conn, err := grpcgo.Dial(cfg.Address, creds)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialing grpc server")
+	}
+
+	return &GRPCWriter{
+		cfg:    cfg,
+		conn:   conn,
+		client: pb.NewLogServiceClient(conn),
+		queue:  make(chan *pb.LogMessage, cfg.GetQueueSize()),
+		ctx:    ctx,
+		closed: make(chan struct{}),
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+var _ Writer = (*GRPCWriter)(nil)
+
+// GRPCWriter streams log messages to a gRPC server
+type GRPCWriter struct {
+	cfg    *config.GRPCWriter
+	conn   *grpcgo.ClientConn
+	client pb.LogServiceClient
+
+	// queue holds the messages waiting to be sent.
+	queue chan *pb.LogMessage
+	// unacked holds the messages sent, but not yet acknowledged by the
+	// server. They are sent again if the stream breaks.
+	unacked []*pb.LogMessage
+	// dropped counts the messages dropped because the queue was full.
+	dropped uint64
+
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+}
+
+func toProto(msg logging.LogMessage) *pb.LogMessage {
+	return &pb.LogMessage{
+		Timestamp: msg.Timestamp.UnixNano(),
+		Hostname:  msg.Hostname,
+		AppName:   msg.AppName,
+		Priority:  int32(msg.Priority),
+		Severity:  int32(msg.Severity),
+		Facility:  int32(msg.Facility),
+		ProcId:    int32(msg.ProcID),
+		MsgId:     msg.MsgID,
+		Message:   msg.Message,
+	}
+}
+
+func (g *GRPCWriter) stopping() bool {
+	select {
+	case <-g.ctx.Done():
+		return true
+	case <-g.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// streamState tracks the messages acknowledged on a stream.
+type streamState struct {
+	// acked is the number of messages acknowledged by the server,
+	// updated as acknowledgements are received.
+	acked uint64
+	// trimmed is the number of acknowledged messages removed from
+	// unacked so far.
+	trimmed uint64
+	// ack is notified when new acknowledgements arrive.
+	ack chan struct{}
+	// recvErr receives the error that ended the stream.
+	recvErr chan error
+}
+
+// receive reads acknowledgements from the stream, until it is closed.
+// A broken stream is only reported when receiving.
+func (st *streamState) receive(stream pb.LogService_StreamLogsClient) {
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			st.recvErr <- err
+			return
+		}
+		atomic.StoreUint64(&st.acked, resp.Received)
+		select {
+		case st.ack <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// trimAcked removes acknowledged messages from unacked.
+func (g *GRPCWriter) trimAcked(st *streamState) {
+	acked := atomic.LoadUint64(&st.acked)
+	if acked <= st.trimmed {
+		return
+	}
+	n := int(acked - st.trimmed)
+	if n > len(g.unacked) {
+		n = len(g.unacked)
+	}
+	g.unacked = g.unacked[n:]
+	st.trimmed = acked
+}
+
+// closeStream sends the messages still queued, and waits for the
+// server to acknowledge them and close the stream.
+func (g *GRPCWriter) closeStream(stream pb.LogService_StreamLogsClient, st *streamState) {
+	for {
+		var msg *pb.LogMessage
+		select {
+		case msg = <-g.queue:
+		default:
+		}
+		if msg == nil {
+			break
+		}
+		if err := stream.Send(msg); err != nil {
+			log.Errorf("failed to send log messages before closing stream: %v", err)
+			return
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		log.Errorf("failed to close stream: %v", err)
+		return
+	}
+	select {
+	case <-st.recvErr:
+	case <-time.After(shutdownTimeout):
+		log.Warningf("timed out waiting for the server to close the stream")
+	}
+}
+
+// stream opens a stream and sends queued messages on it, until either
+// the stream breaks or the writer is stopped. Messages left
+// unacknowledged by a previous stream are sent first. It returns true
+// if the server acknowledged at least one message.
+func (g *GRPCWriter) stream() (bool, error) {
+	// The stream is not bound to our context, so we can still send
+	// the messages left in the queue while stopping.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := g.client.StreamLogs(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "opening stream")
+	}
+	if dropped := atomic.SwapUint64(&g.dropped, 0); dropped > 0 {
+		log.Warningf("dropped %d log messages, as the queue was full", dropped)
+	}
+
+	st := &streamState{
+		ack:     make(chan struct{}, 1),
+		recvErr: make(chan error, 1),
+	}
+	go st.receive(stream)
+
+	retry := g.unacked
+	g.unacked = nil
+	maxUnacked := g.cfg.GetQueueSize()
+	for {
+		g.trimAcked(st)
+
+		var msg *pb.LogMessage
+		if len(retry) > 0 {
+			msg, retry = retry[0], retry[1:]
+		} else if len(g.unacked) >= maxUnacked {
+			// Wait for the server to catch up. New messages are
+			// queued in the meantime.
+			select {
+			case <-st.ack:
+				continue
+			case err := <-st.recvErr:
+				return st.trimmed > 0, errors.Wrap(err, "receiving from stream")
+			case <-g.ctx.Done():
+				g.closeStream(stream, st)
+				return st.trimmed > 0, nil
+			case <-g.quit:
+				g.closeStream(stream, st)
+				return st.trimmed > 0, nil
+			}
+		} else {
+			select {
+			case msg = <-g.queue:
+			case <-st.ack:
+				continue
+			case err := <-st.recvErr:
+				return st.trimmed > 0, errors.Wrap(err, "receiving from stream")
+			case <-g.ctx.Done():
+				g.closeStream(stream, st)
+				return st.trimmed > 0, nil
+			case <-g.quit:
+				g.closeStream(stream, st)
+				return st.trimmed > 0, nil
+			}
+		}
+
+		g.unacked = append(g.unacked, msg)
+		if err := stream.Send(msg); err != nil {
+			g.trimAcked(st)
+			g.unacked = append(g.unacked, retry...)
+			return st.trimmed > 0, errors.Wrap(err, "sending to stream")
+		}
+	}
+}
+
+func (g *GRPCWriter) doWork() {
+	defer func() {
+		if dropped := atomic.SwapUint64(&g.dropped, 0); dropped > 0 {
+			log.Warningf("dropped %d log messages, as the queue was full", dropped)
+		}
+		g.conn.Close()
+		close(g.closed)
+	}()
+
+	backoff := initialBackoff
+	for {
+		acked, err := g.stream()
+		if g.stopping() {
+			return
+		}
+		if acked {
+			backoff = initialBackoff
+		}
+		log.Warningf("log stream broken (reconnecting in %s): %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-g.ctx.Done():
+			return
+		case <-g.quit:
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Write queues a message to be sent. Messages are dropped if the queue
+// is full, which happens when the stream is down for too long.
+func (g *GRPCWriter) Write(logMsg logging.LogMessage) error {
+	select {
+	case g.queue <- toProto(logMsg):
+	default:
+		atomic.AddUint64(&g.dropped, 1)
+	}
+	return nil
+}
+
+func (g *GRPCWriter) Start() error {
+	go g.doWork()
+	return nil
+}
+
+func (g *GRPCWriter) Stop() error {
+	close(g.quit)
+	g.Wait()
+	return nil
+}
+
+func (g *GRPCWriter) Wait() {
+	<-g.closed
+}
@@ -0,0 +1,270 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	"coriolis-logger/worker"
+)
+
+var log = loggo.GetLogger("coriolis.logger.writers.kafka")
+
+// appNamePlaceholder is replaced with the application name in
+// topic templates.
+const appNamePlaceholder = "{appname}"
+
+// statsInterval is the interval at which dropped and failed messages
+// are reported.
+const statsInterval = time.Minute
+
+// Writer is the interface implemented by the Kafka writer
+type Writer interface {
+	worker.SimpleWorker
+	logging.Writer
+}
+
+func saslMechanism(cfg *config.Kafka) (sasl.Mechanism, error) {
+	switch cfg.SASLMechanism {
+	case config.KafkaSASLPlain:
+		return plain.Mechanism{
+			Username: cfg.Username,
+			Password: cfg.Password,
+		}, nil
+	case config.KafkaSASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, cfg.Username, cfg.Password)
+	default:
+		return nil, nil
+	}
+}
+
+func NewKafkaWriter(ctx context.Context, cfg *config.Kafka) (Writer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating kafka config")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config")
+	}
+	mechanism, err := saslMechanism(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting SASL mechanism")
+	}
+
+	return &KafkaWriter{
+		cfg: cfg,
+		transport: &kafkago.Transport{
+			TLS:  tlsCfg,
+			SASL: mechanism,
+		},
+		writers: map[string]*kafkago.Writer{},
+		ctx:     ctx,
+		closed:  make(chan struct{}),
+		quit:    make(chan struct{}),
+	}, nil
+}
+
+var _ Writer = (*KafkaWriter)(nil)
+
+// KafkaWriter publishes log messages to Kafka, as JSON. Messages are
+// batched by the underlying kafka writers, which publish a batch once
+// it is full, or once the flush interval has passed.
+type KafkaWriter struct {
+	cfg       *config.Kafka
+	transport *kafkago.Transport
+
+	mut sync.Mutex
+	// writers holds one kafka writer for each topic.
+	writers map[string]*kafkago.Writer
+
+	// pending is the number of messages waiting to be published.
+	pending int64
+	// dropped counts the messages dropped because too many were
+	// pending, and failed the ones that could not be published.
+	dropped uint64
+	failed  uint64
+
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+}
+
+// message is the JSON representation of a published log message.
+type message struct {
+	Timestamp time.Time `json:"timestamp"`
+	Hostname  string    `json:"hostname"`
+	AppName   string    `json:"app_name"`
+	Priority  int       `json:"priority"`
+	Severity  int       `json:"severity"`
+	Facility  int       `json:"facility"`
+	ProcID    int       `json:"proc_id,omitempty"`
+	MsgID     string    `json:"msg_id,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// topic returns the topic the messages of appName are published to.
+func (k *KafkaWriter) topic(appName string) string {
+	if k.cfg.TopicTemplate == "" {
+		return k.cfg.GetTopic()
+	}
+	// Topic names may only contain alphanumerics, '.', '_' and '-'.
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, appName)
+	return strings.Replace(k.cfg.TopicTemplate, appNamePlaceholder, name, -1)
+}
+
+func (k *KafkaWriter) getWriter(topic string) *kafkago.Writer {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+
+	if writer, ok := k.writers[topic]; ok {
+		return writer
+	}
+	writer := &kafkago.Writer{
+		Addr:         kafkago.TCP(k.cfg.Brokers...),
+		Topic:        topic,
+		Balancer:     &kafkago.Hash{},
+		BatchSize:    k.cfg.GetBatchSize(),
+		BatchTimeout: k.cfg.GetFlushInterval(),
+		Async:        true,
+		Transport:    k.transport,
+		Completion: func(messages []kafkago.Message, err error) {
+			atomic.AddInt64(&k.pending, -int64(len(messages)))
+			if err != nil {
+				atomic.AddUint64(&k.failed, uint64(len(messages)))
+				log.Errorf("failed to publish %d messages to %q: %v", len(messages), topic, err)
+			}
+		},
+	}
+	k.writers[topic] = writer
+	return writer
+}
+
+// reportStats logs the number of messages dropped or failed since
+// the last call.
+func (k *KafkaWriter) reportStats() {
+	if dropped := atomic.SwapUint64(&k.dropped, 0); dropped > 0 {
+		log.Warningf("dropped %d log messages, as too many were waiting to be published", dropped)
+	}
+	if failed := atomic.SwapUint64(&k.failed, 0); failed > 0 {
+		log.Warningf("failed to publish %d log messages", failed)
+	}
+}
+
+// Write queues a message to be published. Messages are dropped if
+// max_buffered messages are already waiting, so a slow cluster does
+// not block the syslog server.
+func (k *KafkaWriter) Write(logMsg logging.LogMessage) error {
+	if atomic.LoadInt64(&k.pending) >= int64(k.cfg.GetMaxBuffered()) {
+		atomic.AddUint64(&k.dropped, 1)
+		return nil
+	}
+	value, err := json.Marshal(message{
+		Timestamp: logMsg.Timestamp,
+		Hostname:  logMsg.Hostname,
+		AppName:   logMsg.AppName,
+		Priority:  logMsg.Priority,
+		Severity:  int(logMsg.Severity),
+		Facility:  int(logMsg.Facility),
+		ProcID:    logMsg.ProcID,
+		MsgID:     logMsg.MsgID,
+		Message:   logMsg.Message,
+	})
+	if err != nil {
+		return errors.Wrap(err, "encoding log message")
+	}
+
+	writer := k.getWriter(k.topic(logMsg.AppName))
+	atomic.AddInt64(&k.pending, 1)
+	// The writer is asynchronous, so this only fails if the writer
+	// was closed.
+	err = writer.WriteMessages(k.ctx, kafkago.Message{
+		Key:   []byte(logMsg.AppName),
+		Value: value,
+		Time:  logMsg.Timestamp,
+	})
+	if err != nil {
+		atomic.AddInt64(&k.pending, -1)
+		return errors.Wrap(err, fmt.Sprintf("publishing to %q", writer.Topic))
+	}
+	return nil
+}
+
+// closeWriters flushes pending messages and closes all writers.
+func (k *KafkaWriter) closeWriters() {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	for topic, writer := range k.writers {
+		if err := writer.Close(); err != nil {
+			log.Errorf("failed to close writer for %q: %v", topic, err)
+		}
+	}
+	k.writers = map[string]*kafkago.Writer{}
+}
+
+func (k *KafkaWriter) Start() error {
+	go func() {
+		ticker := time.NewTicker(statsInterval)
+		defer func() {
+			ticker.Stop()
+			k.closeWriters()
+			k.reportStats()
+			close(k.closed)
+		}()
+		for {
+			select {
+			case <-k.ctx.Done():
+				return
+			case <-k.quit:
+				return
+			case <-ticker.C:
+				k.reportStats()
+			}
+		}
+	}()
+	return nil
+}
+
+func (k *KafkaWriter) Stop() error {
+	close(k.quit)
+	k.Wait()
+	return nil
+}
+
+func (k *KafkaWriter) Wait() {
+	<-k.closed
+}
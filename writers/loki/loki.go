@@ -0,0 +1,299 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package loki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	"coriolis-logger/worker"
+)
+
+var log = loggo.GetLogger("coriolis.logger.writers.loki")
+
+const (
+	pushPath = "/loki/api/v1/push"
+
+	// initialBackoff is the time we wait before retrying a failed push.
+	// It is doubled after every attempt, up to maxBackoff.
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// Writer is the interface implemented by the Loki writer
+type Writer interface {
+	worker.SimpleWorker
+	logging.Writer
+}
+
+func NewLokiWriter(ctx context.Context, cfg *config.Loki) (Writer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating loki config")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	return &LokiWriter{
+		cfg:     cfg,
+		pushURL: strings.TrimRight(cfg.URL, "/") + pushPath,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+		messages: []logging.LogMessage{},
+		ctx:      ctx,
+		flush:    make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+var _ Writer = (*LokiWriter)(nil)
+
+// LokiWriter batches log messages and pushes them to Loki
+type LokiWriter struct {
+	cfg     *config.Loki
+	pushURL string
+	client  *http.Client
+
+	mut      sync.Mutex
+	messages []logging.LogMessage
+
+	ctx    context.Context
+	flush  chan struct{}
+	closed chan struct{}
+	quit   chan struct{}
+}
+
+type stream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type pushRequest struct {
+	Streams []stream `json:"streams"`
+}
+
+func labels(msg logging.LogMessage) map[string]string {
+	return map[string]string{
+		"hostname":    msg.Hostname,
+		"severity":    msg.Severity.String(),
+		"facility":    msg.Facility.String(),
+		"binary_name": msg.AppName,
+	}
+}
+
+// streamKey returns a key uniquely identifying the label set
+// of a message.
+func streamKey(msg logging.LogMessage) string {
+	return strings.Join([]string{
+		msg.AppName, msg.Hostname,
+		msg.Severity.String(), msg.Facility.String()}, "\x00")
+}
+
+func buildRequest(messages []logging.LogMessage) ([]byte, error) {
+	streams := map[string]*stream{}
+	order := []string{}
+	for _, msg := range messages {
+		key := streamKey(msg)
+		st, ok := streams[key]
+		if !ok {
+			st = &stream{
+				Stream: labels(msg),
+				Values: [][2]string{},
+			}
+			streams[key] = st
+			order = append(order, key)
+		}
+		st.Values = append(st.Values, [2]string{
+			strconv.FormatInt(msg.Timestamp.UnixNano(), 10),
+			strings.TrimRight(msg.Message, "\n"),
+		})
+	}
+
+	req := pushRequest{
+		Streams: make([]stream, 0, len(order)),
+	}
+	for _, key := range order {
+		req.Streams = append(req.Streams, *streams[key])
+	}
+	return json.Marshal(req)
+}
+
+// shouldRetry returns true if a push that failed with the given
+// status code may succeed if sent again.
+func shouldRetry(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func (l *LokiWriter) push(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", l.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.cfg.Username != "" {
+		req.SetBasicAuth(l.cfg.Username, l.cfg.Password)
+	}
+	if l.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.cfg.TenantID)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return shouldRetry(resp.StatusCode), fmt.Errorf(
+		"loki returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// pushWithRetry pushes a batch, retrying with exponential backoff on
+// network errors, 429 and 5xx responses.
+func (l *LokiWriter) pushWithRetry(messages []logging.LogMessage) error {
+	body, err := buildRequest(messages)
+	if err != nil {
+		return errors.Wrap(err, "encoding messages")
+	}
+
+	backoff := initialBackoff
+	maxRetries := l.cfg.GetMaxRetries()
+	for attempt := 0; ; attempt++ {
+		retry, err := l.push(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= maxRetries {
+			return errors.Wrap(err, "pushing logs")
+		}
+		log.Warningf("failed to push logs to loki (retrying in %s): %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-l.ctx.Done():
+			return errors.Wrap(err, "pushing logs")
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (l *LokiWriter) flushMessages() error {
+	l.mut.Lock()
+	messages := l.messages
+	l.messages = []logging.LogMessage{}
+	l.mut.Unlock()
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	batchSize := l.cfg.GetBatchSize()
+	for len(messages) > 0 {
+		n := batchSize
+		if n > len(messages) {
+			n = len(messages)
+		}
+		if err := l.pushWithRetry(messages[:n]); err != nil {
+			return errors.Wrapf(err, "dropping %d messages", len(messages))
+		}
+		messages = messages[n:]
+	}
+	return nil
+}
+
+func (l *LokiWriter) doWork() {
+	ticker := time.NewTicker(l.cfg.GetFlushInterval())
+	defer func() {
+		ticker.Stop()
+		if err := l.flushMessages(); err != nil {
+			log.Errorf("failed to flush logs to loki: %v", err)
+		}
+		close(l.closed)
+	}()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-l.quit:
+			return
+		case <-ticker.C:
+			if err := l.flushMessages(); err != nil {
+				log.Errorf("failed to flush logs to loki: %v", err)
+			}
+		case <-l.flush:
+			if err := l.flushMessages(); err != nil {
+				log.Errorf("failed to flush logs to loki: %v", err)
+			}
+		}
+	}
+}
+
+func (l *LokiWriter) Write(logMsg logging.LogMessage) error {
+	l.mut.Lock()
+	l.messages = append(l.messages, logMsg)
+	full := len(l.messages) >= l.cfg.GetBatchSize()
+	l.mut.Unlock()
+
+	if full {
+		// Wake up the worker. A flush is already pending if
+		// the channel is full.
+		select {
+		case l.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (l *LokiWriter) Start() error {
+	go l.doWork()
+	return nil
+}
+
+func (l *LokiWriter) Stop() error {
+	close(l.quit)
+	l.Wait()
+	return nil
+}
+
+func (l *LokiWriter) Wait() {
+	<-l.closed
+}
@@ -0,0 +1,35 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package metrics
+
+import (
+	"coriolis-logger/logging"
+	"coriolis-logger/metrics"
+)
+
+func NewMetricsWriter() (logging.Writer, error) {
+	return &MetricsWriter{}, nil
+}
+
+var _ logging.Writer = (*MetricsWriter)(nil)
+
+// MetricsWriter counts log messages without storing them
+type MetricsWriter struct{}
+
+func (m *MetricsWriter) Write(logMsg logging.LogMessage) error {
+	metrics.LogMessages.WithLabelValues(
+		logMsg.AppName, logMsg.Hostname, logMsg.Severity.String()).Inc()
+	return nil
+}
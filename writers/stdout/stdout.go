@@ -15,6 +15,7 @@
 package stdout
 
 import (
+	"context"
 	"fmt"
 
 	"coriolis-logger/logging"
@@ -33,3 +34,9 @@ func (i *StdOutWriter) Write(logMsg logging.LogMessage) error {
 	fmt.Println(logMsg.Message)
 	return nil
 }
+
+// HealthCheck always succeeds, as writing to stdout can not fail in a
+// way we could recover from.
+func (i *StdOutWriter) HealthCheck(ctx context.Context) error {
+	return nil
+}
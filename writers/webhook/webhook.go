@@ -0,0 +1,279 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	"coriolis-logger/worker"
+)
+
+var log = loggo.GetLogger("coriolis.logger.writers.webhook")
+
+const (
+	// signatureHeader holds the hex encoded HMAC-SHA256 of the request
+	// body, when auth_type is hmac.
+	signatureHeader = "X-Coriolis-Signature"
+
+	// initialBackoff is the time we wait before retrying a failed
+	// request. It is doubled after every attempt, up to maxBackoff.
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// Writer is the interface implemented by the webhook writer
+type Writer interface {
+	worker.SimpleWorker
+	logging.Writer
+}
+
+func NewWebhookWriter(ctx context.Context, cfg *config.Webhook) (Writer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating webhook config")
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting TLS config")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	return &WebhookWriter{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+		messages: []logging.LogMessage{},
+		ctx:      ctx,
+		flush:    make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+var _ Writer = (*WebhookWriter)(nil)
+
+// WebhookWriter batches log messages and POSTs them to a webhook
+type WebhookWriter struct {
+	cfg    *config.Webhook
+	client *http.Client
+
+	mut      sync.Mutex
+	messages []logging.LogMessage
+
+	ctx    context.Context
+	flush  chan struct{}
+	closed chan struct{}
+	quit   chan struct{}
+}
+
+type message struct {
+	Timestamp time.Time `json:"timestamp"`
+	Hostname  string    `json:"hostname"`
+	AppName   string    `json:"app_name"`
+	Priority  int       `json:"priority"`
+	Severity  int       `json:"severity"`
+	Facility  int       `json:"facility"`
+	ProcID    int       `json:"proc_id,omitempty"`
+	MsgID     string    `json:"msg_id,omitempty"`
+	Message   string    `json:"message"`
+}
+
+func buildRequest(messages []logging.LogMessage) ([]byte, error) {
+	req := make([]message, 0, len(messages))
+	for _, msg := range messages {
+		req = append(req, message{
+			Timestamp: msg.Timestamp,
+			Hostname:  msg.Hostname,
+			AppName:   msg.AppName,
+			Priority:  msg.Priority,
+			Severity:  int(msg.Severity),
+			Facility:  int(msg.Facility),
+			ProcID:    msg.ProcID,
+			MsgID:     msg.MsgID,
+			Message:   msg.Message,
+		})
+	}
+	return json.Marshal(req)
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shouldRetry returns true if a request that failed with the given
+// status code may succeed if sent again.
+func shouldRetry(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func (w *WebhookWriter) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch w.cfg.AuthType {
+	case config.WebhookAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+w.cfg.Secret)
+	case config.WebhookAuthHMAC:
+		req.Header.Set(signatureHeader, sign(w.cfg.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return shouldRetry(resp.StatusCode), fmt.Errorf(
+		"webhook returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// postWithRetry sends a batch, retrying with exponential backoff on
+// network errors, 429 and 5xx responses, until max_attempts is reached.
+func (w *WebhookWriter) postWithRetry(messages []logging.LogMessage) error {
+	body, err := buildRequest(messages)
+	if err != nil {
+		return errors.Wrap(err, "encoding messages")
+	}
+
+	backoff := initialBackoff
+	maxAttempts := w.cfg.GetMaxAttempts()
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= maxAttempts {
+			return errors.Wrap(err, "sending logs")
+		}
+		log.Warningf("failed to send logs to webhook (retrying in %s): %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return errors.Wrap(err, "sending logs")
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (w *WebhookWriter) flushMessages() error {
+	w.mut.Lock()
+	messages := w.messages
+	w.messages = []logging.LogMessage{}
+	w.mut.Unlock()
+
+	batchSize := w.cfg.GetBatchSize()
+	for len(messages) > 0 {
+		n := batchSize
+		if n > len(messages) {
+			n = len(messages)
+		}
+		if err := w.postWithRetry(messages[:n]); err != nil {
+			return errors.Wrapf(err, "dropping %d messages", len(messages))
+		}
+		messages = messages[n:]
+	}
+	return nil
+}
+
+func (w *WebhookWriter) doWork() {
+	ticker := time.NewTicker(w.cfg.GetFlushInterval())
+	defer func() {
+		ticker.Stop()
+		if err := w.flushMessages(); err != nil {
+			log.Errorf("failed to flush logs to webhook: %v", err)
+		}
+		close(w.closed)
+	}()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			if err := w.flushMessages(); err != nil {
+				log.Errorf("failed to flush logs to webhook: %v", err)
+			}
+		case <-w.flush:
+			if err := w.flushMessages(); err != nil {
+				log.Errorf("failed to flush logs to webhook: %v", err)
+			}
+		}
+	}
+}
+
+func (w *WebhookWriter) Write(logMsg logging.LogMessage) error {
+	w.mut.Lock()
+	w.messages = append(w.messages, logMsg)
+	full := len(w.messages) >= w.cfg.GetBatchSize()
+	w.mut.Unlock()
+
+	if full {
+		// Wake up the worker. A flush is already pending if
+		// the channel is full.
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (w *WebhookWriter) Start() error {
+	go w.doWork()
+	return nil
+}
+
+func (w *WebhookWriter) Stop() error {
+	close(w.quit)
+	w.Wait()
+	return nil
+}
+
+func (w *WebhookWriter) Wait() {
+	<-w.closed
+}
@@ -15,6 +15,10 @@
 package websocket
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -38,11 +42,61 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 1024
+
+	// sendBufferSize is the number of live messages buffered for a
+	// client. Room for the replayed history is added on top.
+	sendBufferSize = 1024
 )
 
+// AllTopics is the topic of clients receiving the logs of all
+// applications.
+const AllTopics = "*"
+
+// ClientFilterOptions holds the filters applied to the logs sent to
+// a client. Severity is the highest severity level sent, and
+// MinSeverity the lowest. Topics holds the applications the client
+// subscribed to, and takes precedence over AppName.
 type ClientFilterOptions struct {
-	Severity *logging.Severity `json:"omitempty"`
-	AppName  *string
+	Severity    *logging.Severity
+	MinSeverity *logging.Severity
+	AppName     *string
+	Topics      []string
+	Hostname    *string
+	Facility    *logging.Facility
+}
+
+// topics returns the applications whose logs are sent to the client,
+// or AllTopics.
+func (o ClientFilterOptions) topics() []string {
+	if len(o.Topics) == 0 {
+		if o.AppName != nil && *o.AppName != "" {
+			return []string{*o.AppName}
+		}
+		return []string{AllTopics}
+	}
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, topic := range o.Topics {
+		if topic == AllTopics {
+			return []string{AllTopics}
+		}
+		if !seen[topic] {
+			seen[topic] = true
+			ret = append(ret, topic)
+		}
+	}
+	return ret
+}
+
+// subscribed returns true if the logs of the application are sent to
+// the client.
+func (o ClientFilterOptions) subscribed(appName string) bool {
+	for _, topic := range o.topics() {
+		if topic == AllTopics || topic == appName {
+			return true
+		}
+	}
+	return false
 }
 
 func NewClient(conn *websocket.Conn, opts ClientFilterOptions, hub *Hub) (*Client, error) {
@@ -52,18 +106,42 @@ func NewClient(conn *websocket.Conn, opts ClientFilterOptions, hub *Hub) (*Clien
 		options: opts,
 		conn:    conn,
 		hub:     hub,
-		send:    make(chan LogMessage, 1024),
+		send:    make(chan interface{}, sendBufferSize+hub.history.size()),
+		replies: make(chan interface{}, 10),
 	}, nil
 }
 
+// NewStreamClient returns a client that is not backed by a web socket.
+// Its messages are read from Messages(), and it must be unregistered
+// once the caller stops reading them. It is used to stream logs over
+// Server-Sent Events.
+func NewStreamClient(opts ClientFilterOptions, hub *Hub) *Client {
+	return &Client{
+		id:      uuid.New().String(),
+		options: opts,
+		hub:     hub,
+		send:    make(chan interface{}, sendBufferSize+hub.history.size()),
+		replies: make(chan interface{}, 10),
+	}
+}
+
 type Client struct {
-	id      string
-	options ClientFilterOptions
-	conn    *websocket.Conn
+	id string
+	// options is updated by the client reader, when the client
+	// sends a new subscription.
+	options    ClientFilterOptions
+	optionsMut sync.RWMutex
+	conn       *websocket.Conn
 	// Buffered channel of outbound messages.
-	send chan LogMessage
+	send chan interface{}
+	// replies holds the frames sent in response to the client's own
+	// messages. Unlike send, it is never closed by the hub.
+	replies chan interface{}
 
 	hub *Hub
+	// topics holds the topics the hub has the client registered under.
+	// It is only used by the hub.
+	topics []string
 }
 
 func (c *Client) Go() {
@@ -71,8 +149,9 @@ func (c *Client) Go() {
 	go c.clientWriter()
 }
 
-// clientReader waits for options changes from the client. The client can at any time
-// change the log level and binary name it watches.
+// clientReader waits for subscriptions from the client. The client can at
+// any time change the logs it receives, by sending a new Subscription.
+// Invalid subscriptions are answered with an error frame.
 func (c *Client) clientReader() {
 	defer func() {
 		c.hub.unregister <- c
@@ -82,14 +161,50 @@ func (c *Client) clientReader() {
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		opts := ClientFilterOptions{}
-		if err := c.conn.ReadJSON(&opts); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Errorf("error: %v", err)
 			}
 			break
 		}
+		opts, err := parseSubscription(data)
+		if err != nil {
+			c.reply(ErrorMessage{
+				Type:  ErrorMessageType,
+				Error: err.Error(),
+			})
+			continue
+		}
+		c.optionsMut.Lock()
 		c.options = opts
+		c.optionsMut.Unlock()
+		// The hub moves the client to its new topics.
+		c.hub.resubscribe <- c
+	}
+}
+
+// parseSubscription decodes and validates a subscription message.
+func parseSubscription(data []byte) (ClientFilterOptions, error) {
+	var sub Subscription
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sub); err != nil {
+		return ClientFilterOptions{}, fmt.Errorf("invalid subscription: %v", err)
+	}
+	opts, err := sub.FilterOptions()
+	if err != nil {
+		return ClientFilterOptions{}, fmt.Errorf("invalid subscription: %v", err)
+	}
+	return opts, nil
+}
+
+// reply queues a frame sent in response to a client message. Replies
+// are dropped if the client is not reading them.
+func (c *Client) reply(msg interface{}) {
+	select {
+	case c.replies <- msg:
+	default:
 	}
 }
 
@@ -114,6 +229,12 @@ func (c *Client) clientWriter() {
 				log.Errorf("error sending message: %v", err)
 				return
 			}
+		case reply := <-c.replies:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteJSON(reply); err != nil {
+				log.Errorf("error sending message: %v", err)
+				return
+			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -123,32 +244,72 @@ func (c *Client) clientWriter() {
 	}
 }
 
-func (c *Client) ShouldSend(msg logging.LogMessage) bool {
-	severity := logging.DefaultSeverityLevel
-	var binName string
-	if c.options.Severity != nil {
-		severity = *c.options.Severity
+// Messages returns the channel the hub sends the messages of the
+// client to. It is closed once the hub drops the client.
+func (c *Client) Messages() <-chan interface{} {
+	return c.send
+}
+
+// Unregister asks the hub to drop the client.
+func (c *Client) Unregister() {
+	select {
+	case c.hub.unregister <- c:
+	case <-c.hub.closed:
 	}
+}
+
+// filterOptions returns the filters currently set by the client.
+func (c *Client) filterOptions() ClientFilterOptions {
+	c.optionsMut.RLock()
+	defer c.optionsMut.RUnlock()
+	return c.options
+}
 
-	if c.options.AppName != nil {
-		binName = *c.options.AppName
+func (c *Client) ShouldSend(msg logging.LogMessage) bool {
+	options := c.filterOptions()
+	severity := logging.DefaultSeverityLevel
+	if options.Severity != nil {
+		severity = *options.Severity
 	}
 
-	if binName != "" && binName != msg.AppName {
+	if !options.subscribed(msg.AppName) {
 		return false
 	}
 	if msg.Severity > severity {
 		return false
 	}
+	if options.MinSeverity != nil && msg.Severity < *options.MinSeverity {
+		return false
+	}
+	if options.Hostname != nil && *options.Hostname != msg.Hostname {
+		return false
+	}
+	if options.Facility != nil && *options.Facility != msg.Facility {
+		return false
+	}
 	return true
 }
 
+// ShouldSendRate returns true if the client is interested in the
+// message rate of the given application.
+func (c *Client) ShouldSendRate(appName string) bool {
+	return c.filterOptions().subscribed(appName)
+}
+
 func (c *Client) SyslogMessageToLogMessage(msg logging.LogMessage) LogMessage {
-	return LogMessage{
+	ret := LogMessage{
+		Type:      LogMessageType,
 		Severity:  int(msg.Severity),
 		AppName:   msg.AppName,
 		Hostname:  msg.Hostname,
 		Timestamp: msg.Timestamp,
 		Message:   msg.Message,
+
+		SourceAddr: msg.SourceAddr,
+	}
+	if msg.Unparsed {
+		parsed := false
+		ret.Parsed = &parsed
 	}
+	return ret
 }
@@ -14,12 +14,124 @@
 
 package websocket
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"coriolis-logger/logging"
+)
+
+const (
+	// LogMessageType is the type of frames that carry a log line.
+	LogMessageType = "log"
+	// RateMessageType is the type of frames that carry the message
+	// rate of an application, measured over the last rate window.
+	RateMessageType = "rate"
+	// ErrorMessageType is the type of frames sent when a message from
+	// the client is rejected.
+	ErrorMessageType = "error"
+)
 
 type LogMessage struct {
+	Type      string    `json:"type"`
 	Severity  int       `json:"severity"`
 	AppName   string    `json:"app_name"`
 	Message   string    `json:"message"`
 	Hostname  string    `json:"hostname"`
 	Timestamp time.Time `json:"timestamp"`
+	// Replay is set for messages logged before the client connected.
+	Replay bool `json:"replay,omitempty"`
+	// Parsed is false for messages stored as is, as they failed to
+	// parse, and not set otherwise.
+	Parsed *bool `json:"parsed,omitempty"`
+	// SourceAddr is the IP address the message was received from.
+	SourceAddr string `json:"source_addr,omitempty"`
+}
+
+type RateMessage struct {
+	Type string   `json:"type"`
+	Data RateData `json:"data"`
+}
+
+type RateData struct {
+	AppName       string  `json:"app"`
+	Rate          float64 `json:"rate"`
+	WindowSeconds int     `json:"window_seconds"`
+}
+
+type ErrorMessage struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// Subscription is the message clients send to change the logs they
+// receive. Unset fields do not filter anything. A subscription
+// replaces all filters set before, including the ones set through the
+// query parameters of the web socket URL.
+type Subscription struct {
+	Hostname string `json:"hostname,omitempty"`
+	// SeverityMin and SeverityMax are the range of severity levels
+	// sent, between 0 (emergency) and 7 (debug).
+	SeverityMin *int   `json:"severity_min,omitempty"`
+	SeverityMax *int   `json:"severity_max,omitempty"`
+	BinaryName  string `json:"binary_name,omitempty"`
+	// Facility is either the numeric code or the keyword of a
+	// facility.
+	Facility string `json:"facility,omitempty"`
+	// Subscribe lists the applications whose logs are sent, or "*"
+	// for all of them. It can not be used along with BinaryName.
+	Subscribe []string `json:"subscribe,omitempty"`
+}
+
+func validSeverity(severity *int) bool {
+	return severity == nil || (*severity >= int(logging.Emergency) && *severity <= int(logging.Debug))
+}
+
+// FilterOptions validates the subscription and returns the filters it
+// sets.
+func (s Subscription) FilterOptions() (ClientFilterOptions, error) {
+	opts := ClientFilterOptions{}
+	if !validSeverity(s.SeverityMin) {
+		return opts, fmt.Errorf("invalid severity_min %d", *s.SeverityMin)
+	}
+	if !validSeverity(s.SeverityMax) {
+		return opts, fmt.Errorf("invalid severity_max %d", *s.SeverityMax)
+	}
+	if s.SeverityMin != nil && s.SeverityMax != nil && *s.SeverityMin > *s.SeverityMax {
+		return opts, fmt.Errorf("severity_min is greater than severity_max")
+	}
+	if s.SeverityMin != nil {
+		severity := logging.Severity(*s.SeverityMin)
+		opts.MinSeverity = &severity
+	}
+	// Unlike the query parameters, debug messages are sent unless
+	// severity_max says otherwise.
+	maxSeverity := logging.Debug
+	if s.SeverityMax != nil {
+		maxSeverity = logging.Severity(*s.SeverityMax)
+	}
+	opts.Severity = &maxSeverity
+	if s.Facility != "" {
+		facility, err := logging.ParseFacility(s.Facility)
+		if err != nil {
+			return opts, err
+		}
+		opts.Facility = &facility
+	}
+	if s.Hostname != "" {
+		opts.Hostname = &s.Hostname
+	}
+	if s.BinaryName != "" {
+		if len(s.Subscribe) > 0 {
+			return opts, fmt.Errorf("binary_name and subscribe can not be used together")
+		}
+		opts.AppName = &s.BinaryName
+	}
+	for _, topic := range s.Subscribe {
+		if topic == "" {
+			return opts, fmt.Errorf("invalid empty topic")
+		}
+	}
+	opts.Topics = s.Subscribe
+	return opts, nil
 }
@@ -17,21 +17,32 @@ package websocket
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"coriolis-logger/config"
 	"coriolis-logger/logging"
+	"coriolis-logger/metrics"
 	"coriolis-logger/worker"
 )
 
-func NewHub(ctx context.Context) *Hub {
+func NewHub(ctx context.Context, cfg config.APIServer) *Hub {
 	return &Hub{
-		clients:    map[string]*Client{},
-		broadcast:  make(chan logging.LogMessage, 100),
-		register:   make(chan *Client, 100),
-		unregister: make(chan *Client, 100),
-		ctx:        ctx,
-		closed:     make(chan struct{}),
-		quit:       make(chan struct{}),
+		clients:         map[string]*Client{},
+		broadcast:       make(chan logging.LogMessage, 100),
+		register:        make(chan *Client, 100),
+		unregister:      make(chan *Client, 100),
+		rates:           map[string]*uint64{},
+		rateInterval:    cfg.GetWSRateInterval(),
+		history:         newHistory(cfg.GetWSReplayCount(), cfg.GetWSReplayMaxAge()),
+		compactInterval: cfg.GetWSReplayCompactInterval(),
+		topics:          map[string]map[string]*Client{},
+		resubscribe:     make(chan *Client, 100),
+		ctx:             ctx,
+		closed:          make(chan struct{}),
+		quit:            make(chan struct{}),
 	}
 }
 
@@ -43,6 +54,12 @@ type Hub struct {
 	quit   chan struct{}
 	// Registered clients.
 	clients map[string]*Client
+	// topics holds the registered clients by topic, and client ID.
+	// Clients receiving all logs are under AllTopics.
+	topics map[string]map[string]*Client
+	// clientCount is the number of registered clients, readable
+	// outside of the hub loop.
+	clientCount int64
 
 	// Inbound messages from the clients.
 	broadcast chan logging.LogMessage
@@ -52,9 +69,238 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Requests from clients that changed their subscription.
+	resubscribe chan *Client
+
+	// Per application message counters for the current rate window.
+	rates        map[string]*uint64
+	ratesMut     sync.RWMutex
+	rateInterval time.Duration
+
+	// history holds the recent messages, replayed to new clients.
+	history *history
+	// compactInterval is the interval at which expired messages are
+	// removed from the history.
+	compactInterval time.Duration
+}
+
+// historyEntry is a message held in the history, along with the time
+// it was received.
+type historyEntry struct {
+	msg      logging.LogMessage
+	received time.Time
+}
+
+// history is a ring buffer holding the last messages sent to the hub.
+// Messages older than maxAge are not replayed, and are removed from
+// the buffer by compact().
+type history struct {
+	mut     sync.Mutex
+	entries []historyEntry
+	maxAge  time.Duration
+	// next is the index the next message is written at, once the
+	// buffer is full.
+	next int
+}
+
+func newHistory(size int, maxAge time.Duration) *history {
+	metrics.WebsocketReplayBufferCapacity.Set(float64(size))
+	return &history{
+		entries: make([]historyEntry, 0, size),
+		maxAge:  maxAge,
+	}
+}
+
+func (h *history) add(msg logging.LogMessage) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if cap(h.entries) == 0 {
+		return
+	}
+	entry := historyEntry{
+		msg:      msg,
+		received: time.Now(),
+	}
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, entry)
+		metrics.WebsocketReplayBufferSize.Set(float64(len(h.entries)))
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// size returns the maximum number of messages held.
+func (h *history) size() int {
+	return cap(h.entries)
+}
+
+// ordered returns the entries held, oldest first. The caller must hold
+// h.mut.
+func (h *history) ordered() []historyEntry {
+	ret := make([]historyEntry, 0, len(h.entries))
+	ret = append(ret, h.entries[h.next:]...)
+	return append(ret, h.entries[:h.next]...)
+}
+
+// snapshot returns a copy of the messages that have not expired,
+// oldest first.
+func (h *history) snapshot() []logging.LogMessage {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	oldest := time.Now().Add(-h.maxAge)
+	ret := []logging.LogMessage{}
+	for _, entry := range h.ordered() {
+		if entry.received.Before(oldest) {
+			continue
+		}
+		ret = append(ret, entry.msg)
+	}
+	return ret
+}
+
+// compact removes the expired messages, freeing their memory.
+func (h *history) compact() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	oldest := time.Now().Add(-h.maxAge)
+	entries := h.ordered()
+	// Entries are ordered by the time they were received.
+	idx := sort.Search(len(entries), func(i int) bool {
+		return !entries[i].received.Before(oldest)
+	})
+	if idx == 0 {
+		return
+	}
+	kept := make([]historyEntry, 0, cap(h.entries))
+	h.entries = append(kept, entries[idx:]...)
+	h.next = 0
+	metrics.WebsocketReplayBufferSize.Set(float64(len(h.entries)))
+}
+
+// countMessage increments the message counter of an application.
+func (h *Hub) countMessage(appName string) {
+	h.ratesMut.RLock()
+	counter, ok := h.rates[appName]
+	if ok {
+		atomic.AddUint64(counter, 1)
+	}
+	h.ratesMut.RUnlock()
+	if ok {
+		return
+	}
+
+	h.ratesMut.Lock()
+	defer h.ratesMut.Unlock()
+	counter, ok = h.rates[appName]
+	if !ok {
+		counter = new(uint64)
+		h.rates[appName] = counter
+	}
+	atomic.AddUint64(counter, 1)
+}
+
+// collectRates resets the message counters and returns the rate of each
+// application over the last window. Applications that have not sent any
+// message during the window report a rate of 0 and are then forgotten.
+func (h *Hub) collectRates() []RateMessage {
+	h.ratesMut.Lock()
+	defer h.ratesMut.Unlock()
+
+	window := h.rateInterval.Seconds()
+	ret := make([]RateMessage, 0, len(h.rates))
+	for appName, counter := range h.rates {
+		count := atomic.SwapUint64(counter, 0)
+		if count == 0 {
+			delete(h.rates, appName)
+		}
+		ret = append(ret, RateMessage{
+			Type: RateMessageType,
+			Data: RateData{
+				AppName:       appName,
+				Rate:          float64(count) / window,
+				WindowSeconds: int(window),
+			},
+		})
+	}
+	return ret
+}
+
+// subscribe adds a client under the topics it subscribed to.
+func (h *Hub) subscribe(client *Client) {
+	client.topics = client.filterOptions().topics()
+	for _, topic := range client.topics {
+		if h.topics[topic] == nil {
+			h.topics[topic] = map[string]*Client{}
+		}
+		h.topics[topic][client.id] = client
+	}
+}
+
+// unsubscribe removes a client from all its topics.
+func (h *Hub) unsubscribe(client *Client) {
+	for _, topic := range client.topics {
+		delete(h.topics[topic], client.id)
+		if len(h.topics[topic]) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+	client.topics = nil
+}
+
+// updateClientCount publishes the number of registered clients.
+func (h *Hub) updateClientCount() {
+	atomic.StoreInt64(&h.clientCount, int64(len(h.clients)))
+	metrics.WebsocketConnections.Set(float64(len(h.clients)))
+}
+
+// ClientCount returns the number of connected clients.
+func (h *Hub) ClientCount() int {
+	return int(atomic.LoadInt64(&h.clientCount))
+}
+
+// removeClient unregisters a client, and closes its send channel.
+func (h *Hub) removeClient(client *Client) {
+	h.unsubscribe(client)
+	delete(h.clients, client.id)
+	h.updateClientCount()
+	close(client.send)
+}
+
+// sendToClient sends a message to a client, dropping the client if
+// it does not consume the message in a timely manner.
+func (h *Hub) sendToClient(client *Client, msg interface{}) {
+	select {
+	case client.send <- msg:
+	case <-time.After(5 * time.Second):
+		h.removeClient(client)
+	}
+}
+
+// replay queues the recent messages matching its filters for a new
+// client. Clients have room in their send buffer for the whole history,
+// so replaying never blocks the hub.
+func (h *Hub) replay(client *Client) {
+	for _, msg := range h.history.snapshot() {
+		if !client.ShouldSend(msg) {
+			continue
+		}
+		payload := client.SyslogMessageToLogMessage(msg)
+		payload.Replay = true
+		select {
+		case client.send <- payload:
+		default:
+			return
+		}
+	}
 }
 
 func (h *Hub) run() {
+	rateTicker := time.NewTicker(h.rateInterval)
+	defer rateTicker.Stop()
+	compactTicker := time.NewTicker(h.compactInterval)
+	defer compactTicker.Stop()
 	for {
 		select {
 		case <-h.quit:
@@ -66,28 +312,48 @@ func (h *Hub) run() {
 		case client := <-h.register:
 			if client != nil {
 				h.clients[client.id] = client
+				h.updateClientCount()
+				h.subscribe(client)
+				h.replay(client)
 			}
 		case client := <-h.unregister:
 			if client != nil {
 				if _, ok := h.clients[client.id]; ok {
-					delete(h.clients, client.id)
-					close(client.send)
+					h.removeClient(client)
 				}
 			}
+		case client := <-h.resubscribe:
+			if _, ok := h.clients[client.id]; ok {
+				h.unsubscribe(client)
+				h.subscribe(client)
+			}
 		case message := <-h.broadcast:
-			for id, client := range h.clients {
-				if client == nil {
-					continue
+			// Messages are added to the history here, rather than in
+			// Write(), so new clients never get a message both
+			// replayed and live.
+			h.history.add(message)
+			// Only the clients subscribed to the application, or
+			// to all of them, are looked at.
+			for _, topic := range []string{message.AppName, AllTopics} {
+				for _, client := range h.topics[topic] {
+					if !client.ShouldSend(message) {
+						continue
+					}
+					h.sendToClient(client, client.SyslogMessageToLogMessage(message))
 				}
-				if !client.ShouldSend(message) {
-					continue
+				if message.AppName == AllTopics {
+					break
 				}
-				msg := client.SyslogMessageToLogMessage(message)
-				select {
-				case client.send <- msg:
-				case <-time.After(5 * time.Second):
-					close(client.send)
-					delete(h.clients, id)
+			}
+		case <-compactTicker.C:
+			h.history.compact()
+		case <-rateTicker.C:
+			for _, rate := range h.collectRates() {
+				for _, client := range h.clients {
+					if client == nil || !client.ShouldSendRate(rate.Data.AppName) {
+						continue
+					}
+					h.sendToClient(client, rate)
 				}
 			}
 		}
@@ -100,17 +366,32 @@ func (h *Hub) Register(client *Client) error {
 }
 
 func (h *Hub) Write(msg logging.LogMessage) error {
+	h.countMessage(msg.AppName)
+
 	ticker := time.NewTicker(60 * time.Second)
 	defer ticker.Stop()
 
 	select {
 	case <-ticker.C:
 		return fmt.Errorf("timed out sending message to client")
+	case <-h.closed:
+		// Once stopped, there are no clients to send messages to.
 	case h.broadcast <- msg:
 	}
 	return nil
 }
 
+// HealthCheck fails once the hub stopped. Clients that can not keep
+// up are disconnected by the hub itself, so they are not a concern.
+func (h *Hub) HealthCheck(ctx context.Context) error {
+	select {
+	case <-h.closed:
+		return fmt.Errorf("hub is not running")
+	default:
+		return nil
+	}
+}
+
 func (h *Hub) Start() error {
 	go h.run()
 	return nil
@@ -0,0 +1,46 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func TestWriteAfterStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := NewHub(ctx, config.APIServer{})
+	if err := hub.Start(); err != nil {
+		t.Fatalf("failed to start hub: %v", err)
+	}
+	cancel()
+	hub.Wait()
+
+	// Writes do not wait for the hub once it stopped, even with its
+	// buffer full.
+	start := time.Now()
+	for idx := 0; idx < 2*cap(hub.broadcast); idx++ {
+		if err := hub.Write(logging.LogMessage{AppName: "coriolis-worker", Message: "message"}); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("writes took %v once the hub stopped", elapsed)
+	}
+}